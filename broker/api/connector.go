@@ -1,11 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,11 +25,28 @@ type WebSocketHelper interface {
 	Close() error
 }
 
+// sourceIDs numbers supervised connections so their events can be told apart
+var sourceIDs uint64
+
 // Source represents an exchange source
 type Source struct {
 	Pairs        []string
+	id           uint64
 	conn         *websocket.Conn
 	exchangeName string
+	dialer       *websocket.Dialer
+	url          *url.URL
+	// subscriptions holds every subscribe payload sent so they can be replayed after a reconnect
+	subscriptions [][]byte
+	supervised    bool
+	policy        ReconnectPolicy
+	stateCh       chan<- ConnectionEvent
+	closed        bool
+	closeCh       chan struct{}
+	// mtx guards conn, subscriptions and closed. gorilla only allows a single concurrent writer
+	// so writes are serialized with writeMtx
+	mtx      sync.RWMutex
+	writeMtx sync.Mutex
 }
 
 // NewWebSocketHelper returns an interface of methods containing common functions
@@ -33,27 +54,160 @@ type Source struct {
 func NewWebSocketHelper(exchangeName string) WebSocketHelper {
 	return &Source{
 		exchangeName: exchangeName,
+		dialer:       websocket.DefaultDialer,
+		closeCh:      make(chan struct{}),
 	}
 }
 
-// Connect connects to the websocket api and stores the connection
+// NewSupervisedWebSocketHelper returns a WebSocketHelper that reconnects on its own following
+// policy whenever dialing or reading fails. Subscribe requests are replayed after every reconnect
+// so adapters keep receiving data without noticing the drop. Every state change is sent to
+// stateCh if it isn't nil, so the channel must be drained by the caller. Connections are dialed
+// with dialer or websocket.DefaultDialer if it's nil
+func NewSupervisedWebSocketHelper(exchangeName string, dialer *websocket.Dialer, policy ReconnectPolicy, stateCh chan<- ConnectionEvent) WebSocketHelper {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	return &Source{
+		id:           atomic.AddUint64(&sourceIDs, 1),
+		exchangeName: exchangeName,
+		dialer:       dialer,
+		supervised:   true,
+		policy:       policy,
+		stateCh:      stateCh,
+		closeCh:      make(chan struct{}),
+	}
+}
+
+// Connect connects to the websocket api and stores the connection. Supervised connections
+// keep retrying until they connect or the reconnect policy gives up.
 func (s *Source) Connect(url *url.URL) error {
-	c, _, err := websocket.DefaultDialer.Dial(url.String(), nil)
-	s.conn = c
+	s.mtx.Lock()
+	s.url = url
+	s.mtx.Unlock()
+	if !s.supervised {
+		return s.dial()
+	}
+	return s.reconnect()
+}
 
+func (s *Source) dial() error {
+	s.mtx.RLock()
+	u := s.url
+	s.mtx.RUnlock()
+	c, _, err := s.dialer.Dial(u.String(), nil)
 	if err != nil {
 		return fmt.Errorf("Error connecting to %s: %s", s.exchangeName, err)
 	}
+	s.mtx.Lock()
+	s.conn = c
+	s.mtx.Unlock()
+	return nil
+}
+
+// reconnect dials the exchange and replays subscriptions until it succeeds, the policy runs
+// out of retries or the source is closed
+func (s *Source) reconnect() error {
+	for attempt := 0; ; attempt++ {
+		if s.isClosed() {
+			return fmt.Errorf("Connection to %s is closed", s.exchangeName)
+		}
+		s.emit(CONNECTING, nil)
+		err := s.dial()
+		if err == nil {
+			err = s.replaySubscriptions()
+		}
+		if err == nil {
+			s.emit(UP, nil)
+			return nil
+		}
+		s.emit(DOWN, err)
+		if s.policy.MaxRetries > 0 && attempt+1 >= s.policy.MaxRetries {
+			return fmt.Errorf("Giving up connecting to %s after %d attempts: %s", s.exchangeName, attempt+1, err)
+		}
+		delay := s.policy.Backoff(attempt)
+		log.Printf("Reconnecting to %s in %s\n", s.exchangeName, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.closeCh:
+			return fmt.Errorf("Connection to %s is closed", s.exchangeName)
+		}
+	}
+}
+
+func (s *Source) replaySubscriptions() error {
+	s.mtx.RLock()
+	subscriptions := s.subscriptions
+	s.mtx.RUnlock()
+	for _, payload := range subscriptions {
+		err := s.WriteMessage(payload)
+		if err != nil {
+			return fmt.Errorf("Error resubscribing to %s: %s", s.exchangeName, err)
+		}
+	}
 	return nil
 }
 
-// ReadMessage reads a message from the websocket connection
+func (s *Source) emit(state ConnectionState, err error) {
+	if s.stateCh == nil {
+		return
+	}
+	select {
+	case s.stateCh <- ConnectionEvent{Exchange: s.exchangeName, Conn: s.id, State: state, Err: err, Time: time.Now()}:
+	case <-s.closeCh:
+	}
+}
+
+func (s *Source) isClosed() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.closed
+}
+
+func (s *Source) getConn() (*websocket.Conn, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.conn == nil {
+		return nil, fmt.Errorf("Not connected to %s", s.exchangeName)
+	}
+	return s.conn, nil
+}
+
+// ReadMessage reads a message from the websocket connection. If the source is supervised,
+// a failed read reconnects and the next message from the new connection is returned.
 func (s *Source) ReadMessage() ([]byte, error) {
-	_, message, err := s.conn.ReadMessage()
-	if err != nil {
-		return []byte{}, err
+	for {
+		conn, err := s.getConn()
+		if err != nil {
+			return []byte{}, err
+		}
+		_, message, err := conn.ReadMessage()
+		if err == nil {
+			return message, nil
+		}
+		if !s.supervised || s.isClosed() {
+			return []byte{}, err
+		}
+		conn.Close()
+		s.emit(DOWN, err)
+		err = s.reconnect()
+		if err != nil {
+			return []byte{}, err
+		}
 	}
-	return message, nil
+}
+
+// recordSubscription stores a subscribe payload to replay on reconnect. Identical payloads
+// are only stored once.
+func (s *Source) recordSubscription(payload []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, val := range s.subscriptions {
+		if bytes.Equal(val, payload) {
+			return
+		}
+	}
+	s.subscriptions = append(s.subscriptions, payload)
 }
 
 // SendSubscribeRequest sends a subscribe request. Some exchanges require this
@@ -63,8 +217,8 @@ func (s *Source) SendSubscribeRequest(req interface{}) error {
 	if err != nil {
 		return err
 	}
-	err = s.WriteMessage(payload)
-	return nil
+	s.recordSubscription(payload)
+	return s.WriteMessage(payload)
 }
 
 // SendSubscribeRequestWithResponse sends a subscribe request and returns the response
@@ -73,36 +227,48 @@ func (s *Source) SendSubscribeRequestWithResponse(ctx context.Context, req inter
 	if err != nil {
 		return nil, err
 	}
-	err = s.WriteMessage(payload)
-	return nil, nil
+	s.recordSubscription(payload)
+	return nil, s.WriteMessage(payload)
 }
 
 // WriteMessage writes a message to the websocket connection
 func (s *Source) WriteMessage(msg []byte) error {
-	err := s.conn.WriteMessage(websocket.TextMessage, msg)
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.write(websocket.TextMessage, msg)
 }
 
 // WritePongMessage sends a ping message to the server
 func (s *Source) WritePongMessage() error {
-	err := s.conn.WriteMessage(websocket.PongMessage, nil)
+	return s.write(websocket.PongMessage, nil)
+}
+
+func (s *Source) write(messageType int, msg []byte) error {
+	conn, err := s.getConn()
 	if err != nil {
 		return err
 	}
-	return nil
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	return conn.WriteMessage(messageType, msg)
 }
 
-// Close closes the connection
+// Close closes the connection and stops any reconnect in progress
 func (s *Source) Close() error {
 	log.Printf("%s interrupt\n", s.exchangeName)
-	err := s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	s.mtx.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closeCh)
+	}
+	s.mtx.Unlock()
+	err := s.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
 		return fmt.Errorf("%s write close: %s", s.exchangeName, err)
 	}
-	err = s.conn.Close()
+	conn, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	err = conn.Close()
 	if err != nil {
 		return fmt.Errorf("Error closing connection for %s: %s", s.exchangeName, err)
 	}
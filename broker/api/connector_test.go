@@ -0,0 +1,102 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kaplanmaxe/helgart/broker/api"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// newDroppingServer returns a server that waits for a subscribe request, answers with the
+// connection number and then drops the connection
+func newDroppingServer(t *testing.T, subscribeCh chan<- string) *httptest.Server {
+	conns := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		conns++
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		subscribeCh <- string(msg)
+		conn.WriteMessage(websocket.TextMessage, []byte{byte('0' + conns)})
+	}))
+}
+
+func TestSupervisedReconnect(t *testing.T) {
+	subscribeCh := make(chan string, 2)
+	server := newDroppingServer(t, subscribeCh)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "ws"
+
+	stateCh := make(chan api.ConnectionEvent, 10)
+	policy := api.ReconnectPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Multiplier: 2}
+	client := api.NewSupervisedWebSocketHelper("mock", nil, policy, stateCh)
+	err = client.Connect(u)
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	err = client.SendSubscribeRequest(map[string]string{"event": "subscribe"})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+
+	for _, expected := range []string{"1", "2"} {
+		msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading message: %s", err)
+		}
+		if string(msg) != expected {
+			t.Errorf("Expected message %s from connection but got %s", expected, msg)
+		}
+		if sub := <-subscribeCh; sub != `{"event":"subscribe"}` {
+			t.Errorf("Expected subscribe request to be sent but got %s", sub)
+		}
+	}
+
+	expectedStates := []api.ConnectionState{api.CONNECTING, api.UP, api.DOWN, api.CONNECTING, api.UP}
+	for _, expected := range expectedStates {
+		event := <-stateCh
+		if event.State != expected {
+			t.Errorf("Expected state %s but got %s", expected, event.State)
+		}
+		if event.Exchange != "mock" {
+			t.Errorf("Expected event for exchange mock but got %s", event.Exchange)
+		}
+	}
+	client.Close()
+}
+
+func TestSupervisedGivesUp(t *testing.T) {
+	policy := api.ReconnectPolicy{InitialBackoff: time.Millisecond, MaxRetries: 3}
+	client := api.NewSupervisedWebSocketHelper("mock", nil, policy, nil)
+	err := client.Connect(&url.URL{Scheme: "ws", Host: "127.0.0.1:1"})
+	if err == nil {
+		t.Fatal("Expected an error after running out of retries")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := api.ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2, Jitter: 0.5}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay := policy.Backoff(attempt)
+		if delay < expected/2 || delay > expected*3/2 {
+			t.Errorf("Attempt %d expected a delay around %s but got %s", attempt, expected, delay)
+		}
+	}
+}
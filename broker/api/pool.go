@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// HelperFactory returns a new WebSocketHelper that isn't connected yet
+type HelperFactory func() WebSocketHelper
+
+// Shard is one connection of a Pool
+type Shard struct {
+	WebSocketHelper
+	// ID is the index of the shard in its pool
+	ID int
+}
+
+// Pool spreads the channels of an exchange over as many connections as needed so that none of
+// them holds more than Limit channels. Exchanges cap the channels of a connection and past the
+// cap subscriptions are dropped, often without an error. Channels fill shards in order: the
+// first Limit channels go to shard 0, the next Limit to shard 1 and so on
+type Pool struct {
+	// Limit is the number of channels per connection. 0 or less puts every channel on a single
+	// connection
+	Limit   int
+	factory HelperFactory
+	shards  []*Shard
+}
+
+// NewPool returns a pool whose first shard is first. More shards are built with factory when
+// the channels don't fit in one connection. A nil factory limits the pool to first
+func NewPool(first WebSocketHelper, factory HelperFactory, limit int) *Pool {
+	return &Pool{
+		Limit:   limit,
+		factory: factory,
+		shards:  []*Shard{{WebSocketHelper: first}},
+	}
+}
+
+// size returns the number of shards needed for channels
+func (p *Pool) size(channels int) int {
+	if p.Limit <= 0 || channels <= p.Limit {
+		return 1
+	}
+	return (channels + p.Limit - 1) / p.Limit
+}
+
+// Connect opens enough connections to u to hold channels
+func (p *Pool) Connect(u *url.URL, channels int) error {
+	return p.ConnectFunc(channels, func(id int) *url.URL {
+		// Every connection gets its own copy since helpers keep the url to reconnect
+		shardURL := *u
+		return &shardURL
+	})
+}
+
+// ConnectFunc opens enough connections to hold channels. Each shard connects to the url
+// returned by shardURL for its id, for exchanges that pick channels in the url
+func (p *Pool) ConnectFunc(channels int, shardURL func(id int) *url.URL) error {
+	size := p.size(channels)
+	if size > 1 && p.factory == nil {
+		return fmt.Errorf("%d channels need %d connections but the pool has no factory to open them", channels, size)
+	}
+	for len(p.shards) < size {
+		p.shards = append(p.shards, &Shard{WebSocketHelper: p.factory(), ID: len(p.shards)})
+	}
+	for _, shard := range p.shards {
+		err := shard.Connect(shardURL(shard.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split splits channels into the groups held by each shard. Group i is subscribed to on
+// Shard(i)
+func (p *Pool) Split(channels []string) [][]string {
+	var groups [][]string
+	size := len(channels)
+	if p.Limit > 0 {
+		size = p.Limit
+	}
+	for len(channels) > size {
+		groups = append(groups, channels[:size:size])
+		channels = channels[size:]
+	}
+	if len(channels) > 0 {
+		groups = append(groups, channels)
+	}
+	return groups
+}
+
+// Shard returns the shard with id or nil if the pool doesn't have it
+func (p *Pool) Shard(id int) *Shard {
+	if id < 0 || id >= len(p.shards) {
+		return nil
+	}
+	return p.shards[id]
+}
+
+// Shards returns every shard of the pool
+func (p *Pool) Shards() []*Shard {
+	return p.shards
+}
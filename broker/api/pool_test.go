@@ -0,0 +1,67 @@
+package api_test
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestPoolConnect(t *testing.T) {
+	var opened []*mock.RecordingConnector
+	factory := func() api.WebSocketHelper {
+		conn := mock.NewRecordingConnector()
+		opened = append(opened, conn)
+		return conn
+	}
+	first := mock.NewRecordingConnector()
+	pool := api.NewPool(first, factory, 2)
+	u := &url.URL{Scheme: "wss", Host: "mock"}
+	err := pool.Connect(u, 5)
+	if err != nil {
+		t.Fatalf("Error connecting pool: %s", err)
+	}
+	if len(pool.Shards()) != 3 || len(opened) != 2 {
+		t.Fatalf("Expected 3 shards with 2 opened by the factory but got %d and %d", len(pool.Shards()), len(opened))
+	}
+	for i, shard := range pool.Shards() {
+		if shard.ID != i {
+			t.Errorf("Expected shard %d to have id %d but got %d", i, i, shard.ID)
+		}
+	}
+	if pool.Shard(0).WebSocketHelper != first || pool.Shard(3) != nil {
+		t.Error("Expected shard 0 to be the first connection and shard 3 to not exist")
+	}
+	for _, conn := range append(opened, first) {
+		if conn.URL == nil || *conn.URL != *u || conn.URL == u {
+			t.Errorf("Expected every connection to get its own copy of %s but got %v", u, conn.URL)
+		}
+	}
+
+	groups := pool.Split([]string{"a", "b", "c", "d", "e"})
+	expected := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected groups %v but got %v", expected, groups)
+	}
+}
+
+func TestPoolWithoutFactory(t *testing.T) {
+	pool := api.NewPool(mock.NewRecordingConnector(), nil, 2)
+	u := &url.URL{Scheme: "wss", Host: "mock"}
+	if err := pool.Connect(u, 2); err != nil {
+		t.Errorf("Expected channels within the limit to connect but got %s", err)
+	}
+	if err := pool.Connect(u, 3); err == nil {
+		t.Error("Expected an error when more connections are needed without a factory")
+	}
+
+	pool = api.NewPool(mock.NewRecordingConnector(), nil, 0)
+	if err := pool.Connect(u, 100); err != nil || len(pool.Shards()) != 1 {
+		t.Errorf("Expected a pool without a limit to use one connection but got %d %v", len(pool.Shards()), err)
+	}
+	if groups := pool.Split([]string{"a", "b", "c"}); len(groups) != 1 {
+		t.Errorf("Expected a single group without a limit but got %v", groups)
+	}
+}
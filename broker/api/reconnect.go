@@ -0,0 +1,79 @@
+package api
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ConnectionState represents the state of a websocket connection to an exchange
+type ConnectionState int
+
+const (
+	// CONNECTING means we are dialing the exchange
+	CONNECTING ConnectionState = iota
+	// UP means the connection is established and subscriptions have been sent
+	UP
+	// DOWN means the connection was lost or a dial attempt failed
+	DOWN
+)
+
+// String returns a readable name for the connection state
+func (s ConnectionState) String() string {
+	switch s {
+	case CONNECTING:
+		return "connecting"
+	case UP:
+		return "up"
+	case DOWN:
+		return "down"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent is emitted by a supervised connection every time its state changes
+type ConnectionEvent struct {
+	Exchange string
+	// Conn identifies the connection the event is from since an exchange can have several
+	Conn  uint64
+	State ConnectionState
+	Err   error
+	Time  time.Time
+}
+
+// ReconnectPolicy configures how a supervised connection retries after a failure.
+// The delay before each attempt grows by Multiplier starting at InitialBackoff and is
+// capped at MaxBackoff. Jitter is the fraction (0-1) of the delay that is randomized so
+// many exchanges dropping at once don't reconnect in lockstep. A MaxRetries of 0 retries forever.
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	MaxRetries     int
+}
+
+// DefaultReconnectPolicy is the policy used by the broker for every exchange
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Backoff returns the delay to wait before the given attempt. Attempts start at 0.
+func (p ReconnectPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		// Spread the delay evenly between delay * (1 - jitter) and delay * (1 + jitter)
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,412 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Directions of a recorded frame
+const (
+	// INBOUND frames were read from the exchange
+	INBOUND = "in"
+	// OUTBOUND frames were written to the exchange
+	OUTBOUND = "out"
+)
+
+// Types of a recorded frame
+const (
+	// CONNECTFRAME frames are recorded when a connection is opened. Data is the url
+	CONNECTFRAME = "connect"
+	// MESSAGEFRAME frames are data messages read from or written to the exchange
+	MESSAGEFRAME = "message"
+	// PONGFRAME frames are pong control messages written to the exchange. Data is empty
+	PONGFRAME = "pong"
+	// CLOSEFRAME frames are recorded when a connection is closed. Data is empty
+	CLOSEFRAME = "close"
+	// RESTFRAME frames are responses from the REST api. URL is the url requested and Data the
+	// body of the response
+	RESTFRAME = "rest"
+)
+
+// Defaults of a Recorder
+const (
+	defaultMaxSize       = 100 << 20
+	defaultMaxAge        = time.Hour
+	defaultFlushInterval = time.Second
+)
+
+// Frame is a websocket frame sent to or received from an exchange.
+//
+// Capture files are gzip compressed streams of frames marshalled as json, one per line, so they
+// can be read while they're written and inspected with zcat and jq:
+//
+//	{"exchange":"kraken","conn":1,"time":1571400000123456789,"dir":"in","type":"message","data":"{\"event\":\"heartbeat\"}"}
+//
+// exchange is the name of the exchange, time is when the frame was sent or received in nanoseconds
+// since the unix epoch, dir is either in or out and type is one of connect, message, pong, close
+// or rest. conn numbers the connections of an exchange from 0 in the order they were opened, so
+// the shards of an exchange can be told apart, and is omitted for 0. data holds the payload as a
+// string. Payloads that aren't valid utf-8 are base64 encoded and have "base64":true. rest frames
+// are successful responses from the REST api and also have the url requested. Frames are in the
+// order they were recorded
+type Frame struct {
+	Exchange  string `json:"exchange"`
+	Conn      int    `json:"conn,omitempty"`
+	Time      int64  `json:"time"`
+	Direction string `json:"dir"`
+	Type      string `json:"type"`
+	URL       string `json:"url,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Base64    bool   `json:"base64,omitempty"`
+}
+
+// NewFrame returns a frame recorded at t. The payload is base64 encoded if it isn't valid utf-8
+func NewFrame(exchangeName, direction, frameType string, payload []byte, t time.Time) Frame {
+	frame := Frame{
+		Exchange:  exchangeName,
+		Time:      t.UnixNano(),
+		Direction: direction,
+		Type:      frameType,
+	}
+	if utf8.Valid(payload) {
+		frame.Data = string(payload)
+	} else {
+		frame.Data = base64.StdEncoding.EncodeToString(payload)
+		frame.Base64 = true
+	}
+	return frame
+}
+
+// Payload returns the decoded payload of the frame
+func (f Frame) Payload() ([]byte, error) {
+	if f.Base64 {
+		return base64.StdEncoding.DecodeString(f.Data)
+	}
+	return []byte(f.Data), nil
+}
+
+// Timestamp returns the time the frame was recorded at
+func (f Frame) Timestamp() time.Time {
+	return time.Unix(0, f.Time)
+}
+
+// Recorder writes frames to capture files in Dir. A new file is started once the current one
+// holds MaxSize uncompressed bytes or is older than MaxAge. Files are named after the time they
+// were started, ex: capture-20191018T120000.000000000Z.jsonl.gz, so they sort chronologically.
+// It's safe for concurrent use and a single recorder can be shared by every exchange
+type Recorder struct {
+	Dir string
+	// MaxSize is the number of uncompressed bytes written to a file before rotating it
+	MaxSize int64
+	// MaxAge is how long frames are written to a file before rotating it
+	MaxAge time.Duration
+	// FlushInterval is how often buffered frames are flushed so the file can be read while
+	// it's written
+	FlushInterval time.Duration
+	mtx           sync.Mutex
+	file          *os.File
+	gz            *gzip.Writer
+	buf           *bufio.Writer
+	size          int64
+	openedAt      time.Time
+	flushedAt     time.Time
+	err           error
+	// conns holds the number of connections recorded by exchange name
+	conns map[string]int
+}
+
+// NewRecorder returns a recorder writing capture files to dir. The directory is created if it
+// doesn't exist
+func NewRecorder(dir string) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating capture directory %s: %s", dir, err)
+	}
+	return &Recorder{
+		Dir:           dir,
+		MaxSize:       defaultMaxSize,
+		MaxAge:        defaultMaxAge,
+		FlushInterval: defaultFlushInterval,
+		conns:         make(map[string]int),
+	}, nil
+}
+
+// nextConn returns the number of the next connection recorded for an exchange
+func (r *Recorder) nextConn(exchangeName string) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	conn := r.conns[exchangeName]
+	r.conns[exchangeName]++
+	return conn
+}
+
+// Record writes a frame to the current capture file, rotating it first if needed. Once writing
+// fails the error is logged and the recorder drops every frame so a full disk doesn't take the
+// feeds down with it
+func (r *Recorder) Record(frame Frame) error {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	err = r.write(line, frame.Timestamp())
+	if err != nil {
+		r.err = err
+		log.Printf("Error recording frames: %s. Recording stopped\n", err)
+	}
+	return err
+}
+
+func (r *Recorder) write(line []byte, now time.Time) error {
+	if r.file != nil && (r.size+int64(len(line)) > r.MaxSize || now.Sub(r.openedAt) >= r.MaxAge) {
+		err := r.closeFile()
+		if err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		err := r.openFile(now)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := r.buf.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if now.Sub(r.flushedAt) >= r.FlushInterval {
+		r.flushedAt = now
+		return r.flush()
+	}
+	return nil
+}
+
+func (r *Recorder) openFile(now time.Time) error {
+	name := filepath.Join(r.Dir, fmt.Sprintf("capture-%s.jsonl.gz", now.UTC().Format("20060102T150405.000000000Z")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating capture file: %s", err)
+	}
+	r.file = file
+	r.gz = gzip.NewWriter(file)
+	r.buf = bufio.NewWriter(r.gz)
+	r.size = 0
+	r.openedAt = now
+	r.flushedAt = now
+	return nil
+}
+
+// flush writes buffered frames down to the file as a complete gzip block
+func (r *Recorder) flush() error {
+	err := r.buf.Flush()
+	if err != nil {
+		return err
+	}
+	return r.gz.Flush()
+}
+
+func (r *Recorder) closeFile() error {
+	defer func() {
+		r.file = nil
+	}()
+	err := r.buf.Flush()
+	if err == nil {
+		err = r.gz.Close()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error closing capture file: %s", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the current capture file. Frames recorded afterwards start a new one
+func (r *Recorder) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.closeFile()
+}
+
+// FrameReader reads the frames of a capture file one at a time
+type FrameReader struct {
+	gz      *gzip.Reader
+	decoder *json.Decoder
+}
+
+// NewFrameReader returns a reader of the frames of the gzip compressed capture r
+func NewFrameReader(r io.Reader) (*FrameReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading capture: %s", err)
+	}
+	return &FrameReader{gz: gz, decoder: json.NewDecoder(gz)}, nil
+}
+
+// Next returns the next frame or io.EOF once every frame has been read. Captures still being
+// written or cut short by a crash end with io.ErrUnexpectedEOF
+func (r *FrameReader) Next() (Frame, error) {
+	var frame Frame
+	err := r.decoder.Decode(&frame)
+	return frame, err
+}
+
+// recordingTransport is an http.RoundTripper recording successful responses
+type recordingTransport struct {
+	next         http.RoundTripper
+	exchangeName string
+	recorder     *Recorder
+}
+
+// NewRecordingTransport returns an http.RoundTripper sending requests with next and recording
+// the body of every 200 response to recorder
+func NewRecordingTransport(next http.RoundTripper, exchangeName string, recorder *Recorder) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &recordingTransport{
+		next:         next,
+		exchangeName: exchangeName,
+		recorder:     recorder,
+	}
+}
+
+// RoundTrip sends the request and records the response. The body is read in full to record it
+// and replaced so the caller can still read it
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	frame := NewFrame(t.exchangeName, INBOUND, RESTFRAME, body, time.Now())
+	frame.URL = req.URL.String()
+	t.recorder.Record(frame)
+	return res, nil
+}
+
+// recordingHelper is a WebSocketHelper recording every frame it sends or receives
+type recordingHelper struct {
+	WebSocketHelper
+	exchangeName string
+	conn         int
+	recorder     *Recorder
+}
+
+// NewRecordingWebSocketHelper returns a WebSocketHelper recording every frame sent or received
+// through helper to recorder. Frames are only recorded once they've been sent or received and
+// failing to record them never fails helper. Helpers of an exchange are numbered in the order
+// they're created, which is the order a Replayer hands them their frames back
+func NewRecordingWebSocketHelper(helper WebSocketHelper, exchangeName string, recorder *Recorder) WebSocketHelper {
+	return &recordingHelper{
+		WebSocketHelper: helper,
+		exchangeName:    exchangeName,
+		conn:            recorder.nextConn(exchangeName),
+		recorder:        recorder,
+	}
+}
+
+func (h *recordingHelper) record(direction, frameType string, payload []byte) {
+	frame := NewFrame(h.exchangeName, direction, frameType, payload, time.Now())
+	frame.Conn = h.conn
+	h.recorder.Record(frame)
+}
+
+// Connect connects helper and records the url
+func (h *recordingHelper) Connect(u *url.URL) error {
+	err := h.WebSocketHelper.Connect(u)
+	if err == nil {
+		h.record(OUTBOUND, CONNECTFRAME, []byte(u.String()))
+	}
+	return err
+}
+
+// SendSubscribeRequest sends and records a subscribe request
+func (h *recordingHelper) SendSubscribeRequest(req interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = h.WebSocketHelper.SendSubscribeRequest(req)
+	if err == nil {
+		h.record(OUTBOUND, MESSAGEFRAME, payload)
+	}
+	return err
+}
+
+// SendSubscribeRequestWithResponse sends and records a subscribe request
+func (h *recordingHelper) SendSubscribeRequestWithResponse(ctx context.Context, req interface{}) ([]byte, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.WebSocketHelper.SendSubscribeRequestWithResponse(ctx, req)
+	if err == nil {
+		h.record(OUTBOUND, MESSAGEFRAME, payload)
+	}
+	return res, err
+}
+
+// WriteMessage sends and records a message
+func (h *recordingHelper) WriteMessage(msg []byte) error {
+	err := h.WebSocketHelper.WriteMessage(msg)
+	if err == nil {
+		h.record(OUTBOUND, MESSAGEFRAME, msg)
+	}
+	return err
+}
+
+// WritePongMessage sends and records a pong message
+func (h *recordingHelper) WritePongMessage() error {
+	err := h.WebSocketHelper.WritePongMessage()
+	if err == nil {
+		h.record(OUTBOUND, PONGFRAME, nil)
+	}
+	return err
+}
+
+// ReadMessage reads and records a message
+func (h *recordingHelper) ReadMessage() ([]byte, error) {
+	msg, err := h.WebSocketHelper.ReadMessage()
+	if err == nil {
+		h.record(INBOUND, MESSAGEFRAME, msg)
+	}
+	return msg, err
+}
+
+// Close closes helper and records it
+func (h *recordingHelper) Close() error {
+	err := h.WebSocketHelper.Close()
+	h.record(OUTBOUND, CLOSEFRAME, nil)
+	return err
+}
@@ -0,0 +1,190 @@
+package api_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+// readCaptures returns every frame recorded in dir, reading capture files in order
+func readCaptures(t *testing.T, dir string) []api.Frame {
+	names, err := filepath.Glob(filepath.Join(dir, "capture-*.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []api.Frame
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := api.NewFrameReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			frame, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading %s: %s", name, err)
+			}
+			frames = append(frames, frame)
+		}
+		file.Close()
+	}
+	return frames
+}
+
+func TestRecordingWebSocketHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := api.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := mock.NewRecordingConnector()
+	client := api.NewRecordingWebSocketHelper(conn, "mock", recorder)
+
+	start := time.Now()
+	err = client.Connect(&url.URL{Scheme: "wss", Host: "example.com", Path: "/ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SendSubscribeRequest(map[string]string{"event": "subscribe"})
+	conn.Push([]byte(`{"event":"subscribed"}`))
+	conn.Push([]byte{0xff, 0x00})
+	for i := 0; i < 2; i++ {
+		if _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.WritePongMessage()
+	client.Close()
+	// Connections of an exchange are numbered in the order they're created
+	shard := api.NewRecordingWebSocketHelper(mock.NewRecordingConnector(), "mock", recorder)
+	shard.Close()
+	err = recorder.Close()
+	if err != nil {
+		t.Fatalf("Error closing recorder: %s", err)
+	}
+
+	expected := []struct {
+		direction string
+		frameType string
+		payload   string
+	}{
+		{api.OUTBOUND, api.CONNECTFRAME, "wss://example.com/ws"},
+		{api.OUTBOUND, api.MESSAGEFRAME, `{"event":"subscribe"}`},
+		{api.INBOUND, api.MESSAGEFRAME, `{"event":"subscribed"}`},
+		{api.INBOUND, api.MESSAGEFRAME, "\xff\x00"},
+		{api.OUTBOUND, api.PONGFRAME, ""},
+		{api.OUTBOUND, api.CLOSEFRAME, ""},
+		{api.OUTBOUND, api.CLOSEFRAME, ""},
+	}
+	frames := readCaptures(t, dir)
+	if len(frames) != len(expected) {
+		t.Fatalf("Expected %d frames but got %d: %v", len(expected), len(frames), frames)
+	}
+	for i, frame := range frames {
+		payload, err := frame.Payload()
+		if err != nil {
+			t.Errorf("Error decoding frame %d: %s", i, err)
+		}
+		if frame.Exchange != "mock" || frame.Direction != expected[i].direction || frame.Type != expected[i].frameType || string(payload) != expected[i].payload {
+			t.Errorf("Expected frame %d to be %v but got %v", i, expected[i], frame)
+		}
+		if frame.Timestamp().Before(start) {
+			t.Errorf("Expected frame %d to be recorded after %s but got %s", i, start, frame.Timestamp())
+		}
+	}
+	if frames[5].Conn != 0 || frames[6].Conn != 1 {
+		t.Errorf("Expected frames of the second connection to be numbered 1 but got %d and %d", frames[5].Conn, frames[6].Conn)
+	}
+	if !frames[3].Base64 {
+		t.Error("Expected a payload that isn't utf-8 to be base64 encoded")
+	}
+}
+
+func TestRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := api.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.MaxSize = 200
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		err := recorder.Record(api.NewFrame("mock", api.INBOUND, api.MESSAGEFRAME, []byte{byte('0' + i)}, now.Add(time.Duration(i))))
+		if err != nil {
+			t.Fatalf("Error recording: %s", err)
+		}
+	}
+	// Frames recorded after the max age start a new file as well
+	recorder.MaxSize = 1 << 20
+	err = recorder.Record(api.NewFrame("mock", api.INBOUND, api.MESSAGEFRAME, []byte("a"), now.Add(2*time.Hour)))
+	if err != nil {
+		t.Fatalf("Error recording: %s", err)
+	}
+	recorder.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if len(names) != 6 {
+		t.Errorf("Expected frames to be spread over 6 files but got %d", len(names))
+	}
+	frames := readCaptures(t, dir)
+	if len(frames) != 11 {
+		t.Fatalf("Expected 11 frames but got %d", len(frames))
+	}
+	for i, frame := range frames[:10] {
+		if frame.Data != string(byte('0'+i)) {
+			t.Errorf("Expected frame %d to hold %d but got %s", i, i, frame.Data)
+		}
+	}
+}
+
+func TestRecordingTransport(t *testing.T) {
+	server, u := mock.NewRESTServer(`{"result":"ok"}`)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := api.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: api.NewRecordingTransport(nil, "mock", recorder)}
+	u.Path = "/pairs"
+	res, err := client.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	recorder.Close()
+	if string(body) != `{"result":"ok"}` {
+		t.Errorf("Expected the response body to still be readable but got %s", body)
+	}
+	frames := readCaptures(t, dir)
+	if len(frames) != 1 || frames[0].Type != api.RESTFRAME || frames[0].URL != u.String() || frames[0].Data != `{"result":"ok"}` {
+		t.Errorf("Expected the response to be recorded but got %v", frames)
+	}
+}
@@ -0,0 +1,362 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replayer plays capture files written by a Recorder back to the exchanges they were recorded
+// from. Messages received by a connection of an exchange are read from the connection with the
+// same number the exchange opens through NewWebSocketHelper, in the order they were recorded and
+// paced by Speed. Responses from the REST api are served by the client returned by HTTPClient.
+//
+// A message is only handed to its exchange once the exchange it was handed before is done
+// with its own, so every replay of a capture produces the same quotes in the same order
+type Replayer struct {
+	// Speed is how fast frames are replayed relative to the time they were recorded at. 1
+	// replays in realtime, 10 ten times faster and 0 or less as fast as possible
+	Speed     float64
+	files     []string
+	exchanges map[string]int
+	// responses holds the recorded bodies of every url requested by each exchange in order
+	responses map[string]map[string][][]byte
+	mtx       sync.Mutex
+	helpers   map[string][]*replayHelper
+	// now is the time the message being replayed was recorded at
+	now time.Time
+}
+
+// NewReplayer returns a replayer of the capture files. Files are replayed in the order given
+// and read once upfront for the responses of the REST api
+func NewReplayer(files []string, speed float64) (*Replayer, error) {
+	r := &Replayer{
+		Speed:     speed,
+		files:     files,
+		exchanges: make(map[string]int),
+		responses: make(map[string]map[string][][]byte),
+		helpers:   make(map[string][]*replayHelper),
+	}
+	for _, file := range files {
+		err := readCapture(file, func(frame Frame) error {
+			switch {
+			case frame.Type == RESTFRAME:
+				key, err := responseKey(frame.URL)
+				if err != nil {
+					return err
+				}
+				payload, err := frame.Payload()
+				if err != nil {
+					return err
+				}
+				if r.responses[frame.Exchange] == nil {
+					r.responses[frame.Exchange] = make(map[string][][]byte)
+				}
+				r.responses[frame.Exchange][key] = append(r.responses[frame.Exchange][key], payload)
+			case frame.Direction == INBOUND && frame.Type == MESSAGEFRAME:
+				r.exchanges[frame.Exchange]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// readCapture calls fn with every frame of a capture file. A capture cut short by a crash is
+// read up to the last complete frame
+func readCapture(file string, fn func(Frame) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Error opening capture %s: %s", file, err)
+	}
+	defer f.Close()
+	reader, err := NewFrameReader(f)
+	if err != nil {
+		return fmt.Errorf("Error reading capture %s: %s", file, err)
+	}
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Capture %s ends with an incomplete frame\n", file)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading capture %s: %s", file, err)
+		}
+		err = fn(frame)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// responseKey identifies the responses to a url regardless of its host, since the REST url of
+// an exchange can be overridden
+func responseKey(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return u.RequestURI(), nil
+}
+
+// Exchanges returns the names of the exchanges messages were recorded from sorted
+// alphabetically
+func (r *Replayer) Exchanges() []string {
+	var names []string
+	for name := range r.exchanges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewWebSocketHelper returns a connection to exchangeName. Connections are numbered in the
+// order they're opened and receive the messages recorded from the connection with the same
+// number, so sharded exchanges get back the streams of each shard
+func (r *Replayer) NewWebSocketHelper(exchangeName string) WebSocketHelper {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	helper := &replayHelper{
+		exchangeName: exchangeName,
+		frameCh:      make(chan []byte),
+		readyCh:      make(chan struct{}),
+		closeCh:      make(chan struct{}),
+	}
+	r.helpers[exchangeName] = append(r.helpers[exchangeName], helper)
+	return helper
+}
+
+// HTTPClient returns a client answering the requests of exchangeName with the responses
+// recorded for the same path and query. Responses to a url are served in the order they were
+// recorded and the last one is repeated once they run out
+func (r *Replayer) HTTPClient(exchangeName string) *http.Client {
+	return &http.Client{Transport: &replayTransport{responses: r.responses[exchangeName]}}
+}
+
+// helper returns the connection of exchangeName with number conn or nil if the exchange
+// hasn't opened it
+func (r *Replayer) helper(exchangeName string, conn int) *replayHelper {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if helpers := r.helpers[exchangeName]; conn < len(helpers) {
+		return helpers[conn]
+	}
+	return nil
+}
+
+// Now returns the time the message being replayed was recorded at. Quotes are parsed from a
+// message before the next one is replayed so it's the time a quote would have been received at
+func (r *Replayer) Now() time.Time {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.now
+}
+
+// Run replays the messages of every capture file and returns the number of messages replayed
+// once the exchange of the last message is done with it or ctx is done. Messages of
+// connections that haven't been opened are skipped
+func (r *Replayer) Run(ctx context.Context) (int, error) {
+	var first int64
+	start := time.Now()
+	replayed := 0
+	for _, file := range r.files {
+		err := readCapture(file, func(frame Frame) error {
+			if frame.Direction != INBOUND || frame.Type != MESSAGEFRAME {
+				return nil
+			}
+			helper := r.helper(frame.Exchange, frame.Conn)
+			if helper == nil {
+				return nil
+			}
+			if first == 0 {
+				first = frame.Time
+			}
+			if r.Speed > 0 {
+				at := start.Add(time.Duration(float64(frame.Time-first) / r.Speed))
+				select {
+				case <-time.After(time.Until(at)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			payload, err := frame.Payload()
+			if err != nil {
+				return err
+			}
+			r.mtx.Lock()
+			r.now = frame.Timestamp()
+			r.mtx.Unlock()
+			err = helper.deliver(ctx, payload)
+			if err != nil {
+				return err
+			}
+			replayed++
+			return nil
+		})
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Close closes every connection returned by NewWebSocketHelper
+func (r *Replayer) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, helpers := range r.helpers {
+		for _, helper := range helpers {
+			helper.Close()
+		}
+	}
+	return nil
+}
+
+// replayTransport is an http.RoundTripper serving recorded responses
+type replayTransport struct {
+	mtx       sync.Mutex
+	responses map[string][][]byte
+	served    map[string]int
+}
+
+// RoundTrip returns the next response recorded for the url of the request. Urls without any
+// recorded response are answered with a 404
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	key := req.URL.RequestURI()
+	bodies := t.responses[key]
+	if len(bodies) == 0 {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("No response recorded for " + key))),
+			Request:    req,
+		}, nil
+	}
+	if t.served == nil {
+		t.served = make(map[string]int)
+	}
+	i := t.served[key]
+	if i >= len(bodies) {
+		i = len(bodies) - 1
+	}
+	t.served[key]++
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(bodies[i])),
+		Request:    req,
+	}, nil
+}
+
+// replayHelper is a WebSocketHelper reading messages handed to it by a Replayer. Requests
+// written to it are dropped
+type replayHelper struct {
+	exchangeName string
+	frameCh      chan []byte
+	// readyCh is sent to whenever the reader asks for a message, which means it's done with
+	// the previous one
+	readyCh   chan struct{}
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	// reading is true once the reader has asked for its first message
+	reading bool
+}
+
+// deliver hands msg to the reader and waits for the reader to be done with it
+func (h *replayHelper) deliver(ctx context.Context, msg []byte) error {
+	if !h.reading {
+		err := h.wait(ctx)
+		if err != nil {
+			return err
+		}
+		h.reading = true
+	}
+	select {
+	case h.frameCh <- msg:
+	case <-h.closeCh:
+		return fmt.Errorf("Replay of %s is closed", h.exchangeName)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return h.wait(ctx)
+}
+
+// wait waits for the reader to ask for a message
+func (h *replayHelper) wait(ctx context.Context) error {
+	select {
+	case <-h.readyCh:
+		return nil
+	case <-h.closeCh:
+		return fmt.Errorf("Replay of %s is closed", h.exchangeName)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Connect does nothing since messages come from the replayer
+func (h *replayHelper) Connect(*url.URL) error {
+	return nil
+}
+
+// SendSubscribeRequest drops the request
+func (h *replayHelper) SendSubscribeRequest(interface{}) error {
+	return nil
+}
+
+// SendSubscribeRequestWithResponse drops the request
+func (h *replayHelper) SendSubscribeRequestWithResponse(context.Context, interface{}) ([]byte, error) {
+	return nil, nil
+}
+
+// WriteMessage drops the message
+func (h *replayHelper) WriteMessage([]byte) error {
+	return nil
+}
+
+// WritePongMessage does nothing
+func (h *replayHelper) WritePongMessage() error {
+	return nil
+}
+
+// ReadMessage returns the next message handed by the replayer. It blocks until there is one
+// or the connection is closed
+func (h *replayHelper) ReadMessage() ([]byte, error) {
+	select {
+	case h.readyCh <- struct{}{}:
+	case <-h.closeCh:
+		return []byte{}, fmt.Errorf("Replay of %s is closed", h.exchangeName)
+	}
+	select {
+	case msg := <-h.frameCh:
+		return msg, nil
+	case <-h.closeCh:
+		return []byte{}, fmt.Errorf("Replay of %s is closed", h.exchangeName)
+	}
+}
+
+// Close stops the connection. Pending and future reads fail
+func (h *replayHelper) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.closeCh)
+	})
+	return nil
+}
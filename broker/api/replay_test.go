@@ -0,0 +1,137 @@
+package api_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+)
+
+// writeCapture records frames to a capture file in dir and returns its path
+func writeCapture(t *testing.T, dir string, frames []api.Frame) string {
+	recorder, err := api.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		err := recorder.Record(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+	names, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if len(names) != 1 {
+		t.Fatalf("Expected a single capture file but got %v", names)
+	}
+	return names[0]
+}
+
+func TestReplayer(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	pairs := api.NewFrame("mock", api.INBOUND, api.RESTFRAME, []byte(`["BTCUSD"]`), at(0))
+	pairs.URL = "https://api.example.com/symbols?limit=10"
+	// Frames of the second connection are replayed to the second connection opened
+	second := api.NewFrame("mock", api.INBOUND, api.MESSAGEFRAME, []byte("shard"), at(20))
+	second.Conn = 1
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeCapture(t, dir, []api.Frame{
+		pairs,
+		api.NewFrame("mock", api.OUTBOUND, api.MESSAGEFRAME, []byte(`{"event":"subscribe"}`), at(1)),
+		api.NewFrame("mock", api.INBOUND, api.MESSAGEFRAME, []byte("1"), at(2)),
+		api.NewFrame("other", api.INBOUND, api.MESSAGEFRAME, []byte("skipped"), at(3)),
+		second,
+		api.NewFrame("mock", api.INBOUND, api.MESSAGEFRAME, []byte("2"), at(40)),
+	})
+
+	replayer, err := api.NewReplayer([]string{file}, 2)
+	if err != nil {
+		t.Fatalf("Error loading capture: %s", err)
+	}
+	if names := replayer.Exchanges(); len(names) != 2 || names[0] != "mock" || names[1] != "other" {
+		t.Errorf("Expected mock and other to be recorded but got %v", names)
+	}
+
+	// Responses are matched on their path and query whatever the host
+	res, err := replayer.HTTPClient("mock").Get("http://localhost/symbols?limit=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != `["BTCUSD"]` {
+		t.Errorf("Expected the recorded response but got %s", body)
+	}
+	if res, err := replayer.HTTPClient("mock").Get("http://localhost/symbols"); err != nil || res.StatusCode != 404 {
+		t.Errorf("Expected a 404 for a url without a recorded response but got %v", err)
+	}
+
+	helper := replayer.NewWebSocketHelper("mock")
+	shard := replayer.NewWebSocketHelper("mock")
+	idle := replayer.NewWebSocketHelper("mock")
+	readCh := make(chan string, 3)
+	go func() {
+		for {
+			msg, err := helper.ReadMessage()
+			if err != nil {
+				close(readCh)
+				return
+			}
+			readCh <- string(msg)
+		}
+	}()
+	shardCh := make(chan string, 2)
+	go func() {
+		for {
+			msg, err := shard.ReadMessage()
+			if err != nil {
+				close(shardCh)
+				return
+			}
+			shardCh <- string(msg)
+		}
+	}()
+	go func() {
+		if msg, err := idle.ReadMessage(); err == nil {
+			t.Errorf("Expected a connection without recorded messages not to receive any but got %s", msg)
+		}
+	}()
+
+	replayStart := time.Now()
+	replayed, err := replayer.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+	// Frames 38ms apart are replayed 19ms apart at twice the speed
+	if elapsed := time.Since(replayStart); elapsed < 19*time.Millisecond {
+		t.Errorf("Expected the replay to take at least 19ms but took %s", elapsed)
+	}
+	if replayed != 3 {
+		t.Errorf("Expected 3 messages to be replayed but got %d", replayed)
+	}
+	replayer.Close()
+	var messages []string
+	for msg := range readCh {
+		messages = append(messages, msg)
+	}
+	if len(messages) != 2 || messages[0] != "1" || messages[1] != "2" {
+		t.Errorf("Expected messages 1 and 2 in order but got %v", messages)
+	}
+	var shardMessages []string
+	for msg := range shardCh {
+		shardMessages = append(shardMessages, msg)
+	}
+	if len(shardMessages) != 1 || shardMessages[0] != "shard" {
+		t.Errorf("Expected the second connection to receive its message but got %v", shardMessages)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter spaces out requests to a REST api so that no more than one is sent every Interval.
+// It's safe for concurrent use
+type RateLimiter struct {
+	Interval time.Duration
+	mtx      sync.Mutex
+	next     time.Time
+}
+
+// NewRateLimiter returns a limiter allowing one request every interval
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{Interval: interval}
+}
+
+// Wait blocks until the next request is allowed or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mtx.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.Interval)
+	l.mtx.Unlock()
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Nonce generates strictly increasing nonces for the private REST apis of exchanges from the
+// time in microseconds. It's safe for concurrent use
+type Nonce struct {
+	mtx  sync.Mutex
+	last int64
+}
+
+// Next returns a nonce greater than every nonce returned before
+func (n *Nonce) Next() string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	nonce := time.Now().UnixNano() / int64(time.Microsecond)
+	if nonce <= n.last {
+		nonce = n.last + 1
+	}
+	n.last = nonce
+	return strconv.FormatInt(nonce, 10)
+}
+
+// Do sends req with client and returns the response along with its body, which is read
+// whatever the status
+func Do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, body, nil
+}
+
+// GetJSON sends a GET request to u with client and unmarshals the json response into v.
+// Responses other than 200 are errors
+func GetJSON(ctx context.Context, client *http.Client, u *url.URL, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, body, err := Do(ctx, client, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", u.Path, res.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
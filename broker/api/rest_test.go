@@ -0,0 +1,74 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := api.NewRateLimiter(20 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := limiter.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("Error waiting: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 3 requests to take at least 40ms but took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter.Wait(ctx)
+	if err := limiter.Wait(ctx); err == nil {
+		t.Error("Expected an error waiting with a canceled context")
+	}
+}
+
+func TestGetJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ticker" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"bid":"1.5"}`))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res struct {
+		Bid string `json:"bid"`
+	}
+	u.Path = "/ticker"
+	err = api.GetJSON(context.Background(), api.DefaultHTTPClient, u, &res)
+	if err != nil || res.Bid != "1.5" {
+		t.Errorf("Expected bid 1.5 but got %s %v", res.Bid, err)
+	}
+	u.Path = "/limited"
+	if err := api.GetJSON(context.Background(), api.DefaultHTTPClient, u, &res); err == nil {
+		t.Error("Expected an error for a non 200 response")
+	}
+}
+
+func TestNonce(t *testing.T) {
+	var nonce api.Nonce
+	last := int64(0)
+	for i := 0; i < 100; i++ {
+		next, err := strconv.ParseInt(nonce.Next(), 10, 64)
+		if err != nil || next <= last {
+			t.Fatalf("Expected nonce %d to be greater than %d", next, last)
+		}
+		last = next
+	}
+}
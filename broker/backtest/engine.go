@@ -0,0 +1,255 @@
+package backtest
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// sweepInterval is how often stale quotes are evicted, in quote time, like the live broker does
+const sweepInterval = 5 * time.Second
+
+// pnlPrecision is the number of decimal places prices, fees and PnL are rounded to in USD
+const pnlPrecision = 8
+
+var one = decimal.NewFromInt(1)
+
+// Trade is an opportunity picked by the strategy and its simulated fills. Prices, fees and PnL
+// are in USD
+type Trade struct {
+	HeBase string `json:"he_base"`
+	// Buy and Sell are the sides of the opportunity when it was detected
+	Buy  exchange.MarketSide `json:"buy"`
+	Sell exchange.MarketSide `json:"sell"`
+	// Spread is the spread in percent of the opportunity when it was detected
+	Spread     decimal.Decimal `json:"spread"`
+	DetectedAt time.Time       `json:"detected_at"`
+	FilledAt   time.Time       `json:"filled_at"`
+	// Quantity is the quantity of the base the strategy asked for and Filled what was filled
+	// given the sizes quoted when the orders were filled
+	Quantity decimal.Decimal `json:"quantity"`
+	Filled   decimal.Decimal `json:"filled"`
+	// ExpectedPnL is the profit of Filled at the prices the opportunity was detected at,
+	// before fees and slippage
+	ExpectedPnL decimal.Decimal `json:"expected_pnl"`
+	BuyPrice    decimal.Decimal `json:"buy_price"`
+	SellPrice   decimal.Decimal `json:"sell_price"`
+	Fees        decimal.Decimal `json:"fees"`
+	// GrossPnL is the profit before fees and PnL after
+	GrossPnL decimal.Decimal `json:"gross_pnl"`
+	PnL      decimal.Decimal `json:"pnl"`
+	// Missed is set when either side wasn't quoted anymore when the orders were filled
+	Missed bool `json:"missed,omitempty"`
+}
+
+// Report is the outcome of a backtest. Volumes and PnL are in USD
+type Report struct {
+	// Quotes is the number of quotes run through the broker
+	Quotes int `json:"quotes"`
+	// Opportunities is the number of distinct opportunities detected and Traded the number
+	// the strategy traded
+	Opportunities int             `json:"opportunities"`
+	Traded        int             `json:"traded"`
+	Missed        int             `json:"missed"`
+	Volume        decimal.Decimal `json:"volume"`
+	Fees          decimal.Decimal `json:"fees"`
+	GrossPnL      decimal.Decimal `json:"gross_pnl"`
+	PnL           decimal.Decimal `json:"pnl"`
+	Trades        []*Trade        `json:"trades"`
+}
+
+// Engine runs historical quotes through an exchange.Broker like the live broker does and
+// simulates trading the opportunities Strategy picks. Orders are filled Latency after an
+// opportunity is detected at the prices and sizes quoted then, so an opportunity that closed
+// in the meantime loses money or is missed. Fills are charged the fees of Broker.Fees, which
+// the spreads of opportunities are net of. Time is the time quotes were received at
+type Engine struct {
+	Broker   *exchange.Broker
+	Strategy Strategy
+	// Latency is the time between detecting an opportunity and both of its orders being filled
+	Latency time.Duration
+	// Slippage is the ratio of the price lost on every fill, ex: 0.0005 buys 0.05% above the
+	// ask and sells 0.05% below the bid
+	Slippage decimal.Decimal
+	now      time.Time
+	sweptAt  time.Time
+	// detected holds the last opportunity detected for each base so unchanged opportunities
+	// are only counted once
+	detected map[string]*exchange.ArbMarket
+	pending  []*Trade
+	report   Report
+}
+
+// NewEngine returns an engine running quotes through broker and trading with strategy
+func NewEngine(broker *exchange.Broker, strategy Strategy) *Engine {
+	return &Engine{
+		Broker:   broker,
+		Strategy: strategy,
+		detected: make(map[string]*exchange.ArbMarket),
+	}
+}
+
+// OnQuote fills the orders due by the time quote was received at, inserts it in the broker and
+// trades the opportunity of its base if the strategy picks it. Quotes must be passed in the
+// order they were received
+func (e *Engine) OnQuote(quote exchange.Quote) {
+	now := quote.ReceivedAt
+	if now.IsZero() {
+		now = quote.ExchangeTime
+	}
+	if now.Before(e.now) {
+		now = e.now
+	}
+	e.advance(now)
+	e.report.Quotes++
+	if e.Broker.ArbProducts != nil {
+		if _, ok := e.Broker.ArbProducts[quote.HeBase]; !ok {
+			return
+		}
+	}
+	if quote.Ask.IsZero() || quote.Bid.IsZero() {
+		return
+	}
+	e.Broker.InsertActiveMarket(&exchange.ActiveMarket{
+		Exchange:     quote.Exchange,
+		HePair:       quote.HePair,
+		ExPair:       quote.ExPair,
+		HeBase:       quote.HeBase,
+		HeQuote:      quote.HeQuote,
+		Bid:          quote.Bid,
+		Ask:          quote.Ask,
+		BidSize:      quote.BidSize,
+		AskSize:      quote.AskSize,
+		ExchangeTime: quote.ExchangeTime,
+		ReceivedAt:   now,
+	})
+	e.evaluate(quote.HeBase)
+}
+
+// advance moves the clock to now, filling the orders due and evicting stale quotes
+func (e *Engine) advance(now time.Time) {
+	e.now = now
+	for len(e.pending) > 0 && !e.pending[0].DetectedAt.Add(e.Latency).After(now) {
+		e.fill(e.pending[0])
+		e.pending = e.pending[1:]
+	}
+	if now.Sub(e.sweptAt) >= sweepInterval {
+		e.Broker.EvictStale(now)
+		e.sweptAt = now
+	}
+}
+
+// evaluate hands the best opportunity of base to the strategy if it changed since the last
+// one. A base isn't traded again while its previous trade is waiting to be filled
+func (e *Engine) evaluate(base string) {
+	market := e.Broker.BestArbMarket(base)
+	if market == nil || market.Spread.Sign() <= 0 {
+		delete(e.detected, base)
+		return
+	}
+	if market.Low.Exchange == market.High.Exchange && market.Low.HePair == market.High.HePair {
+		return
+	}
+	if last, ok := e.detected[base]; ok && sameOpportunity(last, market) {
+		return
+	}
+	e.detected[base] = market
+	e.report.Opportunities++
+	for _, trade := range e.pending {
+		if trade.HeBase == base {
+			return
+		}
+	}
+	quantity := e.Strategy.Quantity(market)
+	if quantity.Sign() <= 0 {
+		return
+	}
+	e.pending = append(e.pending, &Trade{
+		HeBase:     base,
+		Buy:        market.Low,
+		Sell:       market.High,
+		Spread:     market.Spread,
+		DetectedAt: e.now,
+		Quantity:   quantity,
+	})
+}
+
+// sameOpportunity returns true if an opportunity is between the same markets with the same
+// spread and quantity
+func sameOpportunity(a, b *exchange.ArbMarket) bool {
+	return a.Spread == b.Spread && a.Quantity == b.Quantity &&
+		a.Low.Exchange == b.Low.Exchange && a.Low.HePair == b.Low.HePair &&
+		a.High.Exchange == b.High.Exchange && a.High.HePair == b.High.HePair
+}
+
+// fill fills both orders of a trade at the prices and sizes quoted now
+func (e *Engine) fill(trade *Trade) {
+	trade.FilledAt = e.now
+	e.report.Traded++
+	e.report.Trades = append(e.report.Trades, trade)
+	ask, okAsk := e.quoted(trade.HeBase, trade.Buy, false)
+	bid, okBid := e.quoted(trade.HeBase, trade.Sell, true)
+	if !okAsk || !okBid {
+		trade.Missed = true
+		e.report.Missed++
+		return
+	}
+	filled := trade.Quantity
+	for _, size := range []decimal.Decimal{ask.Size, bid.Size} {
+		// Sizes are unknown for exchanges that don't send them
+		if size.Sign() > 0 {
+			filled = decimal.Min(filled, size)
+		}
+	}
+	trade.Filled = filled
+	trade.ExpectedPnL = trade.Sell.TriangulatedPrice.Sub(trade.Buy.TriangulatedPrice).Mul(filled).Round(pnlPrecision)
+	trade.BuyPrice = ask.TriangulatedPrice.Mul(one.Add(e.Slippage)).Round(pnlPrecision)
+	trade.SellPrice = bid.TriangulatedPrice.Mul(one.Sub(e.Slippage)).Round(pnlPrecision)
+	bought := trade.BuyPrice.Mul(filled)
+	sold := trade.SellPrice.Mul(filled)
+	buyFee := e.Broker.Fees.Taker(trade.Buy.Exchange, trade.Buy.HePair)
+	sellFee := e.Broker.Fees.Taker(trade.Sell.Exchange, trade.Sell.HePair)
+	trade.Fees = bought.Mul(buyFee).Add(sold.Mul(sellFee)).Round(pnlPrecision)
+	trade.GrossPnL = sold.Sub(bought).Round(pnlPrecision)
+	trade.PnL = trade.GrossPnL.Sub(trade.Fees)
+
+	e.report.Volume = e.report.Volume.Add(bought.Round(pnlPrecision))
+	e.report.Fees = e.report.Fees.Add(trade.Fees)
+	e.report.GrossPnL = e.report.GrossPnL.Add(trade.GrossPnL)
+	e.report.PnL = e.report.PnL.Add(trade.PnL)
+}
+
+// quoted returns the current quote of the market of side, from the bids if bid is true and
+// the asks otherwise. It returns false if the market isn't quoted or can't be valued in USD
+func (e *Engine) quoted(base string, side exchange.MarketSide, bid bool) (exchange.MarketSide, bool) {
+	market, ok := e.Broker.ActiveMarkets[base]
+	if !ok {
+		return exchange.MarketSide{}, false
+	}
+	sides := market.Asks
+	if bid {
+		sides = market.Bids
+	}
+	for _, val := range sides {
+		if val.Exchange == side.Exchange && val.HePair == side.HePair {
+			return val, val.TriangulatedPrice.Sign() > 0
+		}
+	}
+	return exchange.MarketSide{}, false
+}
+
+// Finish fills the orders still waiting at the last quotes received and returns the report.
+// Trades are sorted by the time they were detected at
+func (e *Engine) Finish() *Report {
+	for _, trade := range e.pending {
+		e.fill(trade)
+	}
+	e.pending = nil
+	sort.SliceStable(e.report.Trades, func(i, j int) bool {
+		return e.report.Trades[i].DetectedAt.Before(e.report.Trades[j].DetectedAt)
+	})
+	report := e.report
+	return &report
+}
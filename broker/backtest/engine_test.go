@@ -0,0 +1,98 @@
+package backtest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/backtest"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+var start = time.Date(2019, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func newQuote(ex, base string, bid, ask, bidSize, askSize string, at time.Duration) exchange.Quote {
+	return exchange.Quote{
+		Exchange:   ex,
+		HePair:     base + "-USD",
+		HeBase:     base,
+		HeQuote:    "USD",
+		Bid:        decimal.MustParse(bid),
+		Ask:        decimal.MustParse(ask),
+		BidSize:    decimal.MustParse(bidSize),
+		AskSize:    decimal.MustParse(askSize),
+		ReceivedAt: start.Add(at),
+	}
+}
+
+func TestEngine(t *testing.T) {
+	engine := backtest.NewEngine(exchange.NewBroker(nil, nil), &backtest.ThresholdStrategy{MinSpread: decimal.MustParse("0.01")})
+	engine.Latency = 10 * time.Millisecond
+	engine.Broker.Fees = exchange.NewFeeSchedule()
+	engine.Broker.Fees.Set(exchange.Fee{Exchange: exchange.COINBASE, Taker: decimal.MustParse("0.01")})
+
+	engine.OnQuote(newQuote(exchange.COINBASE, "BTC", "100", "101", "2", "2", 0))
+	engine.OnQuote(newQuote(exchange.KRAKEN, "BTC", "103", "104", "1", "1", time.Millisecond))
+	// The opportunity shrinks before the orders are filled and isn't traded again while they
+	// are pending
+	engine.OnQuote(newQuote(exchange.KRAKEN, "BTC", "102.5", "104", "0.5", "1", 5*time.Millisecond))
+	engine.OnQuote(newQuote(exchange.KRAKEN, "BTC", "102.5", "104", "0.5", "1", 6*time.Millisecond))
+	engine.OnQuote(newQuote(exchange.COINBASE, "ETH", "10", "11", "1", "1", 20*time.Millisecond))
+	report := engine.Finish()
+
+	if report.Quotes != 5 || report.Opportunities != 2 || report.Traded != 1 || report.Missed != 0 {
+		t.Fatalf("Expected 1 trade out of 2 opportunities over 5 quotes but got %+v", report)
+	}
+	trade := report.Trades[0]
+	expected := map[string]struct {
+		value    decimal.Decimal
+		expected string
+	}{
+		"filled":       {trade.Filled, "0.5"},
+		"expected pnl": {trade.ExpectedPnL, "1"},
+		"buy price":    {trade.BuyPrice, "101"},
+		"sell price":   {trade.SellPrice, "102.5"},
+		"fees":         {trade.Fees, "0.505"},
+		"gross pnl":    {trade.GrossPnL, "0.75"},
+		"pnl":          {trade.PnL, "0.245"},
+		"volume":       {report.Volume, "50.5"},
+		"total pnl":    {report.PnL, "0.245"},
+	}
+	for name, val := range expected {
+		if val.value.String() != val.expected {
+			t.Errorf("Expected %s to be %s but got %s", name, val.expected, val.value)
+		}
+	}
+	if trade.Buy.Exchange != exchange.COINBASE || trade.Sell.Exchange != exchange.KRAKEN ||
+		!trade.DetectedAt.Equal(start.Add(time.Millisecond)) || !trade.FilledAt.Equal(start.Add(20*time.Millisecond)) {
+		t.Errorf("Expected to buy on coinbase and sell on kraken 19ms later but got %+v", trade)
+	}
+}
+
+func TestEngineSlippage(t *testing.T) {
+	engine := backtest.NewEngine(exchange.NewBroker(nil, nil), &backtest.ThresholdStrategy{})
+	engine.Slippage = decimal.MustParse("0.01")
+	engine.OnQuote(newQuote(exchange.COINBASE, "BTC", "99", "100", "1", "1", 0))
+	engine.OnQuote(newQuote(exchange.KRAKEN, "BTC", "110", "111", "1", "1", 0))
+	report := engine.Finish()
+	if report.Traded != 1 || report.Trades[0].BuyPrice.String() != "101" || report.Trades[0].SellPrice.String() != "108.9" {
+		t.Errorf("Expected to buy at 101 and sell at 108.9 with slippage but got %+v", report.Trades)
+	}
+}
+
+func TestEngineMissedFill(t *testing.T) {
+	broker := exchange.NewBroker(nil, nil)
+	broker.Configs = map[string]*exchange.Config{exchange.KRAKEN: {Name: exchange.KRAKEN, MaxAge: time.Second}}
+	engine := backtest.NewEngine(broker, &backtest.ThresholdStrategy{})
+	engine.Latency = 10 * time.Second
+
+	engine.OnQuote(newQuote(exchange.COINBASE, "ETH", "9", "10", "1", "1", 0))
+	engine.OnQuote(newQuote(exchange.KRAKEN, "ETH", "11", "12", "1", "1", 0))
+	// The kraken quote is evicted once it's older than its max age
+	engine.OnQuote(newQuote(exchange.COINBASE, "ETH", "9", "10", "1", "1", 6*time.Second))
+	engine.OnQuote(newQuote(exchange.COINBASE, "ETH", "9", "10", "1", "1", 11*time.Second))
+	report := engine.Finish()
+	if report.Traded != 1 || report.Missed != 1 || !report.Trades[0].Missed || !report.PnL.IsZero() {
+		t.Errorf("Expected the trade to be missed once kraken's quote is stale but got %+v", report)
+	}
+}
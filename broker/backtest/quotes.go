@@ -0,0 +1,43 @@
+package backtest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// QuoteReader reads a normalized quote file. Quote files hold exchange.Quote marshalled as
+// json, one per line in the order they were received, and can be gzip compressed:
+//
+//	{"exchange":"kraken","he_pair":"BTC-USD","he_base":"BTC","he_quote":"USD","bid":"8000.1","ask":"8000.2","bid_size":"1.5","ask_size":"0.3","received_at":"2019-10-18T12:00:00.123456789Z"}
+//
+// Decimals can be strings or numbers. Sizes of 0 are unknown and received_at falls back to
+// exchange_time if missing
+type QuoteReader struct {
+	decoder *json.Decoder
+}
+
+// NewQuoteReader returns a reader of the quote file r. Gzip compressed files are detected on
+// their header
+func NewQuoteReader(r io.Reader) (*QuoteReader, error) {
+	buf := bufio.NewReader(r)
+	header, err := buf.Peek(2)
+	if err == nil && header[0] == 0x1f && header[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &QuoteReader{decoder: json.NewDecoder(gz)}, nil
+	}
+	return &QuoteReader{decoder: json.NewDecoder(buf)}, nil
+}
+
+// Next returns the next quote or io.EOF once every quote has been read
+func (r *QuoteReader) Next() (exchange.Quote, error) {
+	var quote exchange.Quote
+	err := r.decoder.Decode(&quote)
+	return quote, err
+}
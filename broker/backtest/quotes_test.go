@@ -0,0 +1,46 @@
+package backtest_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/backtest"
+)
+
+const quoteFile = `{"exchange":"kraken","he_pair":"BTC-USD","he_base":"BTC","he_quote":"USD","bid":"8000.1","ask":8000.2,"received_at":"2019-10-18T12:00:00.123456789Z"}
+{"exchange":"coinbase","he_pair":"BTC-USD","he_base":"BTC","he_quote":"USD","bid":"8001","ask":"8002","bid_size":"1.5"}
+`
+
+func TestQuoteReader(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(quoteFile))
+	gz.Close()
+
+	for name, r := range map[string]io.Reader{"plain": strings.NewReader(quoteFile), "gzip": &compressed} {
+		reader, err := backtest.NewQuoteReader(r)
+		if err != nil {
+			t.Fatalf("Error opening %s quotes: %s", name, err)
+		}
+		var exchanges []string
+		for {
+			quote, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading %s quotes: %s", name, err)
+			}
+			exchanges = append(exchanges, quote.Exchange)
+			if quote.Exchange == "kraken" && (quote.Ask.String() != "8000.2" || quote.ReceivedAt.Nanosecond() != 123456789) {
+				t.Errorf("Expected the kraken quote to be read from %s quotes but got %+v", name, quote)
+			}
+		}
+		if len(exchanges) != 2 || exchanges[0] != "kraken" || exchanges[1] != "coinbase" {
+			t.Errorf("Expected 2 quotes in order from %s quotes but got %v", name, exchanges)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package backtest
+
+import (
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// Strategy decides which arbitrage opportunities are traded during a backtest
+type Strategy interface {
+	// Quantity returns the quantity of the base to buy on the low side of market and sell on
+	// its high side. 0 skips the opportunity
+	Quantity(market *exchange.ArbMarket) decimal.Decimal
+}
+
+// ThresholdStrategy trades every opportunity whose spread is at least MinSpread, like the
+// broker does when it broadcasts opportunities
+type ThresholdStrategy struct {
+	// MinSpread is the minimum spread in percent net of fees
+	MinSpread decimal.Decimal
+	// MaxQuantity caps the quantity traded per opportunity. 0 trades the whole quantity of the
+	// opportunity
+	MaxQuantity decimal.Decimal
+	// DefaultQuantity is traded when the exchanges don't send sizes and the quantity of the
+	// opportunity is unknown. 0 skips those opportunities
+	DefaultQuantity decimal.Decimal
+}
+
+// Quantity returns the quantity of the opportunity capped at MaxQuantity if its spread is high
+// enough
+func (s *ThresholdStrategy) Quantity(market *exchange.ArbMarket) decimal.Decimal {
+	if market.Spread.LessThan(s.MinSpread) {
+		return decimal.Decimal{}
+	}
+	quantity := market.Quantity
+	if quantity.IsZero() {
+		quantity = s.DefaultQuantity
+	}
+	if s.MaxQuantity.Sign() > 0 {
+		quantity = decimal.Min(quantity, s.MaxQuantity)
+	}
+	return quantity
+}
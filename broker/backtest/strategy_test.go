@@ -0,0 +1,33 @@
+package backtest_test
+
+import (
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/backtest"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func TestThresholdStrategy(t *testing.T) {
+	strategy := &backtest.ThresholdStrategy{
+		MinSpread:       decimal.MustParse("0.5"),
+		MaxQuantity:     decimal.MustParse("2"),
+		DefaultQuantity: decimal.MustParse("0.1"),
+	}
+	tests := []struct {
+		spread   string
+		quantity string
+		expected string
+	}{
+		{"0.4", "1", "0"},
+		{"0.5", "1", "1"},
+		{"3", "5", "2"},
+		{"1", "0", "0.1"},
+	}
+	for _, test := range tests {
+		market := &exchange.ArbMarket{Spread: decimal.MustParse(test.spread), Quantity: decimal.MustParse(test.quantity)}
+		if quantity := strategy.Quantity(market); quantity.String() != test.expected {
+			t.Errorf("Expected to trade %s of an opportunity of %s with a spread of %s but got %s", test.expected, test.quantity, test.spread, quantity)
+		}
+	}
+}
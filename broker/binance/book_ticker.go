@@ -0,0 +1,63 @@
+package binance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// streamsPerConnection is the number of streams binance allows on a single connection
+const streamsPerConnection = 1024
+
+// bookTickerStreams returns the bookTicker stream name of every symbol
+func (c *Client) bookTickerStreams() []string {
+	var streams []string
+	for _, pair := range c.symbols() {
+		streams = append(streams, strings.ToLower(pair)+"@bookTicker")
+	}
+	return streams
+}
+
+// streamURL returns the combined stream url for streams. The path is kept if WSURL is set
+func (c *Client) streamURL(streams []string) *url.URL {
+	u := &url.URL{Scheme: "wss", Host: "stream.binance.com:9443", Path: "/stream"}
+	if c.WSURL != nil {
+		wsURL := *c.WSURL
+		u = &wsURL
+	}
+	// Stream names only hold characters allowed in a query so they're joined as is since
+	// binance expects the separators unescaped
+	u.RawQuery = "streams=" + strings.Join(streams, "/")
+	return u
+}
+
+// parseBookTickerResponse returns a quote from a bookTicker event
+func (c *Client) parseBookTickerResponse(msg []byte) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	var res BookTickerResponse
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	product, ok := c.productMap[res.Pair]
+	if !ok {
+		return quotes, nil
+	}
+	quotes = append(quotes, exchange.Quote{
+		Exchange: c.exchangeName,
+		Bid:      res.Bid,
+		Ask:      res.Ask,
+		BidSize:  res.BidQuantity,
+		AskSize:  res.AskQuantity,
+		ExPair:   product.ExPair,
+		HePair:   product.HePair,
+		ExBase:   product.ExBase,
+		HeBase:   product.HeBase,
+		ExQuote:  product.ExQuote,
+		HeQuote:  product.HeQuote,
+	})
+	return quotes, nil
+}
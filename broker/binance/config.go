@@ -0,0 +1,47 @@
+package binance
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func init() {
+	exchange.Register(exchange.BINANCE, NewClientFromConfig)
+	exchange.RegisterTrader(exchange.BINANCE, NewTraderFromConfig)
+}
+
+// NewClientFromConfig returns a new instance of the API configured from the exchange config.
+// channel is either ticker, depth or bookTicker
+func NewClientFromConfig(newHelper api.HelperFactory, httpClient *http.Client, config *exchange.Config, quoteCh chan<- exchange.Quote, errorCh chan<- error) (exchange.Exchange, error) {
+	c := NewClient(newHelper(), quoteCh, errorCh)
+	c.NewHelper = newHelper
+	switch config.Channel {
+	case "", TICKER:
+	case DEPTH, BOOKTICKER:
+		c.Mode = config.Channel
+	default:
+		return nil, fmt.Errorf("Unsupported %s channel %s", c.exchangeName, config.Channel)
+	}
+	if config.ChannelsPerConnection > 0 {
+		c.ChannelsPerConnection = config.ChannelsPerConnection
+	}
+	if config.Depth > 0 {
+		c.Depth = config.Depth
+	}
+	var err error
+	c.WSURL, err = config.GetWSURL()
+	if err != nil {
+		return nil, err
+	}
+	c.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		c.HTTPClient = httpClient
+	}
+	return c, nil
+}
@@ -0,0 +1,290 @@
+package binance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// snapshotLimit is the number of levels per side requested from the REST depth endpoint. Up to
+// 100 levels weigh 1 of the 1200 request weight binance allows per minute, 1000 levels weigh 10
+const snapshotLimit = 100
+
+// snapshotInterval is the delay between two snapshot requests so resyncing every symbol at
+// once stays well within the request weight limit
+const snapshotInterval = 200 * time.Millisecond
+
+// maxBufferedUpdates is the number of events kept per symbol while its snapshot is fetched
+const maxBufferedUpdates = 1000
+
+// snapshotRetryDelay is how long we wait before fetching a snapshot again after a failure so
+// a REST outage doesn't turn every depth event into a request
+const snapshotRetryDelay = 5 * time.Second
+
+// depthBook is a local order book kept in sync with the diff depth stream of a symbol
+// following https://github.com/binance-exchange/binance-official-api-docs/blob/master/web-socket-streams.md#how-to-manage-a-local-order-book-correctly
+type depthBook struct {
+	book *exchange.OrderBook
+	// lastUpdateID is the final update id of the last event applied or of the snapshot
+	lastUpdateID int64
+	// synced is false until the first event overlapping the snapshot has been applied
+	synced bool
+	// fetching is true while a snapshot is queued or being fetched. Events received meanwhile
+	// are buffered and applied once the snapshot is
+	fetching bool
+	buffered []*DepthUpdate
+	retryAt  time.Time
+}
+
+// FormatSubscribeRequest creates the request subscribing to the depth stream of every product
+func (c *Client) FormatSubscribeRequest() interface{} {
+	var params []string
+	for _, pair := range c.symbols() {
+		params = append(params, strings.ToLower(pair)+"@depth@100ms")
+	}
+	return &streamRequest{
+		Method: "SUBSCRIBE",
+		Params: params,
+		ID:     1,
+	}
+}
+
+// symbols returns every binance symbol in the product map sorted alphabetically
+func (c *Client) symbols() []string {
+	var symbols []string
+	for pair := range c.productMap {
+		symbols = append(symbols, pair)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// parseDepthResponse applies a depth event to the local book of its symbol and returns a quote
+// if the best bid or ask level changed. Events of a book that isn't in sync are buffered while
+// its snapshot is fetched by syncSnapshots
+func (c *Client) parseDepthResponse(msg []byte) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	var res DepthUpdate
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	// Responses to subscribe requests don't have an event type
+	if res.Event != "depthUpdate" {
+		return quotes, nil
+	}
+
+	depth, ok := c.depthBooks[res.Pair]
+	if !ok {
+		depth = &depthBook{book: exchange.NewOrderBook(c.Depth)}
+		depth.book.Invalid = true
+		c.depthBooks[res.Pair] = depth
+	}
+	if !depth.book.Invalid {
+		quotes, err = c.applyDepthUpdate(depth, &res)
+		if err != nil || !depth.book.Invalid {
+			return quotes, err
+		}
+	}
+	depth.buffered = append(depth.buffered, &res)
+	if len(depth.buffered) > maxBufferedUpdates {
+		depth.buffered = depth.buffered[1:]
+	}
+	c.requestSnapshot(res.Pair, depth)
+	return quotes, nil
+}
+
+// requestSnapshot queues the symbol of a book for syncSnapshots unless its snapshot is already
+// queued or a failed fetch is waiting to be retried
+func (c *Client) requestSnapshot(pair string, depth *depthBook) {
+	if depth.fetching || time.Now().Before(depth.retryAt) {
+		return
+	}
+	select {
+	case c.snapshotCh <- pair:
+		depth.fetching = true
+	default:
+	}
+}
+
+// applyDepthUpdate applies an event to a book loaded from a snapshot and returns a quote if the
+// best bid or ask level changed. The book is marked invalid if events are missing
+func (c *Client) applyDepthUpdate(depth *depthBook, res *DepthUpdate) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	if depth.synced && res.FirstUpdateID != depth.lastUpdateID+1 {
+		log.Printf("Gap in %s depth stream for %s. Resyncing\n", c.exchangeName, res.Pair)
+		depth.synced = false
+		depth.book.Invalid = true
+		return quotes, nil
+	}
+	if !depth.synced {
+		// Drop any event already reflected in the snapshot
+		if res.FinalUpdateID <= depth.lastUpdateID {
+			return quotes, nil
+		}
+		// The first event applied must overlap the snapshot, otherwise events are missing
+		// and we need a newer snapshot
+		if res.FirstUpdateID > depth.lastUpdateID+1 {
+			depth.book.Invalid = true
+			return quotes, nil
+		}
+		depth.synced = true
+	}
+
+	cachedBestBid, _ := depth.book.Bids.Best()
+	cachedBestAsk, _ := depth.book.Asks.Best()
+	err := c.applyLevels(depth.book, exchange.BIDS, res.Bids)
+	if err != nil {
+		return []exchange.Quote{}, err
+	}
+	err = c.applyLevels(depth.book, exchange.ASKS, res.Asks)
+	if err != nil {
+		return []exchange.Quote{}, err
+	}
+	depth.lastUpdateID = res.FinalUpdateID
+
+	bestBid, okBid := depth.book.Bids.Best()
+	bestAsk, okAsk := depth.book.Asks.Best()
+	if okBid && okAsk && (bestBid != cachedBestBid || bestAsk != cachedBestAsk) {
+		product := c.productMap[res.Pair]
+		quotes = append(quotes, exchange.Quote{
+			Exchange:     c.exchangeName,
+			Bid:          bestBid.Price,
+			Ask:          bestAsk.Price,
+			BidSize:      bestBid.Size,
+			AskSize:      bestAsk.Size,
+			ExPair:       product.ExPair,
+			HePair:       product.HePair,
+			ExBase:       product.ExBase,
+			HeBase:       product.HeBase,
+			ExQuote:      product.ExQuote,
+			HeQuote:      product.HeQuote,
+			ExchangeTime: eventTime(res.EventTime),
+		})
+	}
+	return quotes, nil
+}
+
+// syncSnapshots fetches the snapshots of the symbols queued by requestSnapshot one at a time
+// until ctx is done. Requests are spaced out by SnapshotLimiter and never hold up reading
+// from the websocket
+func (c *Client) syncSnapshots(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pair := <-c.snapshotCh:
+			err := c.SnapshotLimiter.Wait(ctx)
+			if err != nil {
+				return
+			}
+			snapshot, err := c.fetchSnapshot(ctx, pair)
+			receivedAt := time.Now()
+			c.parseMtx.Lock()
+			quotes, err := c.loadSnapshot(pair, snapshot, err)
+			c.parseMtx.Unlock()
+			if err != nil {
+				c.errorCh <- err
+			}
+			for _, val := range quotes {
+				val.ReceivedAt = receivedAt
+				c.quoteCh <- val
+			}
+		}
+	}
+}
+
+// loadSnapshot rebuilds the book of a symbol from its snapshot then applies the events
+// buffered while it was fetched. If the fetch failed the book stays invalid until
+// snapshotRetryDelay has passed. Callers must hold parseMtx
+func (c *Client) loadSnapshot(pair string, snapshot *DepthSnapshot, fetchErr error) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	depth := c.depthBooks[pair]
+	depth.fetching = false
+	if fetchErr != nil {
+		depth.retryAt = time.Now().Add(snapshotRetryDelay)
+		return quotes, fetchErr
+	}
+	depth.book.Reset()
+	err := c.applyLevels(depth.book, exchange.BIDS, snapshot.Bids)
+	if err != nil {
+		return quotes, err
+	}
+	err = c.applyLevels(depth.book, exchange.ASKS, snapshot.Asks)
+	if err != nil {
+		return quotes, err
+	}
+	depth.lastUpdateID = snapshot.LastUpdateID
+	depth.synced = false
+	depth.book.Invalid = false
+
+	buffered := depth.buffered
+	depth.buffered = nil
+	for i, update := range buffered {
+		res, err := c.applyDepthUpdate(depth, update)
+		if err != nil {
+			return quotes, err
+		}
+		quotes = append(quotes, res...)
+		// Events are missing since the snapshot so we need a newer one
+		if depth.book.Invalid {
+			depth.buffered = buffered[i:]
+			c.requestSnapshot(pair, depth)
+			break
+		}
+	}
+	return quotes, nil
+}
+
+// fetchSnapshot fetches the book of a symbol from the REST depth endpoint
+func (c *Client) fetchSnapshot(ctx context.Context, pair string) (*DepthSnapshot, error) {
+	u := c.GetRESTURL()
+	u.Path = "/api/v3/depth"
+	q := u.Query()
+	q.Set("symbol", pair)
+	q.Set("limit", strconv.Itoa(snapshotLimit))
+	u.RawQuery = q.Encode()
+	var snapshot DepthSnapshot
+	err := api.GetJSON(ctx, c.HTTPClient, u, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s depth snapshot for %s: %s", c.exchangeName, pair, err)
+	}
+	return &snapshot, nil
+}
+
+// applyLevels applies price levels to a side of the book. A quantity of 0 removes the level
+func (c *Client) applyLevels(book *exchange.OrderBook, side int, levels [][]string) error {
+	for _, val := range levels {
+		if len(val) < 2 {
+			return fmt.Errorf("Error parsing order book level from %s: %v", c.exchangeName, val)
+		}
+		price, err := decimal.Parse(val[0])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s: %s", c.exchangeName, err)
+		}
+		quantity, err := decimal.Parse(val[1])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s: %s", c.exchangeName, err)
+		}
+		book.Update(side, price, quantity)
+	}
+	return nil
+}
+
+// OrderBook returns the order book maintained for a symbol in DEPTH mode or nil if we haven't
+// received any event for it
+func (c *Client) OrderBook(pair string) *exchange.OrderBook {
+	if depth, ok := c.depthBooks[pair]; ok {
+		return depth.book
+	}
+	return nil
+}
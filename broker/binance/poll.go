@@ -0,0 +1,52 @@
+package binance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// restInterval is the delay between two REST requests. The book ticker of every symbol weighs
+// 2 of the 1200 request weight binance allows per minute
+const restInterval = time.Second
+
+// PollQuotes fetches the best bid and ask of every symbol in the product map from the REST api
+func (c *Client) PollQuotes(ctx context.Context) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	err := c.Limiter.Wait(ctx)
+	if err != nil {
+		return quotes, err
+	}
+	u := c.GetRESTURL()
+	u.Path = "/api/v3/ticker/bookTicker"
+	var res []RESTBookTicker
+	err = api.GetJSON(ctx, c.HTTPClient, u, &res)
+	if err != nil {
+		return quotes, fmt.Errorf("Error fetching %s book tickers: %s", c.exchangeName, err)
+	}
+	receivedAt := time.Now()
+	for _, val := range res {
+		product, ok := c.productMap[val.Pair]
+		if !ok {
+			continue
+		}
+		quotes = append(quotes, exchange.Quote{
+			Exchange:   c.exchangeName,
+			Bid:        val.Bid,
+			Ask:        val.Ask,
+			BidSize:    val.BidQuantity,
+			AskSize:    val.AskQuantity,
+			ExPair:     product.ExPair,
+			HePair:     product.HePair,
+			ExBase:     product.ExBase,
+			HeBase:     product.HeBase,
+			ExQuote:    product.ExQuote,
+			HeQuote:    product.HeQuote,
+			ReceivedAt: receivedAt,
+		})
+	}
+	return quotes, nil
+}
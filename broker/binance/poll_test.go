@@ -0,0 +1,29 @@
+package binance_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/binance"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestPollQuotes(t *testing.T) {
+	server, restURL := mock.NewRESTServer(`[{"symbol":"MOCKUSD","bidPrice":"4.00000000","bidQty":"431.00000000","askPrice":"4.00000200","askQty":"9.00000000"},{"symbol":"OTHERUSD","bidPrice":"1","bidQty":"1","askPrice":"2","askQty":"1"}]`)
+	defer server.Close()
+	client := binance.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	client.RESTURL = restURL
+	err := client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	quotes, err := client.PollQuotes(context.Background())
+	if err != nil {
+		t.Fatalf("Error polling quotes: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].ExPair != "MOCKUSD" || quotes[0].Bid.String() != "4" ||
+		quotes[0].Ask.String() != "4.000002" || quotes[0].BidSize.String() != "431" {
+		t.Errorf("Expected a quote for MOCKUSD only but got %#v", quotes)
+	}
+}
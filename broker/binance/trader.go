@@ -0,0 +1,267 @@
+package binance
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// recvWindow is how long in milliseconds a signed request is valid for after its timestamp
+const recvWindow = "5000"
+
+// Trader trades on a binance account through the REST api. Requests are signed with
+// HMAC-SHA256 of their parameters
+type Trader struct {
+	APIKey    string
+	APISecret string
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// HTTPClient sends every request to the REST api
+	HTTPClient *http.Client
+}
+
+// NewTrader returns a trader for the account of the api key
+func NewTrader(apiKey, apiSecret string) *Trader {
+	return &Trader{
+		APIKey:     apiKey,
+		APISecret:  apiSecret,
+		HTTPClient: api.DefaultHTTPClient,
+	}
+}
+
+// NewTraderFromConfig returns a trader configured from the exchange config
+func NewTraderFromConfig(httpClient *http.Client, config *exchange.Config) (exchange.Trader, error) {
+	t := NewTrader(config.APIKey, config.APISecret)
+	var err error
+	t.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		t.HTTPClient = httpClient
+	}
+	return t, nil
+}
+
+// orderResponse is an order returned by the order endpoints
+type orderResponse struct {
+	Symbol        string          `json:"symbol"`
+	OrderID       int64           `json:"orderId"`
+	ClientOrderID string          `json:"clientOrderId"`
+	TransactTime  int64           `json:"transactTime"`
+	Time          int64           `json:"time"`
+	Price         decimal.Decimal `json:"price"`
+	OrigQty       decimal.Decimal `json:"origQty"`
+	ExecutedQty   decimal.Decimal `json:"executedQty"`
+	QuoteQty      decimal.Decimal `json:"cummulativeQuoteQty"`
+	Status        string          `json:"status"`
+	TimeInForce   string          `json:"timeInForce"`
+	Type          string          `json:"type"`
+	Side          string          `json:"side"`
+}
+
+// accountResponse is the response of the account endpoint
+type accountResponse struct {
+	Balances []struct {
+		Asset  string          `json:"asset"`
+		Free   decimal.Decimal `json:"free"`
+		Locked decimal.Decimal `json:"locked"`
+	} `json:"balances"`
+}
+
+// errorResponse is the body of failed requests
+type errorResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// orderStatuses maps binance order statuses to exchange order statuses
+var orderStatuses = map[string]string{
+	"NEW":              exchange.OPEN,
+	"PARTIALLY_FILLED": exchange.OPEN,
+	"PENDING_CANCEL":   exchange.OPEN,
+	"FILLED":           exchange.FILLED,
+	"CANCELED":         exchange.CANCELED,
+	"EXPIRED":          exchange.CANCELED,
+	"REJECTED":         exchange.REJECTED,
+}
+
+// PlaceOrder places an order. IOC orders are limit orders with an IOC time in force
+func (t *Trader) PlaceOrder(ctx context.Context, req *exchange.OrderRequest) (*exchange.Order, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("symbol", tradeSymbol(req.ExPair))
+	params.Set("side", strings.ToUpper(req.Side))
+	params.Set("quantity", req.Quantity.String())
+	switch req.Type {
+	case exchange.MARKET:
+		params.Set("type", "MARKET")
+	case exchange.LIMIT:
+		params.Set("type", "LIMIT")
+		params.Set("timeInForce", "GTC")
+		params.Set("price", req.Price.String())
+	case exchange.IOC:
+		params.Set("type", "LIMIT")
+		params.Set("timeInForce", "IOC")
+		params.Set("price", req.Price.String())
+	}
+	if req.ClientID != "" {
+		params.Set("newClientOrderId", req.ClientID)
+	}
+	params.Set("newOrderRespType", "RESULT")
+	var res orderResponse
+	err = t.send(ctx, http.MethodPost, "/api/v3/order", params, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.order(req.ExPair), nil
+}
+
+// CancelOrder cancels an open order
+func (t *Trader) CancelOrder(ctx context.Context, exPair, id string) error {
+	params := url.Values{}
+	params.Set("symbol", tradeSymbol(exPair))
+	params.Set("orderId", id)
+	var res orderResponse
+	return t.send(ctx, http.MethodDelete, "/api/v3/order", params, &res)
+}
+
+// GetOrder returns an order
+func (t *Trader) GetOrder(ctx context.Context, exPair, id string) (*exchange.Order, error) {
+	params := url.Values{}
+	params.Set("symbol", tradeSymbol(exPair))
+	params.Set("orderId", id)
+	var res orderResponse
+	err := t.send(ctx, http.MethodGet, "/api/v3/order", params, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.order(exPair), nil
+}
+
+// GetBalances returns the balance of every asset held by the account
+func (t *Trader) GetBalances(ctx context.Context) (map[string]exchange.Balance, error) {
+	var res accountResponse
+	err := t.send(ctx, http.MethodGet, "/api/v3/account", url.Values{}, &res)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]exchange.Balance)
+	for _, val := range res.Balances {
+		if val.Free.IsZero() && val.Locked.IsZero() {
+			continue
+		}
+		balances[val.Asset] = exchange.Balance{Free: val.Free, Locked: val.Locked}
+	}
+	return balances, nil
+}
+
+// send sends a signed request with params in the query string and unmarshals the response
+// into v
+func (t *Trader) send(ctx context.Context, method, path string, params url.Values, v interface{}) error {
+	params.Set("recvWindow", recvWindow)
+	params.Set("timestamp", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+	query := params.Encode()
+	mac := hmac.New(sha256.New, []byte(t.APISecret))
+	mac.Write([]byte(query))
+	u := t.restURL()
+	u.Path = path
+	u.RawQuery = query + "&signature=" + hex.EncodeToString(mac.Sum(nil))
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-MBX-APIKEY", t.APIKey)
+	res, body, err := api.Do(ctx, t.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return tradeError(res.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// restURL returns the base url for the REST api
+func (t *Trader) restURL() *url.URL {
+	if t.RESTURL != nil {
+		u := *t.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.binance.com"}
+}
+
+// tradeError maps the error response of a request to an exchange error
+func tradeError(status int, body []byte) error {
+	var res errorResponse
+	if json.Unmarshal(body, &res) != nil || res.Msg == "" {
+		res.Msg = http.StatusText(status)
+	}
+	err := &exchange.TradeError{Exchange: exchange.BINANCE, Message: res.Msg}
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusTeapot || res.Code == -1003:
+		err.Err = exchange.ErrRateLimited
+	case res.Code == -2010 && strings.Contains(strings.ToLower(res.Msg), "insufficient balance"):
+		err.Err = exchange.ErrInsufficientFunds
+	case res.Code == -2011 || res.Code == -2013:
+		err.Err = exchange.ErrOrderNotFound
+	case res.Code == -1022 || res.Code == -2014 || res.Code == -2015 || status == http.StatusUnauthorized:
+		err.Err = exchange.ErrAuthentication
+	case res.Code == -1013 || res.Code == -2010 || (res.Code <= -1100 && res.Code >= -1199):
+		err.Err = exchange.ErrInvalidOrder
+	}
+	return err
+}
+
+// order returns the exchange order of a response
+func (res *orderResponse) order(exPair string) *exchange.Order {
+	order := &exchange.Order{
+		ID:       strconv.FormatInt(res.OrderID, 10),
+		ClientID: res.ClientOrderID,
+		ExPair:   exPair,
+		Side:     strings.ToLower(res.Side),
+		Type:     exchange.LIMIT,
+		Price:    res.Price,
+		Quantity: res.OrigQty,
+		Filled:   res.ExecutedQty,
+		Status:   orderStatuses[res.Status],
+	}
+	if res.Type == "MARKET" {
+		order.Type = exchange.MARKET
+	} else if res.TimeInForce == "IOC" {
+		order.Type = exchange.IOC
+	}
+	if order.Status == "" {
+		order.Status = exchange.OPEN
+	}
+	if res.ExecutedQty.Sign() > 0 {
+		order.AvgPrice = res.QuoteQty.DivRound(res.ExecutedQty, 8)
+	}
+	created := res.TransactTime
+	if res.Time > 0 {
+		created = res.Time
+	}
+	if created > 0 {
+		order.CreatedAt = time.Unix(0, created*int64(time.Millisecond))
+	}
+	return order
+}
+
+// tradeSymbol returns the symbol of an exchange pair, ex: BTCUSDT for BTC-USDT
+func tradeSymbol(exPair string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", "/", "").Replace(exPair))
+}
@@ -0,0 +1,104 @@
+package binance_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/binance"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+// binanceStub checks the signature of requests and answers like the binance REST api
+func binanceStub(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		i := strings.Index(r.URL.RawQuery, "&signature=")
+		if i == -1 || r.Header.Get("X-MBX-APIKEY") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":-2015,"msg":"Invalid API-key, IP, or permissions for action."}`))
+			return
+		}
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.URL.RawQuery[:i]))
+		if r.URL.RawQuery[i+len("&signature="):] != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":-1022,"msg":"Signature for this request is not valid."}`))
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("timestamp") == "" || q.Get("recvWindow") == "" {
+			t.Errorf("Expected a timestamp and recvWindow but got %s", r.URL.RawQuery)
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v3/order":
+			if q.Get("quantity") == "100" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"code":-2010,"msg":"Account has insufficient balance for requested action."}`))
+				return
+			}
+			if q.Get("symbol") != "BTCUSDT" || q.Get("side") != "BUY" || q.Get("type") != "LIMIT" || q.Get("timeInForce") != "IOC" || q.Get("price") != "100" {
+				t.Errorf("Unexpected order %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"symbol":"BTCUSDT","orderId":28,"clientOrderId":"arb-1","transactTime":1571400000000,"price":"100.00000000","origQty":"0.50000000","executedQty":"0.20000000","cummulativeQuoteQty":"19.90000000","status":"EXPIRED","timeInForce":"IOC","type":"LIMIT","side":"BUY"}`))
+		case "GET /api/v3/order":
+			w.Write([]byte(`{"symbol":"BTCUSDT","orderId":29,"clientOrderId":"x","time":1571400000000,"price":"0.00000000","origQty":"1.00000000","executedQty":"1.00000000","cummulativeQuoteQty":"101.00000000","status":"FILLED","timeInForce":"GTC","type":"MARKET","side":"SELL"}`))
+		case "DELETE /api/v3/order":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":-2011,"msg":"Unknown order sent."}`))
+		case "GET /api/v3/account":
+			w.Write([]byte(`{"balances":[{"asset":"BTC","free":"0.5","locked":"0.1"},{"asset":"ETH","free":"0.00000000","locked":"0.00000000"},{"asset":"USDT","free":"1000","locked":"0"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestTrader(t *testing.T) {
+	server, restURL := mock.NewStubServer(binanceStub(t))
+	defer server.Close()
+	trader := binance.NewTrader("key", "secret")
+	trader.RESTURL = restURL
+	ctx := context.Background()
+
+	order, err := trader.PlaceOrder(ctx, &exchange.OrderRequest{
+		ExPair:   "BTC-USDT",
+		Side:     exchange.BUY,
+		Type:     exchange.IOC,
+		Quantity: decimal.MustParse("0.5"),
+		Price:    decimal.MustParse("100"),
+		ClientID: "arb-1",
+	})
+	if err != nil {
+		t.Fatalf("Error placing order: %s", err)
+	}
+	if order.ID != "28" || order.Type != exchange.IOC || order.Status != exchange.CANCELED || order.Filled.String() != "0.2" ||
+		order.AvgPrice.String() != "99.5" || order.CreatedAt.Unix() != 1571400000 {
+		t.Errorf("Expected a partially filled IOC order but got %+v", order)
+	}
+	order, err = trader.GetOrder(ctx, "BTC-USDT", "29")
+	if err != nil || order.Side != exchange.SELL || order.Type != exchange.MARKET || order.Status != exchange.FILLED {
+		t.Errorf("Expected a filled market sell but got %+v, %v", order, err)
+	}
+	_, err = trader.PlaceOrder(ctx, &exchange.OrderRequest{ExPair: "BTC-USDT", Side: exchange.BUY, Type: exchange.MARKET, Quantity: decimal.MustParse("100")})
+	if exchange.Cause(err) != exchange.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds but got %v", err)
+	}
+	if err := trader.CancelOrder(ctx, "BTC-USDT", "30"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	balances, err := trader.GetBalances(ctx)
+	if err != nil || len(balances) != 2 || balances["BTC"].Free.String() != "0.5" || balances["BTC"].Locked.String() != "0.1" {
+		t.Errorf("Expected BTC and USDT balances but got %v, %v", balances, err)
+	}
+
+	trader.APISecret = "wrong"
+	if _, err := trader.GetBalances(ctx); exchange.Cause(err) != exchange.ErrAuthentication {
+		t.Errorf("Expected an authentication error with the wrong secret but got %v", err)
+	}
+}
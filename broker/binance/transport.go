@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kaplanmaxe/helgart/broker/api"
@@ -14,60 +17,145 @@ import (
 
 // Client represents an API client
 type Client struct {
+	// Mode is the market data quotes are built from, either TICKER, DEPTH or BOOKTICKER
+	Mode string
+	// Depth is the number of levels per side emitted from each book in DEPTH mode
+	Depth int
+	// WSURL overrides the websocket url if set
+	WSURL *url.URL
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// ChannelsPerConnection is the number of streams subscribed to on each connection in
+	// BOOKTICKER mode
+	ChannelsPerConnection int
+	// NewHelper opens the connections beyond API. Without it every stream shares API
+	NewHelper api.HelperFactory
+	// Limiter spaces out requests to the REST api when polling quotes
+	Limiter *api.RateLimiter
+	// SnapshotLimiter spaces out requests for depth snapshots in DEPTH mode
+	SnapshotLimiter *api.RateLimiter
+	// HTTPClient sends every request to the REST api
+	HTTPClient   *http.Client
 	quoteCh      chan<- exchange.Quote
 	errorCh      chan<- error
 	API          api.WebSocketHelper
 	exchangeName string
 	productMap   exchange.ExProductMap
+	depthBooks   map[string]*depthBook
+	snapshotCh   chan string
+	pool         *api.Pool
+	parseMtx     sync.Mutex
 }
 
 // NewClient returns a new instance of the API
-func NewClient(api api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
+func NewClient(helper api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
 	return &Client{
-		quoteCh:      quoteCh,
-		errorCh:      errorCh,
-		API:          api,
-		exchangeName: exchange.BINANCE,
+		Mode:                  TICKER,
+		Depth:                 10,
+		ChannelsPerConnection: streamsPerConnection,
+		Limiter:               api.NewRateLimiter(restInterval),
+		SnapshotLimiter:       api.NewRateLimiter(snapshotInterval),
+		HTTPClient:            api.DefaultHTTPClient,
+		quoteCh:               quoteCh,
+		errorCh:               errorCh,
+		API:                   helper,
+		exchangeName:          exchange.BINANCE,
+		depthBooks:            make(map[string]*depthBook),
 	}
 }
 
 // Start starts the api connection and listens for new ticker messages
 func (c *Client) Start(ctx context.Context, productMap exchange.ProductMap, doneCh chan<- struct{}) error {
 	c.productMap = productMap[c.exchangeName]
-	err := c.API.Connect(c.GetURL())
+	// binance often returns bad handshake errors. A supervised api.WebSocketHelper retries
+	// with backoff until it connects
+	c.pool = api.NewPool(c.API, c.NewHelper, c.ChannelsPerConnection)
+	var err error
+	if c.Mode == BOOKTICKER {
+		// Streams are picked in the url so each connection gets the url of its own streams
+		streams := c.bookTickerStreams()
+		groups := c.pool.Split(streams)
+		err = c.pool.ConnectFunc(len(streams), func(id int) *url.URL {
+			if id < len(groups) {
+				return c.streamURL(groups[id])
+			}
+			return c.streamURL(nil)
+		})
+	} else {
+		err = c.API.Connect(c.GetURL())
+	}
 	if err != nil {
-		log.Println("Retrying binance connection")
-		// TODO: binance api often returns bad handshake errors. We try again until we connect
-		// but this should be removed eventually or a check should be put in place that it doesn't
-		// try to connect n times
-		return c.Start(ctx, productMap, doneCh)
-		// return err
+		return err
+	}
+	if c.Mode == DEPTH {
+		err = c.API.SendSubscribeRequest(c.FormatSubscribeRequest())
+		if err != nil {
+			return err
+		}
+		// Every symbol is queued at most once at a time so queueing never blocks
+		c.snapshotCh = make(chan string, len(c.productMap))
+		go c.syncSnapshots(ctx)
 	}
 	go c.StartTickerListener(ctx, doneCh)
 	return nil
 }
 
-// StartTickerListener starts a new goroutine to listen for new ticker messages
+// Name returns the name of the exchange
+func (c *Client) Name() string {
+	return c.exchangeName
+}
+
+// SubscribedPairs returns the symbols quotes are emitted for. The ticker stream covers every
+// symbol so this is every symbol in the product map
+func (c *Client) SubscribedPairs() []string {
+	return c.symbols()
+}
+
+// StartTickerListener starts a new goroutine to listen for new ticker messages. Every
+// connection is read from its own goroutine and doneCh is sent to once all of them are closed
 func (c *Client) StartTickerListener(ctx context.Context, doneCh chan<- struct{}) {
+	conns := []api.WebSocketHelper{c.API}
+	if c.pool != nil {
+		conns = conns[:0]
+		for _, shard := range c.pool.Shards() {
+			conns = append(conns, shard)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn api.WebSocketHelper) {
+			defer wg.Done()
+			c.listen(ctx, conn)
+		}(conn)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		doneCh <- struct{}{}
+	}
+}
+
+// listen reads messages from a single connection until ctx is done or reading fails
+func (c *Client) listen(ctx context.Context, conn api.WebSocketHelper) {
 	ticker := time.NewTicker(time.Minute * 3)
-cLoop:
+	defer ticker.Stop()
 	for {
-		message, err := c.API.ReadMessage()
+		message, err := conn.ReadMessage()
 		if err != nil {
 			c.errorCh <- fmt.Errorf("Error reading from %s: %s", c.exchangeName, err)
 			return
 		}
+		receivedAt := time.Now()
 
 		select {
 		case <-ctx.Done():
-			err := c.API.Close()
+			err := conn.Close()
 			if err != nil {
 				c.errorCh <- fmt.Errorf("Error closing %s: %s", c.exchangeName, err)
 			}
-			doneCh <- struct{}{}
-			break cLoop
+			return
 		case <-ticker.C:
-			err := c.API.WritePongMessage()
+			err := conn.WritePongMessage()
 			if err != nil {
 				log.Println(err)
 				c.errorCh <- fmt.Errorf("Error sending pong message for %s: %s", c.exchangeName, err)
@@ -75,12 +163,15 @@ cLoop:
 				log.Printf("Pong for %s sent successfully", c.exchangeName)
 			}
 		default:
+			c.parseMtx.Lock()
 			res, err := c.ParseTickerResponse(message)
+			c.parseMtx.Unlock()
 			if err != nil {
 				c.errorCh <- err
 			} else if len(res) > 0 {
 				for _, val := range res {
 					if val.HePair != "" {
+						val.ReceivedAt = receivedAt
 						c.quoteCh <- val
 					}
 				}
@@ -89,8 +180,30 @@ cLoop:
 	}
 }
 
-// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote
+// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote.
+// Messages are dispatched on their type: arrays are !ticker@arr batches, events from the
+// combined stream endpoint are dispatched on their stream and other objects are depth events
+// or responses to requests
 func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
+	if len(msg) > 0 && msg[0] == '[' {
+		return c.parseTickerArrayResponse(msg)
+	}
+	var res StreamMessage
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	switch {
+	case strings.HasSuffix(res.Stream, "@bookTicker"):
+		return c.parseBookTickerResponse(res.Data)
+	case res.Stream == "" && c.Mode == DEPTH:
+		return c.parseDepthResponse(msg)
+	}
+	return []exchange.Quote{}, nil
+}
+
+// parseTickerArrayResponse returns a quote for every ticker of a !ticker@arr batch
+func (c *Client) parseTickerArrayResponse(msg []byte) ([]exchange.Quote, error) {
 	var err error
 	var quotes []exchange.Quote
 
@@ -105,15 +218,18 @@ func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
 		if val.Pair != "" {
 			product := c.productMap[val.Pair]
 			quotes = append(quotes, exchange.Quote{
-				Exchange: c.exchangeName,
-				Bid:      val.Bid,
-				Ask:      val.Ask,
-				ExPair:   product.ExPair,
-				HePair:   product.HePair,
-				ExBase:   product.ExBase,
-				HeBase:   product.HeBase,
-				ExQuote:  product.ExQuote,
-				HeQuote:  product.HeQuote,
+				Exchange:     c.exchangeName,
+				Bid:          val.Bid,
+				Ask:          val.Ask,
+				BidSize:      val.BidQuantity,
+				AskSize:      val.AskQuantity,
+				ExPair:       product.ExPair,
+				HePair:       product.HePair,
+				ExBase:       product.ExBase,
+				HeBase:       product.HeBase,
+				ExQuote:      product.ExQuote,
+				HeQuote:      product.HeQuote,
+				ExchangeTime: eventTime(val.EventTime),
 			})
 		}
 	}
@@ -122,5 +238,25 @@ func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
 
 // GetURL returns the url for the websocket connection
 func (c *Client) GetURL() *url.URL {
+	if c.WSURL != nil {
+		u := *c.WSURL
+		return &u
+	}
+	if c.Mode == DEPTH {
+		// Depth streams are subscribed to once connected
+		return &url.URL{Scheme: "wss", Host: "stream.binance.com:9443", Path: "/ws"}
+	}
+	if c.Mode == BOOKTICKER {
+		return c.streamURL(c.bookTickerStreams())
+	}
 	return &url.URL{Scheme: "wss", Host: "stream.binance.com:9443", Path: "/ws/!ticker@arr"}
 }
+
+// GetRESTURL returns the base url for the REST api
+func (c *Client) GetRESTURL() *url.URL {
+	if c.RESTURL != nil {
+		u := *c.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.binance.com"}
+}
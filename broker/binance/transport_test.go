@@ -3,9 +3,16 @@ package binance_test
 import (
 	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/kaplanmaxe/helgart/broker/api"
 	"github.com/kaplanmaxe/helgart/broker/binance"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
 	"github.com/kaplanmaxe/helgart/broker/mock"
 )
@@ -25,9 +32,9 @@ func TestStart(t *testing.T) {
 
 	mockResponse := []binance.TickerResponse{
 		binance.TickerResponse{
-			AskQuantity: "123",
+			AskQuantity: decimal.MustParse("123"),
 			Pair:        "MOCKUSD",
-			Bid:         "1000000.00",
+			Bid:         decimal.MustParse("1000000.00"),
 		},
 	}
 	msg, err := json.Marshal(mockResponse)
@@ -54,3 +61,135 @@ listener:
 	}
 	client.API.Close()
 }
+
+func TestDepthSync(t *testing.T) {
+	snapshots := []string{
+		`{"lastUpdateId":100,"bids":[["99.00000000","1.00000000"]],"asks":[["101.00000000","1.00000000"]]}`,
+		`{"lastUpdateId":115,"bids":[["98.00000000","1.00000000"]],"asks":[["102.00000000","1.00000000"]]}`,
+	}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v3/depth" || query.Get("symbol") != "MOCKUSD" || query.Get("limit") != "100" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(snapshots[atomic.AddInt32(&requests, 1)-1]))
+	}))
+	defer server.Close()
+	restURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quoteCh := make(chan exchange.Quote)
+	errorCh := make(chan error, 1)
+	connector := mock.NewRecordingConnector()
+	client := binance.NewClient(connector, quoteCh, errorCh)
+	client.Mode = binance.DEPTH
+	client.RESTURL = restURL
+	client.SnapshotLimiter = api.NewRateLimiter(0)
+	client.WSURL = &url.URL{Scheme: "ws", Host: "127.0.0.1", Path: "/ws"}
+	err = client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	if connector.URL.String() != "ws://127.0.0.1/ws" {
+		t.Errorf("Expected to connect to the overridden url but connected to %s", connector.URL)
+	}
+	expectedSubscription := `{"method":"SUBSCRIBE","params":["mockusd@depth@100ms"],"id":1}`
+	if messages := connector.Messages(); len(messages) != 1 || messages[0] != expectedSubscription {
+		t.Errorf("Expected subscription %s but got %#v", expectedSubscription, messages)
+	}
+
+	events := []string{
+		// Already in the first snapshot so it's dropped
+		`{"e":"depthUpdate","E":1,"s":"MOCKUSD","U":95,"u":100,"b":[["99.50000000","1.00000000"]],"a":[]}`,
+		// Overlaps the snapshot
+		`{"e":"depthUpdate","E":2,"s":"MOCKUSD","U":99,"u":103,"b":[["99.50000000","2.00000000"]],"a":[]}`,
+		`{"e":"depthUpdate","E":3,"s":"MOCKUSD","U":104,"u":105,"b":[],"a":[["100.50000000","1.00000000"]]}`,
+		// Gap since the last event which fetches the second snapshot and is dropped once it's
+		// loaded
+		`{"e":"depthUpdate","E":4,"s":"MOCKUSD","U":110,"u":112,"b":[["99.75000000","1.00000000"]],"a":[]}`,
+		`{"e":"depthUpdate","E":5,"s":"MOCKUSD","U":116,"u":118,"b":[["98.50000000","1.00000000"]],"a":[]}`,
+	}
+	for _, val := range events {
+		connector.Push([]byte(val))
+	}
+	expected := []struct {
+		bid, ask string
+	}{
+		{"99.5", "101"},
+		{"99.5", "100.5"},
+		{"98.5", "102"},
+	}
+	for _, val := range expected {
+		select {
+		case quote := <-quoteCh:
+			if quote.Bid.String() != val.bid || quote.Ask.String() != val.ask || quote.HePair != "MOCK-USD" {
+				t.Errorf("Expected bid %s and ask %s but got %#v", val.bid, val.ask, quote)
+			}
+		case err := <-errorCh:
+			t.Fatalf("%s", err)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for quote")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 snapshots to be fetched but got %d", n)
+	}
+	connector.Close()
+}
+
+func TestBookTicker(t *testing.T) {
+	quoteCh := make(chan exchange.Quote, 2)
+	errorCh := make(chan error, 10)
+	first := mock.NewRecordingConnector()
+	connectors := []*mock.RecordingConnector{first}
+	client := binance.NewClient(first, quoteCh, errorCh)
+	client.Mode = binance.BOOKTICKER
+	client.ChannelsPerConnection = 1
+	client.NewHelper = func() api.WebSocketHelper {
+		conn := mock.NewRecordingConnector()
+		connectors = append(connectors, conn)
+		return conn
+	}
+	productMap := mock.MakeMockProductMap()
+	productMap[exchange.BINANCE]["MOCKBTC"] = exchange.Product{
+		Exchange: exchange.BINANCE,
+		HePair:   "MOCK-BTC",
+		ExPair:   "MOCKBTC",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.Start(ctx, productMap, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	expectedURLs := []string{
+		"wss://stream.binance.com:9443/stream?streams=mockbtc@bookTicker",
+		"wss://stream.binance.com:9443/stream?streams=mockusd@bookTicker",
+	}
+	if len(connectors) != len(expectedURLs) {
+		t.Fatalf("Expected a connection per stream but got %d", len(connectors))
+	}
+	for i, conn := range connectors {
+		if conn.URL.String() != expectedURLs[i] {
+			t.Errorf("Expected connection %d to %s but got %s", i, expectedURLs[i], conn.URL)
+		}
+	}
+
+	first.Push([]byte(`{"result":null,"id":1}`))
+	first.Push([]byte(`{"stream":"mockbtc@bookTicker","data":{"u":400900217,"s":"MOCKBTC","b":"0.00012","B":"31.21","a":"0.00013","A":"40.66"}}`))
+	select {
+	case quote := <-quoteCh:
+		if quote.HePair != "MOCK-BTC" || quote.Bid.String() != "0.00012" || quote.Ask.String() != "0.00013" ||
+			quote.BidSize.String() != "31.21" || quote.AskSize.String() != "40.66" {
+			t.Errorf("Expected a quote from the bookTicker event but got %#v", quote)
+		}
+	case err := <-errorCh:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for quote")
+	}
+}
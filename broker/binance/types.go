@@ -1,5 +1,22 @@
 package binance
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Enum for market data modes
+const (
+	// TICKER consumes the aggregated !ticker@arr stream
+	TICKER = "ticker"
+	// DEPTH consumes <symbol>@depth@100ms diff streams synced against REST snapshots
+	DEPTH = "depth"
+	// BOOKTICKER consumes <symbol>@bookTicker streams which push every best bid or ask change
+	BOOKTICKER = "bookTicker"
+)
+
 // TickerResponse is a response from the ws api with a ticker
 // {
 // 	"e": "24hrTicker",  // Event type
@@ -27,13 +44,89 @@ package binance
 // 	"n": 18151          // Total number of trades
 //   }
 type TickerResponse struct {
+	// Same as with AskQuantity, the event type has to be deserialized or it would be matched
+	// to EventTime
+	Event     string `json:"e"`
+	EventTime int64  `json:"E"`
 	// We need this in order to properly set the price. Sometimes during deserialization
 	// Price will be set to `json:"A"` if we don't also deserialize AskQuantity
-	AskQuantity string `json:"A"`
-	Ask         string `json:"a"`
-	BidQuantity string `json:"B"`
-	Bid         string `json:"b"`
-	Pair        string `json:"s"`
+	AskQuantity decimal.Decimal `json:"A"`
+	Ask         decimal.Decimal `json:"a"`
+	BidQuantity decimal.Decimal `json:"B"`
+	Bid         decimal.Decimal `json:"b"`
+	Pair        string          `json:"s"`
+}
+
+// BookTickerResponse is an event from the <symbol>@bookTicker stream
+// {
+// 	"u": 400900217,     // Order book updateId
+// 	"s": "BNBUSDT",     // Symbol
+// 	"b": "25.35190000", // Best bid price
+// 	"B": "31.21000000", // Best bid qty
+// 	"a": "25.36520000", // Best ask price
+// 	"A": "40.66000000"  // Best ask qty
+// }
+type BookTickerResponse struct {
+	UpdateID    int64           `json:"u"`
+	Pair        string          `json:"s"`
+	Bid         decimal.Decimal `json:"b"`
+	BidQuantity decimal.Decimal `json:"B"`
+	Ask         decimal.Decimal `json:"a"`
+	AskQuantity decimal.Decimal `json:"A"`
+}
+
+// RESTBookTicker is the best bid and ask of a symbol from the REST api
+// {"symbol":"LTCBTC","bidPrice":"4.00000000","bidQty":"431.00000000","askPrice":"4.00000200","askQty":"9.00000000"}
+type RESTBookTicker struct {
+	Pair        string          `json:"symbol"`
+	Bid         decimal.Decimal `json:"bidPrice"`
+	BidQuantity decimal.Decimal `json:"bidQty"`
+	Ask         decimal.Decimal `json:"askPrice"`
+	AskQuantity decimal.Decimal `json:"askQty"`
+}
+
+// StreamMessage wraps every event sent on the combined stream endpoint with the name of the
+// stream it was sent on
+// {"stream":"bnbusdt@bookTicker","data":{...}}
+type StreamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// streamRequest subscribes to or unsubscribes from streams on an open connection
+// {"method":"SUBSCRIBE","params":["btcusdt@depth@100ms"],"id":1}
+type streamRequest struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	ID     int      `json:"id"`
+}
+
+// DepthUpdate is an event from the <symbol>@depth@100ms stream
+// {
+// 	"e": "depthUpdate", // Event type
+// 	"E": 123456789,     // Event time
+// 	"s": "BNBBTC",      // Symbol
+// 	"U": 157,           // First update ID in event
+// 	"u": 160,           // Final update ID in event
+// 	"b": [["0.0024", "10"]], // Bids to be updated
+// 	"a": [["0.0026", "100"]] // Asks to be updated
+// }
+type DepthUpdate struct {
+	Event         string     `json:"e"`
+	EventTime     int64      `json:"E"`
+	Pair          string     `json:"s"`
+	FirstUpdateID int64      `json:"U"`
+	FinalUpdateID int64      `json:"u"`
+	Bids          [][]string `json:"b"`
+	Asks          [][]string `json:"a"`
+}
+
+// DepthSnapshot is a response from the REST depth endpoint
+// {"lastUpdateId":1027024,"bids":[["4.00000000","431.00000000"]],"asks":[["4.00000200","12.00000000"]]}
+type DepthSnapshot struct {
+	LastUpdateID int64      `json:"lastUpdateId"`
+	Bids         [][]string `json:"bids"`
+	Asks         [][]string `json:"asks"`
 }
 
 type productsResponse struct {
@@ -45,3 +138,12 @@ type symbol struct {
 	BaseCurrency  string `json:"baseAsset"`
 	QuoteCurrency string `json:"quoteAsset"`
 }
+
+// eventTime converts an event time in milliseconds since epoch to a time. Missing event times
+// return the zero time
+func eventTime(milliseconds int64) time.Time {
+	if milliseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, milliseconds*int64(time.Millisecond))
+}
@@ -0,0 +1,196 @@
+package bitfinex
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// bookLengths are the lengths bitfinex allows on the book channel
+var bookLengths = []int{1, 25, 100, 250}
+
+// checksumDepth is the number of levels per side bitfinex uses to compute book checksums
+const checksumDepth = 25
+
+// parseBookResponse applies a snapshot or update from a book channel to the book of its pair
+// and returns a quote if the best bid or ask level changed
+// Snapshot: [CHANNEL_ID, [[PRICE, COUNT, AMOUNT], ...]]
+// Update: [CHANNEL_ID, [PRICE, COUNT, AMOUNT]]
+func (c *Client) parseBookResponse(shardID, channelID int, payload json.RawMessage, exchangeTime time.Time) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	pair, ok := c.channelPairMap(shardID)[channelID]
+	if !ok {
+		return quotes, nil
+	}
+
+	var raw []json.RawMessage
+	err := json.Unmarshal(payload, &raw)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	snapshot := len(raw) == 0 || (len(raw[0]) > 0 && raw[0][0] == '[')
+	var levels []BookLevel
+	if snapshot {
+		err = json.Unmarshal(payload, &levels)
+	} else {
+		var level BookLevel
+		err = json.Unmarshal(payload, &level)
+		levels = append(levels, level)
+	}
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error parsing order book levels from %s: %s", c.exchangeName, err)
+	}
+
+	book, ok := c.orderBookMap[pair]
+	if snapshot {
+		if !ok {
+			book = exchange.NewOrderBook(c.Length)
+			c.orderBookMap[pair] = book
+		}
+		book.Reset()
+	} else if !ok || book.Invalid {
+		// Wait for the snapshot to rebuild the book
+		return quotes, nil
+	}
+
+	cachedBestBid, _ := book.Bids.Best()
+	cachedBestAsk, _ := book.Asks.Best()
+	for _, level := range levels {
+		applyLevel(book, level)
+	}
+	// Levels pushed out of the subscribed length are no longer updated
+	book.Truncate()
+
+	bestBid, okBid := book.Bids.Best()
+	bestAsk, okAsk := book.Asks.Best()
+	if okBid && okAsk && (bestBid != cachedBestBid || bestAsk != cachedBestAsk) {
+		product := c.productMap[pair]
+		quotes = append(quotes, exchange.Quote{
+			Exchange:     c.exchangeName,
+			Bid:          bestBid.Price,
+			Ask:          bestAsk.Price,
+			BidSize:      bestBid.Size,
+			AskSize:      bestAsk.Size,
+			ExPair:       product.ExPair,
+			HePair:       product.HePair,
+			ExBase:       product.ExBase,
+			HeBase:       product.HeBase,
+			ExQuote:      product.ExQuote,
+			HeQuote:      product.HeQuote,
+			ExchangeTime: exchangeTime,
+		})
+	}
+	return quotes, nil
+}
+
+// applyLevel applies a P0 level to the book. Asks are stored with a positive size
+func applyLevel(book *exchange.OrderBook, level BookLevel) {
+	side := exchange.BIDS
+	if level.Amount.Sign() < 0 {
+		side = exchange.ASKS
+	}
+	if level.Count == 0 {
+		book.Update(side, level.Price, decimal.Decimal{})
+		return
+	}
+	book.Update(side, level.Price, level.Amount.Abs())
+}
+
+// verifyChecksum compares a checksum message against the book of its channel and resubscribes
+// on mismatch
+// [CHANNEL_ID, "cs", CHECKSUM]
+func (c *Client) verifyChecksum(shardID, channelID int, msg []json.RawMessage) error {
+	if len(msg) < 3 {
+		return fmt.Errorf("Error parsing checksum from %s: missing value", c.exchangeName)
+	}
+	var expected int32
+	err := json.Unmarshal(msg[2], &expected)
+	if err != nil {
+		return fmt.Errorf("Error parsing checksum from %s: %s", c.exchangeName, err)
+	}
+	pair, ok := c.channelPairMap(shardID)[channelID]
+	if !ok {
+		return nil
+	}
+	book, ok := c.orderBookMap[pair]
+	if !ok || book.Invalid {
+		return nil
+	}
+	if checksum(book) != expected {
+		log.Printf("Checksum mismatch on %s for %s. Resubscribing\n", c.exchangeName, pair)
+		return c.resubscribe(shardID, channelID, pair)
+	}
+	return nil
+}
+
+// checksum computes bitfinex's signed CRC32 checksum over the top 25 bids and asks interleaved
+// as bid price, bid amount, ask price, ask amount joined by colons. Ask amounts are negative
+func checksum(book *exchange.OrderBook) int32 {
+	bids := book.Bids.Top(checksumDepth)
+	asks := book.Asks.Top(checksumDepth)
+	var values []string
+	for i := 0; i < checksumDepth; i++ {
+		if i < len(bids) {
+			values = append(values, formatNumber(bids[i].Price), formatNumber(bids[i].Size))
+		}
+		if i < len(asks) {
+			values = append(values, formatNumber(asks[i].Price), formatNumber(asks[i].Size.Neg()))
+		}
+	}
+	return int32(crc32.ChecksumIEEE([]byte(strings.Join(values, ":"))))
+}
+
+// formatNumber formats a number the way javascript's Number.prototype.toString does since
+// that's what bitfinex computes checksums from. Bitfinex sends json numbers so their closest
+// float is what javascript formats
+func formatNumber(d decimal.Decimal) string {
+	val := d.Float64()
+	abs := math.Abs(val)
+	if abs == 0 || (abs >= 1e-6 && abs < 1e21) {
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	// Go pads the exponent to two digits while javascript doesn't: 1e-07 vs 1e-7
+	formatted := strconv.FormatFloat(val, 'e', -1, 64)
+	index := strings.Index(formatted, "e")
+	exponent := strings.TrimLeft(formatted[index+2:], "0")
+	return formatted[:index+2] + exponent
+}
+
+// resubscribe marks the book for a pair as invalid and resubscribes to its book channel on the
+// same connection. Bitfinex answers with a new channel id and snapshot which rebuilds the book
+func (c *Client) resubscribe(shardID, channelID int, pair string) error {
+	book := c.orderBookMap[pair]
+	book.Invalid = true
+
+	// These aren't sent with SendSubscribeRequest since the original subscription already
+	// covers this pair if the connection has to be replayed
+	requests := []interface{}{
+		&UnsubscribeRequest{Event: "unsubscribe", ChannelID: channelID},
+		c.formatSubscribeRequest(pair),
+	}
+	for _, req := range requests {
+		payload, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("Error marshalling resubscribe request for %s on %s: %s", pair, c.exchangeName, err)
+		}
+		err = c.connection(shardID).WriteMessage(payload)
+		if err != nil {
+			return fmt.Errorf("Error sending resubscribe request for %s on %s: %s", pair, c.exchangeName, err)
+		}
+	}
+	return nil
+}
+
+// OrderBook returns the order book maintained for a pair or nil if we haven't received a
+// snapshot for it
+func (c *Client) OrderBook(pair string) *exchange.OrderBook {
+	return c.orderBookMap[pair]
+}
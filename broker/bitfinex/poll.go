@@ -0,0 +1,63 @@
+package bitfinex
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// restInterval is the delay between two REST requests. Bitfinex allows 30 requests per minute
+// on the tickers endpoint
+const restInterval = 2 * time.Second
+
+// PollQuotes fetches the best bid and ask of every subscribed pair from the REST api
+func (c *Client) PollQuotes(ctx context.Context) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	if len(c.Pairs) == 0 {
+		return quotes, nil
+	}
+	err := c.Limiter.Wait(ctx)
+	if err != nil {
+		return quotes, err
+	}
+	var symbols []string
+	for _, pair := range c.Pairs {
+		symbols = append(symbols, "t"+pair)
+	}
+	u := c.GetRESTURL()
+	u.Path = "/v2/tickers"
+	q := u.Query()
+	q.Set("symbols", strings.Join(symbols, ","))
+	u.RawQuery = q.Encode()
+	var res []RESTTicker
+	err = api.GetJSON(ctx, c.HTTPClient, u, &res)
+	if err != nil {
+		return quotes, fmt.Errorf("Error fetching %s tickers: %s", c.exchangeName, err)
+	}
+	receivedAt := time.Now()
+	for _, val := range res {
+		product, ok := c.productMap[val.Pair]
+		if !ok {
+			continue
+		}
+		quotes = append(quotes, exchange.Quote{
+			Exchange:   c.exchangeName,
+			Bid:        val.Bid,
+			Ask:        val.Ask,
+			BidSize:    val.BidSize,
+			AskSize:    val.AskSize,
+			ExPair:     product.ExPair,
+			HePair:     product.HePair,
+			ExBase:     product.ExBase,
+			HeBase:     product.HeBase,
+			ExQuote:    product.ExQuote,
+			HeQuote:    product.HeQuote,
+			ReceivedAt: receivedAt,
+		})
+	}
+	return quotes, nil
+}
@@ -0,0 +1,50 @@
+package bitfinex_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/bitfinex"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestPollQuotes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/symbols":
+			w.Write([]byte(`["mockusd"]`))
+		case "/v2/tickers":
+			if r.URL.Query().Get("symbols") != "tMOCKUSD" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`[["tMOCKUSD",8114.8,67.33,8114.9,3.31,314.9,0.0404,8114.9,18884.37,8199.9,7731]]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	restURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := bitfinex.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	client.RESTURL = restURL
+	err = client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	quotes, err := client.PollQuotes(context.Background())
+	if err != nil {
+		t.Fatalf("Error polling quotes: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].HePair != "MOCK-USD" || quotes[0].Bid.String() != "8114.8" ||
+		quotes[0].AskSize.String() != "3.31" {
+		t.Errorf("Expected a quote for MOCK-USD from the REST tickers but got %#v", quotes)
+	}
+}
@@ -0,0 +1,339 @@
+package bitfinex
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// Trader trades on the exchange wallet of a bitfinex account through the authenticated v2
+// REST api. Requests are signed with HMAC-SHA384 of their path, nonce and body
+type Trader struct {
+	APIKey    string
+	APISecret string
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// HTTPClient sends every request to the REST api
+	HTTPClient *http.Client
+	nonce      api.Nonce
+}
+
+// NewTrader returns a trader for the account of the api key
+func NewTrader(apiKey, apiSecret string) *Trader {
+	return &Trader{
+		APIKey:     apiKey,
+		APISecret:  apiSecret,
+		HTTPClient: api.DefaultHTTPClient,
+	}
+}
+
+// NewTraderFromConfig returns a trader configured from the exchange config
+func NewTraderFromConfig(httpClient *http.Client, config *exchange.Config) (exchange.Trader, error) {
+	t := NewTrader(config.APIKey, config.APISecret)
+	var err error
+	t.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		t.HTTPClient = httpClient
+	}
+	return t, nil
+}
+
+// Fields of the order arrays returned by the order endpoints
+const (
+	fieldID         = 0
+	fieldCID        = 2
+	fieldCreated    = 4
+	fieldAmount     = 6
+	fieldAmountOrig = 7
+	fieldType       = 8
+	fieldStatus     = 13
+	fieldPrice      = 16
+	fieldPriceAvg   = 17
+)
+
+// orderTypes maps order types to bitfinex exchange wallet order types
+var orderTypes = map[string]string{
+	exchange.LIMIT:  "EXCHANGE LIMIT",
+	exchange.MARKET: "EXCHANGE MARKET",
+	exchange.IOC:    "EXCHANGE IOC",
+}
+
+// orderRequest is the body of an order submitted with the order submit endpoint
+type orderRequest struct {
+	Type   string           `json:"type"`
+	Symbol string           `json:"symbol"`
+	Amount decimal.Decimal  `json:"amount"`
+	Price  *decimal.Decimal `json:"price,omitempty"`
+	CID    int64            `json:"cid,omitempty"`
+}
+
+// PlaceOrder places an order on the exchange wallet. The client id must be an integer
+func (t *Trader) PlaceOrder(ctx context.Context, req *exchange.OrderRequest) (*exchange.Order, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	body := orderRequest{
+		Type:   orderTypes[req.Type],
+		Symbol: tradeSymbol(req.ExPair),
+		Amount: req.Quantity,
+	}
+	if req.Type != exchange.MARKET {
+		body.Price = &req.Price
+	}
+	// Sells are orders with a negative amount
+	if req.Side == exchange.SELL {
+		body.Amount = req.Quantity.Neg()
+	}
+	if req.ClientID != "" {
+		body.CID, err = strconv.ParseInt(req.ClientID, 10, 64)
+		if err != nil {
+			return nil, &exchange.TradeError{Exchange: exchange.BITFINEX, Message: fmt.Sprintf("client id %q isn't an integer", req.ClientID), Err: exchange.ErrInvalidOrder}
+		}
+	}
+	var res []json.RawMessage
+	err = t.send(ctx, "/v2/auth/w/order/submit", body, &res)
+	if err != nil {
+		return nil, err
+	}
+	// Notifications hold the submitted orders in their fifth field
+	var orders []json.RawMessage
+	if len(res) < 5 || json.Unmarshal(res[4], &orders) != nil || len(orders) == 0 {
+		return nil, &exchange.TradeError{Exchange: exchange.BITFINEX, Message: "Order submit returned no order"}
+	}
+	return parseOrder(orders[0], req.ExPair)
+}
+
+// CancelOrder cancels an open order
+func (t *Trader) CancelOrder(ctx context.Context, exPair, id string) error {
+	orderID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return &exchange.TradeError{Exchange: exchange.BITFINEX, Message: "Invalid order id " + id, Err: exchange.ErrOrderNotFound}
+	}
+	var res []json.RawMessage
+	return t.send(ctx, "/v2/auth/w/order/cancel", map[string]int64{"id": orderID}, &res)
+}
+
+// GetOrder returns an order from the open orders or the order history
+func (t *Trader) GetOrder(ctx context.Context, exPair, id string) (*exchange.Order, error) {
+	orderID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, &exchange.TradeError{Exchange: exchange.BITFINEX, Message: "Invalid order id " + id, Err: exchange.ErrOrderNotFound}
+	}
+	body := map[string][]int64{"id": {orderID}}
+	active := "/v2/auth/r/orders/" + tradeSymbol(exPair)
+	for _, path := range []string{active, active + "/hist"} {
+		var orders []json.RawMessage
+		err = t.send(ctx, path, body, &orders)
+		if err != nil {
+			return nil, err
+		}
+		if len(orders) > 0 {
+			return parseOrder(orders[0], exPair)
+		}
+	}
+	return nil, &exchange.TradeError{Exchange: exchange.BITFINEX, Message: "Order " + id + " not found", Err: exchange.ErrOrderNotFound}
+}
+
+// GetBalances returns the balance of every currency in the exchange wallet
+func (t *Trader) GetBalances(ctx context.Context) (map[string]exchange.Balance, error) {
+	var wallets [][]json.RawMessage
+	err := t.send(ctx, "/v2/auth/r/wallets", struct{}{}, &wallets)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]exchange.Balance)
+	for _, wallet := range wallets {
+		if len(wallet) < 5 {
+			continue
+		}
+		var walletType, currency string
+		var balance, available decimal.Decimal
+		json.Unmarshal(wallet[0], &walletType)
+		json.Unmarshal(wallet[1], &currency)
+		if walletType != "exchange" {
+			continue
+		}
+		if err := json.Unmarshal(wallet[2], &balance); err != nil || balance.IsZero() {
+			continue
+		}
+		// The available balance is null until it's been computed
+		if string(wallet[4]) == "null" {
+			available = balance
+		} else if err := json.Unmarshal(wallet[4], &available); err != nil {
+			continue
+		}
+		balances[currency] = exchange.Balance{Free: available, Locked: balance.Sub(available)}
+	}
+	return balances, nil
+}
+
+// send sends a signed request with body marshalled as json to an authenticated endpoint and
+// unmarshals the response into v
+func (t *Trader) send(ctx context.Context, path string, body interface{}, v interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	nonce := t.nonce.Next()
+	mac := hmac.New(sha512.New384, []byte(t.APISecret))
+	mac.Write([]byte("/api" + path + nonce))
+	mac.Write(payload)
+	u := t.restURL()
+	u.Path = path
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("bfx-nonce", nonce)
+	req.Header.Set("bfx-apikey", t.APIKey)
+	req.Header.Set("bfx-signature", hex.EncodeToString(mac.Sum(nil)))
+	res, resBody, err := api.Do(ctx, t.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return tradeError(res.StatusCode, resBody)
+	}
+	return json.Unmarshal(resBody, v)
+}
+
+// restURL returns the base url for the authenticated REST api
+func (t *Trader) restURL() *url.URL {
+	if t.RESTURL != nil {
+		u := *t.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.bitfinex.com"}
+}
+
+// tradeError maps the error response of a request to an exchange error. Errors are arrays
+// like ["error", 10001, "Invalid order: not enough exchange balance"]
+func tradeError(status int, body []byte) error {
+	var res []json.RawMessage
+	var code int
+	var msg string
+	if json.Unmarshal(body, &res) == nil && len(res) >= 3 {
+		json.Unmarshal(res[1], &code)
+		json.Unmarshal(res[2], &msg)
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	err := &exchange.TradeError{Exchange: exchange.BITFINEX, Message: msg}
+	lower := strings.ToLower(msg)
+	switch {
+	case status == http.StatusTooManyRequests || code == 11010 || strings.Contains(lower, "ratelimit"):
+		err.Err = exchange.ErrRateLimited
+	case code == 10100 || strings.HasPrefix(lower, "apikey") || strings.Contains(lower, "nonce"):
+		err.Err = exchange.ErrAuthentication
+	case strings.Contains(lower, "not enough") || strings.Contains(lower, "insufficient"):
+		err.Err = exchange.ErrInsufficientFunds
+	case strings.Contains(lower, "not found"):
+		err.Err = exchange.ErrOrderNotFound
+	case code == 10001 || strings.HasPrefix(lower, "invalid"):
+		err.Err = exchange.ErrInvalidOrder
+	}
+	return err
+}
+
+// parseOrder parses an order array
+func parseOrder(raw json.RawMessage, exPair string) (*exchange.Order, error) {
+	var fields []json.RawMessage
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s order: %s", exchange.BITFINEX, err)
+	}
+	if len(fields) <= fieldPriceAvg {
+		return nil, fmt.Errorf("Error parsing %s order: %d fields", exchange.BITFINEX, len(fields))
+	}
+	var id, cid, created int64
+	var amount, amountOrig, price, priceAvg decimal.Decimal
+	var typ, status string
+	values := []struct {
+		field int
+		dest  interface{}
+	}{
+		{fieldID, &id},
+		{fieldCID, &cid},
+		{fieldCreated, &created},
+		{fieldAmount, &amount},
+		{fieldAmountOrig, &amountOrig},
+		{fieldType, &typ},
+		{fieldStatus, &status},
+		{fieldPrice, &price},
+		{fieldPriceAvg, &priceAvg},
+	}
+	for _, val := range values {
+		if string(fields[val.field]) == "null" {
+			continue
+		}
+		err = json.Unmarshal(fields[val.field], val.dest)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s order: %s", exchange.BITFINEX, err)
+		}
+	}
+	order := &exchange.Order{
+		ID:        strconv.FormatInt(id, 10),
+		ExPair:    exPair,
+		Side:      exchange.BUY,
+		Type:      exchange.LIMIT,
+		Price:     price,
+		Quantity:  amountOrig.Abs(),
+		Filled:    amountOrig.Abs().Sub(amount.Abs()),
+		CreatedAt: time.Unix(0, created*int64(time.Millisecond)),
+		Status:    orderStatus(status),
+	}
+	if cid != 0 {
+		order.ClientID = strconv.FormatInt(cid, 10)
+	}
+	if amountOrig.Sign() < 0 {
+		order.Side = exchange.SELL
+	}
+	for orderType, bitfinexType := range orderTypes {
+		if typ == bitfinexType {
+			order.Type = orderType
+		}
+	}
+	if order.Filled.Sign() > 0 {
+		order.AvgPrice = priceAvg
+	}
+	return order, nil
+}
+
+// orderStatus maps the status of an order to an exchange order status. Statuses have details
+// after their name, ex: EXECUTED @ 107.6(-0.2) or CANCELED was: PARTIALLY FILLED @ 107.6(-0.1)
+func orderStatus(status string) string {
+	switch {
+	case strings.HasPrefix(status, "EXECUTED"):
+		return exchange.FILLED
+	case strings.Contains(status, "CANCELED"):
+		return exchange.CANCELED
+	case strings.HasPrefix(status, "INSUFFICIENT"), strings.HasPrefix(status, "RSN_"):
+		return exchange.REJECTED
+	default:
+		return exchange.OPEN
+	}
+}
+
+// tradeSymbol returns the trading symbol of an exchange pair, ex: tBTCUSD for BTCUSD
+func tradeSymbol(exPair string) string {
+	return "t" + strings.ToUpper(strings.NewReplacer("-", "", "/", "").Replace(exPair))
+}
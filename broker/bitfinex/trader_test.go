@@ -0,0 +1,113 @@
+package bitfinex_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/bitfinex"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+const executedOrder = `[1234,null,7,"tBTCUSD",1571400000000,1571400000500,0,-0.5,"EXCHANGE IOC",null,null,null,0,"EXECUTED @ 100.5(-0.5)",null,null,100,100.5,0,0,null,null,null,0,0,null,null,null,"API>BFX",null,null,null]`
+
+// bitfinexStub checks the signature of requests and answers like the bitfinex authenticated
+// REST api
+func bitfinexStub(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha512.New384, []byte("secret"))
+		mac.Write([]byte("/api" + r.URL.Path + r.Header.Get("bfx-nonce") + string(body)))
+		if r.Header.Get("bfx-apikey") != "key" || r.Header.Get("bfx-signature") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`["error",10100,"apikey: invalid"]`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/auth/w/order/submit":
+			var order map[string]interface{}
+			json.Unmarshal(body, &order)
+			if order["amount"] == "100" {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`["error",10001,"Invalid order: not enough exchange balance for 100 BTCUSD at 100"]`))
+				return
+			}
+			if order["symbol"] != "tBTCUSD" || order["type"] != "EXCHANGE IOC" || order["amount"] != "-0.5" || order["price"] != "100" || order["cid"] != 7.0 {
+				t.Errorf("Unexpected order %s", body)
+			}
+			w.Write([]byte(`[1571400000000,"on-req",null,null,[` + executedOrder + `],null,"SUCCESS","Submitting 1 orders."]`))
+		case "/v2/auth/r/orders/tBTCUSD":
+			w.Write([]byte(`[]`))
+		case "/v2/auth/r/orders/tBTCUSD/hist":
+			var query map[string][]int64
+			json.Unmarshal(body, &query)
+			if len(query["id"]) == 1 && query["id"][0] == 1234 {
+				w.Write([]byte(`[` + executedOrder + `]`))
+			} else {
+				w.Write([]byte(`[]`))
+			}
+		case "/v2/auth/w/order/cancel":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`["error",10001,"Order not found."]`))
+		case "/v2/auth/r/wallets":
+			w.Write([]byte(`[["exchange","USD",1000,0,900,null,null],["exchange","BTC",1,0,null,null,null],["margin","USD",50,0,50,null,null],["exchange","ETH",0,0,0,null,null]]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestTrader(t *testing.T) {
+	server, restURL := mock.NewStubServer(bitfinexStub(t))
+	defer server.Close()
+	trader := bitfinex.NewTrader("key", "secret")
+	trader.RESTURL = restURL
+	ctx := context.Background()
+
+	order, err := trader.PlaceOrder(ctx, &exchange.OrderRequest{
+		ExPair:   "BTCUSD",
+		Side:     exchange.SELL,
+		Type:     exchange.IOC,
+		Quantity: decimal.MustParse("0.5"),
+		Price:    decimal.MustParse("100"),
+		ClientID: "7",
+	})
+	if err != nil {
+		t.Fatalf("Error placing order: %s", err)
+	}
+	if order.ID != "1234" || order.ClientID != "7" || order.Side != exchange.SELL || order.Type != exchange.IOC || order.Status != exchange.FILLED ||
+		order.Filled.String() != "0.5" || order.AvgPrice.String() != "100.5" || order.CreatedAt.Unix() != 1571400000 {
+		t.Errorf("Expected a filled IOC sell but got %+v", order)
+	}
+	order, err = trader.GetOrder(ctx, "BTCUSD", "1234")
+	if err != nil || order.Status != exchange.FILLED {
+		t.Errorf("Expected the filled order from the history but got %+v, %v", order, err)
+	}
+	if _, err := trader.GetOrder(ctx, "BTCUSD", "1"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	if err := trader.CancelOrder(ctx, "BTCUSD", "1"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	_, err = trader.PlaceOrder(ctx, &exchange.OrderRequest{ExPair: "BTCUSD", Side: exchange.BUY, Type: exchange.MARKET, Quantity: decimal.MustParse("100")})
+	if exchange.Cause(err) != exchange.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds but got %v", err)
+	}
+	balances, err := trader.GetBalances(ctx)
+	if err != nil || len(balances) != 2 || balances["USD"].Free.String() != "900" || balances["USD"].Locked.String() != "100" ||
+		balances["BTC"].Free.String() != "1" {
+		t.Errorf("Expected USD and BTC exchange balances but got %v, %v", balances, err)
+	}
+
+	trader.APISecret = "wrong"
+	if _, err := trader.GetBalances(ctx); exchange.Cause(err) != exchange.ErrAuthentication {
+		t.Errorf("Expected an authentication error with the wrong secret but got %v", err)
+	}
+}
@@ -5,194 +5,389 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/kaplanmaxe/helgart/broker/api"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/metrics"
 )
 
+// channelsPerConnection is the default number of channels subscribed to on a connection.
+// Bitfinex rejects subscriptions past its per connection channel limit
+const channelsPerConnection = 25
+
 // Client represents an API client
 type Client struct {
-	Pairs          []string
-	quoteCh        chan<- exchange.Quote
-	errorCh        chan<- error
-	API            api.WebSocketHelper
-	channelPairMap exchange.ChannelPairMap
-	exchangeName   string
-	productMap     exchange.ExProductMap
+	Pairs []string
+	// Channel is the channel quotes are built from, either TICKER or BOOK
+	Channel string
+	// Length is the number of price levels per side subscribed to on the BOOK channel
+	Length int
+	// WSURL overrides the websocket url if set
+	WSURL *url.URL
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// ChannelsPerConnection is the number of channels subscribed to on each connection
+	ChannelsPerConnection int
+	// NewHelper opens the connections beyond API. Without it every channel shares API
+	NewHelper api.HelperFactory
+	// Limiter spaces out requests to the REST api when polling quotes
+	Limiter *api.RateLimiter
+	// HTTPClient sends every request to the REST api
+	HTTPClient   *http.Client
+	quoteCh      chan<- exchange.Quote
+	errorCh      chan<- error
+	API          api.WebSocketHelper
+	exchangeName string
+	productMap   exchange.ExProductMap
+	orderBookMap exchange.OrderBookMap
+	pool         *api.Pool
+	// channelPairMaps holds the channel ids of each connection keyed by shard id since
+	// bitfinex assigns them per connection
+	channelPairMaps map[int]exchange.ChannelPairMap
+	// sequences holds the last sequence number received on each connection keyed by shard id
+	sequences map[int]int64
+	gaps      *metrics.GapCounter
+	parseMtx  sync.Mutex
 }
 
 // NewClient returns a new instance of the API
-func NewClient(api api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
+func NewClient(helper api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
 	return &Client{
-		quoteCh:        quoteCh,
-		errorCh:        errorCh,
-		API:            api,
-		channelPairMap: make(exchange.ChannelPairMap),
-		exchangeName:   exchange.BITFINEX,
+		Channel:               TICKER,
+		Length:                25,
+		ChannelsPerConnection: channelsPerConnection,
+		Limiter:               api.NewRateLimiter(restInterval),
+		HTTPClient:            api.DefaultHTTPClient,
+		quoteCh:               quoteCh,
+		errorCh:               errorCh,
+		API:                   helper,
+		exchangeName:          exchange.BITFINEX,
+		orderBookMap:          make(exchange.OrderBookMap),
+		channelPairMaps:       make(map[int]exchange.ChannelPairMap),
+		sequences:             make(map[int]int64),
+		gaps:                  metrics.NewGapCounter(),
 	}
 }
 
 // Start starts the api connection and listens for new ticker messages
 func (c *Client) Start(ctx context.Context, productMap exchange.ProductMap, exchangeDoneCh chan<- struct{}) error {
 	c.productMap = productMap[c.exchangeName]
-	err := c.GetPairs()
+	err := c.validateChannel()
 	if err != nil {
 		return err
 	}
-	c.API.Connect(c.GetURL())
+	err = c.GetPairs()
+	if err != nil {
+		return err
+	}
+	c.Pairs = c.productMap.Tradable(c.Pairs)
+	c.pool = api.NewPool(c.API, c.NewHelper, c.ChannelsPerConnection)
+	err = c.pool.Connect(c.GetURL(), len(c.Pairs))
 	if err != nil {
 		return err
 	}
 
-	doneCh := make(chan struct{}, 1)
-	go c.startSubscribeListener(doneCh)
-	for key, pair := range c.Pairs {
-		req := &SubscriptionRequest{
-			Event:   "subscribe",
-			Channel: "ticker",
-			Symbol:  "t" + strings.ToUpper(pair),
-		}
-
-		err := c.SendSubscribeRequest(req)
+	// The conf request has to be sent before subscribing for the flags to apply
+	flags := TIMESTAMP | SEQALL
+	if c.Channel == BOOK {
+		flags |= CHECKSUM
+	}
+	for i, pairs := range c.pool.Split(c.Pairs) {
+		shard := c.pool.Shard(i)
+		err = c.sendSubscribeRequest(shard, &ConfRequest{Event: "conf", Flags: flags})
 		if err != nil {
 			return err
 		}
+		for _, pair := range pairs {
+			err := c.sendSubscribeRequest(shard, c.formatSubscribeRequest(pair))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Subscription responses are handled by ParseTickerResponse so that book snapshots sent
+	// right after them aren't dropped
+	go c.StartTickerListener(ctx, exchangeDoneCh)
+	return nil
+}
+
+// Name returns the name of the exchange
+func (c *Client) Name() string {
+	return c.exchangeName
+}
 
-		if key == len(c.Pairs)-1 {
-			go func() {
-				<-doneCh
-				c.StartTickerListener(ctx, exchangeDoneCh)
-			}()
+// SequenceGaps returns the number of gaps detected per pair
+func (c *Client) SequenceGaps() map[string]int {
+	return c.gaps.Counts()
+}
+
+// SubscribedPairs returns the pairs subscribed to. Only pairs listed by bitfinex that are in the
+// product map are subscribed to
+func (c *Client) SubscribedPairs() []string {
+	return c.Pairs
+}
 
+func (c *Client) validateChannel() error {
+	switch c.Channel {
+	case TICKER:
+		return nil
+	case BOOK:
+		for _, val := range bookLengths {
+			if c.Length == val {
+				return nil
+			}
 		}
+		return fmt.Errorf("Invalid %s book length %d. Must be one of %v", c.exchangeName, c.Length, bookLengths)
 	}
+	return fmt.Errorf("Unsupported %s channel %s", c.exchangeName, c.Channel)
+}
 
-	return nil
+func (c *Client) formatSubscribeRequest(pair string) *SubscriptionRequest {
+	req := &SubscriptionRequest{
+		Event:   "subscribe",
+		Channel: c.Channel,
+		Symbol:  "t" + strings.ToUpper(pair),
+	}
+	if c.Channel == BOOK {
+		req.Prec = "P0"
+		req.Len = strconv.Itoa(c.Length)
+	}
+	return req
 }
 
 // SendSubscribeRequest overrides the interface method and sends a subscription request and listens
 // for a response
 func (c *Client) SendSubscribeRequest(req interface{}) error {
-	// doneCh := make(chan struct{})
-	payload, err := json.Marshal(req)
-	if err != nil {
-		return fmt.Errorf("Error marshalling %s subscribe request: %s", c.exchangeName, err)
-	}
+	return c.sendSubscribeRequest(c.API, req)
+}
 
-	err = c.API.WriteMessage(payload)
+// sendSubscribeRequest sends a subscription request on a single connection
+func (c *Client) sendSubscribeRequest(conn api.WebSocketHelper, req interface{}) error {
+	// Sent through the api helper so the request is replayed if the connection is reestablished
+	err := conn.SendSubscribeRequest(req)
 	if err != nil {
 		return fmt.Errorf("Error sending subscribe request for %s: %s", c.exchangeName, err)
 	}
 	return nil
 }
 
-func (c *Client) startSubscribeListener(doneCh chan<- struct{}) {
-	var mtx sync.Mutex
-	subs := 0
-Loop:
-	for {
-		mtx.Lock()
-		message, err := c.API.ReadMessage()
-		mtx.Unlock()
-		if err != nil {
-			c.errorCh <- fmt.Errorf("Error reading message from %s: %s", c.exchangeName, err)
-			return
-		}
+// FormatSubscribeRequest creates the type for a subscribe request
+func (c *Client) FormatSubscribeRequest() interface{} {
+	return nil
+}
+
+// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote.
+// The message is treated as read from the first connection
+func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
+	return c.parseMessage(0, msg)
+}
+
+// parseMessage parses a message read from the connection of a shard
+func (c *Client) parseMessage(shardID int, msg []byte) ([]exchange.Quote, error) {
+	var err error
+	var quotes []exchange.Quote
 
+	// Events are objects. After a reconnect the subscriptions are replayed and bitfinex assigns
+	// new channel ids so we need to remap them
+	if len(msg) > 0 && msg[0] == '{' {
 		var subStatusResponse SubscriptionResponse
-		// Skip ticker responses until we are done subscribing
-		if strings.Contains(string(message), "[") {
-			continue
+		err = json.Unmarshal(msg, &subStatusResponse)
+		if err != nil {
+			return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
 		}
-
-		// Weird bitfinex bug where it sends nothing?
-		if len(message) == 0 {
-			continue
+		channelPairMap := c.channelPairMap(shardID)
+		switch subStatusResponse.Event {
+		case "info":
+			// Sent when a connection is opened so sequence numbers start over
+			delete(c.sequences, shardID)
+		case "subscribed":
+			channelPairMap[subStatusResponse.ChannelID] = subStatusResponse.Pair
+		case "unsubscribed":
+			delete(channelPairMap, subStatusResponse.ChannelID)
 		}
+		return quotes, nil
+	}
 
-		err = json.Unmarshal(message, &subStatusResponse)
+	// Channel messages are arrays starting with the channel id
+	// [CHANNEL_ID, "hb"]
+	// [CHANNEL_ID, "cs", CHECKSUM]
+	// [CHANNEL_ID, PAYLOAD]
+	// Each one ends with a sequence number when the SEQALL flag is set followed by a timestamp
+	// in milliseconds when the TIMESTAMP flag is set
+	var channelMsg []json.RawMessage
+	err = json.Unmarshal(msg, &channelMsg)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	if len(channelMsg) < 2 {
+		return []exchange.Quote{}, fmt.Errorf("Error parsing message from %s: %s", c.exchangeName, msg)
+	}
+	var channelID int
+	err = json.Unmarshal(channelMsg[0], &channelID)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error parsing channel id from %s: %s", c.exchangeName, err)
+	}
+	var event string
+	isEvent := json.Unmarshal(channelMsg[1], &event) == nil
+	fields := 2
+	if event == "cs" {
+		fields = 3
+	}
+	if len(channelMsg) >= fields+2 {
+		var sequence int64
+		err = json.Unmarshal(channelMsg[fields], &sequence)
 		if err != nil {
-			c.errorCh <- fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+			return []exchange.Quote{}, fmt.Errorf("Error parsing sequence number from %s: %s", c.exchangeName, err)
 		}
-
-		if subs < len(c.Pairs) {
-			c.channelPairMap[subStatusResponse.ChannelID] = subStatusResponse.Pair
-		} else {
-			close(doneCh)
-			break Loop
+		err = c.checkSequence(shardID, sequence)
+		if err != nil {
+			return []exchange.Quote{}, err
 		}
-		mtx.Lock()
-		subs++
-		mtx.Unlock()
 	}
-	return
-}
-
-// FormatSubscribeRequest creates the type for a subscribe request
-func (c *Client) FormatSubscribeRequest() interface{} {
-	return nil
-}
-
-// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote
-func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
-	var err error
-	var quotes []exchange.Quote
+	if isEvent {
+		switch event {
+		case "hb":
+			// Heartbeats are sent every 15 seconds on channels without updates
+		case "cs":
+			return quotes, c.verifyChecksum(shardID, channelID, channelMsg)
+		}
+		return quotes, nil
+	}
+	var exchangeTime time.Time
+	if len(channelMsg) > 2 {
+		exchangeTime, err = parseTimestamp(channelMsg[len(channelMsg)-1])
+		if err != nil {
+			return []exchange.Quote{}, fmt.Errorf("Error parsing timestamp from %s: %s", c.exchangeName, err)
+		}
+	}
+	if c.Channel == BOOK {
+		return c.parseBookResponse(shardID, channelID, channelMsg[1], exchangeTime)
+	}
 
 	var res TickerResponse
 	err = json.Unmarshal(msg, &res)
 	if err != nil {
 		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
 	}
-	c.getPair(&res)
+	res.Pair = c.channelPairMap(shardID)[res.ChannelID]
 	if res.Pair != "" {
 		product := c.productMap[res.Pair]
 		quotes = append(quotes, exchange.Quote{
-			Exchange: c.exchangeName,
-			Bid:      res.Bid,
-			Ask:      res.Ask,
-			ExPair:   product.ExPair,
-			HePair:   product.HePair,
-			ExBase:   product.ExBase,
-			HeBase:   product.HeBase,
-			ExQuote:  product.ExQuote,
-			HeQuote:  product.HeQuote,
+			Exchange:     c.exchangeName,
+			Bid:          res.Bid,
+			Ask:          res.Ask,
+			BidSize:      res.BidSize,
+			AskSize:      res.AskSize,
+			ExPair:       product.ExPair,
+			HePair:       product.HePair,
+			ExBase:       product.ExBase,
+			HeBase:       product.HeBase,
+			ExQuote:      product.ExQuote,
+			HeQuote:      product.HeQuote,
+			ExchangeTime: exchangeTime,
 		})
 	}
 	return quotes, nil
 }
 
-func (c *Client) getPair(res *TickerResponse) {
-	res.Pair = c.channelPairMap[res.ChannelID]
+// checkSequence compares a sequence number with the last one received on the connection of a
+// shard. Sequence numbers are shared by every channel of a connection so a gap can't be traced
+// to a single channel: a gap is counted for every pair on the connection and their books are
+// resubscribed
+func (c *Client) checkSequence(shardID int, sequence int64) error {
+	last, ok := c.sequences[shardID]
+	c.sequences[shardID] = sequence
+	if !ok || sequence == last+1 {
+		return nil
+	}
+	log.Printf("Sequence gap on %s from %d to %d. Resubscribing\n", c.exchangeName, last, sequence)
+	for channelID, pair := range c.channelPairMap(shardID) {
+		c.gaps.Record(pair)
+		if book, ok := c.orderBookMap[pair]; !ok || book.Invalid {
+			continue
+		}
+		err := c.resubscribe(shardID, channelID, pair)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// StartTickerListener starts a new goroutine to listen for new ticker messages
+// channelPairMap returns the channel ids of the connection of a shard
+func (c *Client) channelPairMap(shardID int) exchange.ChannelPairMap {
+	channelPairMap, ok := c.channelPairMaps[shardID]
+	if !ok {
+		channelPairMap = make(exchange.ChannelPairMap)
+		c.channelPairMaps[shardID] = channelPairMap
+	}
+	return channelPairMap
+}
+
+// connection returns the connection of a shard
+func (c *Client) connection(shardID int) api.WebSocketHelper {
+	if c.pool != nil {
+		if shard := c.pool.Shard(shardID); shard != nil {
+			return shard
+		}
+	}
+	return c.API
+}
+
+// StartTickerListener starts a new goroutine to listen for new ticker messages. Every
+// connection is read from its own goroutine and doneCh is sent to once all of them are closed
 func (c *Client) StartTickerListener(ctx context.Context, doneCh chan<- struct{}) {
-cLoop:
+	shards := []*api.Shard{{WebSocketHelper: c.API}}
+	if c.pool != nil {
+		shards = c.pool.Shards()
+	}
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *api.Shard) {
+			defer wg.Done()
+			c.listen(ctx, shard)
+		}(shard)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		doneCh <- struct{}{}
+	}
+}
+
+// listen reads messages from the connection of a shard until ctx is done or reading fails
+func (c *Client) listen(ctx context.Context, shard *api.Shard) {
 	for {
-		message, err := c.API.ReadMessage()
+		message, err := shard.ReadMessage()
 		if err != nil {
 			c.errorCh <- fmt.Errorf("Error reading from %s: %s", c.exchangeName, err)
 			return
 		}
+		receivedAt := time.Now()
 
 		select {
 		case <-ctx.Done():
-			err := c.API.Close()
+			err := shard.Close()
 			if err != nil {
 				c.errorCh <- fmt.Errorf("Error closing %s: %s", c.exchangeName, err)
 			}
-			doneCh <- struct{}{}
-			break cLoop
+			return
 		default:
-			res, err := c.ParseTickerResponse(message)
+			c.parseMtx.Lock()
+			res, err := c.parseMessage(shard.ID, message)
+			c.parseMtx.Unlock()
 			if err != nil {
 				c.errorCh <- err
 			} else if len(res) > 0 {
 				if res[0].HePair != "" {
+					res[0].ReceivedAt = receivedAt
 					c.quoteCh <- res[0]
 				}
 			}
@@ -202,13 +397,27 @@ cLoop:
 
 // GetURL returns the url for the websocket connection
 func (c *Client) GetURL() *url.URL {
+	if c.WSURL != nil {
+		u := *c.WSURL
+		return &u
+	}
 	return &url.URL{Scheme: "wss", Host: "api-pub.bitfinex.com", Path: "/ws/2"}
 }
 
+// GetRESTURL returns the base url for the REST api
+func (c *Client) GetRESTURL() *url.URL {
+	if c.RESTURL != nil {
+		u := *c.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.bitfinex.com"}
+}
+
 // GetPairs returns all pairs for an exchange
 func (c *Client) GetPairs() error {
-	u := url.URL{Scheme: "https", Host: "api.bitfinex.com", Path: "/v1/symbols"}
-	res, err := http.Get(u.String())
+	u := c.GetRESTURL()
+	u.Path = "/v1/symbols"
+	res, err := c.HTTPClient.Get(u.String())
 	if err != nil {
 		return err
 	}
@@ -222,7 +431,8 @@ func (c *Client) GetPairs() error {
 	}
 	var pairs []string
 	for _, pair := range pairsResponse {
-		pairs = append(pairs, pair)
+		// Symbols are listed in lowercase while the product map and channels use uppercase
+		pairs = append(pairs, strings.ToUpper(pair))
 	}
 	c.Pairs = pairs
 	return nil
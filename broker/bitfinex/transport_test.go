@@ -5,20 +5,24 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/kaplanmaxe/helgart/broker/api"
 	"github.com/kaplanmaxe/helgart/broker/bitfinex"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
 	"github.com/kaplanmaxe/helgart/broker/mock"
 )
 
 type mockSubscriptionResponse struct {
+	Event     string `json:"event"`
 	ChannelID int    `json:"chanId"`
 	Pair      string `json:"pair"`
 	OmitMock  bool   `json:"omitmock"`
 }
 
 func ignoreFunc(msg []byte) bool {
-	if strings.Contains(string(msg), `"symbol"`) {
+	if strings.Contains(string(msg), `"symbol"`) || strings.Contains(string(msg), `"flags"`) {
 		return true
 	} else {
 		return false
@@ -30,9 +34,15 @@ func TestStart(t *testing.T) {
 	errorCh := make(chan error, 1)
 	ctx := context.TODO()
 	client := bitfinex.NewClient(mock.NewConnector(ignoreFunc), quoteCh, errorCh)
+	server, restURL := mock.NewRESTServer(`["mockusd"]`)
+	defer server.Close()
+	client.RESTURL = restURL
 	productMap := mock.MakeMockProductMap()
 	doneCh := make(chan struct{}, 1)
-	client.Start(ctx, productMap, doneCh)
+	err := client.Start(ctx, productMap, doneCh)
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
 	for i := 0; i < len(client.Pairs)+1; i++ {
 		var channelID int
 		if i == 0 {
@@ -42,6 +52,7 @@ func TestStart(t *testing.T) {
 			channelID = i
 		}
 		subscribeResponse := &mockSubscriptionResponse{
+			Event:     "subscribed",
 			ChannelID: channelID,
 			Pair:      "MOCKUSD",
 			OmitMock:  true,
@@ -69,7 +80,7 @@ listener:
 	for {
 		select {
 		case quote := <-quoteCh:
-			if quote.Ask != "8114.90000000" {
+			if quote.Ask != decimal.MustParse("8114.90000000") {
 				t.Fatalf("Expecting response %#v but got %#v", mockResponse, quote)
 			}
 			break listener
@@ -81,3 +92,199 @@ listener:
 	}
 	client.API.Close()
 }
+
+const mockBookSnapshot = `[17082,[[8114.8,2,1.5],[8114.7,1,0.25],[8114.5,4,3],[8115.1,1,-2.1],[8115.2,1,-0.0000001],[8115.5,3,-4]]]`
+
+func TestBookChecksum(t *testing.T) {
+	connector := mock.NewRecordingConnector()
+	client := bitfinex.NewClient(connector, make(chan exchange.Quote), make(chan error, 1))
+	client.Channel = bitfinex.BOOK
+
+	messages := []string{
+		`{"event":"subscribed","channel":"book","chanId":17082,"symbol":"tMOCKUSD","prec":"P0","freq":"F0","len":"25","pair":"MOCKUSD"}`,
+		mockBookSnapshot,
+		`[17082,"cs",-1594209327]`,
+		`[17082,"hb"]`,
+	}
+	for _, msg := range messages {
+		_, err := client.ParseTickerResponse([]byte(msg))
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", msg, err)
+		}
+	}
+	book := client.OrderBook("MOCKUSD")
+	if book == nil || book.Bids.Len() != 3 || book.Asks.Len() != 3 {
+		t.Fatalf("Expected the book to be built from the snapshot but got %#v", book)
+	}
+
+	quotes, err := client.ParseTickerResponse([]byte(`[17082,[8114.9,1,0.5],1559355056098]`))
+	if err != nil {
+		t.Fatalf("Error parsing update: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("8114.90000000") || quotes[0].Ask != decimal.MustParse("8115.10000000") {
+		t.Fatalf("Expected a new quote from the update but got %#v", quotes)
+	}
+	if !quotes[0].ExchangeTime.Equal(time.Unix(1559355056, 98000000)) {
+		t.Errorf("Expected the exchange time from the timestamp flag but got %s", quotes[0].ExchangeTime)
+	}
+	_, err = client.ParseTickerResponse([]byte(`[17082,"cs",935822751]`))
+	if err != nil {
+		t.Fatalf("Error parsing checksum: %s", err)
+	}
+	if len(connector.Messages()) != 0 {
+		t.Errorf("Expected no resubscribe with a valid checksum but got %#v", connector.Messages())
+	}
+
+	// A bad checksum resubscribes the symbol and suppresses quotes until the next snapshot
+	_, err = client.ParseTickerResponse([]byte(`[17082,"cs",12345]`))
+	if err != nil {
+		t.Fatalf("Error parsing checksum: %s", err)
+	}
+	expected := []string{
+		`{"event":"unsubscribe","chanId":17082}`,
+		`{"event":"subscribe","channel":"book","symbol":"tMOCKUSD","prec":"P0","len":"25"}`,
+	}
+	sent := connector.Messages()
+	if len(sent) != len(expected) {
+		t.Fatalf("Expected %d messages to be sent but got %#v", len(expected), sent)
+	}
+	for key, val := range expected {
+		if sent[key] != val {
+			t.Errorf("Expected message %s but got %s", val, sent[key])
+		}
+	}
+	quotes, _ = client.ParseTickerResponse([]byte(`[17082,[8115,1,0.5]]`))
+	if len(quotes) != 0 {
+		t.Errorf("Expected quotes to be suppressed until the next snapshot but got %#v", quotes)
+	}
+
+	messages = []string{
+		`{"event":"unsubscribed","status":"OK","chanId":17082}`,
+		`{"event":"subscribed","channel":"book","chanId":17083,"symbol":"tMOCKUSD","prec":"P0","freq":"F0","len":"25","pair":"MOCKUSD"}`,
+	}
+	for _, msg := range messages {
+		_, err := client.ParseTickerResponse([]byte(msg))
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", msg, err)
+		}
+	}
+	quotes, err = client.ParseTickerResponse([]byte(strings.Replace(mockBookSnapshot, "17082", "17083", 1)))
+	if err != nil {
+		t.Fatalf("Error parsing snapshot: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("8114.80000000") {
+		t.Errorf("Expected the book to be rebuilt from the snapshot but got %#v", quotes)
+	}
+}
+
+func TestShardedChannels(t *testing.T) {
+	quoteCh := make(chan exchange.Quote, 2)
+	errorCh := make(chan error, 10)
+	first := mock.NewRecordingConnector()
+	connectors := []*mock.RecordingConnector{first}
+	client := bitfinex.NewClient(first, quoteCh, errorCh)
+	client.ChannelsPerConnection = 1
+	client.NewHelper = func() api.WebSocketHelper {
+		conn := mock.NewRecordingConnector()
+		connectors = append(connectors, conn)
+		return conn
+	}
+	server, restURL := mock.NewRESTServer(`["mockusd","mockbtc"]`)
+	defer server.Close()
+	client.RESTURL = restURL
+	productMap := mock.MakeMockProductMap()
+	productMap[exchange.BITFINEX]["MOCKBTC"] = exchange.Product{
+		Exchange: exchange.BITFINEX,
+		HePair:   "MOCK-BTC",
+		ExPair:   "MOCKBTC",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.Start(ctx, productMap, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	if len(connectors) != 2 {
+		t.Fatalf("Expected a connection per channel but got %d", len(connectors))
+	}
+
+	// Bitfinex numbers channels per connection so both pairs can get the same channel id
+	pairs := make(map[string]bool)
+	for i, conn := range connectors {
+		sent := conn.Messages()
+		if len(sent) != 2 || !strings.Contains(sent[0], `"conf"`) {
+			t.Fatalf("Expected a conf and a subscribe request on connection %d but got %#v", i, sent)
+		}
+		pair := client.Pairs[i]
+		if !strings.Contains(sent[1], `"t`+pair+`"`) {
+			t.Errorf("Expected connection %d to subscribe to %s but got %s", i, pair, sent[1])
+		}
+		conn.Push([]byte(`{"event":"subscribed","channel":"ticker","chanId":1,"pair":"` + pair + `"}`))
+		conn.Push([]byte("[1,[8114.8,67.3,8114.9,3.3,314.9,0.0404,8114.9,18884.3,8199.9,7731]]"))
+		pairs[productMap[exchange.BITFINEX][pair].HePair] = true
+	}
+	for range connectors {
+		select {
+		case quote := <-quoteCh:
+			if !pairs[quote.HePair] {
+				t.Errorf("Expected a quote for one of %v but got %s", pairs, quote.HePair)
+			}
+			delete(pairs, quote.HePair)
+		case err := <-errorCh:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for quotes")
+		}
+	}
+}
+
+func TestSequenceGap(t *testing.T) {
+	connector := mock.NewRecordingConnector()
+	client := bitfinex.NewClient(connector, make(chan exchange.Quote), make(chan error, 1))
+	client.Channel = bitfinex.BOOK
+
+	messages := []string{
+		`{"event":"info","version":2}`,
+		`{"event":"subscribed","channel":"book","chanId":17082,"symbol":"tMOCKUSD","prec":"P0","freq":"F0","len":"25","pair":"MOCKUSD"}`,
+		strings.Replace(mockBookSnapshot, "]]]", "]],1,1559355056000]", 1),
+		`[17082,"hb",2,1559355057000]`,
+		`[17082,"cs",-1594209327,3,1559355058000]`,
+		`[17082,[8114.9,1,0.5],4,1559355059000]`,
+	}
+	for _, msg := range messages {
+		_, err := client.ParseTickerResponse([]byte(msg))
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", msg, err)
+		}
+	}
+	if gaps := client.SequenceGaps(); len(gaps) != 0 || len(connector.Messages()) != 0 {
+		t.Fatalf("Expected no gaps in consecutive sequence numbers but got %v", gaps)
+	}
+
+	// Skipping sequence number 5 resubscribes every book of the connection
+	_, err := client.ParseTickerResponse([]byte(`[17082,[8115,1,0.5],6,1559355060000]`))
+	if err != nil {
+		t.Fatalf("Error parsing update: %s", err)
+	}
+	if gaps := client.SequenceGaps(); gaps["MOCKUSD"] != 1 {
+		t.Errorf("Expected a gap for MOCKUSD but got %v", gaps)
+	}
+	sent := connector.Messages()
+	if len(sent) != 2 || sent[0] != `{"event":"unsubscribe","chanId":17082}` {
+		t.Errorf("Expected the book to be resubscribed but got %#v", sent)
+	}
+	if !client.OrderBook("MOCKUSD").Invalid {
+		t.Error("Expected the book to wait for a new snapshot")
+	}
+
+	// Sequence numbers start over on a new connection
+	for _, msg := range []string{`{"event":"info","version":2}`, `[17082,"hb",1,1559355061000]`} {
+		_, err := client.ParseTickerResponse([]byte(msg))
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", msg, err)
+		}
+	}
+	if gaps := client.SequenceGaps(); gaps["MOCKUSD"] != 1 {
+		t.Errorf("Expected no gap after a new connection but got %v", gaps)
+	}
+}
@@ -3,19 +3,58 @@ package bitfinex
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Enum for channels
+const (
+	TICKER = "ticker"
+	BOOK   = "book"
+)
+
+// Conf flags
+const (
+	// TIMESTAMP adds the time in milliseconds at the end of every channel message
+	TIMESTAMP = 32768
+	// SEQALL adds a sequence number to every channel message. Sequence numbers are per
+	// connection and come before the timestamp when both flags are set
+	SEQALL = 65536
+	// CHECKSUM makes bitfinex send a checksum after every book update
+	CHECKSUM = 131072
 )
 
-// SubscriptionRequest represents a struct to subscribe to a ticker
+// ConfRequest sets flags on the connection
+// { "event": "conf", "flags": 131072 }
+type ConfRequest struct {
+	Event string `json:"event"`
+	Flags int    `json:"flags"`
+}
+
+// SubscriptionRequest represents a struct to subscribe to a ticker or book
 // { "event": "subscribe", "channel": "ticker", "symbol": "tETHUSD" }
+// { "event": "subscribe", "channel": "book", "symbol": "tETHUSD", "prec": "P0", "len": "25" }
 type SubscriptionRequest struct {
 	Event   string `json:"event"`
 	Channel string `json:"channel"`
 	Symbol  string `json:"symbol"`
+	Prec    string `json:"prec,omitempty"`
+	Len     string `json:"len,omitempty"`
+}
+
+// UnsubscribeRequest represents a request to unsubscribe from a channel
+// { "event": "unsubscribe", "chanId": 32034 }
+type UnsubscribeRequest struct {
+	Event     string `json:"event"`
+	ChannelID int    `json:"chanId"`
 }
 
 // SubscriptionResponse represents a response from the ticker subscription
 // {"event":"subscribed","channel":"ticker","chanId":32034,"symbol":"tBTCUSD","pair":"BTCUSD"}
 type SubscriptionResponse struct {
+	Event     string `json:"event"`
 	ChannelID int    `json:"chanId"`
 	Pair      string `json:"pair"`
 }
@@ -24,30 +63,115 @@ type SubscriptionResponse struct {
 type TickerResponse struct {
 	ChannelID int
 	Pair      string
-	Bid       string
-	Ask       string
+	Bid       decimal.Decimal
+	Ask       decimal.Decimal
+	BidSize   decimal.Decimal
+	AskSize   decimal.Decimal
 }
 
-// UnmarshalJSON overrides UnmarshalJSON due to Bitfinex's weird output
+// UnmarshalJSON overrides UnmarshalJSON due to Bitfinex's weird output. Heartbeats have to be
+// filtered out before as they don't carry a tick
 // [31662,[226.96,242.35969366999996,226.97,706.67194586,19.28,0.0928,226.94,290306.01961965,229.48,199.9]]
 func (s *TickerResponse) UnmarshalJSON(msg []byte) error {
-	// Hack for weird bitfinex response
-	var channel []interface{}
-	json.Unmarshal(msg, &channel)
-	var tmp [][]interface{}
-	json.Unmarshal(msg, &tmp)
-	switch channel[1].(type) {
-	case string:
-		// HEARTBEAT
-		return nil
-	default:
-		if len(tmp) != 0 {
-			// TODO: why the conversion to string?
-			s.Bid = fmt.Sprintf("%8.8f", tmp[1][0])
-			s.Ask = fmt.Sprintf("%8.8f", tmp[1][2])
-			s.ChannelID = int(channel[0].(float64))
-		}
+	var res []json.RawMessage
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return err
+	}
+	if len(res) < 2 {
+		return fmt.Errorf("Unexpected ticker message %s", msg)
+	}
+	err = json.Unmarshal(res[0], &s.ChannelID)
+	if err != nil {
+		return err
+	}
+	var tick []decimal.Decimal
+	err = json.Unmarshal(res[1], &tick)
+	if err != nil {
+		return err
 	}
+	if len(tick) < 4 {
+		return fmt.Errorf("Unexpected ticker message %s", msg)
+	}
+	s.Bid = tick[0]
+	s.Ask = tick[2]
+	s.BidSize = tick[1]
+	s.AskSize = tick[3]
+	return nil
+}
 
+// RESTTicker is the ticker of a pair from the REST api
+// ["tBTCUSD",8114.8,67.33,8114.9,3.31,314.9,0.0404,8114.9,18884.37,8199.9,7731]
+type RESTTicker struct {
+	Pair    string
+	Bid     decimal.Decimal
+	BidSize decimal.Decimal
+	Ask     decimal.Decimal
+	AskSize decimal.Decimal
+}
+
+// UnmarshalJSON unmarshals a ticker from its array representation
+func (t *RESTTicker) UnmarshalJSON(msg []byte) error {
+	var res []json.RawMessage
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return err
+	}
+	if len(res) < 5 {
+		return fmt.Errorf("Unexpected ticker %s", msg)
+	}
+	var symbol string
+	err = json.Unmarshal(res[0], &symbol)
+	if err != nil {
+		return err
+	}
+	t.Pair = strings.TrimPrefix(symbol, "t")
+	values := []*decimal.Decimal{&t.Bid, &t.BidSize, &t.Ask, &t.AskSize}
+	for i, val := range values {
+		err = json.Unmarshal(res[i+1], val)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// BookLevel is a price level on a P0 book channel. A positive amount is a bid and a negative
+// amount an ask. A count of 0 removes the level
+// [8114.8,3,1.2]
+type BookLevel struct {
+	Price  decimal.Decimal
+	Count  int
+	Amount decimal.Decimal
+}
+
+// UnmarshalJSON unmarshals a level from its array representation
+func (l *BookLevel) UnmarshalJSON(msg []byte) error {
+	var level []json.RawMessage
+	err := json.Unmarshal(msg, &level)
+	if err != nil {
+		return err
+	}
+	if len(level) < 3 {
+		return fmt.Errorf("Unexpected book level %s", msg)
+	}
+	err = json.Unmarshal(level[0], &l.Price)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(level[1], &l.Count)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(level[2], &l.Amount)
+}
+
+// parseTimestamp parses a timestamp in milliseconds appended to messages by the TIMESTAMP flag
+func parseTimestamp(msg json.RawMessage) (time.Time, error) {
+	var milliseconds int64
+	err := json.Unmarshal(msg, &milliseconds)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, milliseconds*int64(time.Millisecond)), nil
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/backtest"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	backtestQuotes          string
+	backtestOutput          string
+	backtestMinSpread       string
+	backtestMaxQuantity     string
+	backtestDefaultQuantity string
+	backtestLatency         time.Duration
+	backtestFee             string
+	backtestFees            map[string]string
+	backtestSlippage        string
+)
+
+var backtestCmd = &cobra.Command{
+	Use:   "backtest [capture]...",
+	Short: "Backtest simulates trading the opportunities found in historical quotes",
+	Long: `backtest runs historical quotes through the broker and simulates trading every
+opportunity whose spread net of fees is at least --min-spread. Quotes are either parsed from capture files
+recorded with --record, which needs the database for the product map, or read from a normalized
+quote file given with --quotes. The report with the PnL of every trade and the totals is written
+as json`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (backtestQuotes == "") == (len(args) == 0) {
+			log.Fatal("Either capture files or --quotes must be given")
+		}
+		engine, err := newBacktestEngine()
+		if err != nil {
+			log.Fatalf("Invalid backtest options: %s", err)
+		}
+		if backtestQuotes != "" {
+			// The config is only needed for the max age of quotes
+			if err := viper.ReadInConfig(); err == nil {
+				configs, err := loadExchangeConfigs()
+				if err != nil {
+					log.Fatalf("Invalid exchange config: %s", err)
+				}
+				engine.Broker.Configs = configMap(configs)
+			}
+			err = backtestQuoteFile(engine, backtestQuotes)
+		} else {
+			err = backtestCaptures(engine, args)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		report := engine.Finish()
+		log.Printf("Traded %d of %d opportunities over %d quotes, %d missed. Volume %s USD, fees %s USD, PnL %s USD\n",
+			report.Traded, report.Opportunities, report.Quotes, report.Missed, report.Volume, report.Fees, report.PnL)
+		err = writeReport(report, backtestOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// newBacktestEngine returns an engine with an empty broker configured from the flags. Spreads
+// are net of the fees given with --fee and --fees, which fills are charged
+func newBacktestEngine() (*backtest.Engine, error) {
+	strategy := &backtest.ThresholdStrategy{}
+	engine := backtest.NewEngine(exchange.NewBroker(nil, nil), strategy)
+	engine.Latency = backtestLatency
+	err := decimal.ParseOptions(
+		decimal.Option{Name: "--min-spread", Value: backtestMinSpread, Dest: &strategy.MinSpread},
+		decimal.Option{Name: "--max-quantity", Value: backtestMaxQuantity, Dest: &strategy.MaxQuantity},
+		decimal.Option{Name: "--default-quantity", Value: backtestDefaultQuantity, Dest: &strategy.DefaultQuantity},
+		decimal.Option{Name: "--slippage", Value: backtestSlippage, Dest: &engine.Slippage},
+	)
+	if err != nil {
+		return nil, err
+	}
+	fees := &exchange.FeeConfig{Default: backtestFee}
+	for name, value := range backtestFees {
+		fees.Schedule = append(fees.Schedule, exchange.FeeConfigEntry{Exchange: name, Taker: value})
+	}
+	engine.Broker.Fees = exchange.NewFeeSchedule()
+	err = engine.Broker.Fees.Configure(fees)
+	if err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// configMap returns the configs by exchange name
+func configMap(configs []*exchange.Config) map[string]*exchange.Config {
+	m := make(map[string]*exchange.Config)
+	for _, config := range configs {
+		m[config.Name] = config
+	}
+	return m
+}
+
+// backtestQuoteFile runs every quote of a normalized quote file through the engine
+func backtestQuoteFile(engine *backtest.Engine, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("Error opening quotes: %s", err)
+	}
+	defer file.Close()
+	reader, err := backtest.NewQuoteReader(file)
+	if err != nil {
+		return fmt.Errorf("Error reading quotes: %s", err)
+	}
+	for {
+		quote, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading quotes: %s", err)
+		}
+		engine.OnQuote(quote)
+	}
+}
+
+// backtestCaptures replays capture files as fast as possible and runs the quotes the exchanges
+// parse from them through the engine. Quotes are received at the time their message was
+// recorded at
+func backtestCaptures(engine *backtest.Engine, files []string) error {
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("Can't read config: %s", err)
+	}
+	replayer, err := api.NewReplayer(files, 0)
+	if err != nil {
+		return err
+	}
+	configs, err := loadExchangeConfigs()
+	if err != nil {
+		return fmt.Errorf("Invalid exchange config: %s", err)
+	}
+	configs = replayedConfigs(configs, replayer.Exchanges())
+	if len(configs) == 0 {
+		return fmt.Errorf("No enabled exchange was recorded in %v", files)
+	}
+	ws := newWebsocketAPI()
+	exchanges, err := ws.getExchanges(configs, connectReplay(replayer))
+	if err != nil {
+		return fmt.Errorf("Invalid exchange config: %s", err)
+	}
+	db, err := ws.connectDB()
+	if err != nil {
+		return err
+	}
+	broker := exchange.NewBroker(exchanges, db)
+	broker.Configs = configMap(configs)
+	broker.Fees = engine.Broker.Fees
+	engine.Broker = broker
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = broker.Start(ctx, ws.exchangeDoneCh)
+	if err != nil {
+		return err
+	}
+
+	replayDoneCh := make(chan error, 1)
+	go func() {
+		replayed, err := replayer.Run(ctx)
+		log.Printf("Replayed %d messages\n", replayed)
+		replayDoneCh <- err
+	}()
+replay:
+	for {
+		select {
+		case quote := <-ws.quoteCh:
+			quote.ReceivedAt = replayer.Now()
+			engine.OnQuote(quote)
+		case err = <-ws.errorCh:
+			log.Println(err)
+		case err = <-replayDoneCh:
+			break replay
+		}
+	}
+
+	cancel()
+	replayer.Close()
+	for done := 0; done < len(exchanges); {
+		select {
+		case <-ws.exchangeDoneCh:
+			done++
+		case <-ws.errorCh:
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error replaying: %s", err)
+	}
+	return nil
+}
+
+// writeReport writes the report as json to the file name or stdout if name is empty
+func writeReport(report *backtest.Report, name string) error {
+	out := os.Stdout
+	if name != "" {
+		file, err := os.Create(name)
+		if err != nil {
+			return fmt.Errorf("Error creating report: %s", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(report)
+	if err != nil {
+		return fmt.Errorf("Error writing report: %s", err)
+	}
+	return nil
+}
+
+func init() {
+	flags := backtestCmd.Flags()
+	flags.StringVar(&backtestQuotes, "quotes", "", "normalized quote file to backtest instead of capture files, json lines optionally gzip compressed")
+	flags.StringVarP(&backtestOutput, "output", "o", "", "file the json report is written to (default is stdout)")
+	flags.StringVar(&backtestMinSpread, "min-spread", minSpread.String(), "minimum spread in percent of the opportunities traded")
+	flags.StringVar(&backtestMaxQuantity, "max-quantity", "0", "maximum quantity of the base traded per opportunity, 0 for no limit")
+	flags.StringVar(&backtestDefaultQuantity, "default-quantity", "0", "quantity traded when exchanges don't send sizes, 0 skips those opportunities")
+	flags.DurationVar(&backtestLatency, "latency", 100*time.Millisecond, "time between detecting an opportunity and its orders being filled")
+	flags.StringVar(&backtestFee, "fee", "0.002", "taker fee of every exchange as a ratio of the notional")
+	flags.StringToStringVar(&backtestFees, "fees", nil, "taker fee by exchange overriding --fee, ex: kraken=0.0026,coinbase=0.005")
+	flags.StringVar(&backtestSlippage, "slippage", "0", "ratio of the price lost on every fill, ex: 0.0005")
+	rootCmd.AddCommand(backtestCmd)
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	replaySpeed float64
+	replayExit  bool
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <file>...",
+	Short: "Replay runs the broker against captured exchange traffic",
+	Long: `replay feeds the frames of capture files recorded with --record to the exchanges they
+were recorded from instead of connecting to them. Quotes go through the same pipeline as a
+live broker, including the websocket API, so incidents can be reproduced offline. Files are
+replayed in the order given`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Fatalf("Can't read config: %s", err)
+		}
+		replayer, err := api.NewReplayer(args, replaySpeed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configs, err := loadExchangeConfigs()
+		if err != nil {
+			log.Fatalf("Invalid exchange config: %s", err)
+		}
+		configs = replayedConfigs(configs, replayer.Exchanges())
+		if len(configs) == 0 {
+			log.Fatalf("No enabled exchange was recorded in %v", args)
+		}
+		ws := newWebsocketAPI()
+		ws.replayClock = replayer.Now
+		exchanges, err := ws.getExchanges(configs, connectReplay(replayer))
+		if err != nil {
+			log.Fatalf("Invalid exchange config: %s", err)
+		}
+		go ws.serveWS()
+		db, err := ws.connectDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		signal.Notify(ws.interruptCh, os.Interrupt)
+		ctx, cancel := context.WithCancel(context.Background())
+		err = ws.startBroker(ctx, exchanges, configs, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go ws.startBrokerPump(ctx)
+
+		replayDoneCh := make(chan struct{})
+		go func() {
+			defer close(replayDoneCh)
+			log.Printf("Replaying %v at speed %v\n", args, replaySpeed)
+			replayed, err := replayer.Run(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error replaying: %s\n", err)
+			}
+			log.Printf("Replayed %d messages\n", replayed)
+		}()
+		if replayExit {
+			select {
+			case <-replayDoneCh:
+			case <-ws.interruptCh:
+			}
+		} else {
+			<-ws.interruptCh
+		}
+
+		cancel()
+		replayer.Close()
+		for range exchanges {
+			<-ws.exchangeDoneCh
+		}
+	},
+}
+
+// connectReplay connects exchanges to the messages and REST responses recorded from them
+func connectReplay(replayer *api.Replayer) connector {
+	return func(config *exchange.Config) (api.HelperFactory, *http.Client, error) {
+		name := config.Name
+		newHelper := func() api.WebSocketHelper {
+			return replayer.NewWebSocketHelper(name)
+		}
+		return newHelper, replayer.HTTPClient(name), nil
+	}
+}
+
+// replayedConfigs returns the configs of the exchanges recorded in the capture. Nothing is
+// recorded while replaying
+func replayedConfigs(configs []*exchange.Config, recorded []string) []*exchange.Config {
+	var replayed []*exchange.Config
+	for _, config := range configs {
+		for _, name := range recorded {
+			if config.Name == name {
+				config.Record = false
+				replayed = append(replayed, config)
+			}
+		}
+	}
+	return replayed
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "replay speed relative to the capture, ex: 10 replays ten times faster. 0 replays as fast as possible")
+	replayCmd.Flags().BoolVar(&replayExit, "exit", false, "exit once every message has been replayed instead of serving the websocket API until interrupted")
+	rootCmd.AddCommand(replayCmd)
+}
@@ -2,28 +2,46 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
 	"github.com/kaplanmaxe/helgart/broker/api"
-	"github.com/kaplanmaxe/helgart/broker/binance"
-	"github.com/kaplanmaxe/helgart/broker/bitfinex"
-	"github.com/kaplanmaxe/helgart/broker/coinbase"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
-	"github.com/kaplanmaxe/helgart/broker/kraken"
+	"github.com/kaplanmaxe/helgart/broker/inventory"
+	"github.com/kaplanmaxe/helgart/broker/metrics"
+	"github.com/kaplanmaxe/helgart/broker/paper"
 	"github.com/kaplanmaxe/helgart/broker/storage/mysql"
 	"github.com/kaplanmaxe/helgart/broker/wsapi"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	// Exchanges register themselves with the exchange registry
+	_ "github.com/kaplanmaxe/helgart/broker/binance"
+	_ "github.com/kaplanmaxe/helgart/broker/bitfinex"
+	_ "github.com/kaplanmaxe/helgart/broker/coinbase"
+	_ "github.com/kaplanmaxe/helgart/broker/kraken"
 )
 
+// minSpread is the minimum net spread in percent for a market to be an arbitrage opportunity
+var minSpread = decimal.New(1, -2)
+
+// defaultFillLimit is the number of paper fills returned when the request doesn't set a limit
+const defaultFillLimit = 100
+
+// staleSweepInterval is how often quotes older than the max age of their exchange are evicted
+const staleSweepInterval = 5 * time.Second
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true }, // allow for browsers to connect
 }
@@ -39,12 +57,35 @@ type websocketAPI struct {
 	quoteCh        chan exchange.Quote
 	arbCh          chan *exchange.ArbMarket
 	errorCh        chan error
+	stateCh        chan api.ConnectionEvent
 	interruptCh    chan os.Signal
 	exchangeDoneCh chan struct{}
 	writeCh        chan []byte
 	arbMap         map[string]*exchange.ArbMarket
 	mtx            *sync.Mutex
 	conns          map[*websocket.Conn]*websocketClient
+	latency        *metrics.LatencyTracker
+	fallback       *exchange.Fallback
+	// recorder writes the traffic of exchanges with recording enabled to capture files
+	recorder *api.Recorder
+	// paper simulates trading the opportunities sent on arbCh if paper trading is enabled
+	paper *paper.Trader
+	// inventory tracks the balances of exchange accounts if inventory tracking is enabled
+	inventory *inventory.Tracker
+	// subscriptions holds the pairs each exchange subscribed to once the broker has started
+	subscriptions map[string][]string
+	subMtx        sync.RWMutex
+	// replayClock returns the time the message being replayed was recorded at when replaying.
+	// Quotes are received and go stale on that clock instead of the wall clock
+	replayClock func() time.Time
+}
+
+// now returns the time on the replay clock when replaying and the wall clock otherwise
+func (ws *websocketAPI) now() time.Time {
+	if ws.replayClock != nil {
+		return ws.replayClock()
+	}
+	return time.Now()
 }
 
 func (ws *websocketAPI) quoteHandler(w http.ResponseWriter, r *http.Request) {
@@ -114,24 +155,19 @@ func (ws *websocketAPI) writePump(c *websocket.Conn) {
 
 func (ws *websocketAPI) marshalArbMarkets() ([]byte, error) {
 	var markets []*wsapi.ArbMarket
+	now := ws.now()
 	for _, val := range ws.arbMap {
 		markets = append(markets, &wsapi.ArbMarket{
-			HeBase: val.HeBase,
-			Spread: val.Spread,
-			Low: &wsapi.ArbMarket_ActiveMarket{
-				Exchange:          val.Low.Exchange,
-				HePair:            val.Low.HePair,
-				ExPair:            val.Low.ExPair,
-				Price:             fmt.Sprintf("%8.8f", val.Low.Price),
-				TriangulatedPrice: fmt.Sprintf("%8.8f", val.Low.TriangulatedPrice),
-			},
-			High: &wsapi.ArbMarket_ActiveMarket{
-				Exchange:          val.High.Exchange,
-				HePair:            val.High.HePair,
-				ExPair:            val.High.ExPair,
-				Price:             fmt.Sprintf("%8.8f", val.High.Price),
-				TriangulatedPrice: fmt.Sprintf("%8.8f", val.High.TriangulatedPrice),
-			},
+			HeBase:             val.HeBase,
+			GrossSpread:        val.GrossSpread.Float64(),
+			Fees:               val.Fees.Float64(),
+			Spread:             val.Spread.Float64(),
+			Quantity:           val.Quantity.Float64(),
+			Profit:             val.Profit.Float64(),
+			Executable:         val.Executable,
+			ExecutableQuantity: val.ExecutableQuantity.Float64(),
+			Low:                newProtoActiveMarket(val.Low, now),
+			High:               newProtoActiveMarket(val.High, now),
 		})
 	}
 	pb := &wsapi.ArbMarkets{
@@ -141,30 +177,147 @@ func (ws *websocketAPI) marshalArbMarkets() ([]byte, error) {
 }
 
 func (ws *websocketAPI) marshalArbMarket(market *exchange.ArbMarket) ([]byte, error) {
+	now := ws.now()
 	pb := &wsapi.ArbMarket{
-		HeBase: market.HeBase,
-		Spread: market.Spread,
-		Low: &wsapi.ArbMarket_ActiveMarket{
-			Exchange:          market.Low.Exchange,
-			HePair:            market.Low.HePair,
-			ExPair:            market.Low.ExPair,
-			Price:             fmt.Sprintf("%8.8f", market.Low.Price),
-			TriangulatedPrice: fmt.Sprintf("%8.8f", market.Low.TriangulatedPrice),
-		},
-		High: &wsapi.ArbMarket_ActiveMarket{
-			Exchange:          market.High.Exchange,
-			HePair:            market.High.HePair,
-			ExPair:            market.High.ExPair,
-			Price:             fmt.Sprintf("%8.8f", market.High.Price),
-			TriangulatedPrice: fmt.Sprintf("%8.8f", market.High.TriangulatedPrice),
-		},
+		HeBase:             market.HeBase,
+		GrossSpread:        market.GrossSpread.Float64(),
+		Fees:               market.Fees.Float64(),
+		Spread:             market.Spread.Float64(),
+		Quantity:           market.Quantity.Float64(),
+		Profit:             market.Profit.Float64(),
+		Executable:         market.Executable,
+		ExecutableQuantity: market.ExecutableQuantity.Float64(),
+		Removed:            market.Removed,
+		Low:                newProtoActiveMarket(market.Low, now),
+		High:               newProtoActiveMarket(market.High, now),
 	}
 	return proto.Marshal(pb)
 }
 
+// newProtoActiveMarket converts a side of an arbitrage market with the age of its quote at now
+func newProtoActiveMarket(side exchange.MarketSide, now time.Time) *wsapi.ArbMarket_ActiveMarket {
+	return &wsapi.ArbMarket_ActiveMarket{
+		Exchange:          side.Exchange,
+		HePair:            side.HePair,
+		ExPair:            side.ExPair,
+		Price:             side.Price.StringFixed(8),
+		TriangulatedPrice: side.TriangulatedPrice.StringFixed(8),
+		AgeMs:             int64(side.Age(now) / time.Millisecond),
+		Size:              side.Size.StringFixed(8),
+	}
+}
+
+// latencyHandler returns the feed latency percentiles of each exchange as json
+func (ws *websocketAPI) latencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ws.latency.Summary())
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding latency: %s", err)
+	}
+}
+
+// gapsHandler returns the number of sequence gaps detected per pair of each exchange as json
+func (ws *websocketAPI) gapsHandler(w http.ResponseWriter, r *http.Request) {
+	gaps := make(map[string]map[string]int)
+	// Subscriptions are only set once the broker has started
+	ws.subMtx.RLock()
+	if ws.subscriptions != nil {
+		gaps = ws.broker.SequenceGaps()
+	}
+	ws.subMtx.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(gaps)
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding gaps: %s", err)
+	}
+}
+
+// subscriptionsHandler returns the pairs each exchange is subscribed to as json
+func (ws *websocketAPI) subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ws.subMtx.RLock()
+	defer ws.subMtx.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ws.subscriptions)
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding subscriptions: %s", err)
+	}
+}
+
+// paperHandler returns the balances and realized PnL of the paper trader as json
+func (ws *websocketAPI) paperHandler(w http.ResponseWriter, r *http.Request) {
+	if ws.paper == nil {
+		http.Error(w, "Paper trading is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ws.paper.Summary())
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding paper summary: %s", err)
+	}
+}
+
+// paperFillsHandler returns the fills of the paper trader as json, most recent first. They're
+// filtered with the base, since (RFC 3339) and limit query parameters, ex:
+// /paper/fills?base=BTC&since=2019-10-18T00:00:00Z&limit=10
+func (ws *websocketAPI) paperFillsHandler(w http.ResponseWriter, r *http.Request) {
+	if ws.paper == nil {
+		http.Error(w, "Paper trading is disabled", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	query := paper.FillQuery{HeBase: strings.ToUpper(params.Get("base")), Limit: defaultFillLimit}
+	var err error
+	if since := params.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", limit), http.StatusBadRequest)
+			return
+		}
+	}
+	fills, err := ws.paper.Fills(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fills == nil {
+		fills = []*paper.Fill{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(fills)
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding paper fills: %s", err)
+	}
+}
+
+// inventoryHandler returns the holdings of every exchange account as json
+func (ws *websocketAPI) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if ws.inventory == nil {
+		http.Error(w, "Inventory tracking is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ws.inventory.Holdings())
+	if err != nil {
+		ws.errorCh <- fmt.Errorf("Error encoding inventory: %s", err)
+	}
+}
+
 func (ws *websocketAPI) serveWS() {
 	http.HandleFunc("/ticker", ws.quoteHandler)
 	http.HandleFunc("/arb", ws.arbitrageHandler)
+	http.HandleFunc("/subscriptions", ws.subscriptionsHandler)
+	http.HandleFunc("/latency", ws.latencyHandler)
+	http.HandleFunc("/gaps", ws.gapsHandler)
+	http.HandleFunc("/paper", ws.paperHandler)
+	http.HandleFunc("/paper/fills", ws.paperFillsHandler)
+	http.HandleFunc("/inventory", ws.inventoryHandler)
 	http.ListenAndServe(fmt.Sprintf("%s:%d", viper.Get("api.host"), viper.Get("api.port")), nil)
 }
 
@@ -183,71 +336,320 @@ func (ws *websocketAPI) connectDB() (exchange.ProductStorage, error) {
 	return db, nil
 }
 
-func (ws *websocketAPI) getExchanges() []exchange.Exchange {
-	return []exchange.Exchange{
-		binance.NewClient(api.NewWebSocketHelper(exchange.BINANCE), ws.quoteCh, ws.errorCh),
-		kraken.NewClient(api.NewWebSocketHelper(exchange.KRAKEN), ws.quoteCh, ws.errorCh),
-		coinbase.NewClient(api.NewWebSocketHelper(exchange.COINBASE), ws.quoteCh, ws.errorCh),
-		bitfinex.NewClient(api.NewWebSocketHelper(exchange.BITFINEX), ws.quoteCh, ws.errorCh),
+// newWebSocketHelper returns a connection that reconnects on its own and reports its state
+// back to the broker pump. stateCh is buffered since exchanges report their state while
+// connecting, before the pump is running. Every frame is recorded if record is true
+func (ws *websocketAPI) newWebSocketHelper(exchangeName string, dialer *websocket.Dialer, record bool) api.WebSocketHelper {
+	helper := api.NewSupervisedWebSocketHelper(exchangeName, dialer, api.DefaultReconnectPolicy, ws.stateCh)
+	if record {
+		return api.NewRecordingWebSocketHelper(helper, exchangeName, ws.recorder)
+	}
+	return helper
+}
+
+// loadExchangeConfigs reads the exchanges enabled in the config file. Every registered exchange
+// is enabled with its defaults if the config doesn't list any. Exchanges without a proxy of
+// their own use the global proxy and every exchange is recorded with --record
+func loadExchangeConfigs() ([]*exchange.Config, error) {
+	configs := exchange.DefaultConfigs()
+	if viper.IsSet("exchanges") {
+		configs = nil
+		err := viper.UnmarshalKey("exchanges", &configs)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading exchanges from config: %s", err)
+		}
+	}
+	for _, config := range configs {
+		if config.Proxy == "" {
+			config.Proxy = viper.GetString("proxy")
+		}
+		if record {
+			config.Record = true
+		}
 	}
+	err := exchange.ValidateConfigs(configs)
+	if err != nil {
+		return nil, err
+	}
+	return configs, nil
 }
 
-func (ws *websocketAPI) startBroker(ctx context.Context, exchanges []exchange.Exchange, db exchange.ProductStorage) error {
+// loadFees loads the fee schedule spreads are net of from db if it stores fees, then from the
+// fees section of the config which takes precedence
+func loadFees(db exchange.ProductStorage) (*exchange.FeeSchedule, error) {
+	fees := exchange.NewFeeSchedule()
+	if storage, ok := db.(exchange.FeeStorage); ok {
+		err := fees.Load(storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var config exchange.FeeConfig
+	err := viper.UnmarshalKey("fees", &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading fees from config: %s", err)
+	}
+	err = fees.Configure(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fee config: %s", err)
+	}
+	return fees, nil
+}
+
+// newPaperTrader configures the paper trader from the paper section of the config. Fills and
+// balances are persisted to db
+func (ws *websocketAPI) newPaperTrader(db exchange.ProductStorage) error {
+	var config paper.Config
+	err := viper.UnmarshalKey("paper", &config)
+	if err != nil {
+		return fmt.Errorf("Error reading paper from config: %s", err)
+	}
+	if config.MinSpread == "" {
+		config.MinSpread = minSpread.String()
+	}
+	store, ok := db.(paper.Store)
+	if !ok {
+		return fmt.Errorf("Paper trading isn't supported by the database")
+	}
+	ws.paper, err = paper.NewTrader(&config, store)
+	if err != nil {
+		return fmt.Errorf("Invalid paper config: %s", err)
+	}
+	summary := ws.paper.Summary()
+	log.Printf("Paper trading with balances %v, realized PnL %s USD\n", summary.Balances, summary.PnL)
+	return nil
+}
+
+// newInventory configures the inventory tracker from the inventory section of the config.
+// Balances are fetched from every exchange with an api key and persisted to db
+func (ws *websocketAPI) newInventory(configs []*exchange.Config, db exchange.ProductStorage) error {
+	store, ok := db.(inventory.Store)
+	if !ok {
+		return fmt.Errorf("Inventory tracking isn't supported by the database")
+	}
+	traders := make(map[string]exchange.Trader)
+	for _, config := range configs {
+		if config.APIKey == "" {
+			continue
+		}
+		proxy, err := config.GetProxy()
+		if err != nil {
+			return err
+		}
+		// Authenticated traffic is never recorded
+		traders[config.Name], err = exchange.NewTrader(api.NewHTTPClient(proxy), config)
+		if err != nil {
+			return err
+		}
+	}
+	if len(traders) == 0 {
+		return fmt.Errorf("Inventory tracking needs the api_key of at least one exchange")
+	}
+	var err error
+	ws.inventory, err = inventory.NewTracker(traders, store)
+	if err != nil {
+		return err
+	}
+	if viper.IsSet("inventory.interval") {
+		ws.inventory.Interval = viper.GetDuration("inventory.interval")
+		if ws.inventory.Interval <= 0 {
+			return fmt.Errorf("Invalid inventory interval %q", viper.GetString("inventory.interval"))
+		}
+	}
+	log.Printf("Tracking the inventory of %v every %s\n", ws.inventory.Exchanges(), ws.inventory.Interval)
+	return nil
+}
+
+// connector returns how an exchange opens websocket connections and the client it sends REST
+// requests with
+type connector func(config *exchange.Config) (api.HelperFactory, *http.Client, error)
+
+// connectLive connects an exchange to the exchange itself, through its proxy. Both websocket
+// and REST traffic are recorded if recording is enabled
+func (ws *websocketAPI) connectLive(config *exchange.Config) (api.HelperFactory, *http.Client, error) {
+	proxy, err := config.GetProxy()
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := api.NewDialer(proxy)
+	httpClient := api.NewHTTPClient(proxy)
+	if config.Record {
+		if ws.recorder == nil {
+			ws.recorder, err = api.NewRecorder(captureDir())
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		httpClient.Transport = api.NewRecordingTransport(httpClient.Transport, config.Name, ws.recorder)
+	}
+	name, record := config.Name, config.Record
+	newHelper := func() api.WebSocketHelper {
+		return ws.newWebSocketHelper(name, dialer, record)
+	}
+	return newHelper, httpClient, nil
+}
+
+func (ws *websocketAPI) getExchanges(configs []*exchange.Config, connect connector) ([]exchange.Exchange, error) {
+	var exchanges []exchange.Exchange
+	for _, config := range configs {
+		newHelper, httpClient, err := connect(config)
+		if err != nil {
+			return nil, err
+		}
+		ex, err := exchange.New(newHelper, httpClient, config, ws.quoteCh, ws.errorCh)
+		if err != nil {
+			return nil, err
+		}
+		if config.RESTFallback > 0 {
+			poller, ok := ex.(exchange.Poller)
+			if !ok {
+				return nil, fmt.Errorf("%s doesn't support a REST fallback", config.Name)
+			}
+			ws.fallback.Add(poller, config.RESTFallback)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	return exchanges, nil
+}
+
+func (ws *websocketAPI) startBroker(ctx context.Context, exchanges []exchange.Exchange, configs []*exchange.Config, db exchange.ProductStorage) error {
 	ws.broker = exchange.NewBroker(exchanges, db)
-	return ws.broker.Start(ctx, ws.exchangeDoneCh)
+	ws.broker.Configs = make(map[string]*exchange.Config)
+	for _, config := range configs {
+		ws.broker.Configs[config.Name] = config
+	}
+	var err error
+	ws.broker.Fees, err = loadFees(db)
+	if err != nil {
+		return err
+	}
+	err = ws.broker.Start(ctx, ws.exchangeDoneCh)
+	if err != nil {
+		return err
+	}
+	subscriptions := ws.broker.Subscriptions()
+	for name, pairs := range subscriptions {
+		log.Printf("Subscribed to %d pairs on %s: %v\n", len(pairs), name, pairs)
+	}
+	ws.subMtx.Lock()
+	ws.subscriptions = subscriptions
+	ws.subMtx.Unlock()
+	return nil
 }
 
-func (ws *websocketAPI) startBrokerPump() {
+// broadcast sends an arbitrage market to every connected client and the paper trader. The
+// paper trader misses opportunities rather than holding up the pump when it falls behind.
+// Opportunities are marked executable or not with the inventory first if it's tracked
+func (ws *websocketAPI) broadcast(market *exchange.ArbMarket) {
+	if ws.inventory != nil && !market.Removed {
+		ws.inventory.Mark(market)
+	}
+	if ws.paper != nil && !market.Removed {
+		select {
+		case ws.arbCh <- market:
+		default:
+			log.Printf("Paper trader is behind, skipping %s opportunity\n", market.HeBase)
+		}
+	}
+	for _, client := range ws.conns {
+		if _, ok := ws.conns[client.conn]; ok {
+			client.sendCh <- market
+		} else {
+			delete(ws.conns, client.conn)
+			close(client.sendCh)
+		}
+	}
+}
+
+// evictStale removes stale quotes and recomputes the opportunity of every base that lost one.
+// Clients are told about opportunities that no longer exist
+func (ws *websocketAPI) evictStale(now time.Time) {
+	for _, base := range ws.broker.EvictStale(now) {
+		cached, ok := ws.arbMap[base]
+		market := ws.broker.BestArbMarket(base)
+		if market != nil && !market.Spread.LessThan(minSpread) {
+			if ok && sameOpportunity(market, cached) {
+				continue
+			}
+			ws.arbMap[base] = market
+			ws.broadcast(market)
+		} else if ok {
+			delete(ws.arbMap, base)
+			removed := *cached
+			removed.Removed = true
+			ws.broadcast(&removed)
+		}
+	}
+}
+
+// sameOpportunity returns true if an opportunity hasn't changed enough to be broadcast again
+func sameOpportunity(a, b *exchange.ArbMarket) bool {
+	return a.Spread == b.Spread && a.Quantity == b.Quantity
+}
+
+func (ws *websocketAPI) startBrokerPump(ctx context.Context) {
+	// Replays sweep stale quotes as the replay clock moves forward instead
+	var sweepCh <-chan time.Time
+	if ws.replayClock == nil {
+		sweeper := time.NewTicker(staleSweepInterval)
+		defer sweeper.Stop()
+		sweepCh = sweeper.C
+	}
+	var sweptAt time.Time
 	for {
 		select {
 		case quote := <-ws.quoteCh:
+			if ws.replayClock != nil {
+				quote.ReceivedAt = ws.replayClock()
+				if quote.ReceivedAt.Sub(sweptAt) >= staleSweepInterval {
+					sweptAt = quote.ReceivedAt
+					ws.evictStale(sweptAt)
+				}
+			}
+			ws.latency.Observe(quote.Exchange, quote.ExchangeTime, quote.ReceivedAt)
 			if _, ok := ws.broker.ArbProducts[quote.HeBase]; ok {
 				// TODO: investigate this bug where coinbase returns no price for MKR-BTC
-				if quote.Ask == "" || quote.Bid == "" {
+				if quote.Ask.IsZero() || quote.Bid.IsZero() {
 					continue
 				}
-				bid, err := strconv.ParseFloat(quote.Bid, 64)
-				if err != nil {
-					ws.errorCh <- err
-				}
-				ask, err := strconv.ParseFloat(quote.Ask, 64)
-				if err != nil {
-					ws.errorCh <- err
-				}
 				ws.broker.InsertActiveMarket(&exchange.ActiveMarket{
-					Exchange: quote.Exchange,
-					HePair:   quote.HePair,
-					ExPair:   quote.ExPair,
-					HeBase:   quote.HeBase,
-					HeQuote:  quote.HeQuote,
-					Bid:      bid,
-					Ask:      ask,
+					Exchange:     quote.Exchange,
+					HePair:       quote.HePair,
+					ExPair:       quote.ExPair,
+					HeBase:       quote.HeBase,
+					HeQuote:      quote.HeQuote,
+					Bid:          quote.Bid,
+					Ask:          quote.Ask,
+					BidSize:      quote.BidSize,
+					AskSize:      quote.AskSize,
+					ExchangeTime: quote.ExchangeTime,
+					ReceivedAt:   quote.ReceivedAt,
 				})
 				// If there is more than one quote and the best bid or ask has changed, we perform an update operation
 				if len(ws.broker.ActiveMarkets[quote.HeBase].Bids) > 0 && len(ws.broker.ActiveMarkets[quote.HeBase].Asks) > 0 {
 
 					high := ws.broker.ActiveMarkets[quote.HeBase].Bids[0] // Sell at highest price
 					low := ws.broker.ActiveMarkets[quote.HeBase].Asks[0]  // Buy at lowest price
-					if market := exchange.NewArbMarket(quote.HeBase, low, high); market.Spread >= 0.01 {
+					if market := exchange.NewArbMarket(quote.HeBase, low, high, ws.broker.Fees); !market.Spread.LessThan(minSpread) {
 						// TODO: why are we getting duplicates?
-						if val, ok := ws.arbMap[market.HeBase]; ok && market.Spread == val.Spread {
+						if val, ok := ws.arbMap[market.HeBase]; ok && sameOpportunity(market, val) {
 							continue
 						}
 						ws.arbMap[market.HeBase] = market
-
-						for _, client := range ws.conns {
-							if _, ok := ws.conns[client.conn]; ok {
-								client.sendCh <- market
-							} else {
-								delete(ws.conns, client.conn)
-								close(client.sendCh)
-							}
-
-						}
+						ws.broadcast(market)
 					}
 
 				}
 			}
+		case now := <-sweepCh:
+			ws.evictStale(now)
+		case event := <-ws.stateCh:
+			if event.Err != nil {
+				log.Printf("%s connection %s: %s\n", event.Exchange, event.State, event.Err)
+			} else {
+				log.Printf("%s connection %s\n", event.Exchange, event.State)
+			}
+			ws.fallback.Handle(ctx, event)
 		case err := <-ws.errorCh:
 			// TODO: send a message back to the client
 			log.Println(err)
@@ -256,6 +658,24 @@ func (ws *websocketAPI) startBrokerPump() {
 	}
 }
 
+func newWebsocketAPI() *websocketAPI {
+	ws := &websocketAPI{
+		quoteCh:        make(chan exchange.Quote),
+		arbCh:          make(chan *exchange.ArbMarket, 256),
+		errorCh:        make(chan error),
+		stateCh:        make(chan api.ConnectionEvent, 64),
+		interruptCh:    make(chan os.Signal, 1),
+		exchangeDoneCh: make(chan struct{}),
+		writeCh:        make(chan []byte),
+		arbMap:         make(map[string]*exchange.ArbMarket),
+		mtx:            &sync.Mutex{},
+		conns:          make(map[*websocket.Conn]*websocketClient),
+		latency:        metrics.NewLatencyTracker(metrics.DefaultWindow),
+	}
+	ws.fallback = exchange.NewFallback(ws.quoteCh, ws.errorCh)
+	return ws
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start starts the broker service",
@@ -265,63 +685,92 @@ var rootCmd = &cobra.Command{
 			log.Fatalf("Can't read config: %s", err)
 			os.Exit(1)
 		}
-		ws := &websocketAPI{
-			quoteCh:        make(chan exchange.Quote),
-			arbCh:          make(chan *exchange.ArbMarket),
-			errorCh:        make(chan error),
-			interruptCh:    make(chan os.Signal, 1),
-			exchangeDoneCh: make(chan struct{}),
-			writeCh:        make(chan []byte),
-			arbMap:         make(map[string]*exchange.ArbMarket),
-			mtx:            &sync.Mutex{},
-			conns:          make(map[*websocket.Conn]*websocketClient),
+		// Fail on a bad exchange config before connecting to anything
+		configs, err := loadExchangeConfigs()
+		if err != nil {
+			log.Fatalf("Invalid exchange config: %s", err)
+		}
+		ws := newWebsocketAPI()
+		exchanges, err := ws.getExchanges(configs, ws.connectLive)
+		if err != nil {
+			log.Fatalf("Invalid exchange config: %s", err)
 		}
-		// Start websocket API
-		go ws.serveWS()
 		// Connect to db
 		db, err := ws.connectDB()
 		if err != nil {
 			log.Fatal(err)
 		}
+		if paperTrading || viper.GetBool("paper.enabled") {
+			err = ws.newPaperTrader(db)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if viper.GetBool("inventory.enabled") {
+			err = ws.newInventory(configs, db)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Start websocket API
+		go ws.serveWS()
 
 		// Interrupt handler logic
 		log.Print("Starting quote server")
-		doneCh := make(chan struct{}, 1)
 		signal.Notify(ws.interruptCh, os.Interrupt)
 		ctx, cancel := context.WithCancel(context.Background())
 
 		// Start broker
-		exchanges := ws.getExchanges()
-		err = ws.startBroker(ctx, exchanges, db)
+		err = ws.startBroker(ctx, exchanges, configs, db)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if ws.paper != nil {
+			ws.paper.Fees = ws.broker.Fees
+			go ws.paper.Run(ctx, ws.arbCh, ws.errorCh)
+		}
+		if ws.inventory != nil {
+			ws.inventory.Fees = ws.broker.Fees
+			ws.inventory.SetProducts(ws.broker.ProductMap)
+			go ws.inventory.Run(ctx, ws.errorCh)
+		}
+		go ws.startBrokerPump(ctx)
 
-		ws.startBrokerPump()
-		// interrupt handler
-		go func() {
-			<-ws.interruptCh
-			log.Println("interrupt received")
-			cancel()
-			canceledExchanges := 0
-		interrupt:
-			for {
-				select {
-				case <-ws.exchangeDoneCh:
-					canceledExchanges++
-					if canceledExchanges == len(exchanges) {
-						close(doneCh)
-						break interrupt
-					}
-				}
+		// Capture files are only complete once every exchange is done writing to them
+		<-ws.interruptCh
+		log.Println("interrupt received")
+		cancel()
+		for range exchanges {
+			<-ws.exchangeDoneCh
+		}
+		if ws.recorder != nil {
+			err = ws.recorder.Close()
+			if err != nil {
+				log.Println(err)
 			}
-
-		}()
-		<-doneCh
+		}
 	},
 }
 
-var cfgFile string
+var (
+	cfgFile   string
+	record    bool
+	recordDir string
+	// paperTrading enables the paper trader regardless of paper.enabled in the config
+	paperTrading bool
+)
+
+// captureDir returns the directory capture files are written to. --record-dir takes precedence
+// over record_dir in the config file
+func captureDir() string {
+	if recordDir != "" {
+		return recordDir
+	}
+	if dir := viper.GetString("record_dir"); dir != "" {
+		return dir
+	}
+	return "recordings"
+}
 
 // Execute is the main entry point to the application and executes the root cmd
 func Execute() {
@@ -334,6 +783,9 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.helgart/.broker.config.yml)")
+	rootCmd.Flags().BoolVar(&record, "record", false, "record the websocket traffic of every exchange")
+	rootCmd.Flags().StringVar(&recordDir, "record-dir", "", "directory capture files are written to (default is recordings)")
+	rootCmd.Flags().BoolVar(&paperTrading, "paper", false, "simulate trading the arbitrage opportunities found against the paper balances in the config")
 }
 
 func initConfig() {
@@ -0,0 +1,43 @@
+package coinbase
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func init() {
+	exchange.Register(exchange.COINBASE, NewClientFromConfig)
+	exchange.RegisterTrader(exchange.COINBASE, NewTraderFromConfig)
+}
+
+// NewClientFromConfig returns a new instance of the API configured from the exchange config.
+// Quotes are always built from the level2 channel
+func NewClientFromConfig(newHelper api.HelperFactory, httpClient *http.Client, config *exchange.Config, quoteCh chan<- exchange.Quote, errorCh chan<- error) (exchange.Exchange, error) {
+	c := NewClient(newHelper(), quoteCh, errorCh)
+	c.NewHelper = newHelper
+	if config.ChannelsPerConnection > 0 {
+		c.ChannelsPerConnection = config.ChannelsPerConnection
+	}
+	if config.Channel != "" && config.Channel != "level2" {
+		return nil, fmt.Errorf("Unsupported %s channel %s", c.exchangeName, config.Channel)
+	}
+	if config.Depth > 0 {
+		c.Depth = config.Depth
+	}
+	var err error
+	c.WSURL, err = config.GetWSURL()
+	if err != nil {
+		return nil, err
+	}
+	c.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		c.HTTPClient = httpClient
+	}
+	return c, nil
+}
@@ -0,0 +1,57 @@
+package coinbase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// restInterval is the delay between two REST requests. Coinbase allows 3 public requests per
+// second
+const restInterval = time.Second / 3
+
+// PollQuotes fetches the best bid and ask of every subscribed product from the REST api. Coinbase
+// only serves a single product per request
+func (c *Client) PollQuotes(ctx context.Context) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	// Waiting even without products paces callers polling in a loop
+	if len(c.pairs) == 0 {
+		return quotes, c.Limiter.Wait(ctx)
+	}
+	for _, pair := range c.pairs {
+		err := c.Limiter.Wait(ctx)
+		if err != nil {
+			return quotes, err
+		}
+		u := c.GetRESTURL()
+		u.Path = "/products/" + pair + "/book"
+		u.RawQuery = "level=1"
+		var res RESTBook
+		err = api.GetJSON(ctx, c.HTTPClient, u, &res)
+		if err != nil {
+			return quotes, fmt.Errorf("Error fetching %s book for %s: %s", c.exchangeName, pair, err)
+		}
+		if len(res.Bids) == 0 || len(res.Asks) == 0 || len(res.Bids[0]) < 2 || len(res.Asks[0]) < 2 {
+			continue
+		}
+		product := c.productMap[pair]
+		quotes = append(quotes, exchange.Quote{
+			Exchange:   c.exchangeName,
+			Bid:        res.Bids[0][0],
+			Ask:        res.Asks[0][0],
+			BidSize:    res.Bids[0][1],
+			AskSize:    res.Asks[0][1],
+			ExPair:     product.ExPair,
+			HePair:     product.HePair,
+			ExBase:     product.ExBase,
+			HeBase:     product.HeBase,
+			ExQuote:    product.ExQuote,
+			HeQuote:    product.HeQuote,
+			ReceivedAt: time.Now(),
+		})
+	}
+	return quotes, nil
+}
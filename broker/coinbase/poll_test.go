@@ -0,0 +1,52 @@
+package coinbase_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/coinbase"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestPollQuotes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/products":
+			w.Write([]byte(`[{"id":"MOCK-USD","base_currency":"MOCK","quote_currency":"USD"}]`))
+		case "/products/MOCK-USD/book":
+			if r.URL.Query().Get("level") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"sequence":3,"bids":[["295.96","4.39088265",2]],"asks":[["295.97","25.23542881",12]]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	restURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := coinbase.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	client.RESTURL = restURL
+	client.Limiter = api.NewRateLimiter(0)
+	err = client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	quotes, err := client.PollQuotes(context.Background())
+	if err != nil {
+		t.Fatalf("Error polling quotes: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].HePair != "MOCK-USD" || quotes[0].Bid.String() != "295.96" ||
+		quotes[0].Ask.String() != "295.97" || quotes[0].AskSize.String() != "25.23542881" {
+		t.Errorf("Expected a quote for MOCK-USD from the REST book but got %#v", quotes)
+	}
+}
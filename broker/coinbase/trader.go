@@ -0,0 +1,273 @@
+package coinbase
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// Trader trades on a coinbase pro account through the REST api. Requests are signed with
+// HMAC-SHA256 of their timestamp, method, path and body keyed with the base64 decoded secret,
+// and carry the passphrase of the api key
+type Trader struct {
+	APIKey     string
+	APISecret  string
+	Passphrase string
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// HTTPClient sends every request to the REST api
+	HTTPClient *http.Client
+}
+
+// NewTrader returns a trader for the account of the api key
+func NewTrader(apiKey, apiSecret, passphrase string) *Trader {
+	return &Trader{
+		APIKey:     apiKey,
+		APISecret:  apiSecret,
+		Passphrase: passphrase,
+		HTTPClient: api.DefaultHTTPClient,
+	}
+}
+
+// NewTraderFromConfig returns a trader configured from the exchange config
+func NewTraderFromConfig(httpClient *http.Client, config *exchange.Config) (exchange.Trader, error) {
+	if config.Passphrase == "" {
+		return nil, fmt.Errorf("Missing passphrase")
+	}
+	if _, err := base64.StdEncoding.DecodeString(config.APISecret); err != nil {
+		return nil, fmt.Errorf("api_secret isn't base64: %s", err)
+	}
+	t := NewTrader(config.APIKey, config.APISecret, config.Passphrase)
+	var err error
+	t.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		t.HTTPClient = httpClient
+	}
+	return t, nil
+}
+
+// orderRequest is the body of an order placed with the orders endpoint
+type orderRequest struct {
+	ClientOID   string           `json:"client_oid,omitempty"`
+	Type        string           `json:"type"`
+	Side        string           `json:"side"`
+	ProductID   string           `json:"product_id"`
+	Price       *decimal.Decimal `json:"price,omitempty"`
+	Size        decimal.Decimal  `json:"size"`
+	TimeInForce string           `json:"time_in_force,omitempty"`
+}
+
+// orderResponse is an order returned by the orders endpoints
+type orderResponse struct {
+	ID            string          `json:"id"`
+	ClientOID     string          `json:"client_oid"`
+	Price         decimal.Decimal `json:"price"`
+	Size          decimal.Decimal `json:"size"`
+	ProductID     string          `json:"product_id"`
+	Side          string          `json:"side"`
+	Type          string          `json:"type"`
+	TimeInForce   string          `json:"time_in_force"`
+	CreatedAt     time.Time       `json:"created_at"`
+	FilledSize    decimal.Decimal `json:"filled_size"`
+	ExecutedValue decimal.Decimal `json:"executed_value"`
+	Status        string          `json:"status"`
+	DoneReason    string          `json:"done_reason"`
+}
+
+// accountResponse is an account returned by the accounts endpoint
+type accountResponse struct {
+	Currency  string          `json:"currency"`
+	Balance   decimal.Decimal `json:"balance"`
+	Available decimal.Decimal `json:"available"`
+	Hold      decimal.Decimal `json:"hold"`
+}
+
+// PlaceOrder places an order. The client id must be a UUID
+func (t *Trader) PlaceOrder(ctx context.Context, req *exchange.OrderRequest) (*exchange.Order, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	body := orderRequest{
+		ClientOID: req.ClientID,
+		Type:      exchange.LIMIT,
+		Side:      req.Side,
+		ProductID: req.ExPair,
+		Size:      req.Quantity,
+	}
+	switch req.Type {
+	case exchange.MARKET:
+		body.Type = exchange.MARKET
+	case exchange.LIMIT:
+		body.Price = &req.Price
+		body.TimeInForce = "GTC"
+	case exchange.IOC:
+		body.Price = &req.Price
+		body.TimeInForce = "IOC"
+	}
+	var res orderResponse
+	err = t.send(ctx, http.MethodPost, "/orders", body, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.order(), nil
+}
+
+// CancelOrder cancels an open order
+func (t *Trader) CancelOrder(ctx context.Context, exPair, id string) error {
+	var res json.RawMessage
+	return t.send(ctx, http.MethodDelete, "/orders/"+url.PathEscape(id), nil, &res)
+}
+
+// GetOrder returns an order
+func (t *Trader) GetOrder(ctx context.Context, exPair, id string) (*exchange.Order, error) {
+	var res orderResponse
+	err := t.send(ctx, http.MethodGet, "/orders/"+url.PathEscape(id), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.order(), nil
+}
+
+// GetBalances returns the balance of every asset held by the account
+func (t *Trader) GetBalances(ctx context.Context) (map[string]exchange.Balance, error) {
+	var res []accountResponse
+	err := t.send(ctx, http.MethodGet, "/accounts", nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]exchange.Balance)
+	for _, val := range res {
+		if val.Balance.IsZero() {
+			continue
+		}
+		balances[val.Currency] = exchange.Balance{Free: val.Available, Locked: val.Hold}
+	}
+	return balances, nil
+}
+
+// send sends a signed request with body marshalled as json if not nil and unmarshals the
+// response into v
+func (t *Trader) send(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	secret, err := base64.StdEncoding.DecodeString(t.APISecret)
+	if err != nil {
+		return fmt.Errorf("Invalid %s api secret: %s", exchange.COINBASE, err)
+	}
+	var payload []byte
+	if body != nil {
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + method + path))
+	mac.Write(payload)
+	u := t.restURL()
+	u.Path = path
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("CB-ACCESS-KEY", t.APIKey)
+	req.Header.Set("CB-ACCESS-SIGN", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("CB-ACCESS-TIMESTAMP", timestamp)
+	req.Header.Set("CB-ACCESS-PASSPHRASE", t.Passphrase)
+	res, resBody, err := api.Do(ctx, t.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return tradeError(res.StatusCode, resBody)
+	}
+	return json.Unmarshal(resBody, v)
+}
+
+// restURL returns the base url for the REST api
+func (t *Trader) restURL() *url.URL {
+	if t.RESTURL != nil {
+		u := *t.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.pro.coinbase.com"}
+}
+
+// tradeError maps the error response of a request to an exchange error. Coinbase errors only
+// have a message so they're mapped on the status
+func tradeError(status int, body []byte) error {
+	var res struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &res) != nil || res.Message == "" {
+		res.Message = http.StatusText(status)
+	}
+	err := &exchange.TradeError{Exchange: exchange.COINBASE, Message: res.Message}
+	switch {
+	case status == http.StatusTooManyRequests:
+		err.Err = exchange.ErrRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		err.Err = exchange.ErrAuthentication
+	case status == http.StatusNotFound:
+		err.Err = exchange.ErrOrderNotFound
+	case status == http.StatusBadRequest && strings.Contains(strings.ToLower(res.Message), "insufficient funds"):
+		err.Err = exchange.ErrInsufficientFunds
+	case status == http.StatusBadRequest:
+		err.Err = exchange.ErrInvalidOrder
+	}
+	return err
+}
+
+// order returns the exchange order of a response
+func (res *orderResponse) order() *exchange.Order {
+	order := &exchange.Order{
+		ID:        res.ID,
+		ClientID:  res.ClientOID,
+		ExPair:    res.ProductID,
+		Side:      res.Side,
+		Type:      exchange.LIMIT,
+		Price:     res.Price,
+		Quantity:  res.Size,
+		Filled:    res.FilledSize,
+		CreatedAt: res.CreatedAt,
+	}
+	if res.Type == "market" {
+		order.Type = exchange.MARKET
+	} else if res.TimeInForce == "IOC" {
+		order.Type = exchange.IOC
+	}
+	if res.FilledSize.Sign() > 0 {
+		order.AvgPrice = res.ExecutedValue.DivRound(res.FilledSize, 8)
+	}
+	switch res.Status {
+	case "pending", "received":
+		order.Status = exchange.PENDING
+	case "done":
+		order.Status = exchange.CANCELED
+		if res.DoneReason == "filled" {
+			order.Status = exchange.FILLED
+		}
+	case "rejected":
+		order.Status = exchange.REJECTED
+	default:
+		order.Status = exchange.OPEN
+	}
+	return order
+}
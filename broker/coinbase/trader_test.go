@@ -0,0 +1,110 @@
+package coinbase_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/coinbase"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+var secret = base64.StdEncoding.EncodeToString([]byte("secret"))
+
+// coinbaseStub checks the signature and passphrase of requests and answers like the coinbase
+// pro REST api
+func coinbaseStub(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("CB-ACCESS-TIMESTAMP") + r.Method + r.URL.Path + string(body)))
+		if r.Header.Get("CB-ACCESS-KEY") != "key" || r.Header.Get("CB-ACCESS-PASSPHRASE") != "passphrase" ||
+			r.Header.Get("CB-ACCESS-SIGN") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"invalid signature"}`))
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /orders":
+			var order map[string]string
+			json.Unmarshal(body, &order)
+			if order["size"] == "100" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"message":"Insufficient funds"}`))
+				return
+			}
+			if order["product_id"] != "BTC-USD" || order["side"] != "sell" || order["type"] != "limit" ||
+				order["time_in_force"] != "GTC" || order["price"] != "100.5" || order["size"] != "0.5" {
+				t.Errorf("Unexpected order %s", body)
+			}
+			w.Write([]byte(`{"id":"d0c5340b-6d6c-49d9-b567-48c4bfca13d2","price":"100.50000000","size":"0.50000000","product_id":"BTC-USD","side":"sell","type":"limit","time_in_force":"GTC","created_at":"2019-10-18T12:00:00.000000Z","filled_size":"0.00000000","executed_value":"0.0000000000000000","status":"pending"}`))
+		case "GET /orders/d0c5340b-6d6c-49d9-b567-48c4bfca13d2":
+			w.Write([]byte(`{"id":"d0c5340b-6d6c-49d9-b567-48c4bfca13d2","price":"100.50000000","size":"0.50000000","product_id":"BTC-USD","side":"sell","type":"limit","time_in_force":"GTC","created_at":"2019-10-18T12:00:00.000000Z","filled_size":"0.50000000","executed_value":"50.2500000000000000","status":"done","done_reason":"filled"}`))
+		case "GET /accounts":
+			w.Write([]byte(`[{"id":"1","currency":"BTC","balance":"1.5","available":"1","hold":"0.5"},{"id":"2","currency":"ETH","balance":"0.0000000000000000","available":"0","hold":"0"}]`))
+		case "DELETE /orders/d0c5340b-6d6c-49d9-b567-48c4bfca13d2":
+			w.Write([]byte(`["d0c5340b-6d6c-49d9-b567-48c4bfca13d2"]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"NotFound"}`))
+		}
+	}
+}
+
+func TestTrader(t *testing.T) {
+	server, restURL := mock.NewStubServer(coinbaseStub(t))
+	defer server.Close()
+	trader := coinbase.NewTrader("key", secret, "passphrase")
+	trader.RESTURL = restURL
+	ctx := context.Background()
+
+	order, err := trader.PlaceOrder(ctx, &exchange.OrderRequest{
+		ExPair:   "BTC-USD",
+		Side:     exchange.SELL,
+		Type:     exchange.LIMIT,
+		Quantity: decimal.MustParse("0.5"),
+		Price:    decimal.MustParse("100.5"),
+	})
+	if err != nil || order.Status != exchange.PENDING || order.Type != exchange.LIMIT || order.CreatedAt.Hour() != 12 {
+		t.Fatalf("Expected a pending limit order but got %+v, %v", order, err)
+	}
+	order, err = trader.GetOrder(ctx, "BTC-USD", order.ID)
+	if err != nil || order.Status != exchange.FILLED || order.Filled.String() != "0.5" || order.AvgPrice.String() != "100.5" {
+		t.Errorf("Expected a filled order but got %+v, %v", order, err)
+	}
+	if err := trader.CancelOrder(ctx, "BTC-USD", order.ID); err != nil {
+		t.Errorf("Error canceling order: %s", err)
+	}
+	if _, err := trader.GetOrder(ctx, "BTC-USD", "unknown"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	_, err = trader.PlaceOrder(ctx, &exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.BUY, Type: exchange.MARKET, Quantity: decimal.MustParse("100")})
+	if exchange.Cause(err) != exchange.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds but got %v", err)
+	}
+	balances, err := trader.GetBalances(ctx)
+	if err != nil || len(balances) != 1 || balances["BTC"].Free.String() != "1" || balances["BTC"].Locked.String() != "0.5" {
+		t.Errorf("Expected a BTC balance but got %v, %v", balances, err)
+	}
+
+	trader.Passphrase = "wrong"
+	if _, err := trader.GetBalances(ctx); exchange.Cause(err) != exchange.ErrAuthentication {
+		t.Errorf("Expected an authentication error with the wrong passphrase but got %v", err)
+	}
+}
+
+func TestNewTraderFromConfig(t *testing.T) {
+	if _, err := coinbase.NewTraderFromConfig(nil, &exchange.Config{APIKey: "key", APISecret: secret}); err == nil {
+		t.Error("Expected an error without a passphrase")
+	}
+	if _, err := coinbase.NewTraderFromConfig(nil, &exchange.Config{APIKey: "key", APISecret: "not base64!", Passphrase: "passphrase"}); err == nil {
+		t.Error("Expected an error for a secret that isn't base64")
+	}
+}
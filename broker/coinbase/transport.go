@@ -8,17 +8,44 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/metrics"
 )
 
+// orderBookLength is the default number of levels per side used from each book. The full book
+// is always maintained
 const orderBookLength = 500
 
+// channelsPerConnection is the default number of products subscribed to on a connection.
+// Coinbase doesn't document a limit but large subscriptions on one socket fall behind and get
+// disconnected
+const channelsPerConnection = 100
+
+// heartbeatInterval is how often coinbase sends a heartbeat for each product
+const heartbeatInterval = time.Second
+
 // Client represents an API client
 type Client struct {
+	// Depth is the number of levels per side used from each book
+	Depth int
+	// WSURL overrides the websocket url if set
+	WSURL *url.URL
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// ChannelsPerConnection is the number of products subscribed to on each connection
+	ChannelsPerConnection int
+	// NewHelper opens the connections beyond API. Without it every product shares API
+	NewHelper api.HelperFactory
+	// Limiter spaces out requests to the REST api when polling quotes
+	Limiter *api.RateLimiter
+	// HTTPClient sends every request to the REST api
+	HTTPClient   *http.Client
 	pairs        []string
 	quoteCh      chan<- exchange.Quote
 	errorCh      chan<- error
@@ -26,16 +53,29 @@ type Client struct {
 	exchangeName string
 	productMap   exchange.ExProductMap
 	orderBookMap exchange.OrderBookMap
+	pool         *api.Pool
+	// pairShards is the connection each product is subscribed on
+	pairShards map[string]*api.Shard
+	parseMtx   sync.Mutex
+	// heartbeats holds the last heartbeat of each product since its last snapshot
+	heartbeats map[string]HeartbeatResponse
+	gaps       *metrics.GapCounter
 }
 
 // NewClient returns a new instance of the API
-func NewClient(api api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
+func NewClient(helper api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
 	return &Client{
-		quoteCh:      quoteCh,
-		errorCh:      errorCh,
-		API:          api,
-		exchangeName: exchange.COINBASE,
-		orderBookMap: make(exchange.OrderBookMap),
+		Depth:                 orderBookLength,
+		ChannelsPerConnection: channelsPerConnection,
+		Limiter:               api.NewRateLimiter(restInterval),
+		HTTPClient:            api.DefaultHTTPClient,
+		quoteCh:               quoteCh,
+		errorCh:               errorCh,
+		API:                   helper,
+		exchangeName:          exchange.COINBASE,
+		orderBookMap:          make(exchange.OrderBookMap),
+		heartbeats:            make(map[string]HeartbeatResponse),
+		gaps:                  metrics.NewGapCounter(),
 	}
 }
 
@@ -46,58 +86,97 @@ func (c *Client) Start(ctx context.Context, productMap exchange.ProductMap, done
 	if err != nil {
 		return err
 	}
-	err = c.API.Connect(c.GetURL())
+	c.pairs = c.productMap.Tradable(c.pairs)
+	c.pool = api.NewPool(c.API, c.NewHelper, c.ChannelsPerConnection)
+	c.pairShards = make(map[string]*api.Shard)
+	err = c.pool.Connect(c.GetURL(), len(c.pairs))
 	if err != nil {
 		return err
 	}
-	err = c.API.SendSubscribeRequest(c.FormatSubscribeRequest())
-	if err != nil {
-		return err
+	for i, pairs := range c.pool.Split(c.pairs) {
+		shard := c.pool.Shard(i)
+		err = shard.SendSubscribeRequest(c.formatProductRequest("subscribe", pairs, "level2", "heartbeat"))
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			c.pairShards[pair] = shard
+		}
 	}
 	go c.StartTickerListener(ctx, doneCh)
 	return nil
 }
 
+// Name returns the name of the exchange
+func (c *Client) Name() string {
+	return c.exchangeName
+}
+
+// SubscribedPairs returns the pairs subscribed to. Only pairs listed by coinbase that are in the
+// product map are subscribed to
+func (c *Client) SubscribedPairs() []string {
+	return c.pairs
+}
+
 // FormatSubscribeRequest creates the type for a subscribe request
 func (c *Client) FormatSubscribeRequest() interface{} {
-	return &subscribeRequest{
-		Type:       "subscribe",
-		ProductIDs: c.pairs,
-		Channels: []struct {
-			Name       string   `json:"name"`
-			ProductIDs []string `json:"product_ids"`
-		}{
-			{
-				Name:       "level2",
-				ProductIDs: c.pairs,
-			},
-		},
-	}
+	return c.formatProductRequest("subscribe", c.pairs, "level2", "heartbeat")
 }
 
-// StartTickerListener starts a new goroutine to listen for new ticker messages
+// SequenceGaps returns the number of gaps detected per product
+func (c *Client) SequenceGaps() map[string]int {
+	return c.gaps.Counts()
+}
+
+// StartTickerListener starts a new goroutine to listen for new ticker messages. Every
+// connection is read from its own goroutine and doneCh is sent to once all of them are closed
 func (c *Client) StartTickerListener(ctx context.Context, doneCh chan<- struct{}) {
-cLoop:
+	conns := []api.WebSocketHelper{c.API}
+	if c.pool != nil {
+		conns = conns[:0]
+		for _, shard := range c.pool.Shards() {
+			conns = append(conns, shard)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn api.WebSocketHelper) {
+			defer wg.Done()
+			c.listen(ctx, conn)
+		}(conn)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		doneCh <- struct{}{}
+	}
+}
+
+// listen reads messages from a single connection until ctx is done or reading fails
+func (c *Client) listen(ctx context.Context, conn api.WebSocketHelper) {
 	for {
-		message, err := c.API.ReadMessage()
+		message, err := conn.ReadMessage()
 		if err != nil {
 			c.errorCh <- fmt.Errorf("Error reading from %s: %s", c.exchangeName, err)
 			return
 		}
+		receivedAt := time.Now()
 		select {
 		case <-ctx.Done():
-			err := c.API.Close()
+			err := conn.Close()
 			if err != nil {
 				c.errorCh <- fmt.Errorf("Error closing %s: %s", c.exchangeName, err)
 			}
-			doneCh <- struct{}{}
-			break cLoop
+			return
 		default:
+			c.parseMtx.Lock()
 			res, err := c.ParseTickerResponse(message)
+			c.parseMtx.Unlock()
 			if err != nil {
 				c.errorCh <- err
 			} else if len(res) > 0 {
 				if res[0].HePair != "" {
+					res[0].ReceivedAt = receivedAt
 					c.quoteCh <- res[0]
 				}
 			}
@@ -108,60 +187,42 @@ cLoop:
 // ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote
 func (c *Client) ParseTickerResponse(message []byte) ([]exchange.Quote, error) {
 	var quotes []exchange.Quote
-	// On snapshot response we store best bid and ask per pair
+	// On snapshot response we rebuild the full book per pair
 	if strings.Contains(string(message), "snapshot") {
 		var snapshotResponse SnapshotResponse
 		err := json.Unmarshal(message, &snapshotResponse)
 		if err != nil {
 			return []exchange.Quote{}, fmt.Errorf("Error unmarshalling snapshot response for %s", c.exchangeName)
 		}
-		// Initialize bids and asks stacks
-		if _, ok := c.orderBookMap[snapshotResponse.Pair]; !ok {
-			pair := c.orderBookMap[snapshotResponse.Pair]
-			pair.Bids = exchange.NewSpreadStack(orderBookLength, "bid")
-			pair.Asks = exchange.NewSpreadStack(orderBookLength, "ask")
-			c.orderBookMap[snapshotResponse.Pair] = pair
+		// A snapshot is sent again whenever the subscription is replayed after a reconnect or
+		// when we resync a single product so we always rebuild the book from scratch
+		book, ok := c.orderBookMap[snapshotResponse.Pair]
+		if !ok {
+			book = exchange.NewOrderBook(c.Depth)
+			c.orderBookMap[snapshotResponse.Pair] = book
 		}
-		// Initialize bid side
-		var length int
-		if len(snapshotResponse.Bids) >= orderBookLength {
-			length = orderBookLength
-		} else {
-			length = len(snapshotResponse.Bids)
+		book.Reset()
+		// Heartbeats missed before the snapshot are reflected in it
+		delete(c.heartbeats, snapshotResponse.Pair)
+		err = c.applyLevels(book, exchange.BIDS, snapshotResponse.Bids)
+		if err != nil {
+			return []exchange.Quote{}, err
 		}
-		for i := 0; i < length; i++ {
-			price, err := strconv.ParseFloat(snapshotResponse.Bids[i][0], 64)
-			if err != nil {
-				return []exchange.Quote{}, fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
-			}
-			size, err := strconv.ParseFloat(snapshotResponse.Bids[i][1], 64)
-			if err != nil {
-				return []exchange.Quote{}, fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
-			}
-			c.orderBookMap[snapshotResponse.Pair].Bids.Push(&exchange.SpreadNode{
-				Price: price,
-				Size:  size,
-			})
+		err = c.applyLevels(book, exchange.ASKS, snapshotResponse.Asks)
+		if err != nil {
+			return []exchange.Quote{}, err
 		}
-		if len(snapshotResponse.Asks) >= orderBookLength {
-			length = orderBookLength
-		} else {
-			length = len(snapshotResponse.Asks)
+	} else if strings.Contains(string(message), `"heartbeat"`) {
+		var response HeartbeatResponse
+		err := json.Unmarshal(message, &response)
+		if err != nil {
+			return []exchange.Quote{}, fmt.Errorf("Error unmarshalling heartbeat response for %s", c.exchangeName)
 		}
-		for i := 0; i < length; i++ {
-			price, err := strconv.ParseFloat(snapshotResponse.Asks[i][0], 64)
-			if err != nil {
-				return []exchange.Quote{}, fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
-			}
-			size, err := strconv.ParseFloat(snapshotResponse.Asks[i][1], 64)
-			if err != nil {
-				return []exchange.Quote{}, fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
-			}
-			c.orderBookMap[snapshotResponse.Pair].Asks.Push(&exchange.SpreadNode{
-				Price: price,
-				Size:  size,
-			})
+		// Subscription confirmations list the heartbeat channel too
+		if response.Type != "heartbeat" {
+			return quotes, nil
 		}
+		return quotes, c.checkHeartbeat(response)
 	} else if strings.Contains(string(message), "l2update") {
 		var response LevelTwoResponse
 		err := json.Unmarshal(message, &response)
@@ -172,97 +233,181 @@ func (c *Client) ParseTickerResponse(message []byte) ([]exchange.Quote, error) {
 		if response.Pair == "" {
 			return []exchange.Quote{}, nil
 		}
+		// Suppress quotes while the book is waiting on a new snapshot. Any update dropped here
+		// is reflected in that snapshot
+		book, ok := c.orderBookMap[response.Pair]
+		if !ok || book.Invalid {
+			return []exchange.Quote{}, nil
+		}
+		cachedBestBid, _ := book.Bids.Best()
+		cachedBestAsk, _ := book.Asks.Best()
 		for _, val := range response.Changes {
-			price, err := strconv.ParseFloat(val[1], 64)
+			if len(val) < 3 {
+				return []exchange.Quote{}, fmt.Errorf("Error parsing order book level from %s: %v", c.exchangeName, val)
+			}
+			price, err := decimal.Parse(val[1])
 			if err != nil {
 				return []exchange.Quote{}, fmt.Errorf("Error reading new quote from %s", c.exchangeName)
 			}
-			size, err := strconv.ParseFloat(val[2], 64)
+			size, err := decimal.Parse(val[2])
 			if err != nil {
 				return []exchange.Quote{}, fmt.Errorf("Error reading new quote from %s", c.exchangeName)
 			}
-			// TODO: orderbook is empty. We need to unsubscribe than resubscribe
-			if len(c.orderBookMap[response.Pair].Bids.Nodes) == 0 || len(c.orderBookMap[response.Pair].Asks.Nodes) == 0 {
-				log.Fatalf("Orderbook on %s is empty for %s\n", c.exchangeName, response.Pair)
-				return []exchange.Quote{}, nil
-			}
-			cachedBestBid := c.orderBookMap[response.Pair].Bids.Nodes[0].Price
-			cachedBestAsk := c.orderBookMap[response.Pair].Asks.Nodes[0].Price
-			buySide := c.orderBookMap[response.Pair].Bids
-			sellSide := c.orderBookMap[response.Pair].Asks
 			if val[0] == "buy" {
-				if size == 0 {
-					// If size is 0 we remove it
-					buySide.Pop(price)
-				} else if price > buySide.Nodes[len(buySide.Nodes)-1].Price && size > 0 {
-					// If on the buy side, the price is greater than the last node, and the size isn't 0, we add
-					buySide.Push(&exchange.SpreadNode{
-						Price: price,
-						Size:  size,
-					})
-				} else if len(buySide.Nodes) == 0 {
-					// If nothing left in the book, we gotta add one price
-					// TODO: unsubscribe and resubscribe
-					buySide.Push(&exchange.SpreadNode{
-						Price: price,
-						Size:  size,
-					})
-				}
+				book.Update(exchange.BIDS, price, size)
 			} else if val[0] == "sell" {
-				if size == 0 {
-					// If size is 0 we remove it
-					sellSide.Pop(price)
-				} else if price < sellSide.Nodes[len(sellSide.Nodes)-1].Price && size > 0 {
-					// If on the buy side, the price is greater than the last node, and the size isn't 0, we add
-					sellSide.Push(&exchange.SpreadNode{
-						Price: price,
-						Size:  size,
-					})
-				} else if len(sellSide.Nodes) == 0 {
-					// If nothing left in the book, we gotta add one price
-					// TODO: unsubscribe and resubscribe
-					sellSide.Push(&exchange.SpreadNode{
-						Price: price,
-						Size:  size,
-					})
-				}
-			}
-			// TODO: orderbook is empty. We need to unsubscribe than resubscribe
-			if len(c.orderBookMap[response.Pair].Bids.Nodes) == 0 || len(c.orderBookMap[response.Pair].Asks.Nodes) == 0 {
-				log.Fatalf("Orderbook on %s is empty for %s\n", c.exchangeName, response.Pair)
-				return []exchange.Quote{}, nil
-			}
-			if c.orderBookMap[response.Pair].Bids.Nodes[0].Price > cachedBestBid ||
-				c.orderBookMap[response.Pair].Asks.Nodes[0].Price < cachedBestAsk {
-
-				product := c.productMap[response.Pair]
-				quotes = append(quotes, exchange.Quote{
-					Exchange: c.exchangeName,
-					// TODO: remove the string conversion
-					Bid:     fmt.Sprintf("%8.8f", c.orderBookMap[response.Pair].Bids.Nodes[0].Price),
-					Ask:     fmt.Sprintf("%8.8f", c.orderBookMap[response.Pair].Asks.Nodes[0].Price),
-					ExPair:  product.ExPair,
-					HePair:  product.HePair,
-					ExBase:  product.ExBase,
-					HeBase:  product.HeBase,
-					ExQuote: product.ExQuote,
-					HeQuote: product.HeQuote,
-				})
+				book.Update(exchange.ASKS, price, size)
 			}
 		}
+		// If a side of the book is empty we can't trust it anymore so we rebuild it
+		if book.Empty() {
+			return quotes, c.resync(response.Pair)
+		}
+		bestBid, _ := book.Bids.Best()
+		bestAsk, _ := book.Asks.Best()
+		if bestBid != cachedBestBid || bestAsk != cachedBestAsk {
+			product := c.productMap[response.Pair]
+			quotes = append(quotes, exchange.Quote{
+				Exchange: c.exchangeName,
+				Bid:      bestBid.Price,
+				Ask:      bestAsk.Price,
+				BidSize:  bestBid.Size,
+				AskSize:  bestAsk.Size,
+				ExPair:   product.ExPair,
+				HePair:   product.HePair,
+				ExBase:   product.ExBase,
+				HeBase:   product.HeBase,
+				ExQuote:  product.ExQuote,
+				HeQuote:  product.HeQuote,
+				// Snapshots don't carry a time so only updates have one
+				ExchangeTime: response.Time,
+			})
+		}
 	}
 	return quotes, nil
 }
 
+// applyLevels inserts every price and size pair from a snapshot into a side of the book
+func (c *Client) applyLevels(book *exchange.OrderBook, side int, levels [][]string) error {
+	for _, val := range levels {
+		if len(val) < 2 {
+			return fmt.Errorf("Error parsing order book level from %s: %v", c.exchangeName, val)
+		}
+		price, err := decimal.Parse(val[0])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
+		}
+		size, err := decimal.Parse(val[1])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s", c.exchangeName)
+		}
+		book.Update(side, price, size)
+	}
+	return nil
+}
+
+// OrderBook returns the order book maintained for a pair or nil if we haven't received a
+// snapshot for it
+func (c *Client) OrderBook(pair string) *exchange.OrderBook {
+	return c.orderBookMap[pair]
+}
+
+// resync marks the order book for a pair as invalid and resubscribes to the level2 channel
+// for just that product. Coinbase answers with a new snapshot which rebuilds the book.
+// Other products on the connection are unaffected.
+func (c *Client) resync(pair string) error {
+	book := c.orderBookMap[pair]
+	if book.Invalid {
+		return nil
+	}
+	book.Invalid = true
+	log.Printf("Orderbook on %s is empty for %s. Resyncing\n", c.exchangeName, pair)
+
+	// These aren't sent with SendSubscribeRequest since the original subscription already
+	// covers this product if the connection has to be replayed
+	for _, reqType := range []string{"unsubscribe", "subscribe"} {
+		payload, err := json.Marshal(c.formatProductRequest(reqType, []string{pair}, "level2"))
+		if err != nil {
+			return fmt.Errorf("Error marshalling %s request for %s on %s: %s", reqType, pair, c.exchangeName, err)
+		}
+		err = c.connection(pair).WriteMessage(payload)
+		if err != nil {
+			return fmt.Errorf("Error sending %s request for %s on %s: %s", reqType, pair, c.exchangeName, err)
+		}
+	}
+	return nil
+}
+
+// checkHeartbeat compares a heartbeat with the previous one of its product. Level2 messages
+// don't carry sequence numbers but heartbeats do and are sent once a second on the same
+// connection, so a sequence going backwards or a missed heartbeat means messages were lost
+// and the book is resynced
+func (c *Client) checkHeartbeat(heartbeat HeartbeatResponse) error {
+	last, ok := c.heartbeats[heartbeat.Pair]
+	c.heartbeats[heartbeat.Pair] = heartbeat
+	if !ok {
+		return nil
+	}
+	if heartbeat.Sequence >= last.Sequence && heartbeat.Time.Sub(last.Time) < 2*heartbeatInterval {
+		return nil
+	}
+	log.Printf("Sequence gap on %s for %s after sequence %d\n", c.exchangeName, heartbeat.Pair, last.Sequence)
+	c.gaps.Record(heartbeat.Pair)
+	if _, ok := c.orderBookMap[heartbeat.Pair]; !ok {
+		return nil
+	}
+	return c.resync(heartbeat.Pair)
+}
+
+// connection returns the connection a product is subscribed on
+func (c *Client) connection(pair string) api.WebSocketHelper {
+	if shard, ok := c.pairShards[pair]; ok {
+		return shard
+	}
+	return c.API
+}
+
+// formatProductRequest creates a subscribe or unsubscribe request for channels of products
+func (c *Client) formatProductRequest(reqType string, pairs []string, channels ...string) interface{} {
+	req := &subscribeRequest{
+		Type:       reqType,
+		ProductIDs: pairs,
+	}
+	for _, name := range channels {
+		req.Channels = append(req.Channels, struct {
+			Name       string   `json:"name"`
+			ProductIDs []string `json:"product_ids"`
+		}{
+			Name:       name,
+			ProductIDs: pairs,
+		})
+	}
+	return req
+}
+
 // GetURL returns the url for the websocket connection
 func (c *Client) GetURL() *url.URL {
+	if c.WSURL != nil {
+		u := *c.WSURL
+		return &u
+	}
 	return &url.URL{Scheme: "wss", Host: "ws-feed.pro.coinbase.com"}
 }
 
+// GetRESTURL returns the base url for the REST api
+func (c *Client) GetRESTURL() *url.URL {
+	if c.RESTURL != nil {
+		u := *c.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.pro.coinbase.com"}
+}
+
 // GetPairs returns all pairs for an exchange
 func (c *Client) GetPairs() error {
-	u := url.URL{Scheme: "https", Host: "api.pro.coinbase.com", Path: "/products"}
-	res, err := http.Get(u.String())
+	u := c.GetRESTURL()
+	u.Path = "/products"
+	res, err := c.HTTPClient.Get(u.String())
 	if err != nil {
 		return err
 	}
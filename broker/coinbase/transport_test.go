@@ -1,12 +1,17 @@
 package coinbase_test
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kaplanmaxe/helgart/broker/coinbase"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
 	"github.com/kaplanmaxe/helgart/broker/mock"
 )
@@ -23,9 +28,15 @@ func TestStart(t *testing.T) {
 	ctx := context.TODO()
 
 	client := coinbase.NewClient(mock.NewConnector(ignoreFunc), quoteCh, errorCh)
+	server, restURL := mock.NewRESTServer(`[{"id":"MOCK-USD","base_currency":"MOCK","quote_currency":"USD"}]`)
+	defer server.Close()
+	client.RESTURL = restURL
 	productMap := mock.MakeMockProductMap()
 	doneCh := make(chan struct{}, 1)
-	client.Start(ctx, productMap, doneCh)
+	err := client.Start(ctx, productMap, doneCh)
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
 	snapshotResponse := &coinbase.SnapshotResponse{
 		Type: "snapshot",
 		Pair: "MOCK-USD",
@@ -61,7 +72,7 @@ listener:
 	for {
 		select {
 		case quote := <-quoteCh:
-			if mockResponse.Pair != quote.HePair || mockResponse.Changes[0][1] != quote.Bid {
+			if mockResponse.Pair != quote.HePair || decimal.MustParse(mockResponse.Changes[0][1]) != quote.Bid {
 				t.Fatalf("Expecting response %#v but got %#v", mockResponse, quote)
 			}
 			break listener
@@ -73,3 +84,198 @@ listener:
 	}
 	client.API.Close()
 }
+
+func parse(t *testing.T, client *coinbase.Client, res interface{}) []exchange.Quote {
+	msg, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("Error marshalling json: %s", err)
+	}
+	quotes, err := client.ParseTickerResponse(msg)
+	if err != nil {
+		t.Fatalf("Error parsing response: %s", err)
+	}
+	return quotes
+}
+
+func TestShortLevels(t *testing.T) {
+	client := coinbase.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	msg, _ := json.Marshal(&coinbase.SnapshotResponse{
+		Type: "snapshot",
+		Pair: "MOCK-USD",
+		Bids: [][]string{{"99"}},
+		Asks: [][]string{{"101", "2"}},
+	})
+	if _, err := client.ParseTickerResponse(msg); err == nil {
+		t.Error("Expected an error for a snapshot level without a size")
+	}
+	parse(t, client, &coinbase.SnapshotResponse{
+		Type: "snapshot",
+		Pair: "MOCK-USD",
+		Bids: [][]string{{"99", "1"}},
+		Asks: [][]string{{"101", "2"}},
+	})
+	msg, _ = json.Marshal(&coinbase.LevelTwoResponse{
+		Type:    "l2update",
+		Pair:    "MOCK-USD",
+		Changes: [][]string{{"buy", "100"}},
+	})
+	if _, err := client.ParseTickerResponse(msg); err == nil {
+		t.Error("Expected an error for an update without a size")
+	}
+}
+
+func TestResync(t *testing.T) {
+	connector := mock.NewRecordingConnector()
+	client := coinbase.NewClient(connector, make(chan exchange.Quote), make(chan error, 1))
+	for _, pair := range []string{"MOCK-USD", "MOCK-EUR"} {
+		parse(t, client, &coinbase.SnapshotResponse{
+			Type: "snapshot",
+			Pair: pair,
+			Bids: [][]string{{"99", "1"}},
+			Asks: [][]string{{"101", "2"}},
+		})
+	}
+
+	// Removing the only bid empties the book which should resync instead of exiting
+	quotes := parse(t, client, &coinbase.LevelTwoResponse{
+		Type:    "l2update",
+		Pair:    "MOCK-USD",
+		Changes: [][]string{{"buy", "99", "0"}},
+	})
+	if len(quotes) != 0 {
+		t.Errorf("Expected no quotes for an empty book but got %#v", quotes)
+	}
+	expected := []string{
+		`{"type":"unsubscribe","product_ids":["MOCK-USD"],"channels":[{"name":"level2","product_ids":["MOCK-USD"]}]}`,
+		`{"type":"subscribe","product_ids":["MOCK-USD"],"channels":[{"name":"level2","product_ids":["MOCK-USD"]}]}`,
+	}
+	messages := connector.Messages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages to be sent but got %#v", len(expected), messages)
+	}
+	for key, val := range expected {
+		if messages[key] != val {
+			t.Errorf("Expected message %s but got %s", val, messages[key])
+		}
+	}
+
+	// Quotes are suppressed for the pair while it is rebuilding
+	quotes = parse(t, client, &coinbase.LevelTwoResponse{
+		Type:    "l2update",
+		Pair:    "MOCK-USD",
+		Changes: [][]string{{"sell", "100", "1"}},
+	})
+	if len(quotes) != 0 {
+		t.Errorf("Expected quotes to be suppressed while resyncing but got %#v", quotes)
+	}
+	if len(connector.Messages()) != len(expected) {
+		t.Errorf("Expected resync to only be requested once but got %#v", connector.Messages())
+	}
+
+	// Other pairs keep flowing
+	quotes = parse(t, client, &coinbase.LevelTwoResponse{
+		Type:    "l2update",
+		Pair:    "MOCK-EUR",
+		Changes: [][]string{{"buy", "100", "1"}},
+	})
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("100.00000000") {
+		t.Errorf("Expected a new quote for MOCK-EUR but got %#v", quotes)
+	}
+
+	// A new snapshot rebuilds the book
+	parse(t, client, &coinbase.SnapshotResponse{
+		Type: "snapshot",
+		Pair: "MOCK-USD",
+		Bids: [][]string{{"98", "1"}},
+		Asks: [][]string{{"101", "2"}},
+	})
+	quotes = parse(t, client, &coinbase.LevelTwoResponse{
+		Type:    "l2update",
+		Pair:    "MOCK-USD",
+		Changes: [][]string{{"buy", "99", "1"}},
+	})
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("99.00000000") {
+		t.Errorf("Expected a new quote for MOCK-USD after resync but got %#v", quotes)
+	}
+}
+
+// TestLevelTwoReplay replays a recorded snapshot and stream of updates and compares the
+// resulting book against a snapshot taken at the end of the stream
+func TestLevelTwoReplay(t *testing.T) {
+	client := coinbase.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	f, err := os.Open("testdata/level2_updates.jsonl")
+	if err != nil {
+		t.Fatalf("Error opening fixture: %s", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		_, err := client.ParseTickerResponse(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("Error parsing response: %s", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Error reading fixture: %s", err)
+	}
+
+	snapshot, err := ioutil.ReadFile("testdata/level2_snapshot.json")
+	if err != nil {
+		t.Fatalf("Error opening fixture: %s", err)
+	}
+	fresh := coinbase.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	_, err = fresh.ParseTickerResponse(snapshot)
+	if err != nil {
+		t.Fatalf("Error parsing snapshot: %s", err)
+	}
+
+	book := client.OrderBook("BTC-USD")
+	if book == nil {
+		t.Fatal("Expected an order book for BTC-USD")
+	}
+	err = book.Verify(fresh.OrderBook("BTC-USD"))
+	if err != nil {
+		t.Errorf("Book diverged from snapshot: %s", err)
+	}
+}
+
+func TestHeartbeatGap(t *testing.T) {
+	connector := mock.NewRecordingConnector()
+	client := coinbase.NewClient(connector, make(chan exchange.Quote), make(chan error, 1))
+	parse(t, client, &coinbase.SnapshotResponse{
+		Type: "snapshot",
+		Pair: "MOCK-USD",
+		Bids: [][]string{{"99", "1"}},
+		Asks: [][]string{{"101", "2"}},
+	})
+	start := time.Date(2019, 5, 7, 13, 9, 7, 0, time.UTC)
+	heartbeats := []*coinbase.HeartbeatResponse{
+		{Type: "heartbeat", Pair: "MOCK-USD", Sequence: 90, Time: start},
+		{Type: "heartbeat", Pair: "MOCK-USD", Sequence: 95, Time: start.Add(time.Second)},
+		// A heartbeat for a product without a book is counted but doesn't resync
+		{Type: "heartbeat", Pair: "MOCK-EUR", Sequence: 10, Time: start},
+		{Type: "heartbeat", Pair: "MOCK-EUR", Sequence: 5, Time: start.Add(time.Second)},
+	}
+	for _, heartbeat := range heartbeats {
+		parse(t, client, heartbeat)
+	}
+	if gaps := client.SequenceGaps(); len(gaps) != 1 || gaps["MOCK-EUR"] != 1 {
+		t.Errorf("Expected a gap for MOCK-EUR only but got %v", gaps)
+	}
+	if messages := connector.Messages(); len(messages) != 0 {
+		t.Fatalf("Expected no resync without a gap in a book but got %#v", messages)
+	}
+
+	// Missing the heartbeats in between means level2 messages were probably lost too
+	parse(t, client, &coinbase.HeartbeatResponse{Type: "heartbeat", Pair: "MOCK-USD", Sequence: 120, Time: start.Add(4 * time.Second)})
+	if gaps := client.SequenceGaps(); gaps["MOCK-USD"] != 1 {
+		t.Errorf("Expected a gap for MOCK-USD but got %v", gaps)
+	}
+	if messages := connector.Messages(); len(messages) != 2 || !strings.Contains(messages[1], `"subscribe"`) {
+		t.Errorf("Expected the book to be resynced but got %#v", messages)
+	}
+	if book := client.OrderBook("MOCK-USD"); !book.Invalid {
+		t.Error("Expected the book to wait for a new snapshot")
+	}
+}
@@ -1,5 +1,11 @@
 package coinbase
 
+import (
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
 // {
 //     "type": "subscribe",
 //     "product_ids": [
@@ -46,9 +52,9 @@ type subscribeRequest struct {
 // 	"last_size":"19.17919361"
 // }
 type TickerResponse struct {
-	Pair string `json:"product_id"`
-	Ask  string `json:"best_ask"`
-	Bid  string `json:"best_bid"`
+	Pair string          `json:"product_id"`
+	Ask  decimal.Decimal `json:"best_ask"`
+	Bid  decimal.Decimal `json:"best_bid"`
 }
 
 // SnapshotResponse is the intial response coinbase sends to you on the level2 channel
@@ -65,6 +71,33 @@ type LevelTwoResponse struct {
 	Type    string     `json:"type"`
 	Pair    string     `json:"product_id"`
 	Changes [][]string `json:"changes"`
+	Time    time.Time  `json:"time"`
+}
+
+// HeartbeatResponse is sent once a second for every product on the heartbeat channel. Sequence
+// is the sequence number of the last message of the product
+// {
+// 	"type": "heartbeat",
+// 	"sequence": 90,
+// 	"last_trade_id": 20,
+// 	"product_id": "BTC-USD",
+// 	"time": "2014-11-07T08:19:28.464459Z"
+// }
+type HeartbeatResponse struct {
+	Type        string    `json:"type"`
+	Sequence    int64     `json:"sequence"`
+	LastTradeID int64     `json:"last_trade_id"`
+	Pair        string    `json:"product_id"`
+	Time        time.Time `json:"time"`
+}
+
+// RESTBook is the top of the book of a product from the REST api. Levels are price, size and
+// number of orders
+// {"sequence":3,"bids":[["295.96","4.39088265",2]],"asks":[["295.97","25.23542881",12]]}
+type RESTBook struct {
+	Sequence int64               `json:"sequence"`
+	Bids     [][]decimal.Decimal `json:"bids"`
+	Asks     [][]decimal.Decimal `json:"asks"`
 }
 
 type productsResponse struct {
@@ -14,6 +14,50 @@ CREATE TABLE IF NOT EXISTS products (
     PRIMARY KEY(id)
 );
 
+CREATE TABLE IF NOT EXISTS fees (
+    exchange varchar(50) not null,
+    he_pair varchar(20) not null default '',
+    tier varchar(20) not null default '',
+    taker decimal(36,18) not null,
+    PRIMARY KEY(exchange, he_pair, tier)
+);
+
+CREATE TABLE IF NOT EXISTS paper_fills (
+    id bigint(20) not null AUTO_INCREMENT,
+    filled_at datetime(6) not null,
+    he_base varchar(10) not null,
+    spread decimal(36,18) not null,
+    quantity decimal(36,18) not null,
+    buy_exchange varchar(50) not null,
+    buy_pair varchar(20) not null,
+    buy_price decimal(36,18) not null,
+    buy_fee decimal(36,18) not null,
+    sell_exchange varchar(50) not null,
+    sell_pair varchar(20) not null,
+    sell_price decimal(36,18) not null,
+    sell_fee decimal(36,18) not null,
+    fees_usd decimal(36,18) not null,
+    pnl decimal(36,18) not null,
+    PRIMARY KEY(id),
+    KEY(he_base, filled_at)
+);
+
+CREATE TABLE IF NOT EXISTS paper_balances (
+    exchange varchar(50) not null,
+    asset varchar(10) not null,
+    amount decimal(36,18) not null,
+    PRIMARY KEY(exchange, asset)
+);
+
+CREATE TABLE IF NOT EXISTS inventory_holdings (
+    exchange varchar(50) not null,
+    asset varchar(10) not null,
+    free decimal(36,18) not null,
+    locked decimal(36,18) not null,
+    updated_at datetime(6) not null,
+    PRIMARY KEY(exchange, asset)
+);
+
 -- SELECT 
 --     ex_pair, 
 --     COUNT(ex_pair)
@@ -0,0 +1,451 @@
+// Package decimal provides an exact base 10 number type for prices and sizes. Exchanges send
+// prices as decimal strings that float64 can't always represent, so comparing, summing or
+// using them as map keys as floats drifts
+package decimal
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// DivisionPrecision is the number of decimal places quotients are rounded to by Div
+const DivisionPrecision = 16
+
+// maxDigits is the number of digits that always fit in the coefficient
+const maxDigits = 18
+
+// Decimal is the exact number coef * 10^exp. Values are kept normalized without trailing zeros
+// in the coefficient so equal numbers compare equal with == and can be used as map keys. Up to
+// 18 significant digits are kept exactly, more are rounded. The zero value is 0
+type Decimal struct {
+	coef int64
+	exp  int32
+}
+
+var pow10 = [maxDigits + 1]int64{
+	1, 10, 100, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18,
+}
+
+var (
+	bigTen     = big.NewInt(10)
+	bigMaxCoef = big.NewInt(math.MaxInt64)
+)
+
+// New returns the decimal coef * 10^exp, ex: New(127, -2) is 1.27
+func New(coef int64, exp int32) Decimal {
+	if coef == math.MinInt64 {
+		return fromBig(big.NewInt(coef), exp)
+	}
+	return normalize(coef, exp)
+}
+
+// NewFromInt returns the decimal of an integer
+func NewFromInt(i int64) Decimal {
+	return New(i, 0)
+}
+
+// NewFromFloat returns the decimal with the shortest representation of a float, ex: 0.1 is
+// exactly 0.1. NaN and infinities return 0
+func NewFromFloat(f float64) Decimal {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Decimal{}
+	}
+	d, _ := Parse(strconv.FormatFloat(f, 'g', -1, 64))
+	return d
+}
+
+// Parse parses a decimal string with an optional sign, fraction and exponent, ex: "8000.10",
+// "-0.5" or "1.2e-7"
+func Parse(s string) (Decimal, error) {
+	raw := s
+	var exp int64
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, fmt.Errorf("Can't parse %q as a decimal", raw)
+		}
+		exp = e
+		s = s[:i]
+	}
+	neg := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	digits := intPart + fracPart
+	if digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("Can't parse %q as a decimal", raw)
+	}
+	exp -= int64(len(fracPart))
+	digits = strings.TrimLeft(digits, "0")
+	trimmed := strings.TrimRight(digits, "0")
+	exp += int64(len(digits) - len(trimmed))
+	if trimmed == "" {
+		return Decimal{}, nil
+	}
+	if exp > math.MaxInt32 || exp < math.MinInt32 {
+		return Decimal{}, fmt.Errorf("Exponent of %q is out of range", raw)
+	}
+	if len(trimmed) <= maxDigits {
+		coef, _ := strconv.ParseInt(trimmed, 10, 64)
+		if neg {
+			coef = -coef
+		}
+		return Decimal{coef: coef, exp: int32(exp)}, nil
+	}
+	coef, _ := new(big.Int).SetString(trimmed, 10)
+	if neg {
+		coef.Neg(coef)
+	}
+	return fromBig(coef, int32(exp)), nil
+}
+
+// MustParse is like Parse but panics if the string can't be parsed. It's meant for constants
+// and tests
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Option is a named decimal setting parsed into Dest, ex: an option of the config file or a
+// flag
+type Option struct {
+	Name  string
+	Value string
+	Dest  *Decimal
+}
+
+// ParseOptions parses the value of every option into its destination. Options without a value
+// keep their destination
+func ParseOptions(options ...Option) error {
+	for _, option := range options {
+		if option.Value == "" {
+			continue
+		}
+		d, err := Parse(option.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %s", option.Name, err)
+		}
+		*option.Dest = d
+	}
+	return nil
+}
+
+// normalize strips trailing zeros from the coefficient
+func normalize(coef int64, exp int32) Decimal {
+	if coef == 0 {
+		return Decimal{}
+	}
+	for coef%10 == 0 {
+		coef /= 10
+		exp++
+	}
+	return Decimal{coef: coef, exp: exp}
+}
+
+// fromBig returns the decimal of a big coefficient, rounding off the least significant digits
+// until it fits
+func fromBig(coef *big.Int, exp int32) Decimal {
+	if coef.CmpAbs(bigMaxCoef) <= 0 {
+		return normalize(coef.Int64(), exp)
+	}
+	c := new(big.Int).Set(coef)
+	for c.CmpAbs(bigMaxCoef) > 0 {
+		c = roundQuoBig(c, bigTen)
+		exp++
+	}
+	return normalize(c.Int64(), exp)
+}
+
+// roundQuoBig returns a / b rounded half away from zero
+func roundQuoBig(a, b *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	r.Abs(r).Lsh(r, 1)
+	if r.CmpAbs(b) >= 0 {
+		if a.Sign()*b.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// pow10Big returns 10^n as a big.Int
+func pow10Big(n int32) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// scale returns coef * 10^n and false if it overflows
+func scale(coef int64, n int32) (int64, bool) {
+	if n > maxDigits {
+		return 0, false
+	}
+	p := pow10[n]
+	if coef > math.MaxInt64/p || coef < -math.MaxInt64/p {
+		return 0, false
+	}
+	return coef * p, true
+}
+
+// big returns the coefficient as a big.Int
+func (d Decimal) big() *big.Int {
+	return big.NewInt(d.coef)
+}
+
+// Add returns d + d2
+func (d Decimal) Add(d2 Decimal) Decimal {
+	if d.coef == 0 {
+		return d2
+	}
+	if d2.coef == 0 {
+		return d
+	}
+	// Align on the smaller exponent
+	a, b := d, d2
+	if a.exp < b.exp {
+		a, b = b, a
+	}
+	if coef, ok := scale(a.coef, a.exp-b.exp); ok {
+		sum := coef + b.coef
+		// Overflow flips the sign of the sum
+		if (sum > coef) == (b.coef > 0) && sum != math.MinInt64 {
+			return normalize(sum, b.exp)
+		}
+	}
+	sum := new(big.Int).Mul(a.big(), pow10Big(a.exp-b.exp))
+	return fromBig(sum.Add(sum, b.big()), b.exp)
+}
+
+// Sub returns d - d2
+func (d Decimal) Sub(d2 Decimal) Decimal {
+	return d.Add(d2.Neg())
+}
+
+// Mul returns d * d2
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	if d.coef == 0 || d2.coef == 0 {
+		return Decimal{}
+	}
+	hi, lo := bits.Mul64(uint64(abs(d.coef)), uint64(abs(d2.coef)))
+	if hi == 0 && lo <= math.MaxInt64 {
+		coef := int64(lo)
+		if (d.coef < 0) != (d2.coef < 0) {
+			coef = -coef
+		}
+		return normalize(coef, d.exp+d2.exp)
+	}
+	return fromBig(new(big.Int).Mul(d.big(), d2.big()), d.exp+d2.exp)
+}
+
+// Div returns d / d2 rounded to DivisionPrecision decimal places. It panics if d2 is 0
+func (d Decimal) Div(d2 Decimal) Decimal {
+	return d.DivRound(d2, DivisionPrecision)
+}
+
+// DivRound returns d / d2 rounded half away from zero to places decimal places. It panics if
+// d2 is 0
+func (d Decimal) DivRound(d2 Decimal, places int32) Decimal {
+	if d2.coef == 0 {
+		panic("decimal: division by zero")
+	}
+	if d.coef == 0 {
+		return Decimal{}
+	}
+	// d / d2 * 10^places = d.coef * 10^n / d2.coef
+	num, den := d.big(), d2.big()
+	if n := d.exp - d2.exp + places; n >= 0 {
+		num.Mul(num, pow10Big(n))
+	} else {
+		den.Mul(den, pow10Big(-n))
+	}
+	return fromBig(roundQuoBig(num, den), -places)
+}
+
+// Floor returns d rounded down to places decimal places, so an amount rounded with it never
+// exceeds the amount
+func (d Decimal) Floor(places int32) Decimal {
+	rounded := d.Round(places)
+	if rounded.GreaterThan(d) {
+		rounded = rounded.Sub(New(1, -places))
+	}
+	return rounded
+}
+
+// Round returns d rounded half away from zero to places decimal places
+func (d Decimal) Round(places int32) Decimal {
+	if d.exp >= -places {
+		return d
+	}
+	n := -places - d.exp
+	if n > maxDigits {
+		return fromBig(roundQuoBig(d.big(), pow10Big(n)), -places)
+	}
+	p := pow10[n]
+	q, r := d.coef/p, d.coef%p
+	if abs(r)*2 >= p {
+		if d.coef < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+	return normalize(q, -places)
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: -d.coef, exp: d.exp}
+}
+
+// Abs returns the absolute value of d
+func (d Decimal) Abs() Decimal {
+	return Decimal{coef: abs(d.coef), exp: d.exp}
+}
+
+// Sign returns -1, 0 or 1 if d is negative, zero or positive
+func (d Decimal) Sign() int {
+	switch {
+	case d.coef < 0:
+		return -1
+	case d.coef > 0:
+		return 1
+	}
+	return 0
+}
+
+// IsZero returns true if d is 0
+func (d Decimal) IsZero() bool {
+	return d.coef == 0
+}
+
+// Cmp returns -1, 0 or 1 if d is less than, equal to or greater than d2
+func (d Decimal) Cmp(d2 Decimal) int {
+	if d.exp == d2.exp {
+		switch {
+		case d.coef < d2.coef:
+			return -1
+		case d.coef > d2.coef:
+			return 1
+		}
+		return 0
+	}
+	return d.Sub(d2).Sign()
+}
+
+// LessThan returns true if d < d2
+func (d Decimal) LessThan(d2 Decimal) bool {
+	return d.Cmp(d2) < 0
+}
+
+// GreaterThan returns true if d > d2
+func (d Decimal) GreaterThan(d2 Decimal) bool {
+	return d.Cmp(d2) > 0
+}
+
+// Min returns the smaller of a and b
+func Min(a, b Decimal) Decimal {
+	if b.LessThan(a) {
+		return b
+	}
+	return a
+}
+
+// Max returns the larger of a and b
+func Max(a, b Decimal) Decimal {
+	if b.GreaterThan(a) {
+		return b
+	}
+	return a
+}
+
+// Float64 returns the float closest to d
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatInt(d.coef, 10)+"e"+strconv.Itoa(int(d.exp)), 64)
+	return f
+}
+
+// String returns d without exponent and trailing zeros, ex: "0.00000012"
+func (d Decimal) String() string {
+	if d.exp >= 0 {
+		if d.coef == 0 {
+			return "0"
+		}
+		return strconv.FormatInt(d.coef, 10) + strings.Repeat("0", int(d.exp))
+	}
+	digits := strconv.FormatInt(abs(d.coef), 10)
+	places := int(-d.exp)
+	if len(digits) <= places {
+		digits = strings.Repeat("0", places-len(digits)+1) + digits
+	}
+	s := digits[:len(digits)-places] + "." + digits[len(digits)-places:]
+	if d.coef < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+// StringFixed returns d rounded to places decimal places and padded with zeros, ex:
+// StringFixed(8) formats 8000.1 as "8000.10000000"
+func (d Decimal) StringFixed(places int32) string {
+	rounded := d.Round(places)
+	s := rounded.String()
+	if places <= 0 {
+		return s
+	}
+	decimals := int32(0)
+	if rounded.exp < 0 {
+		decimals = -rounded.exp
+	} else {
+		s += "."
+	}
+	return s + strings.Repeat("0", int(places-decimals))
+}
+
+// MarshalJSON marshals d as a string so it doesn't lose precision in clients
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.String() + `"`), nil
+}
+
+// UnmarshalJSON unmarshals a decimal from a json number or string. null and empty strings
+// are 0
+func (d *Decimal) UnmarshalJSON(msg []byte) error {
+	s := string(msg)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	if s == "" {
+		*d = Decimal{}
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func abs(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
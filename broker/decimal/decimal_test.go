@@ -0,0 +1,141 @@
+package decimal_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"8000.10", "8000.1"},
+		{"0.00000012", "0.00000012"},
+		{"-0.5", "-0.5"},
+		{"+12", "12"},
+		{"1.2e-7", "0.00000012"},
+		{"1E3", "1000"},
+		{"000.000", "0"},
+		{".5", "0.5"},
+		{"12345678901234567890123", "12345678901234567890000"},
+	}
+	for _, test := range tests {
+		d, err := decimal.Parse(test.input)
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", test.input, err)
+			continue
+		}
+		if d.String() != test.expected {
+			t.Errorf("Expected %s to parse as %s but got %s", test.input, test.expected, d)
+		}
+	}
+	for _, input := range []string{"", "-", ".", "1.2.3", "abc", "1e", "0x10"} {
+		if _, err := decimal.Parse(input); err == nil {
+			t.Errorf("Expected an error parsing %q", input)
+		}
+	}
+}
+
+func TestEquality(t *testing.T) {
+	if decimal.MustParse("0.10") != decimal.MustParse("0.1000") {
+		t.Error("Expected equal values with different trailing zeros to be ==")
+	}
+	prices := map[decimal.Decimal]struct{}{decimal.MustParse("8000.10"): {}}
+	if _, ok := prices[decimal.MustParse("8000.1")]; !ok {
+		t.Error("Expected decimals to be usable as map keys")
+	}
+	// 0.1 + 0.2 drifts as floats
+	if sum := decimal.MustParse("0.1").Add(decimal.MustParse("0.2")); sum != decimal.MustParse("0.3") {
+		t.Errorf("Expected 0.1 + 0.2 to be 0.3 but got %s", sum)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a := decimal.MustParse("8100.5")
+	b := decimal.MustParse("0.00000012")
+	tests := []struct {
+		name     string
+		result   decimal.Decimal
+		expected string
+	}{
+		{"add", a.Add(b), "8100.50000012"},
+		{"sub", b.Sub(a), "-8100.49999988"},
+		{"mul", a.Mul(decimal.New(127, -2)), "10287.635"},
+		{"mul overflow", decimal.MustParse("999999999999").Mul(decimal.MustParse("999999999999")), "999999999998000000000000"},
+		{"div", decimal.NewFromInt(1).Div(decimal.NewFromInt(3)), "0.3333333333333333"},
+		{"div round", decimal.NewFromInt(2).DivRound(decimal.NewFromInt(3), 2), "0.67"},
+		{"round", decimal.MustParse("-1.005").Round(2), "-1.01"},
+		{"round down", decimal.MustParse("1.004").Round(2), "1"},
+		{"floor", decimal.MustParse("1.666666666").Floor(8), "1.66666666"},
+		{"floor negative", decimal.MustParse("-1.001").Floor(2), "-1.01"},
+		{"floor exact", decimal.MustParse("1.5").Floor(2), "1.5"},
+		{"add far exponents", decimal.MustParse("1e20").Add(decimal.MustParse("1e-20")), "100000000000000000000"},
+	}
+	for _, test := range tests {
+		if test.result.String() != test.expected {
+			t.Errorf("Expected %s to be %s but got %s", test.name, test.expected, test.result)
+		}
+	}
+	if !b.LessThan(a) || a.Cmp(a) != 0 || !a.GreaterThan(b) {
+		t.Error("Expected comparisons to order values")
+	}
+	if decimal.Min(a, b) != b || decimal.Max(a, b) != a {
+		t.Error("Expected Min and Max to pick the smaller and larger value")
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	d := decimal.MustParse("8000.1")
+	if s := d.StringFixed(8); s != "8000.10000000" {
+		t.Errorf("Expected 8000.10000000 but got %s", s)
+	}
+	if s := decimal.NewFromInt(5).StringFixed(2); s != "5.00" {
+		t.Errorf("Expected 5.00 but got %s", s)
+	}
+	if s := decimal.MustParse("0.123456789").StringFixed(8); s != "0.12345679" {
+		t.Errorf("Expected 0.12345679 but got %s", s)
+	}
+	if f := decimal.MustParse("0.1").Float64(); f != 0.1 {
+		t.Errorf("Expected 0.1 but got %v", f)
+	}
+	if d := decimal.NewFromFloat(0.1); d.String() != "0.1" {
+		t.Errorf("Expected 0.1 but got %s", d)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var levels []decimal.Decimal
+	err := json.Unmarshal([]byte(`["8000.10", 1.2e-7, 3, null, ""]`), &levels)
+	if err != nil {
+		t.Fatalf("Error unmarshalling: %s", err)
+	}
+	expected := []string{"8000.1", "0.00000012", "3", "0", "0"}
+	for i, level := range levels {
+		if level.String() != expected[i] {
+			t.Errorf("Expected %s but got %s", expected[i], level)
+		}
+	}
+	msg, err := json.Marshal(levels[0])
+	if err != nil || string(msg) != `"8000.1"` {
+		t.Errorf("Expected decimals to marshal as strings but got %s %v", msg, err)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	spread := decimal.MustParse("0.5")
+	var quantity decimal.Decimal
+	err := decimal.ParseOptions(
+		decimal.Option{Name: "min_spread", Value: "", Dest: &spread},
+		decimal.Option{Name: "max_quantity", Value: "0.10", Dest: &quantity},
+	)
+	if err != nil || spread.String() != "0.5" || quantity.String() != "0.1" {
+		t.Errorf("Expected options without a value to be kept but got %s, %s, %v", spread, quantity, err)
+	}
+	err = decimal.ParseOptions(decimal.Option{Name: "max_quantity", Value: "one", Dest: &quantity})
+	if err == nil || quantity.String() != "0.1" {
+		t.Errorf("Expected an error for an invalid value but got %s, %v", quantity, err)
+	}
+}
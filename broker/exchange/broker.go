@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 )
 
 const (
@@ -18,6 +21,12 @@ const (
 	BITFINEX = "bitfinex"
 )
 
+// SpreadPrecision is the number of decimal places spread percentages are rounded to
+const SpreadPrecision = 8
+
+// hundred converts ratios to percentages
+var hundred = decimal.NewFromInt(100)
+
 // side represents an order book side for the below enum
 type side int
 
@@ -30,12 +39,16 @@ const (
 
 // Rates map represents a map of pairs we will want to triangulate.
 // Ex: "BTC-USD": 8000
-type ratesMap map[string]float64
+type ratesMap map[string]decimal.Decimal
 
 // // cryptoRates represents a map of commonly used crypto quote currencies and the exchange rates
 // // back to a given fiat
 // var cryptoRates ratesMap
 
+// DefaultMaxAge is how long a quote is kept without an update when the exchange config doesn't
+// set max_age
+const DefaultMaxAge = 5 * time.Minute
+
 // fiatQuoteCurrencies represents a slice of fiat currences we will value pairs in
 var fiatQuoteCurrencies = []string{"USD", "EUR", "GBP", "CAD"}
 
@@ -83,31 +96,69 @@ type ArbProductMap map[string]struct{}
 
 // ActiveMarket represents a market to go into the ActiveMarketMap
 type ActiveMarket struct {
-	Exchange string  `json:"exchange"`
-	HePair   string  `json:"he_pair"`
-	ExPair   string  `json:"ex_pair"`
-	HeBase   string  `json:"he_base"`
-	HeQuote  string  `json:"he_quote"`
-	Bid      float64 `json:"bid"`
-	Ask      float64 `json:"ask"`
+	Exchange string          `json:"exchange"`
+	HePair   string          `json:"he_pair"`
+	ExPair   string          `json:"ex_pair"`
+	HeBase   string          `json:"he_base"`
+	HeQuote  string          `json:"he_quote"`
+	Bid      decimal.Decimal `json:"bid"`
+	Ask      decimal.Decimal `json:"ask"`
+	// BidSize and AskSize are the quantities at the best bid and ask. 0 means unknown
+	BidSize decimal.Decimal `json:"bid_size"`
+	AskSize decimal.Decimal `json:"ask_size"`
+	// ExchangeTime is when the exchange generated the quote if known
+	ExchangeTime time.Time `json:"exchange_time"`
+	// ReceivedAt is when the quote was received. The time of insertion is used if not set
+	ReceivedAt time.Time `json:"received_at"`
 }
 
 // ArbMarket represents a market for arbitrage with a spread, low exchange, and high exchange
 type ArbMarket struct {
-	HeBase string     `json:"he_base"`
-	Spread float64    `json:"spread"`
-	Low    MarketSide `json:"low"`
-	High   MarketSide `json:"high"`
+	HeBase string `json:"he_base"`
+	// GrossSpread is the difference between the high bid and low ask as a percentage of the
+	// low ask
+	GrossSpread decimal.Decimal `json:"gross_spread"`
+	// Fees are the taker fees of buying on low and selling on high as a percentage of the low
+	// ask
+	Fees decimal.Decimal `json:"fees"`
+	// Spread is the net spread, GrossSpread less Fees
+	Spread decimal.Decimal `json:"spread"`
+	Low    MarketSide      `json:"low"`
+	High   MarketSide      `json:"high"`
+	// Quantity is the most of the base that can be bought at the low ask and sold at the
+	// high bid. It's 0 if either exchange doesn't send sizes
+	Quantity decimal.Decimal `json:"quantity"`
+	// Profit is the notional profit in USD of trading Quantity after fees
+	Profit decimal.Decimal `json:"profit"`
+	// Executable is set by the inventory when we hold the quote currency on the low exchange
+	// and the base on the high exchange. ExecutableQuantity is how much of the base they cover
+	Executable         bool            `json:"executable"`
+	ExecutableQuantity decimal.Decimal `json:"executable_quantity"`
+	// Removed is set when the opportunity no longer exists
+	Removed bool `json:"removed,omitempty"`
 }
 
-// NewArbMarket returns a new ArbMarket
-func NewArbMarket(heBase string, low, high MarketSide) *ArbMarket {
-	spread := ((high.TriangulatedPrice - low.TriangulatedPrice) / low.TriangulatedPrice) * 100
+// NewArbMarket returns a new ArbMarket with the taker fees of fees, which can be nil
+func NewArbMarket(heBase string, low, high MarketSide, fees *FeeSchedule) *ArbMarket {
+	difference := high.TriangulatedPrice.Sub(low.TriangulatedPrice)
+	// What buying and selling one unit of the base costs in fees in USD
+	cost := low.TriangulatedPrice.Mul(fees.Taker(low.Exchange, low.HePair)).
+		Add(high.TriangulatedPrice.Mul(fees.Taker(high.Exchange, high.HePair)))
+	var grossSpread, feeSpread decimal.Decimal
+	if !low.TriangulatedPrice.IsZero() {
+		grossSpread = difference.Mul(hundred).DivRound(low.TriangulatedPrice, SpreadPrecision)
+		feeSpread = cost.Mul(hundred).DivRound(low.TriangulatedPrice, SpreadPrecision)
+	}
+	quantity := decimal.Min(low.Size, high.Size)
 	return &ArbMarket{
-		HeBase: heBase,
-		Spread: spread,
-		Low:    low,
-		High:   high,
+		HeBase:      heBase,
+		GrossSpread: grossSpread,
+		Fees:        feeSpread,
+		Spread:      grossSpread.Sub(feeSpread),
+		Low:         low,
+		High:        high,
+		Quantity:    quantity,
+		Profit:      difference.Sub(cost).Mul(quantity),
 	}
 }
 
@@ -119,11 +170,37 @@ type Market struct {
 
 // MarketSide is a quote from an exchange
 type MarketSide struct {
-	Exchange          string  `json:"exchange"`
-	Price             float64 `json:"price"`
-	TriangulatedPrice float64 `json:"triangulated_price,omitempty"`
-	ExPair            string  `json:"ex_pair"`
-	HePair            string  `json:"he_pair"`
+	Exchange          string          `json:"exchange"`
+	Price             decimal.Decimal `json:"price"`
+	TriangulatedPrice decimal.Decimal `json:"triangulated_price"`
+	ExPair            string          `json:"ex_pair"`
+	HePair            string          `json:"he_pair"`
+	// Size is the quantity available at Price. 0 means unknown
+	Size decimal.Decimal `json:"size"`
+	// UpdatedAt is when the quote for this side was last received
+	UpdatedAt time.Time `json:"updated_at"`
+	// ExchangeTime is when the exchange generated the last quote for this side if known
+	ExchangeTime time.Time `json:"exchange_time"`
+}
+
+// QuoteCurrency returns the helgart quote currency of the pair of the side given its base, ex:
+// USD for BTC-USD
+func (m MarketSide) QuoteCurrency(heBase string) string {
+	return strings.TrimPrefix(m.HePair, heBase+"-")
+}
+
+// Age returns how old the quote for this side is at now. The exchange time is used if known
+// since it also accounts for the time the quote took to reach us
+func (m MarketSide) Age(now time.Time) time.Duration {
+	since := m.UpdatedAt
+	if !m.ExchangeTime.IsZero() {
+		since = m.ExchangeTime
+	}
+	if age := now.Sub(since); age > 0 {
+		return age
+	}
+	// Clock skew with the exchange can put its time ahead of ours
+	return 0
 }
 
 // ActiveMarketMap is a map representing markets broker is pulling from and receiving data from
@@ -146,11 +223,16 @@ type Broker struct {
 	ProductMap    ProductMap
 	ArbProducts   ArbProductMap
 	ActiveMarkets ActiveMarketMap
-	exchanges     []Exchange
-	db            ProductStorage
-	cache         ProductCache
-	cryptoRates   ratesMap
-	forexRates    ratesMap
+	// Configs holds the config of each exchange by name. Products for pairs the config
+	// doesn't allow are left out of the ProductMap
+	Configs map[string]*Config
+	// Fees are the taker fees spreads are net of. Spreads are gross if it's nil
+	Fees        *FeeSchedule
+	exchanges   []Exchange
+	db          ProductStorage
+	cache       ProductCache
+	cryptoRates ratesMap
+	forexRates  ratesMap
 }
 
 // NewBroker returns a new broker interface
@@ -158,10 +240,10 @@ func NewBroker(exchanges []Exchange, db ProductStorage) *Broker {
 	// Forex rates to value things back to USD
 	// TODO: fetch programatically
 	var forexRates = ratesMap{
-		"GBP-USD": 1.27,
-		"CAD-USD": 0.74,
-		"EUR-USD": 1.12,
-		"USD-USD": 1,
+		"GBP-USD": decimal.New(127, -2),
+		"CAD-USD": decimal.New(74, -2),
+		"EUR-USD": decimal.New(112, -2),
+		"USD-USD": decimal.NewFromInt(1),
 	}
 	return &Broker{
 		exchanges:     exchanges,
@@ -189,15 +271,15 @@ func indexOf(needle string, haystack []string) int {
 
 // Start starts a new exchange engine
 func (b *Broker) Start(ctx context.Context, doneCh chan<- struct{}) error {
-	err := b.buildProductMap()
-	if err != nil {
-		return fmt.Errorf("Error fetching product map: %s", err)
-	}
 	arbProducts, err := b.db.FetchArbProducts()
 	if err != nil {
 		return fmt.Errorf("Error fetching arb pairs: %s", err)
 	}
 	b.ArbProducts = arbProducts
+	err = b.buildProductMap()
+	if err != nil {
+		return fmt.Errorf("Error fetching product map: %s", err)
+	}
 	for _, exchange := range b.exchanges {
 		err := exchange.Start(ctx, b.ProductMap, doneCh)
 		if err != nil {
@@ -215,6 +297,12 @@ func (b *Broker) buildProductMap() error {
 	}
 	for _, product := range products {
 		exchange := strings.ToLower(product.Exchange)
+		if !b.relevant(product) {
+			continue
+		}
+		if config, ok := b.Configs[exchange]; ok && !config.AllowsPair(product.HePair) {
+			continue
+		}
 		if len(b.ProductMap[exchange]) == 0 {
 			b.ProductMap[exchange] = map[string]Product{}
 		}
@@ -232,6 +320,36 @@ func (b *Broker) buildProductMap() error {
 	return nil
 }
 
+// relevant returns true if quotes for a product can be used for arbitrage, either because its
+// base trades on more than one market or because it's needed to triangulate prices
+func (b *Broker) relevant(product Product) bool {
+	if _, ok := b.ArbProducts[product.HeBase]; ok {
+		return true
+	}
+	return indexOf(product.HeBase, cryptoQuoteCurrencies) > -1
+}
+
+// Subscriptions returns the pairs each exchange is subscribed to by exchange name
+func (b *Broker) Subscriptions() map[string][]string {
+	subscriptions := make(map[string][]string)
+	for _, exchange := range b.exchanges {
+		subscriptions[exchange.Name()] = exchange.SubscribedPairs()
+	}
+	return subscriptions
+}
+
+// SequenceGaps returns the number of sequence gaps per pair of every exchange that detects them
+// by exchange name
+func (b *Broker) SequenceGaps() map[string]map[string]int {
+	gaps := make(map[string]map[string]int)
+	for _, exchange := range b.exchanges {
+		if reporter, ok := exchange.(GapReporter); ok {
+			gaps[exchange.Name()] = reporter.SequenceGaps()
+		}
+	}
+	return gaps
+}
+
 func (b *Broker) insertMarketIntoMarketSide(side int, market *ActiveMarket) {
 	var m MarketSide
 	if side == BIDS {
@@ -239,12 +357,15 @@ func (b *Broker) insertMarketIntoMarketSide(side int, market *ActiveMarket) {
 			if market.Exchange == val.Exchange && market.HePair == val.HePair {
 
 				b.ActiveMarkets[market.HeBase].Bids[key].Price = market.Bid
+				b.ActiveMarkets[market.HeBase].Bids[key].Size = market.BidSize
+				b.ActiveMarkets[market.HeBase].Bids[key].UpdatedAt = market.ReceivedAt
+				b.ActiveMarkets[market.HeBase].Bids[key].ExchangeTime = market.ExchangeTime
 				b.calculatedTriangulatedPrice(&b.ActiveMarkets[market.HeBase].Bids[key], market.HeBase, market.HeQuote)
 				return
 			}
 		}
 		m = b.mapMarketSide(BIDS, market)
-		if m.Price > 0 {
+		if m.Price.Sign() > 0 {
 			b.ActiveMarkets[market.HeBase].Bids = append(b.ActiveMarkets[market.HeBase].Bids, m)
 		}
 
@@ -252,12 +373,15 @@ func (b *Broker) insertMarketIntoMarketSide(side int, market *ActiveMarket) {
 		for key, val := range b.ActiveMarkets[market.HeBase].Asks {
 			if market.Exchange == val.Exchange && market.HePair == val.HePair {
 				b.ActiveMarkets[market.HeBase].Asks[key].Price = market.Ask
+				b.ActiveMarkets[market.HeBase].Asks[key].Size = market.AskSize
+				b.ActiveMarkets[market.HeBase].Asks[key].UpdatedAt = market.ReceivedAt
+				b.ActiveMarkets[market.HeBase].Asks[key].ExchangeTime = market.ExchangeTime
 				b.calculatedTriangulatedPrice(&b.ActiveMarkets[market.HeBase].Asks[key], market.HeBase, market.HeQuote)
 				return
 			}
 		}
 		m = b.mapMarketSide(ASKS, market)
-		if m.Price > 0 {
+		if m.Price.Sign() > 0 {
 			b.ActiveMarkets[market.HeBase].Asks = append(b.ActiveMarkets[market.HeBase].Asks, m)
 		}
 
@@ -265,17 +389,20 @@ func (b *Broker) insertMarketIntoMarketSide(side int, market *ActiveMarket) {
 }
 
 func (b *Broker) mapMarketSide(s side, market *ActiveMarket) MarketSide {
-	var price float64
+	var price, size decimal.Decimal
 	if s == BIDS {
-		price = market.Bid
+		price, size = market.Bid, market.BidSize
 	} else if s == ASKS {
-		price = market.Ask
+		price, size = market.Ask, market.AskSize
 	}
 	m := MarketSide{
-		Exchange: market.Exchange,
-		Price:    price,
-		ExPair:   market.ExPair,
-		HePair:   market.HePair,
+		Exchange:     market.Exchange,
+		Price:        price,
+		Size:         size,
+		ExPair:       market.ExPair,
+		HePair:       market.HePair,
+		UpdatedAt:    market.ReceivedAt,
+		ExchangeTime: market.ExchangeTime,
 	}
 	b.calculatedTriangulatedPrice(&m, market.HeBase, market.HeQuote)
 	return m
@@ -286,7 +413,7 @@ func (b *Broker) calculatedTriangulatedPrice(m *MarketSide, base, quote string)
 	if forexIndex > -1 {
 		// TODO: allow to value in more fiats
 		index := fmt.Sprintf("%s-USD", quote)
-		m.TriangulatedPrice = m.Price * b.forexRates[index]
+		m.TriangulatedPrice = m.Price.Mul(b.forexRates[index])
 		return
 	}
 
@@ -294,8 +421,8 @@ func (b *Broker) calculatedTriangulatedPrice(m *MarketSide, base, quote string)
 	if cryptoIndex > -1 {
 		// TODO: allow to value in more fiats
 		index := fmt.Sprintf("%s-USD", quote)
-		if b.cryptoRates[index] > 0 {
-			m.TriangulatedPrice = m.Price * b.cryptoRates[index]
+		if b.cryptoRates[index].Sign() > 0 {
+			m.TriangulatedPrice = m.Price.Mul(b.cryptoRates[index])
 			return
 		}
 	}
@@ -307,12 +434,15 @@ func (b *Broker) calculatedTriangulatedPrice(m *MarketSide, base, quote string)
 	}
 
 	// if there is no triangulation, remove the price to remove the market altogether
-	m.Price = 0
+	m.Price = decimal.Decimal{}
 	// m.TriangulatedPrice = m.Price
 }
 
 // InsertActiveMarket inserts a quote into the ActiveMarketMap
 func (b *Broker) InsertActiveMarket(market *ActiveMarket) {
+	if market.ReceivedAt.IsZero() {
+		market.ReceivedAt = time.Now()
+	}
 	// We check if the pair is already in the active market map
 	if _, ok := b.ActiveMarkets[market.HeBase]; !ok {
 		// If not intialize slice
@@ -335,10 +465,57 @@ func (b *Broker) InsertActiveMarket(market *ActiveMarket) {
 
 	// We sort here to easily find the high and low price
 	sort.Slice(b.ActiveMarkets[market.HeBase].Bids, func(i, j int) bool {
-		return b.ActiveMarkets[market.HeBase].Bids[i].TriangulatedPrice > b.ActiveMarkets[market.HeBase].Bids[j].TriangulatedPrice
+		return b.ActiveMarkets[market.HeBase].Bids[i].TriangulatedPrice.GreaterThan(b.ActiveMarkets[market.HeBase].Bids[j].TriangulatedPrice)
 	})
 
 	sort.Slice(b.ActiveMarkets[market.HeBase].Asks, func(i, j int) bool {
-		return b.ActiveMarkets[market.HeBase].Asks[i].TriangulatedPrice < b.ActiveMarkets[market.HeBase].Asks[j].TriangulatedPrice
+		return b.ActiveMarkets[market.HeBase].Asks[i].TriangulatedPrice.LessThan(b.ActiveMarkets[market.HeBase].Asks[j].TriangulatedPrice)
 	})
 }
+
+// maxAge returns how long quotes from an exchange are kept without an update
+func (b *Broker) maxAge(exchange string) time.Duration {
+	if config, ok := b.Configs[exchange]; ok && config.MaxAge > 0 {
+		return config.MaxAge
+	}
+	return DefaultMaxAge
+}
+
+// EvictStale removes every market side that hasn't been updated within the max age of its
+// exchange and returns the bases that lost a side sorted alphabetically. Sides stay sorted so
+// the best bid and ask of those bases are recomputed by BestArbMarket
+func (b *Broker) EvictStale(now time.Time) []string {
+	var evicted []string
+	for base, market := range b.ActiveMarkets {
+		bids, asks := len(market.Bids), len(market.Asks)
+		market.Bids = b.freshSides(market.Bids, now)
+		market.Asks = b.freshSides(market.Asks, now)
+		if len(market.Bids) != bids || len(market.Asks) != asks {
+			evicted = append(evicted, base)
+		}
+	}
+	sort.Strings(evicted)
+	return evicted
+}
+
+// freshSides filters out stale sides in place
+func (b *Broker) freshSides(sides []MarketSide, now time.Time) []MarketSide {
+	fresh := sides[:0]
+	for _, side := range sides {
+		if now.Sub(side.UpdatedAt) <= b.maxAge(side.Exchange) {
+			fresh = append(fresh, side)
+		}
+	}
+	return fresh
+}
+
+// BestArbMarket returns the arbitrage market between the lowest ask and highest bid of a base
+// or nil if either side has no quotes
+func (b *Broker) BestArbMarket(base string) *ArbMarket {
+	market, ok := b.ActiveMarkets[base]
+	if !ok || len(market.Bids) == 0 || len(market.Asks) == 0 {
+		return nil
+	}
+	// Buy at lowest price and sell at highest price
+	return NewArbMarket(base, market.Asks[0], market.Bids[0], b.Fees)
+}
@@ -0,0 +1,107 @@
+package exchange_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func TestEvictStale(t *testing.T) {
+	broker := exchange.NewBroker(nil, nil)
+	broker.Configs = map[string]*exchange.Config{
+		exchange.KRAKEN: {Name: exchange.KRAKEN, MaxAge: 10 * time.Second},
+	}
+	now := time.Now()
+	markets := []*exchange.ActiveMarket{
+		{Exchange: exchange.KRAKEN, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8100"), Ask: decimal.MustParse("8101"), ReceivedAt: now.Add(-time.Minute)},
+		{Exchange: exchange.COINBASE, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8000"), Ask: decimal.MustParse("8001"), ReceivedAt: now.Add(-time.Minute)},
+		{Exchange: exchange.BINANCE, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8050"), Ask: decimal.MustParse("8051"), ReceivedAt: now.Add(-10 * time.Minute)},
+	}
+	for _, market := range markets {
+		broker.InsertActiveMarket(market)
+	}
+	arb := broker.BestArbMarket("BTC")
+	if arb == nil || arb.High.Exchange != exchange.KRAKEN || arb.Low.Exchange != exchange.COINBASE {
+		t.Fatalf("Expected to buy on coinbase and sell on kraken but got %#v", arb)
+	}
+
+	// kraken is past its configured max age and binance past the default
+	evicted := broker.EvictStale(now)
+	if len(evicted) != 1 || evicted[0] != "BTC" {
+		t.Fatalf("Expected BTC to be evicted but got %v", evicted)
+	}
+	market := broker.ActiveMarkets["BTC"]
+	if len(market.Bids) != 1 || market.Bids[0].Exchange != exchange.COINBASE {
+		t.Errorf("Expected only the coinbase bid to remain but got %#v", market.Bids)
+	}
+	arb = broker.BestArbMarket("BTC")
+	if arb == nil || arb.High.Exchange != exchange.COINBASE || arb.Low.Exchange != exchange.COINBASE {
+		t.Errorf("Expected the best bid and ask to be recomputed but got %#v", arb)
+	}
+	if evicted := broker.EvictStale(now); len(evicted) != 0 {
+		t.Errorf("Expected nothing left to evict but got %v", evicted)
+	}
+	if evicted := broker.EvictStale(now.Add(exchange.DefaultMaxAge)); len(evicted) != 1 {
+		t.Errorf("Expected the last quote to be evicted but got %v", evicted)
+	}
+	if arb := broker.BestArbMarket("BTC"); arb != nil {
+		t.Errorf("Expected no market once every quote is evicted but got %#v", arb)
+	}
+}
+
+func TestArbMarketQuantity(t *testing.T) {
+	broker := exchange.NewBroker(nil, nil)
+	markets := []*exchange.ActiveMarket{
+		{Exchange: exchange.KRAKEN, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8100"), Ask: decimal.MustParse("8101"), BidSize: decimal.MustParse("0.5"), AskSize: decimal.MustParse("3")},
+		{Exchange: exchange.COINBASE, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("7999"), Ask: decimal.MustParse("8000"), BidSize: decimal.MustParse("1"), AskSize: decimal.MustParse("2")},
+	}
+	for _, market := range markets {
+		broker.InsertActiveMarket(market)
+	}
+	arb := broker.BestArbMarket("BTC")
+	if arb.Quantity != decimal.MustParse("0.5") {
+		t.Errorf("Expected quantity to be capped by the kraken bid size of 0.5 but got %s", arb.Quantity)
+	}
+	if arb.Profit != decimal.MustParse("50") || arb.Spread != decimal.MustParse("1.25") {
+		t.Errorf("Expected a profit of 50 and spread of 1.25 but got %s and %s", arb.Profit, arb.Spread)
+	}
+
+	// Updating a quote updates the size of its sides
+	broker.InsertActiveMarket(&exchange.ActiveMarket{Exchange: exchange.KRAKEN, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8100"), Ask: decimal.MustParse("8101"), BidSize: decimal.MustParse("4"), AskSize: decimal.MustParse("3")})
+	arb = broker.BestArbMarket("BTC")
+	if arb.Quantity != decimal.MustParse("2") || arb.Profit != decimal.MustParse("200") {
+		t.Errorf("Expected quantity 2 and profit 200 but got %s and %s", arb.Quantity, arb.Profit)
+	}
+
+	// Exchanges without sizes leave the quantity unknown
+	broker.InsertActiveMarket(&exchange.ActiveMarket{Exchange: exchange.BINANCE, HePair: "BTC-USD", HeBase: "BTC", HeQuote: "USD", Bid: decimal.MustParse("8200"), Ask: decimal.MustParse("8201")})
+	arb = broker.BestArbMarket("BTC")
+	if !arb.Quantity.IsZero() || !arb.Profit.IsZero() {
+		t.Errorf("Expected no quantity without sizes but got %s and %s", arb.Quantity, arb.Profit)
+	}
+}
+
+func TestArbMarketFees(t *testing.T) {
+	fees := exchange.NewFeeSchedule()
+	fees.Set(exchange.Fee{Exchange: exchange.COINBASE, Taker: decimal.MustParse("0.005")})
+	fees.Set(exchange.Fee{Exchange: exchange.KRAKEN, Taker: decimal.MustParse("0.0026")})
+	low := exchange.MarketSide{Exchange: exchange.COINBASE, HePair: "BTC-USD", Price: decimal.MustParse("8000"), TriangulatedPrice: decimal.MustParse("8000"), Size: decimal.MustParse("2")}
+	high := exchange.MarketSide{Exchange: exchange.KRAKEN, HePair: "BTC-USD", Price: decimal.MustParse("8100"), TriangulatedPrice: decimal.MustParse("8100"), Size: decimal.MustParse("0.5")}
+
+	// Buying costs 40 USD in fees and selling 21.06 USD
+	arb := exchange.NewArbMarket("BTC", low, high, fees)
+	if arb.GrossSpread.String() != "1.25" || arb.Fees.String() != "0.76325" || arb.Spread.String() != "0.48675" {
+		t.Errorf("Expected a gross spread of 1.25, fees of 0.76325 and net spread of 0.48675 but got %s, %s and %s", arb.GrossSpread, arb.Fees, arb.Spread)
+	}
+	if arb.Profit.String() != "19.47" {
+		t.Errorf("Expected a profit of 19.47 after fees but got %s", arb.Profit)
+	}
+
+	// Spreads are gross without fees
+	arb = exchange.NewArbMarket("BTC", low, high, nil)
+	if arb.Spread != arb.GrossSpread || !arb.Fees.IsZero() || arb.Profit.String() != "50" {
+		t.Errorf("Expected no fees without a schedule but got %s fees and %s profit", arb.Fees, arb.Profit)
+	}
+}
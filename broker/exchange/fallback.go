@@ -0,0 +1,144 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+)
+
+// Poller is implemented by exchanges that can fetch quotes from their REST api
+type Poller interface {
+	Name() string
+	// PollQuotes fetches the best bid and ask of every subscribed pair. Requests are spaced out
+	// to respect the rate limits of the exchange so a call can take a while with many pairs
+	PollQuotes(ctx context.Context) ([]Quote, error)
+}
+
+// DefaultPollInterval is the least time between the start of two polls of an exchange
+const DefaultPollInterval = time.Second
+
+// Fallback polls quotes from the REST api of exchanges while their websocket feed is down.
+// Quotes are sent on the same channel as the feed and polling stops once every connection of
+// the feed is back up
+type Fallback struct {
+	// Interval is the least time between the start of two polls so a poller returning right
+	// away doesn't spin
+	Interval time.Duration
+	quoteCh  chan<- Quote
+	errorCh  chan<- error
+	mtx      sync.Mutex
+	pollers  map[string]fallbackPoller
+	cancels  map[string]context.CancelFunc
+	// down holds the connections of each exchange that are down
+	down map[string]map[uint64]bool
+}
+
+type fallbackPoller struct {
+	poller Poller
+	after  time.Duration
+}
+
+// NewFallback returns a fallback sending polled quotes to quoteCh
+func NewFallback(quoteCh chan<- Quote, errorCh chan<- error) *Fallback {
+	return &Fallback{
+		Interval: DefaultPollInterval,
+		quoteCh:  quoteCh,
+		errorCh:  errorCh,
+		pollers:  make(map[string]fallbackPoller),
+		cancels:  make(map[string]context.CancelFunc),
+		down:     make(map[string]map[uint64]bool),
+	}
+}
+
+// Add enables the fallback for an exchange. Polling starts once its feed has been down for after
+func (f *Fallback) Add(poller Poller, after time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.pollers[poller.Name()] = fallbackPoller{poller: poller, after: after}
+}
+
+// Handle starts polling an exchange when one of its connections goes down and stops once all
+// of them are back up. Events of exchanges without a fallback are ignored
+func (f *Fallback) Handle(ctx context.Context, event api.ConnectionEvent) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	p, ok := f.pollers[event.Exchange]
+	if !ok {
+		return
+	}
+	down, ok := f.down[event.Exchange]
+	if !ok {
+		down = make(map[uint64]bool)
+		f.down[event.Exchange] = down
+	}
+	cancel, polling := f.cancels[event.Exchange]
+	switch event.State {
+	case api.DOWN:
+		down[event.Conn] = true
+		if polling {
+			return
+		}
+		pollCtx, cancel := context.WithCancel(ctx)
+		f.cancels[event.Exchange] = cancel
+		go f.poll(pollCtx, p)
+	case api.UP:
+		delete(down, event.Conn)
+		if polling && len(down) == 0 {
+			cancel()
+			delete(f.cancels, event.Exchange)
+		}
+	}
+}
+
+// Polling returns whether the fallback of an exchange is started. Polling only begins once the
+// feed has been down for the delay given to Add
+func (f *Fallback) Polling(name string) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	_, ok := f.cancels[name]
+	return ok
+}
+
+func (f *Fallback) poll(ctx context.Context, p fallbackPoller) {
+	timer := time.NewTimer(p.after)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+	name := p.poller.Name()
+	log.Printf("%s feed down for %s. Polling REST api\n", name, p.after)
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+	for {
+		quotes, err := p.poller.PollQuotes(ctx)
+		if ctx.Err() != nil {
+			log.Printf("%s feed back up. Stopped polling REST api\n", name)
+			return
+		}
+		if err != nil {
+			select {
+			case f.errorCh <- fmt.Errorf("Error polling %s: %s", name, err):
+			case <-ctx.Done():
+			}
+		}
+		for _, quote := range quotes {
+			select {
+			case f.quoteCh <- quote:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("%s feed back up. Stopped polling REST api\n", name)
+			return
+		}
+	}
+}
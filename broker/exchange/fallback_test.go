@@ -0,0 +1,129 @@
+package exchange_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+type mockPoller struct {
+	mtx   sync.Mutex
+	polls int
+}
+
+func (p *mockPoller) Name() string {
+	return "mock"
+}
+
+func (p *mockPoller) PollQuotes(ctx context.Context) ([]exchange.Quote, error) {
+	p.mtx.Lock()
+	p.polls++
+	p.mtx.Unlock()
+	select {
+	case <-time.After(time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []exchange.Quote{{Exchange: "mock", HePair: "MOCK-USD", Bid: decimal.NewFromInt(1), Ask: decimal.NewFromInt(2)}}, nil
+}
+
+func (p *mockPoller) Polls() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.polls
+}
+
+func TestFallback(t *testing.T) {
+	quoteCh := make(chan exchange.Quote)
+	fallback := exchange.NewFallback(quoteCh, make(chan error, 1))
+	poller := &mockPoller{}
+	fallback.Add(poller, 10*time.Millisecond)
+	ctx := context.Background()
+
+	// Events of other exchanges and the feed coming up don't start polling
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "other", State: api.DOWN})
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", State: api.UP})
+	if fallback.Polling("mock") || fallback.Polling("other") {
+		t.Fatal("Expected no polling while the feed is up")
+	}
+
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", State: api.DOWN})
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", State: api.DOWN})
+	if !fallback.Polling("mock") {
+		t.Fatal("Expected polling to start once the feed is down")
+	}
+	select {
+	case quote := <-quoteCh:
+		if quote.HePair != "MOCK-USD" || quote.Bid != decimal.NewFromInt(1) {
+			t.Errorf("Expected the polled quote but got %#v", quote)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a polled quote")
+	}
+
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", State: api.UP})
+	if fallback.Polling("mock") {
+		t.Fatal("Expected polling to stop once the feed is back up")
+	}
+	// Drain a quote polled before the feed came back up
+	select {
+	case <-quoteCh:
+	case <-time.After(20 * time.Millisecond):
+	}
+	polls := poller.Polls()
+	time.Sleep(20 * time.Millisecond)
+	if poller.Polls() != polls {
+		t.Errorf("Expected no polls once the feed is back up but got %d more", poller.Polls()-polls)
+	}
+}
+
+func TestFallbackDelay(t *testing.T) {
+	fallback := exchange.NewFallback(make(chan exchange.Quote), make(chan error, 1))
+	poller := &mockPoller{}
+	fallback.Add(poller, time.Hour)
+	fallback.Handle(context.Background(), api.ConnectionEvent{Exchange: "mock", State: api.DOWN})
+	time.Sleep(10 * time.Millisecond)
+	fallback.Handle(context.Background(), api.ConnectionEvent{Exchange: "mock", State: api.UP})
+	if poller.Polls() != 0 {
+		t.Errorf("Expected a short outage not to be polled but got %d polls", poller.Polls())
+	}
+}
+
+func TestFallbackConnections(t *testing.T) {
+	fallback := exchange.NewFallback(make(chan exchange.Quote, 10), make(chan error, 1))
+	fallback.Add(&mockPoller{}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Failed reconnects report the same connection down several times
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", Conn: 1, State: api.DOWN})
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", Conn: 1, State: api.DOWN})
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", Conn: 2, State: api.DOWN})
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", Conn: 1, State: api.UP})
+	if !fallback.Polling("mock") {
+		t.Fatal("Expected polling to go on while a connection is still down")
+	}
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", Conn: 2, State: api.UP})
+	if fallback.Polling("mock") {
+		t.Fatal("Expected polling to stop once every connection is back up")
+	}
+}
+
+func TestFallbackInterval(t *testing.T) {
+	fallback := exchange.NewFallback(make(chan exchange.Quote, 10), make(chan error, 1))
+	fallback.Interval = time.Hour
+	poller := &mockPoller{}
+	fallback.Add(poller, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fallback.Handle(ctx, api.ConnectionEvent{Exchange: "mock", State: api.DOWN})
+	time.Sleep(20 * time.Millisecond)
+	if poller.Polls() != 1 {
+		t.Errorf("Expected a single poll within the interval but got %d", poller.Polls())
+	}
+}
@@ -0,0 +1,164 @@
+package exchange
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Fee is the taker fee of an exchange as a ratio of the notional, ex: 0.0026. It applies to
+// every pair of the exchange if HePair is empty and to every account tier if Tier is empty
+type Fee struct {
+	Exchange string          `json:"exchange"`
+	HePair   string          `json:"he_pair"`
+	Tier     string          `json:"tier"`
+	Taker    decimal.Decimal `json:"taker"`
+}
+
+// FeeStorage is an interface to fetch the fee schedule from some persistent storage
+type FeeStorage interface {
+	FetchFees() ([]Fee, error)
+}
+
+// FeeConfig holds the fee schedule from the fees section of the config file. Tiers sets the
+// account tier of exchanges by name, which selects the fees of that tier
+//
+//	fees:
+//	  default: 0.002
+//	  tiers:
+//	    kraken: pro
+//	  schedule:
+//	    - exchange: kraken
+//	      taker: 0.0026
+//	    - exchange: kraken
+//	      tier: pro
+//	      taker: 0.0016
+//	    - exchange: binance
+//	      pair: BTC-USDT
+//	      taker: 0.00075
+type FeeConfig struct {
+	// Default is the fee of exchanges missing from the schedule
+	Default  string            `mapstructure:"default"`
+	Tiers    map[string]string `mapstructure:"tiers"`
+	Schedule []FeeConfigEntry  `mapstructure:"schedule"`
+}
+
+// FeeConfigEntry is a fee of the schedule in the config file. pair and tier are optional
+type FeeConfigEntry struct {
+	Exchange string `mapstructure:"exchange"`
+	Pair     string `mapstructure:"pair"`
+	Tier     string `mapstructure:"tier"`
+	Taker    string `mapstructure:"taker"`
+}
+
+// feeKey identifies a fee in a schedule
+type feeKey struct {
+	exchange string
+	hePair   string
+	tier     string
+}
+
+// FeeSchedule holds the taker fees of exchanges. The fee of a pair is the most specific one
+// set: for the pair and account tier, the pair, the tier then the exchange. It isn't safe to
+// modify while it's used to compute spreads. A nil schedule has no fees
+type FeeSchedule struct {
+	// Default is the fee of exchanges without any fee set
+	Default decimal.Decimal
+	// Tiers holds the account tier by exchange name
+	Tiers map[string]string
+	fees  map[feeKey]decimal.Decimal
+}
+
+// NewFeeSchedule returns an empty fee schedule
+func NewFeeSchedule() *FeeSchedule {
+	return &FeeSchedule{
+		Tiers: make(map[string]string),
+		fees:  make(map[feeKey]decimal.Decimal),
+	}
+}
+
+// Set adds a fee to the schedule, replacing the fee with the same exchange, pair and tier
+func (s *FeeSchedule) Set(fee Fee) {
+	s.fees[newFeeKey(fee.Exchange, fee.HePair, fee.Tier)] = fee.Taker
+}
+
+// Load adds every fee from storage to the schedule
+func (s *FeeSchedule) Load(storage FeeStorage) error {
+	fees, err := storage.FetchFees()
+	if err != nil {
+		return fmt.Errorf("Error fetching fees: %s", err)
+	}
+	for _, fee := range fees {
+		s.Set(fee)
+	}
+	return nil
+}
+
+// Configure adds the fees of config to the schedule. They replace fees loaded from storage
+func (s *FeeSchedule) Configure(config *FeeConfig) error {
+	if config.Default != "" {
+		fee, err := parseFee(config.Default)
+		if err != nil {
+			return fmt.Errorf("Invalid default fee: %s", err)
+		}
+		s.Default = fee
+	}
+	for name, tier := range config.Tiers {
+		s.Tiers[strings.ToLower(name)] = strings.ToLower(tier)
+	}
+	for _, entry := range config.Schedule {
+		if entry.Exchange == "" {
+			return fmt.Errorf("Missing exchange of fee %q", entry.Taker)
+		}
+		fee, err := parseFee(entry.Taker)
+		if err != nil {
+			return fmt.Errorf("Invalid fee for %s: %s", entry.Exchange, err)
+		}
+		s.Set(Fee{Exchange: entry.Exchange, HePair: entry.Pair, Tier: entry.Tier, Taker: fee})
+	}
+	return nil
+}
+
+// Taker returns the taker fee of a pair on an exchange as a ratio of the notional
+func (s *FeeSchedule) Taker(exchangeName, hePair string) decimal.Decimal {
+	if s == nil {
+		return decimal.Decimal{}
+	}
+	exchangeName = strings.ToLower(exchangeName)
+	tier := s.Tiers[exchangeName]
+	keys := []feeKey{
+		newFeeKey(exchangeName, hePair, tier),
+		newFeeKey(exchangeName, hePair, ""),
+		newFeeKey(exchangeName, "", tier),
+		newFeeKey(exchangeName, "", ""),
+	}
+	for _, key := range keys {
+		if fee, ok := s.fees[key]; ok {
+			return fee
+		}
+	}
+	return s.Default
+}
+
+// newFeeKey returns the key of a fee with the exchange and tier in lower case and the pair in
+// upper case
+func newFeeKey(exchangeName, hePair, tier string) feeKey {
+	return feeKey{
+		exchange: strings.ToLower(exchangeName),
+		hePair:   strings.ToUpper(hePair),
+		tier:     strings.ToLower(tier),
+	}
+}
+
+// parseFee parses a fee ratio, which can't be negative or 1 and more
+func parseFee(value string) (decimal.Decimal, error) {
+	fee, err := decimal.Parse(value)
+	if err != nil {
+		return fee, err
+	}
+	if fee.Sign() < 0 || !fee.LessThan(decimal.NewFromInt(1)) {
+		return fee, fmt.Errorf("%s isn't a ratio between 0 and 1", value)
+	}
+	return fee, nil
+}
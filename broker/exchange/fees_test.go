@@ -0,0 +1,78 @@
+package exchange_test
+
+import (
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestFeeSchedule(t *testing.T) {
+	fees := exchange.NewFeeSchedule()
+	err := fees.Load(mock.NewFeeStorage(
+		exchange.Fee{Exchange: exchange.KRAKEN, Taker: decimal.MustParse("0.0026")},
+		exchange.Fee{Exchange: exchange.KRAKEN, Tier: "pro", Taker: decimal.MustParse("0.0016")},
+		exchange.Fee{Exchange: exchange.KRAKEN, HePair: "ETH-USD", Taker: decimal.MustParse("0.002")},
+		exchange.Fee{Exchange: exchange.KRAKEN, HePair: "ETH-USD", Tier: "pro", Taker: decimal.MustParse("0.0012")},
+		exchange.Fee{Exchange: exchange.BINANCE, Taker: decimal.MustParse("0.001")},
+	))
+	if err != nil {
+		t.Fatalf("Error loading fees: %s", err)
+	}
+	// The config overrides storage
+	err = fees.Configure(&exchange.FeeConfig{
+		Default: "0.003",
+		Schedule: []exchange.FeeConfigEntry{
+			{Exchange: "Binance", Pair: "btc-usdt", Taker: "0.00075"},
+			{Exchange: exchange.BINANCE, Taker: "0.0009"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error configuring fees: %s", err)
+	}
+	tests := []struct {
+		exchange string
+		pair     string
+		expected string
+	}{
+		{exchange.KRAKEN, "BTC-USD", "0.0026"},
+		{exchange.KRAKEN, "ETH-USD", "0.002"},
+		{exchange.BINANCE, "BTC-USDT", "0.00075"},
+		{exchange.BINANCE, "ETH-USDT", "0.0009"},
+		{exchange.COINBASE, "BTC-USD", "0.003"},
+	}
+	for _, test := range tests {
+		if fee := fees.Taker(test.exchange, test.pair); fee.String() != test.expected {
+			t.Errorf("Expected a %s fee of %s for %s but got %s", test.exchange, test.expected, test.pair, fee)
+		}
+	}
+
+	// The account tier selects the fees of the tier, the most specific first
+	fees.Tiers[exchange.KRAKEN] = "pro"
+	if fee := fees.Taker(exchange.KRAKEN, "BTC-USD"); fee.String() != "0.0016" {
+		t.Errorf("Expected the pro tier fee of 0.0016 but got %s", fee)
+	}
+	if fee := fees.Taker(exchange.KRAKEN, "ETH-USD"); fee.String() != "0.0012" {
+		t.Errorf("Expected the pro tier ETH-USD fee of 0.0012 but got %s", fee)
+	}
+
+	var none *exchange.FeeSchedule
+	if fee := none.Taker(exchange.KRAKEN, "BTC-USD"); !fee.IsZero() {
+		t.Errorf("Expected no fee without a schedule but got %s", fee)
+	}
+}
+
+func TestFeeScheduleInvalidConfig(t *testing.T) {
+	configs := []*exchange.FeeConfig{
+		{Default: "abc"},
+		{Default: "1"},
+		{Schedule: []exchange.FeeConfigEntry{{Exchange: exchange.KRAKEN, Taker: "-0.001"}}},
+		{Schedule: []exchange.FeeConfigEntry{{Taker: "0.001"}}},
+	}
+	for _, config := range configs {
+		if err := exchange.NewFeeSchedule().Configure(config); err == nil {
+			t.Errorf("Expected an error configuring %+v", config)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// SpreadNode is a price level of an order book with the size available at its price
+type SpreadNode struct {
+	Price decimal.Decimal
+	Size  decimal.Decimal
+}
+
+// BookSide holds every price level on one side of an order book. Levels are kept sorted from
+// the best price to the worst, descending for bids and ascending for asks.
+type BookSide struct {
+	Side   string
+	Levels []SpreadNode
+}
+
+// NewBookSide returns a new empty book side. side is either "bid" or "ask"
+func NewBookSide(side string) *BookSide {
+	return &BookSide{
+		Side:   side,
+		Levels: []SpreadNode{},
+	}
+}
+
+// better returns true if price a ranks ahead of price b on this side of the book
+func (s *BookSide) better(a, b decimal.Decimal) bool {
+	if s.Side == "bid" {
+		return a.GreaterThan(b)
+	}
+	return a.LessThan(b)
+}
+
+// search returns the index where price is or should be inserted
+func (s *BookSide) search(price decimal.Decimal) int {
+	return sort.Search(len(s.Levels), func(i int) bool {
+		return !s.better(s.Levels[i].Price, price)
+	})
+}
+
+// Set inserts a new level, updates the size of an existing level or removes the level if size is 0
+func (s *BookSide) Set(price, size decimal.Decimal) {
+	i := s.search(price)
+	exists := i < len(s.Levels) && s.Levels[i].Price == price
+	switch {
+	case size.IsZero() && exists:
+		s.Levels = append(s.Levels[:i], s.Levels[i+1:]...)
+	case size.IsZero():
+		// Removing a level we don't have is a no-op
+	case exists:
+		s.Levels[i].Size = size
+	default:
+		s.Levels = append(s.Levels, SpreadNode{})
+		copy(s.Levels[i+1:], s.Levels[i:])
+		s.Levels[i] = SpreadNode{Price: price, Size: size}
+	}
+}
+
+// Top returns up to n of the best levels. A n of 0 or less returns every level
+func (s *BookSide) Top(n int) []SpreadNode {
+	if n <= 0 || n > len(s.Levels) {
+		n = len(s.Levels)
+	}
+	return s.Levels[:n]
+}
+
+// Best returns the best level and false if the side is empty
+func (s *BookSide) Best() (SpreadNode, bool) {
+	if len(s.Levels) == 0 {
+		return SpreadNode{}, false
+	}
+	return s.Levels[0], true
+}
+
+// Len returns the number of levels on this side
+func (s *BookSide) Len() int {
+	return len(s.Levels)
+}
+
+// OrderBook maintains the full level 2 book for a pair. Every change is applied against the
+// full book and only the top Depth levels of each side are used for emission.
+type OrderBook struct {
+	Bids  *BookSide
+	Asks  *BookSide
+	Depth int
+	// Invalid is set when the book can no longer be trusted and is waiting to be rebuilt
+	Invalid bool
+}
+
+// NewOrderBook returns a new empty order book emitting depth levels per side. A depth of 0
+// emits the full book
+func NewOrderBook(depth int) *OrderBook {
+	return &OrderBook{
+		Bids:  NewBookSide("bid"),
+		Asks:  NewBookSide("ask"),
+		Depth: depth,
+	}
+}
+
+// Update applies a single change to a side of the book. side is either BIDS or ASKS and a
+// size of 0 removes the level
+func (o *OrderBook) Update(side int, price, size decimal.Decimal) {
+	if side == BIDS {
+		o.Bids.Set(price, size)
+	} else if side == ASKS {
+		o.Asks.Set(price, size)
+	}
+}
+
+// Reset clears both sides of the book so it can be rebuilt from a snapshot
+func (o *OrderBook) Reset() {
+	o.Bids = NewBookSide("bid")
+	o.Asks = NewBookSide("ask")
+	o.Invalid = false
+}
+
+// Truncate removes every level beyond Depth on both sides. Some exchanges only send updates
+// within the subscribed depth and expect levels pushed out of it to be dropped
+func (o *OrderBook) Truncate() {
+	if o.Depth <= 0 {
+		return
+	}
+	o.Bids.Levels = o.Bids.Top(o.Depth)
+	o.Asks.Levels = o.Asks.Top(o.Depth)
+}
+
+// TopBids returns the top Depth bids
+func (o *OrderBook) TopBids() []SpreadNode {
+	return o.Bids.Top(o.Depth)
+}
+
+// TopAsks returns the top Depth asks
+func (o *OrderBook) TopAsks() []SpreadNode {
+	return o.Asks.Top(o.Depth)
+}
+
+// Empty returns true if either side of the book has no levels
+func (o *OrderBook) Empty() bool {
+	return o.Bids.Len() == 0 || o.Asks.Len() == 0
+}
+
+// Verify compares the full book against a book built from a fresh snapshot and returns an
+// error describing the first difference found
+func (o *OrderBook) Verify(snapshot *OrderBook) error {
+	sides := []struct {
+		have, want *BookSide
+	}{
+		{o.Bids, snapshot.Bids},
+		{o.Asks, snapshot.Asks},
+	}
+	for _, val := range sides {
+		if val.have.Len() != val.want.Len() {
+			return fmt.Errorf("%s side has %d levels but snapshot has %d", val.have.Side, val.have.Len(), val.want.Len())
+		}
+		for i, level := range val.want.Levels {
+			if val.have.Levels[i] != level {
+				return fmt.Errorf("%s level %d is %v but snapshot has %v", val.have.Side, i, val.have.Levels[i], level)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package exchange_test
+
+import (
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+var mockSpreads = []exchange.SpreadNode{
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.01"),
+		Size:  decimal.MustParse("0.43"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.04"),
+		Size:  decimal.MustParse("0.04"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.02"),
+		Size:  decimal.MustParse("0.243"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.90"),
+		Size:  decimal.MustParse("0.67"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.83"),
+		Size:  decimal.MustParse("0.145"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.07"),
+		Size:  decimal.MustParse("0.98"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.13"),
+		Size:  decimal.MustParse("0.99"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.25"),
+		Size:  decimal.MustParse("0.67"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.88"),
+		Size:  decimal.MustParse("0.76"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.33"),
+		Size:  decimal.MustParse("0.11"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.44"),
+		Size:  decimal.MustParse("0.25"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.52"),
+		Size:  decimal.MustParse("0.43"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.56"),
+		Size:  decimal.MustParse("0.88"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.69"),
+		Size:  decimal.MustParse("0.69"),
+	},
+	exchange.SpreadNode{
+		Price: decimal.MustParse("8000.73"),
+		Size:  decimal.MustParse("0.43"),
+	},
+}
+
+func TestOrderBookSorting(t *testing.T) {
+	book := exchange.NewOrderBook(5)
+	for _, val := range mockSpreads {
+		book.Update(exchange.BIDS, val.Price, val.Size)
+		book.Update(exchange.ASKS, val.Price, val.Size)
+	}
+	if book.Bids.Len() != len(mockSpreads) || book.Asks.Len() != len(mockSpreads) {
+		t.Fatalf("Expected the full book of %d levels but got %d bids and %d asks", len(mockSpreads), book.Bids.Len(), book.Asks.Len())
+	}
+	for i := 1; i < book.Bids.Len(); i++ {
+		if !book.Bids.Levels[i].Price.LessThan(book.Bids.Levels[i-1].Price) {
+			t.Errorf("Bids are not sorted properly at index %d: %#v", i, book.Bids.Levels)
+		}
+		if !book.Asks.Levels[i].Price.GreaterThan(book.Asks.Levels[i-1].Price) {
+			t.Errorf("Asks are not sorted properly at index %d: %#v", i, book.Asks.Levels)
+		}
+	}
+	if len(book.TopBids()) != 5 || len(book.TopAsks()) != 5 {
+		t.Errorf("Expected 5 levels to be emitted but got %d bids and %d asks", len(book.TopBids()), len(book.TopAsks()))
+	}
+	if book.TopBids()[0].Price != decimal.MustParse("8000.90") || book.TopAsks()[0].Price != decimal.MustParse("8000.01") {
+		t.Errorf("Expected best bid of 8000.90 and best ask of 8000.01 but got %s and %s", book.TopBids()[0].Price, book.TopAsks()[0].Price)
+	}
+}
+
+func TestOrderBookUpdate(t *testing.T) {
+	book := exchange.NewOrderBook(2)
+	book.Update(exchange.BIDS, decimal.NewFromInt(100), decimal.NewFromInt(1))
+	book.Update(exchange.BIDS, decimal.NewFromInt(99), decimal.NewFromInt(2))
+	book.Update(exchange.BIDS, decimal.NewFromInt(98), decimal.NewFromInt(3))
+
+	// Updating a level outside of the emitted depth must still be applied
+	book.Update(exchange.BIDS, decimal.NewFromInt(98), decimal.NewFromInt(4))
+	if book.Bids.Levels[2].Size != decimal.MustParse("4") {
+		t.Errorf("Expected size of 4 for level outside of depth but got %s", book.Bids.Levels[2].Size)
+	}
+
+	// Removing the best level surfaces the next one
+	book.Update(exchange.BIDS, decimal.NewFromInt(100), decimal.NewFromInt(0))
+	top := book.TopBids()
+	if len(top) != 2 || top[0].Price != decimal.MustParse("99") || top[1].Price != decimal.MustParse("98") || top[1].Size != decimal.MustParse("4") {
+		t.Errorf("Expected 99 and 98 to be the top levels but got %#v", top)
+	}
+
+	// Removing a level that doesn't exist does nothing
+	book.Update(exchange.BIDS, decimal.NewFromInt(50), decimal.NewFromInt(0))
+	if book.Bids.Len() != 2 {
+		t.Errorf("Expected 2 levels but got %d", book.Bids.Len())
+	}
+	if !book.Empty() {
+		t.Error("Expected book with no asks to be empty")
+	}
+}
+
+func TestOrderBookVerify(t *testing.T) {
+	book := exchange.NewOrderBook(10)
+	snapshot := exchange.NewOrderBook(10)
+	for _, val := range mockSpreads[:5] {
+		book.Update(exchange.ASKS, val.Price, val.Size)
+		snapshot.Update(exchange.ASKS, val.Price, val.Size)
+	}
+	if err := book.Verify(snapshot); err != nil {
+		t.Errorf("Expected books to match: %s", err)
+	}
+	book.Update(exchange.ASKS, mockSpreads[0].Price, decimal.NewFromInt(100))
+	if err := book.Verify(snapshot); err == nil {
+		t.Error("Expected books with different sizes not to match")
+	}
+	book.Reset()
+	if err := book.Verify(snapshot); err == nil {
+		t.Error("Expected books with a different number of levels not to match")
+	}
+}
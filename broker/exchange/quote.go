@@ -1,20 +1,35 @@
 package exchange
 
+import (
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
 // Quote represents a quote from an exchange
 type Quote struct {
-	Exchange string `json:"exchange"`
-	ExPair   string `json:"ex_pair"`
-	HePair   string `json:"he_pair"`
-	ExBase   string `json:"ex_base"`
-	ExQuote  string `json:"ex_quote"`
-	HeBase   string `json:"he_base"`
-	HeQuote  string `json:"he_quote"`
-	Bid      string `json:"bid"`
-	Ask      string `json:"ask"`
+	Exchange string          `json:"exchange"`
+	ExPair   string          `json:"ex_pair"`
+	HePair   string          `json:"he_pair"`
+	ExBase   string          `json:"ex_base"`
+	ExQuote  string          `json:"ex_quote"`
+	HeBase   string          `json:"he_base"`
+	HeQuote  string          `json:"he_quote"`
+	Bid      decimal.Decimal `json:"bid"`
+	Ask      decimal.Decimal `json:"ask"`
+	// BidSize and AskSize are the quantities available at the best bid and ask in the base
+	// currency. They're 0 if the exchange doesn't send them
+	BidSize decimal.Decimal `json:"bid_size"`
+	AskSize decimal.Decimal `json:"ask_size"`
+	// ExchangeTime is when the exchange generated the quote. It's zero if the exchange doesn't
+	// send event times
+	ExchangeTime time.Time `json:"exchange_time"`
+	// ReceivedAt is when the message the quote was parsed from was read
+	ReceivedAt time.Time `json:"received_at"`
 }
 
 // NewExchangeQuote returns a new exchange quote struct
-func NewExchangeQuote(exchange, pair, bid, ask string) *Quote {
+func NewExchangeQuote(exchange, pair string, bid, ask decimal.Decimal) *Quote {
 	p := pair
 	return &Quote{
 		Exchange: exchange,
@@ -0,0 +1,211 @@
+package exchange
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+)
+
+// Config holds the options of an exchange from the exchanges section of the config file.
+// Zero values keep the adapter's defaults
+//
+// exchanges:
+//   - name: kraken
+//     channel: book
+//     depth: 25
+//     pairs: ["*-USD", "*-BTC"]
+//     exclude_pairs: ["DOGE-*"]
+//     max_age: 30s
+//     proxy: socks5://localhost:1080
+//     record: true
+//     api_key: key
+//     api_secret: secret
+type Config struct {
+	Name string `mapstructure:"name"`
+	// WSURL overrides the websocket url of the exchange
+	WSURL string `mapstructure:"ws_url"`
+	// RESTURL overrides the base url of the exchange's REST api
+	RESTURL string `mapstructure:"rest_url"`
+	// Channel is the market data channel quotes are built from. Each adapter documents the
+	// channels it supports
+	Channel string `mapstructure:"channel"`
+	// Depth is the number of order book levels per side for channels with a book
+	Depth int `mapstructure:"depth"`
+	// Pairs only allows helgart pairs matching one of these patterns if set. Patterns use
+	// shell globbing, ex: BTC-USD, *-BTC or DOGE-*
+	Pairs []string `mapstructure:"pairs"`
+	// ExcludePairs denies helgart pairs matching one of these patterns
+	ExcludePairs []string `mapstructure:"exclude_pairs"`
+	// MaxAge is how long a quote is used for arbitrage without an update, ex: 30s. Defaults to
+	// DefaultMaxAge
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// ChannelsPerConnection overrides the number of channels an adapter subscribes to on each
+	// connection before opening another one
+	ChannelsPerConnection int `mapstructure:"channels_per_connection"`
+	// RESTFallback is how long the websocket feed has to be down before quotes are polled from
+	// the REST api, ex: 1m. The fallback is disabled if not set
+	RESTFallback time.Duration `mapstructure:"rest_fallback"`
+	// Proxy routes the websocket and REST connections of the exchange through an HTTP CONNECT
+	// or SOCKS5 proxy, ex: http://proxy:3128 or socks5://proxy:1080. direct connects without
+	// a proxy. The proxy from the environment is used if not set
+	Proxy string `mapstructure:"proxy"`
+	// Record writes every websocket frame sent to or received from the exchange to capture
+	// files. See api.Frame for their format
+	Record bool `mapstructure:"record"`
+	// APIKey and APISecret are the credentials of the account traded on. Passphrase is only
+	// needed by coinbase
+	APIKey     string `mapstructure:"api_key"`
+	APISecret  string `mapstructure:"api_secret"`
+	Passphrase string `mapstructure:"passphrase"`
+}
+
+// GetWSURL returns the parsed websocket url override or nil if not set
+func (c *Config) GetWSURL() (*url.URL, error) {
+	return parseURL(c.WSURL)
+}
+
+// GetRESTURL returns the parsed REST url override or nil if not set
+func (c *Config) GetRESTURL() (*url.URL, error) {
+	return parseURL(c.RESTURL)
+}
+
+// GetProxy returns the proxy the exchange connects through
+func (c *Config) GetProxy() (api.ProxyFunc, error) {
+	return api.ParseProxy(c.Proxy)
+}
+
+func parseURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%s is not an absolute url", raw)
+	}
+	return u, nil
+}
+
+// AllowsPair returns true if the helgart pair isn't filtered out by Pairs or ExcludePairs
+func (c *Config) AllowsPair(hePair string) bool {
+	if len(c.Pairs) > 0 && !matchAny(hePair, c.Pairs) {
+		return false
+	}
+	return !matchAny(hePair, c.ExcludePairs)
+}
+
+// matchAny returns true if the pair matches one of the patterns. Patterns are validated when
+// the config is loaded so errors are treated as no match
+func matchAny(pair string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, pair); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Factory builds an exchange from its config. newHelper returns a new connection every time
+// it's called so exchanges can open as many as they need. httpClient sends every request to
+// the REST api of the exchange. A nil client keeps the adapter's default
+type Factory func(newHelper api.HelperFactory, httpClient *http.Client, config *Config, quoteCh chan<- Quote, errorCh chan<- error) (Exchange, error)
+
+var (
+	registryMtx sync.RWMutex
+	registry    = make(map[string]Factory)
+)
+
+// Register makes an exchange available by name. Adapters call it from their init function
+// and it panics if the name is registered twice
+func Register(name string, factory Factory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if factory == nil {
+		panic("exchange: Register factory is nil for " + name)
+	}
+	if _, ok := registry[name]; ok {
+		panic("exchange: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of every registered exchange sorted alphabetically
+func Registered() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the exchange registered under config.Name
+func New(newHelper api.HelperFactory, httpClient *http.Client, config *Config, quoteCh chan<- Quote, errorCh chan<- error) (Exchange, error) {
+	registryMtx.RLock()
+	factory, ok := registry[config.Name]
+	registryMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown exchange %q. Registered exchanges are %v", config.Name, Registered())
+	}
+	exchange, err := factory(newHelper, httpClient, config, quoteCh, errorCh)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring %s: %s", config.Name, err)
+	}
+	return exchange, nil
+}
+
+// ValidateConfigs checks every exchange in the config is registered, listed once and has
+// valid urls and pair patterns
+func ValidateConfigs(configs []*Config) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("No exchanges enabled")
+	}
+	registered := Registered()
+	seen := make(map[string]struct{})
+	for _, config := range configs {
+		if indexOf(config.Name, registered) == -1 {
+			return fmt.Errorf("Unknown exchange %q in config. Registered exchanges are %v", config.Name, registered)
+		}
+		if _, ok := seen[config.Name]; ok {
+			return fmt.Errorf("Exchange %s is listed more than once in config", config.Name)
+		}
+		seen[config.Name] = struct{}{}
+		if _, err := config.GetWSURL(); err != nil {
+			return fmt.Errorf("Invalid ws_url for %s: %s", config.Name, err)
+		}
+		if _, err := config.GetRESTURL(); err != nil {
+			return fmt.Errorf("Invalid rest_url for %s: %s", config.Name, err)
+		}
+		if _, err := config.GetProxy(); err != nil {
+			return fmt.Errorf("Invalid proxy for %s: %s", config.Name, err)
+		}
+		for _, patterns := range [][]string{config.Pairs, config.ExcludePairs} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("Invalid pair pattern %q for %s: %s", pattern, config.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultConfigs returns a config with default options for every registered exchange. It's
+// used when the config file doesn't list any exchanges
+func DefaultConfigs() []*Config {
+	var configs []*Config
+	for _, name := range Registered() {
+		configs = append(configs, &Config{Name: name})
+	}
+	return configs
+}
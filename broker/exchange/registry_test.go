@@ -0,0 +1,78 @@
+package exchange_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func init() {
+	exchange.Register("mock", func(newHelper api.HelperFactory, httpClient *http.Client, config *exchange.Config, quoteCh chan<- exchange.Quote, errorCh chan<- error) (exchange.Exchange, error) {
+		return nil, nil
+	})
+}
+
+func TestValidateConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []*exchange.Config
+		valid   bool
+	}{
+		{"registered", []*exchange.Config{{Name: "mock", WSURL: "wss://example.com/ws"}}, true},
+		{"unknown", []*exchange.Config{{Name: "mock"}, {Name: "mtgox"}}, false},
+		{"duplicate", []*exchange.Config{{Name: "mock"}, {Name: "mock"}}, false},
+		{"relative url", []*exchange.Config{{Name: "mock", RESTURL: "/api"}}, false},
+		{"socks5 proxy", []*exchange.Config{{Name: "mock", Proxy: "socks5://localhost:1080"}}, true},
+		{"direct", []*exchange.Config{{Name: "mock", Proxy: "direct"}}, true},
+		{"unsupported proxy", []*exchange.Config{{Name: "mock", Proxy: "ftp://localhost:21"}}, false},
+		{"empty", []*exchange.Config{}, false},
+	}
+	for _, val := range tests {
+		err := exchange.ValidateConfigs(val.configs)
+		if val.valid && err != nil {
+			t.Errorf("Expected %s config to be valid but got %s", val.name, err)
+		} else if !val.valid && err == nil {
+			t.Errorf("Expected %s config to be invalid", val.name)
+		}
+	}
+	if _, err := exchange.New(nil, nil, &exchange.Config{Name: "mtgox"}, nil, nil); err == nil {
+		t.Error("Expected an error building an unknown exchange")
+	}
+}
+
+func TestAllowsPair(t *testing.T) {
+	config := &exchange.Config{Pairs: []string{"*-USD", "*-BTC"}, ExcludePairs: []string{"DOGE-*", "ETH-USD"}}
+	expected := map[string]bool{
+		"BTC-USD":  true,
+		"ETH-BTC":  true,
+		"ETH-USD":  false,
+		"DOGE-BTC": false,
+		"XRP-EUR":  false,
+	}
+	for pair, allowed := range expected {
+		if config.AllowsPair(pair) != allowed {
+			t.Errorf("Expected AllowsPair(%s) to be %t", pair, allowed)
+		}
+	}
+	config = &exchange.Config{ExcludePairs: []string{"DOGE-USD"}}
+	if !config.AllowsPair("BTC-USD") || config.AllowsPair("DOGE-USD") {
+		t.Error("Expected only excluded pairs to be denied without an allow list")
+	}
+	err := exchange.ValidateConfigs([]*exchange.Config{{Name: "mock", Pairs: []string{"[BTC-USD"}}})
+	if err == nil {
+		t.Error("Expected an error for a malformed pair pattern")
+	}
+}
+
+func TestTradable(t *testing.T) {
+	products := exchange.ExProductMap{
+		"XBT/USD": exchange.Product{HePair: "BTC-USD"},
+		"ETH/USD": exchange.Product{HePair: "ETH-USD"},
+	}
+	pairs := products.Tradable([]string{"XRP/USD", "XBT/USD", "ETH/USD"})
+	if len(pairs) != 2 || pairs[0] != "ETH/USD" || pairs[1] != "XBT/USD" {
+		t.Errorf("Expected only listed pairs in the product map but got %v", pairs)
+	}
+}
@@ -0,0 +1,198 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Order sides
+const (
+	BUY  = "buy"
+	SELL = "sell"
+)
+
+// Order types. An IOC order is a limit order whose quantity that can't be filled immediately
+// is canceled
+const (
+	LIMIT  = "limit"
+	MARKET = "market"
+	IOC    = "ioc"
+)
+
+// Order statuses. Orders canceled after being partially filled are CANCELED with Filled set
+const (
+	PENDING  = "pending"
+	OPEN     = "open"
+	FILLED   = "filled"
+	CANCELED = "canceled"
+	REJECTED = "rejected"
+)
+
+// Errors trading adapters map the errors of their exchange to. They're wrapped in a
+// TradeError so check them with Cause
+var (
+	ErrInsufficientFunds = errors.New("Insufficient funds")
+	ErrOrderNotFound     = errors.New("Order not found")
+	ErrInvalidOrder      = errors.New("Invalid order")
+	ErrRateLimited       = errors.New("Rate limited")
+	ErrAuthentication    = errors.New("Authentication failed")
+)
+
+// TradeError is an error returned by the trading api of an exchange. Err is one of the errors
+// above if the exchange error is known
+type TradeError struct {
+	Exchange string
+	// Message is the error as sent by the exchange
+	Message string
+	Err     error
+}
+
+func (e *TradeError) Error() string {
+	msg := e.Message
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", e.Err, e.Message)
+	}
+	if e.Exchange == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s: %s", e.Exchange, msg)
+}
+
+// Cause returns the known error a TradeError maps to, or err itself if it isn't a TradeError
+// or its exchange error is unknown
+func Cause(err error) error {
+	if e, ok := err.(*TradeError); ok && e.Err != nil {
+		return e.Err
+	}
+	return err
+}
+
+// OrderRequest is an order to place on an exchange
+type OrderRequest struct {
+	// ExPair is the pair as named by the exchange, like in the product map
+	ExPair string
+	Side   string
+	Type   string
+	// Quantity is the quantity of the base to buy or sell
+	Quantity decimal.Decimal
+	// Price is the limit price in the quote currency. It's ignored for MARKET orders
+	Price decimal.Decimal
+	// ClientID identifies the order on our side if set. Exchanges restrict its format: a
+	// UUID for coinbase and a positive integer for kraken and bitfinex
+	ClientID string
+}
+
+// Validate checks the side, type, quantity and price of the order are set
+func (r *OrderRequest) Validate() error {
+	if r.ExPair == "" {
+		return &TradeError{Message: "missing pair", Err: ErrInvalidOrder}
+	}
+	if r.Side != BUY && r.Side != SELL {
+		return &TradeError{Message: fmt.Sprintf("unknown side %q", r.Side), Err: ErrInvalidOrder}
+	}
+	switch r.Type {
+	case MARKET:
+	case LIMIT, IOC:
+		if r.Price.Sign() <= 0 {
+			return &TradeError{Message: "price must be positive", Err: ErrInvalidOrder}
+		}
+	default:
+		return &TradeError{Message: fmt.Sprintf("unknown type %q", r.Type), Err: ErrInvalidOrder}
+	}
+	if r.Quantity.Sign() <= 0 {
+		return &TradeError{Message: "quantity must be positive", Err: ErrInvalidOrder}
+	}
+	return nil
+}
+
+// Order is an order as reported by an exchange
+type Order struct {
+	ID       string          `json:"id"`
+	ClientID string          `json:"client_id,omitempty"`
+	ExPair   string          `json:"ex_pair"`
+	Side     string          `json:"side"`
+	Type     string          `json:"type"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Filled   decimal.Decimal `json:"filled"`
+	// AvgPrice is the average price of the fills, 0 if nothing was filled or the exchange
+	// doesn't report it
+	AvgPrice  decimal.Decimal `json:"avg_price"`
+	Status    string          `json:"status"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Balance is the balance of an asset on an exchange account
+type Balance struct {
+	// Free is what can be traded and Locked what is held by open orders
+	Free   decimal.Decimal `json:"free"`
+	Locked decimal.Decimal `json:"locked"`
+}
+
+// Trader places and manages orders on an exchange account. Pairs and assets are named as
+// the exchange names them in its market data, like ExPair, ExBase and ExQuote of products
+type Trader interface {
+	PlaceOrder(ctx context.Context, req *OrderRequest) (*Order, error)
+	CancelOrder(ctx context.Context, exPair, id string) error
+	GetOrder(ctx context.Context, exPair, id string) (*Order, error)
+	// GetBalances returns the balance of every asset held by the account
+	GetBalances(ctx context.Context) (map[string]Balance, error)
+}
+
+// TraderFactory builds the trader of an exchange account from its config. httpClient sends
+// every request to the exchange. A nil client keeps the adapter's default
+type TraderFactory func(httpClient *http.Client, config *Config) (Trader, error)
+
+var traderRegistry = make(map[string]TraderFactory)
+
+// RegisterTrader makes the trader of an exchange available by name. Adapters call it from
+// their init function and it panics if the name is registered twice
+func RegisterTrader(name string, factory TraderFactory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if factory == nil {
+		panic("exchange: RegisterTrader factory is nil for " + name)
+	}
+	if _, ok := traderRegistry[name]; ok {
+		panic("exchange: RegisterTrader called twice for " + name)
+	}
+	traderRegistry[name] = factory
+}
+
+// RegisteredTraders returns the names of every exchange that can be traded on sorted
+// alphabetically
+func RegisteredTraders() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	var names []string
+	for name := range traderRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTrader builds the trader of the exchange named config.Name with the credentials of the
+// config
+func NewTrader(httpClient *http.Client, config *Config) (Trader, error) {
+	registryMtx.RLock()
+	factory, ok := traderRegistry[config.Name]
+	registryMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Trading isn't supported on %q. Supported exchanges are %v", config.Name, RegisteredTraders())
+	}
+	if config.APIKey == "" || config.APISecret == "" {
+		return nil, fmt.Errorf("Missing api_key or api_secret for %s", config.Name)
+	}
+	trader, err := factory(httpClient, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring %s trader: %s", config.Name, err)
+	}
+	return trader, nil
+}
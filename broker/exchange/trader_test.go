@@ -0,0 +1,61 @@
+package exchange_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func init() {
+	exchange.RegisterTrader("mock", func(httpClient *http.Client, config *exchange.Config) (exchange.Trader, error) {
+		return nil, nil
+	})
+}
+
+func TestOrderRequestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   exchange.OrderRequest
+		valid bool
+	}{
+		{"limit", exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.BUY, Type: exchange.LIMIT, Quantity: decimal.MustParse("1"), Price: decimal.MustParse("100")}, true},
+		{"market without price", exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.SELL, Type: exchange.MARKET, Quantity: decimal.MustParse("1")}, true},
+		{"ioc without price", exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.SELL, Type: exchange.IOC, Quantity: decimal.MustParse("1")}, false},
+		{"unknown side", exchange.OrderRequest{ExPair: "BTC-USD", Side: "short", Type: exchange.MARKET, Quantity: decimal.MustParse("1")}, false},
+		{"unknown type", exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.BUY, Type: "stop", Quantity: decimal.MustParse("1")}, false},
+		{"zero quantity", exchange.OrderRequest{ExPair: "BTC-USD", Side: exchange.BUY, Type: exchange.MARKET}, false},
+		{"missing pair", exchange.OrderRequest{Side: exchange.BUY, Type: exchange.MARKET, Quantity: decimal.MustParse("1")}, false},
+	}
+	for _, val := range tests {
+		err := val.req.Validate()
+		if val.valid && err != nil {
+			t.Errorf("Expected %s order to be valid but got %s", val.name, err)
+		} else if !val.valid && exchange.Cause(err) != exchange.ErrInvalidOrder {
+			t.Errorf("Expected %s order to be invalid but got %v", val.name, err)
+		}
+	}
+}
+
+func TestNewTrader(t *testing.T) {
+	if _, err := exchange.NewTrader(nil, &exchange.Config{Name: "mock", APIKey: "key", APISecret: "secret"}); err != nil {
+		t.Errorf("Expected mock trader but got %s", err)
+	}
+	if _, err := exchange.NewTrader(nil, &exchange.Config{Name: "mock", APIKey: "key"}); err == nil {
+		t.Error("Expected an error without an api secret")
+	}
+	if _, err := exchange.NewTrader(nil, &exchange.Config{Name: "mtgox", APIKey: "key", APISecret: "secret"}); err == nil {
+		t.Error("Expected an error for an exchange without a trader")
+	}
+}
+
+func TestTradeError(t *testing.T) {
+	var err error = &exchange.TradeError{Exchange: "mock", Message: "EOrder:Insufficient funds", Err: exchange.ErrInsufficientFunds}
+	if exchange.Cause(err) != exchange.ErrInsufficientFunds {
+		t.Errorf("Expected %s to be insufficient funds", err)
+	}
+	if err := exchange.Cause(exchange.ErrRateLimited); err != exchange.ErrRateLimited {
+		t.Errorf("Expected the cause of an unwrapped error to be itself but got %s", err)
+	}
+}
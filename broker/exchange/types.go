@@ -3,6 +3,7 @@ package exchange
 import (
 	"context"
 	"net/url"
+	"sort"
 )
 
 // ChannelPairMap maps a channelid returned in the api to a specific pair
@@ -10,17 +11,33 @@ type ChannelPairMap map[int]string
 
 // Exchange represents an exchange and each exchange should implement this interface
 type Exchange interface {
+	Name() string
 	Start(context.Context, ProductMap, chan<- struct{}) error
 	StartTickerListener(context.Context, chan<- struct{})
 	GetURL() *url.URL
 	ParseTickerResponse(msg []byte) ([]Quote, error)
+	// SubscribedPairs returns the exchange pairs quotes are received for once started
+	SubscribedPairs() []string
 }
 
-// OrderBook holds the bids and asks for a given pair
-type OrderBook struct {
-	Bids *SpreadStack
-	Asks *SpreadStack
+// GapReporter is implemented by exchanges that detect gaps in the sequence numbers of their feeds
+type GapReporter interface {
+	// SequenceGaps returns the number of gaps detected per exchange pair
+	SequenceGaps() map[string]int
 }
 
-// OrderBookMap holds a stack of bids and asks with the pair as the key
-type OrderBookMap map[string]OrderBook
+// Tradable returns the pairs listed by an exchange that are in the product map sorted
+// alphabetically. These are the only pairs worth subscribing to
+func (m ExProductMap) Tradable(listed []string) []string {
+	var pairs []string
+	for _, pair := range listed {
+		if _, ok := m[pair]; ok {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// OrderBookMap holds the order book for each pair with the pair as the key
+type OrderBookMap map[string]*OrderBook
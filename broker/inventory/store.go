@@ -0,0 +1,26 @@
+package inventory
+
+import (
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Holding is the balance of an asset on an exchange account. Asset is the helgart name of the
+// asset, ex: BTC for XBT on kraken
+type Holding struct {
+	Exchange string          `json:"exchange"`
+	Asset    string          `json:"asset"`
+	Free     decimal.Decimal `json:"free"`
+	Locked   decimal.Decimal `json:"locked"`
+	// UpdatedAt is when the balance was fetched from the exchange
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store persists the holdings of an inventory
+type Store interface {
+	// SaveHoldings replaces every persisted holding of an exchange with holdings
+	SaveHoldings(exchangeName string, holdings []Holding) error
+	// FetchHoldings returns every persisted holding
+	FetchHoldings() ([]Holding, error)
+}
@@ -0,0 +1,206 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// DefaultInterval is how often balances are fetched when the config doesn't set an interval
+const DefaultInterval = time.Minute
+
+// amountPrecision is the number of decimal places executable quantities are rounded down to
+const amountPrecision = 8
+
+var one = decimal.NewFromInt(1)
+
+// Tracker keeps track of the balances of the exchange accounts we trade on. Balances are
+// fetched every Interval with the trader of each exchange, kept in memory by exchange then
+// helgart asset and persisted to a store
+type Tracker struct {
+	Interval time.Duration
+	// Fees is the schedule the spreads of opportunities are net of. Buys are charged the taker
+	// fee in the quote currency so it limits the quantity they can afford
+	Fees    *exchange.FeeSchedule
+	traders map[string]exchange.Trader
+	store   Store
+	mtx     sync.RWMutex
+	// assets maps the asset names of each exchange to helgart names
+	assets   map[string]map[string]string
+	holdings map[string]map[string]Holding
+}
+
+// NewTracker returns a tracker fetching balances with traders by exchange name. Holdings are
+// restored from the store until balances are fetched again
+func NewTracker(traders map[string]exchange.Trader, store Store) (*Tracker, error) {
+	t := &Tracker{
+		Interval: DefaultInterval,
+		traders:  traders,
+		store:    store,
+		assets:   make(map[string]map[string]string),
+		holdings: make(map[string]map[string]Holding),
+	}
+	stored, err := store.FetchHoldings()
+	if err != nil {
+		return nil, err
+	}
+	for _, holding := range stored {
+		if _, ok := t.holdings[holding.Exchange]; !ok {
+			t.holdings[holding.Exchange] = make(map[string]Holding)
+		}
+		t.holdings[holding.Exchange][holding.Asset] = holding
+	}
+	return t, nil
+}
+
+// SetProducts maps the asset names of each exchange to helgart names with the base and quote
+// of its products, ex: XBT to BTC on kraken. Assets without a product keep their name
+func (t *Tracker) SetProducts(products exchange.ProductMap) {
+	assets := make(map[string]map[string]string)
+	for exchangeName, exProducts := range products {
+		names := make(map[string]string)
+		for _, product := range exProducts {
+			names[strings.ToUpper(product.ExBase)] = strings.ToUpper(product.HeBase)
+			names[strings.ToUpper(product.ExQuote)] = strings.ToUpper(product.HeQuote)
+		}
+		assets[exchangeName] = names
+	}
+	t.mtx.Lock()
+	t.assets = assets
+	t.mtx.Unlock()
+}
+
+// Exchanges returns the names of the exchanges balances are fetched from sorted alphabetically
+func (t *Tracker) Exchanges() []string {
+	var names []string
+	for name := range t.traders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run fetches the balances of every exchange now and then every Interval until ctx is done
+func (t *Tracker) Run(ctx context.Context, errorCh chan<- error) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		for _, name := range t.Exchanges() {
+			err := t.Refresh(ctx, name, time.Now())
+			if err != nil {
+				select {
+				case errorCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the balances of an exchange and replaces its holdings with them as of now.
+// Holdings are kept in memory even if persisting them fails
+func (t *Tracker) Refresh(ctx context.Context, exchangeName string, now time.Time) error {
+	trader, ok := t.traders[exchangeName]
+	if !ok {
+		return fmt.Errorf("No trader for %s", exchangeName)
+	}
+	balances, err := trader.GetBalances(ctx)
+	if err != nil {
+		return fmt.Errorf("Error fetching %s balances: %s", exchangeName, err)
+	}
+	t.mtx.RLock()
+	names := t.assets[exchangeName]
+	t.mtx.RUnlock()
+	holdings := make(map[string]Holding)
+	for asset, balance := range balances {
+		name := strings.ToUpper(asset)
+		if heName, ok := names[name]; ok {
+			name = heName
+		}
+		// Different exchange assets can map to the same helgart asset
+		holding := holdings[name]
+		holdings[name] = Holding{
+			Exchange:  exchangeName,
+			Asset:     name,
+			Free:      holding.Free.Add(balance.Free),
+			Locked:    holding.Locked.Add(balance.Locked),
+			UpdatedAt: now,
+		}
+	}
+	t.mtx.Lock()
+	t.holdings[exchangeName] = holdings
+	t.mtx.Unlock()
+	err = t.store.SaveHoldings(exchangeName, sortHoldings(holdings))
+	if err != nil {
+		return fmt.Errorf("Error saving %s holdings: %s", exchangeName, err)
+	}
+	return nil
+}
+
+// Holdings returns every holding sorted by exchange then asset
+func (t *Tracker) Holdings() []Holding {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	var names []string
+	for name := range t.holdings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	holdings := []Holding{}
+	for _, name := range names {
+		holdings = append(holdings, sortHoldings(t.holdings[name])...)
+	}
+	return holdings
+}
+
+// Free returns the free balance of a helgart asset on an exchange, 0 if it has none
+func (t *Tracker) Free(exchangeName, asset string) decimal.Decimal {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.holdings[exchangeName][asset].Free
+}
+
+// Mark sets whether market can be executed with the holdings: buying on the low exchange takes
+// its quote currency, fees included, and selling on the high exchange takes the base.
+// ExecutableQuantity is the most of the base both cover, capped by Quantity if the exchanges
+// send sizes
+func (t *Tracker) Mark(market *exchange.ArbMarket) {
+	market.Executable = false
+	market.ExecutableQuantity = decimal.Decimal{}
+	if market.Low.Price.Sign() <= 0 {
+		return
+	}
+	quote := t.Free(market.Low.Exchange, market.Low.QuoteCurrency(market.HeBase))
+	base := t.Free(market.High.Exchange, market.HeBase)
+	fee := t.Fees.Taker(market.Low.Exchange, market.Low.HePair)
+	quantity := decimal.Min(quote.Div(market.Low.Price.Mul(one.Add(fee))).Floor(amountPrecision), base)
+	if market.Quantity.Sign() > 0 {
+		quantity = decimal.Min(quantity, market.Quantity)
+	}
+	if quantity.Sign() > 0 {
+		market.Executable = true
+		market.ExecutableQuantity = quantity
+	}
+}
+
+// sortHoldings returns holdings sorted by asset
+func sortHoldings(holdings map[string]Holding) []Holding {
+	sorted := make([]Holding, 0, len(holdings))
+	for _, holding := range holdings {
+		sorted = append(sorted, holding)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Asset < sorted[j].Asset })
+	return sorted
+}
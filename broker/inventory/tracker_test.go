@@ -0,0 +1,199 @@
+package inventory_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/inventory"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+var now = time.Date(2019, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func balance(free, locked string) exchange.Balance {
+	return exchange.Balance{Free: decimal.MustParse(free), Locked: decimal.MustParse(locked)}
+}
+
+func side(ex, pair, price, size string) exchange.MarketSide {
+	return exchange.MarketSide{
+		Exchange:          ex,
+		HePair:            pair,
+		Price:             decimal.MustParse(price),
+		TriangulatedPrice: decimal.MustParse(price),
+		Size:              decimal.MustParse(size),
+	}
+}
+
+func newTracker(t *testing.T, store *mock.InventoryStore) (*inventory.Tracker, *mock.Trader, *mock.Trader) {
+	t.Helper()
+	coinbase := mock.NewTrader(map[string]exchange.Balance{"USD": balance("1000", "50")})
+	kraken := mock.NewTrader(map[string]exchange.Balance{"XBT": balance("0.5", "0"), "USD": balance("10", "0")})
+	tracker, err := inventory.NewTracker(map[string]exchange.Trader{
+		exchange.COINBASE: coinbase,
+		exchange.KRAKEN:   kraken,
+	}, store)
+	if err != nil {
+		t.Fatalf("Error creating tracker: %s", err)
+	}
+	tracker.SetProducts(exchange.ProductMap{
+		exchange.KRAKEN: {
+			"XBT/USD": exchange.Product{Exchange: exchange.KRAKEN, ExBase: "XBT", ExQuote: "USD", HeBase: "BTC", HeQuote: "USD"},
+		},
+	})
+	return tracker, coinbase, kraken
+}
+
+func TestTrackerRefresh(t *testing.T) {
+	store := mock.NewInventoryStore()
+	tracker, _, kraken := newTracker(t, store)
+	for _, name := range tracker.Exchanges() {
+		err := tracker.Refresh(context.Background(), name, now)
+		if err != nil {
+			t.Fatalf("Error refreshing %s: %s", name, err)
+		}
+	}
+	// Kraken's XBT is tracked as BTC
+	holdings := tracker.Holdings()
+	expected := []string{"coinbase USD 1000 50", "kraken BTC 0.5 0", "kraken USD 10 0"}
+	if len(holdings) != len(expected) {
+		t.Fatalf("Expected %d holdings but got %+v", len(expected), holdings)
+	}
+	for i, holding := range holdings {
+		got := holding.Exchange + " " + holding.Asset + " " + holding.Free.String() + " " + holding.Locked.String()
+		if got != expected[i] || !holding.UpdatedAt.Equal(now) {
+			t.Errorf("Expected holding %q at %s but got %q at %s", expected[i], now, got, holding.UpdatedAt)
+		}
+	}
+	stored, _ := store.FetchHoldings()
+	if len(stored) != len(expected) {
+		t.Errorf("Expected %d persisted holdings but got %+v", len(expected), stored)
+	}
+
+	// Holdings are replaced on refresh and restored from the store
+	kraken.SetBalances(map[string]exchange.Balance{"USD": balance("20", "0")})
+	err := tracker.Refresh(context.Background(), exchange.KRAKEN, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Error refreshing kraken: %s", err)
+	}
+	if free := tracker.Free(exchange.KRAKEN, "BTC"); !free.IsZero() {
+		t.Errorf("Expected no BTC on kraken after refresh but got %s", free)
+	}
+	restored, err := inventory.NewTracker(nil, store)
+	if err != nil {
+		t.Fatalf("Error restoring tracker: %s", err)
+	}
+	if free := restored.Free(exchange.KRAKEN, "USD"); free.String() != "20" {
+		t.Errorf("Expected 20 USD on kraken to be restored but got %s", free)
+	}
+}
+
+func TestTrackerRefreshError(t *testing.T) {
+	store := mock.NewInventoryStore()
+	tracker, coinbase, _ := newTracker(t, store)
+	err := tracker.Refresh(context.Background(), exchange.COINBASE, now)
+	if err != nil {
+		t.Fatalf("Error refreshing coinbase: %s", err)
+	}
+	// Failed fetches keep the last holdings
+	coinbase.Err = exchange.ErrRateLimited
+	err = tracker.Refresh(context.Background(), exchange.COINBASE, now.Add(time.Minute))
+	if err == nil {
+		t.Errorf("Expected an error when fetching balances fails")
+	}
+	if free := tracker.Free(exchange.COINBASE, "USD"); free.String() != "1000" {
+		t.Errorf("Expected to keep 1000 USD on coinbase but got %s", free)
+	}
+	// Holdings are kept in memory when they can't be persisted
+	coinbase.Err = nil
+	coinbase.SetBalances(map[string]exchange.Balance{"USD": balance("900", "0")})
+	store.Err = errors.New("db down")
+	err = tracker.Refresh(context.Background(), exchange.COINBASE, now.Add(2*time.Minute))
+	if err == nil {
+		t.Errorf("Expected an error when saving holdings fails")
+	}
+	if free := tracker.Free(exchange.COINBASE, "USD"); free.String() != "900" {
+		t.Errorf("Expected 900 USD on coinbase but got %s", free)
+	}
+	if err := tracker.Refresh(context.Background(), exchange.BINANCE, now); err == nil {
+		t.Errorf("Expected an error refreshing an exchange without a trader")
+	}
+}
+
+func TestTrackerMark(t *testing.T) {
+	store := mock.NewInventoryStore(
+		inventory.Holding{Exchange: exchange.COINBASE, Asset: "USD", Free: decimal.MustParse("150")},
+		inventory.Holding{Exchange: exchange.KRAKEN, Asset: "BTC", Free: decimal.MustParse("2")},
+	)
+	tracker, err := inventory.NewTracker(nil, store)
+	if err != nil {
+		t.Fatalf("Error creating tracker: %s", err)
+	}
+	tests := []struct {
+		name     string
+		market   *exchange.ArbMarket
+		expected string
+	}{
+		// 150 USD buys 1.5 BTC on coinbase
+		{"quote", exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "5"), side(exchange.KRAKEN, "BTC-USD", "102", "3"), nil), "1.5"},
+		{"size", exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "0.2"), side(exchange.KRAKEN, "BTC-USD", "102", "3"), nil), "0.2"},
+		{"unknown size", exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "50", "0"), side(exchange.KRAKEN, "BTC-USD", "51", "0"), nil), "2"},
+		{"rounded down", exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "90", "0"), side(exchange.KRAKEN, "BTC-USD", "92", "0"), nil), "1.66666666"},
+		{"no base", exchange.NewArbMarket("BTC", side(exchange.KRAKEN, "BTC-USD", "100", "5"), side(exchange.COINBASE, "BTC-USD", "102", "3"), nil), "0"},
+		{"no quote", exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-EUR", "100", "5"), side(exchange.KRAKEN, "BTC-USD", "102", "3"), nil), "0"},
+	}
+	for _, test := range tests {
+		tracker.Mark(test.market)
+		if test.market.ExecutableQuantity.String() != test.expected || test.market.Executable != (test.expected != "0") {
+			t.Errorf("%s: expected an executable quantity of %s but got %s (executable %t)", test.name, test.expected, test.market.ExecutableQuantity, test.market.Executable)
+		}
+	}
+}
+
+func TestTrackerMarkFees(t *testing.T) {
+	store := mock.NewInventoryStore(
+		inventory.Holding{Exchange: exchange.COINBASE, Asset: "USD", Free: decimal.MustParse("150")},
+		inventory.Holding{Exchange: exchange.KRAKEN, Asset: "BTC", Free: decimal.MustParse("2")},
+	)
+	tracker, err := inventory.NewTracker(nil, store)
+	if err != nil {
+		t.Fatalf("Error creating tracker: %s", err)
+	}
+	tracker.Fees = exchange.NewFeeSchedule()
+	tracker.Fees.Set(exchange.Fee{Exchange: exchange.COINBASE, Taker: decimal.MustParse("0.005")})
+	market := exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "5"), side(exchange.KRAKEN, "BTC-USD", "102", "3"), tracker.Fees)
+	tracker.Mark(market)
+	// 150 USD buys 1.49253731 BTC at 100.5 USD with the fee
+	if market.ExecutableQuantity.String() != "1.49253731" || !market.Executable {
+		t.Errorf("Expected an executable quantity of 1.49253731 but got %s (executable %t)", market.ExecutableQuantity, market.Executable)
+	}
+}
+
+func TestTrackerRun(t *testing.T) {
+	tracker, coinbase, _ := newTracker(t, mock.NewInventoryStore())
+	tracker.Interval = 10 * time.Millisecond
+	coinbase.Err = exchange.ErrAuthentication
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errorCh := make(chan error)
+	go tracker.Run(ctx, errorCh)
+	select {
+	case err := <-errorCh:
+		if err == nil || !strings.Contains(err.Error(), exchange.COINBASE) {
+			t.Errorf("Expected a coinbase error but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the coinbase error to be reported")
+	}
+	deadline := time.Now().Add(time.Second)
+	for tracker.Free(exchange.KRAKEN, "BTC").String() != "0.5" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected kraken balances to be fetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+package kraken
+
+import (
+	"net/http"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+func init() {
+	exchange.Register(exchange.KRAKEN, NewClientFromConfig)
+	exchange.RegisterTrader(exchange.KRAKEN, NewTraderFromConfig)
+}
+
+// NewClientFromConfig returns a new instance of the API configured from the exchange config.
+// channel is either spread or book
+func NewClientFromConfig(newHelper api.HelperFactory, httpClient *http.Client, config *exchange.Config, quoteCh chan<- exchange.Quote, errorCh chan<- error) (exchange.Exchange, error) {
+	c := NewClient(newHelper(), quoteCh, errorCh)
+	c.NewHelper = newHelper
+	if config.ChannelsPerConnection > 0 {
+		c.ChannelsPerConnection = config.ChannelsPerConnection
+	}
+	if config.Channel != "" {
+		c.Subscription = config.Channel
+	}
+	if config.Depth > 0 {
+		c.Depth = config.Depth
+	}
+	err := c.validateSubscription()
+	if err != nil {
+		return nil, err
+	}
+	c.WSURL, err = config.GetWSURL()
+	if err != nil {
+		return nil, err
+	}
+	c.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		c.HTTPClient = httpClient
+	}
+	return c, nil
+}
@@ -0,0 +1,55 @@
+package kraken
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// handleEvent handles an event read from the connection of a shard. Channel ids are recorded
+// from subscription acks and rejected subscriptions are returned as a *SubscriptionError
+func (c *Client) handleEvent(shardID int, msg []byte) error {
+	var res EventResponse
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling event from %s: %s", c.exchangeName, err)
+	}
+	switch res.Event {
+	case HEARTBEAT:
+		// Sent every second on connections without updates
+	case SYSTEMSTATUS:
+		if res.Status != "online" {
+			return fmt.Errorf("Error from %s: system status is %s", c.exchangeName, res.Status)
+		}
+	case SUBSCRIPTIONSTATUS:
+		channelPairMap := c.channelPairMap(shardID)
+		switch res.Status {
+		case "subscribed":
+			channelPairMap[res.ChannelID] = res.Pair
+		case "unsubscribed":
+			delete(channelPairMap, res.ChannelID)
+		case "error":
+			return &SubscriptionError{Pair: res.Pair, Subscription: res.Subscription.Name, Message: res.ErrorMessage}
+		}
+	case ERROR:
+		return &EventError{Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// channelPairMap returns the channel ids of the connection of a shard
+func (c *Client) channelPairMap(shardID int) exchange.ChannelPairMap {
+	channelPairMap, ok := c.channelPairMaps[shardID]
+	if !ok {
+		channelPairMap = make(exchange.ChannelPairMap)
+		c.channelPairMaps[shardID] = channelPairMap
+	}
+	return channelPairMap
+}
+
+// ChannelPair returns the pair subscribed to on a channel of the first connection
+func (c *Client) ChannelPair(channelID int) (string, bool) {
+	pair, ok := c.channelPairMap(0)[channelID]
+	return pair, ok
+}
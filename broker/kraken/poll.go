@@ -0,0 +1,70 @@
+package kraken
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// restInterval is the delay between two REST requests. Kraken allows about one public request
+// per second
+const restInterval = time.Second
+
+// PollQuotes fetches the best bid and ask of every subscribed pair from the REST api
+func (c *Client) PollQuotes(ctx context.Context) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	// The REST api names pairs differently than the websocket api
+	wsPairs := make(map[string]string)
+	var restPairs []string
+	for _, pair := range c.Pairs {
+		if restPair, ok := c.restPairs[pair]; ok {
+			wsPairs[restPair] = pair
+			restPairs = append(restPairs, restPair)
+		}
+	}
+	// Waiting even without pairs paces callers polling in a loop
+	err := c.Limiter.Wait(ctx)
+	if err != nil || len(restPairs) == 0 {
+		return quotes, err
+	}
+	u := c.GetRESTURL()
+	u.Path = "/0/public/Ticker"
+	q := u.Query()
+	q.Set("pair", strings.Join(restPairs, ","))
+	u.RawQuery = q.Encode()
+	var res restTickerResponse
+	err = api.GetJSON(ctx, c.HTTPClient, u, &res)
+	if err != nil {
+		return quotes, fmt.Errorf("Error fetching %s tickers: %s", c.exchangeName, err)
+	}
+	if len(res.Error) > 0 {
+		return quotes, fmt.Errorf("Error fetching %s tickers: %s", c.exchangeName, strings.Join(res.Error, ", "))
+	}
+	receivedAt := time.Now()
+	for restPair, ticker := range res.Result {
+		pair, ok := wsPairs[restPair]
+		if !ok || len(ticker.Bid) < 3 || len(ticker.Ask) < 3 {
+			continue
+		}
+		product := c.productMap[pair]
+		quotes = append(quotes, exchange.Quote{
+			Exchange:   c.exchangeName,
+			Bid:        ticker.Bid[0],
+			Ask:        ticker.Ask[0],
+			BidSize:    ticker.Bid[2],
+			AskSize:    ticker.Ask[2],
+			ExPair:     product.ExPair,
+			HePair:     product.HePair,
+			ExBase:     product.ExBase,
+			HeBase:     product.HeBase,
+			ExQuote:    product.ExQuote,
+			HeQuote:    product.HeQuote,
+			ReceivedAt: receivedAt,
+		})
+	}
+	return quotes, nil
+}
@@ -0,0 +1,52 @@
+package kraken_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/kraken"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+func TestPollQuotes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/0/public/AssetPairs":
+			w.Write([]byte(`{"error":[],"result":{"XMOCKZUSD":{"wsname":"MOCK/USD"}}}`))
+		case "/0/public/Ticker":
+			if r.URL.Query().Get("pair") != "XMOCKZUSD" {
+				w.Write([]byte(`{"error":["EQuery:Unknown asset pair"]}`))
+				return
+			}
+			w.Write([]byte(`{"error":[],"result":{"XMOCKZUSD":{"a":["5541.30000","1","1.500"],"b":["5541.20000","2","2.250"]}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	restURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := kraken.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	client.RESTURL = restURL
+	client.Limiter = api.NewRateLimiter(0)
+	err = client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
+	quotes, err := client.PollQuotes(context.Background())
+	if err != nil {
+		t.Fatalf("Error polling quotes: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].HePair != "MOCK-USD" || quotes[0].Bid.String() != "5541.2" ||
+		quotes[0].Ask.String() != "5541.3" || quotes[0].BidSize.String() != "2.25" || quotes[0].ReceivedAt.IsZero() {
+		t.Errorf("Expected a quote for MOCK-USD from the REST ticker but got %#v", quotes)
+	}
+}
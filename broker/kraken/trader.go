@@ -0,0 +1,313 @@
+package kraken
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// Trader trades on a kraken account through the private REST api. Requests are signed with
+// HMAC-SHA512 of their path and the SHA256 of their nonce and body, keyed with the base64
+// decoded secret
+type Trader struct {
+	APIKey    string
+	APISecret string
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// HTTPClient sends every request to the REST api
+	HTTPClient *http.Client
+	nonce      api.Nonce
+}
+
+// NewTrader returns a trader for the account of the api key
+func NewTrader(apiKey, apiSecret string) *Trader {
+	return &Trader{
+		APIKey:     apiKey,
+		APISecret:  apiSecret,
+		HTTPClient: api.DefaultHTTPClient,
+	}
+}
+
+// NewTraderFromConfig returns a trader configured from the exchange config
+func NewTraderFromConfig(httpClient *http.Client, config *exchange.Config) (exchange.Trader, error) {
+	if _, err := base64.StdEncoding.DecodeString(config.APISecret); err != nil {
+		return nil, fmt.Errorf("api_secret isn't base64: %s", err)
+	}
+	t := NewTrader(config.APIKey, config.APISecret)
+	var err error
+	t.RESTURL, err = config.GetRESTURL()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		t.HTTPClient = httpClient
+	}
+	return t, nil
+}
+
+// privateResponse is the envelope of every private endpoint response
+type privateResponse struct {
+	Error  []string        `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// addOrderResult is the result of the AddOrder endpoint
+type addOrderResult struct {
+	TxID []string `json:"txid"`
+}
+
+// orderInfo is an order returned by the QueryOrders endpoint
+type orderInfo struct {
+	Status   string          `json:"status"`
+	UserRef  int64           `json:"userref"`
+	OpenTime float64         `json:"opentm"`
+	Volume   decimal.Decimal `json:"vol"`
+	Executed decimal.Decimal `json:"vol_exec"`
+	// Price is the average price of the fills
+	Price decimal.Decimal `json:"price"`
+	Descr struct {
+		Type      string          `json:"type"`
+		OrderType string          `json:"ordertype"`
+		Price     decimal.Decimal `json:"price"`
+	} `json:"descr"`
+}
+
+// balanceInfo is the balance of an asset returned by the BalanceEx endpoint
+type balanceInfo struct {
+	Balance   decimal.Decimal `json:"balance"`
+	HoldTrade decimal.Decimal `json:"hold_trade"`
+}
+
+// PlaceOrder places an order. Kraken only returns the id of the order so its status is
+// PENDING until it's queried with GetOrder. The client id must be a 32 bit integer
+func (t *Trader) PlaceOrder(ctx context.Context, req *exchange.OrderRequest) (*exchange.Order, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("pair", tradeSymbol(req.ExPair))
+	params.Set("type", req.Side)
+	params.Set("volume", req.Quantity.String())
+	switch req.Type {
+	case exchange.MARKET:
+		params.Set("ordertype", "market")
+	case exchange.LIMIT, exchange.IOC:
+		params.Set("ordertype", "limit")
+		params.Set("price", req.Price.String())
+	}
+	if req.Type == exchange.IOC {
+		params.Set("timeinforce", "IOC")
+	}
+	if req.ClientID != "" {
+		if _, err := strconv.ParseInt(req.ClientID, 10, 32); err != nil {
+			return nil, &exchange.TradeError{Exchange: exchange.KRAKEN, Message: fmt.Sprintf("client id %q isn't a 32 bit integer", req.ClientID), Err: exchange.ErrInvalidOrder}
+		}
+		params.Set("userref", req.ClientID)
+	}
+	var res addOrderResult
+	err = t.private(ctx, "AddOrder", params, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.TxID) == 0 {
+		return nil, &exchange.TradeError{Exchange: exchange.KRAKEN, Message: "AddOrder returned no txid"}
+	}
+	return &exchange.Order{
+		ID:        res.TxID[0],
+		ClientID:  req.ClientID,
+		ExPair:    req.ExPair,
+		Side:      req.Side,
+		Type:      req.Type,
+		Price:     req.Price,
+		Quantity:  req.Quantity,
+		Status:    exchange.PENDING,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// CancelOrder cancels an open order
+func (t *Trader) CancelOrder(ctx context.Context, exPair, id string) error {
+	params := url.Values{}
+	params.Set("txid", id)
+	var res struct {
+		Count int `json:"count"`
+	}
+	return t.private(ctx, "CancelOrder", params, &res)
+}
+
+// GetOrder returns an order. IOC orders are reported as LIMIT since kraken doesn't return
+// their time in force
+func (t *Trader) GetOrder(ctx context.Context, exPair, id string) (*exchange.Order, error) {
+	params := url.Values{}
+	params.Set("txid", id)
+	var res map[string]orderInfo
+	err := t.private(ctx, "QueryOrders", params, &res)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := res[id]
+	if !ok {
+		return nil, &exchange.TradeError{Exchange: exchange.KRAKEN, Message: "Unknown order " + id, Err: exchange.ErrOrderNotFound}
+	}
+	order := &exchange.Order{
+		ID:        id,
+		ExPair:    exPair,
+		Side:      info.Descr.Type,
+		Type:      exchange.LIMIT,
+		Price:     info.Descr.Price,
+		Quantity:  info.Volume,
+		Filled:    info.Executed,
+		CreatedAt: time.Unix(0, int64(info.OpenTime*float64(time.Second))),
+	}
+	if info.UserRef != 0 {
+		order.ClientID = strconv.FormatInt(info.UserRef, 10)
+	}
+	if info.Descr.OrderType == "market" {
+		order.Type = exchange.MARKET
+	}
+	if info.Executed.Sign() > 0 {
+		order.AvgPrice = info.Price
+	}
+	switch info.Status {
+	case "pending":
+		order.Status = exchange.PENDING
+	case "closed":
+		order.Status = exchange.FILLED
+		if info.Executed.LessThan(info.Volume) {
+			order.Status = exchange.CANCELED
+		}
+	case "canceled", "expired":
+		order.Status = exchange.CANCELED
+	default:
+		order.Status = exchange.OPEN
+	}
+	return order, nil
+}
+
+// GetBalances returns the balance of every asset held by the account. Assets are named like
+// in the websocket api, ex: XBT instead of XXBT
+func (t *Trader) GetBalances(ctx context.Context) (map[string]exchange.Balance, error) {
+	var res map[string]balanceInfo
+	err := t.private(ctx, "BalanceEx", url.Values{}, &res)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]exchange.Balance)
+	for asset, val := range res {
+		if val.Balance.IsZero() {
+			continue
+		}
+		balances[assetName(asset)] = exchange.Balance{
+			Free:   val.Balance.Sub(val.HoldTrade),
+			Locked: val.HoldTrade,
+		}
+	}
+	return balances, nil
+}
+
+// private sends a signed request to a private endpoint and unmarshals its result into v
+func (t *Trader) private(ctx context.Context, method string, params url.Values, v interface{}) error {
+	secret, err := base64.StdEncoding.DecodeString(t.APISecret)
+	if err != nil {
+		return fmt.Errorf("Invalid %s api secret: %s", exchange.KRAKEN, err)
+	}
+	nonce := t.nonce.Next()
+	params.Set("nonce", nonce)
+	body := params.Encode()
+	u := t.restURL()
+	u.Path = "/0/private/" + method
+	hash := sha256.Sum256([]byte(nonce + body))
+	mac := hmac.New(sha512.New, secret)
+	mac.Write([]byte(u.Path))
+	mac.Write(hash[:])
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("API-Key", t.APIKey)
+	req.Header.Set("API-Sign", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	res, resBody, err := api.Do(ctx, t.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	var envelope privateResponse
+	if err := json.Unmarshal(resBody, &envelope); err != nil {
+		if res.StatusCode != http.StatusOK {
+			return &exchange.TradeError{Exchange: exchange.KRAKEN, Message: res.Status}
+		}
+		return err
+	}
+	if len(envelope.Error) > 0 {
+		return tradeError(envelope.Error[0])
+	}
+	return json.Unmarshal(envelope.Result, v)
+}
+
+// restURL returns the base url for the REST api
+func (t *Trader) restURL() *url.URL {
+	if t.RESTURL != nil {
+		u := *t.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.kraken.com"}
+}
+
+// tradeErrors maps kraken errors to exchange errors
+var tradeErrors = map[string]error{
+	"EOrder:Insufficient funds":     exchange.ErrInsufficientFunds,
+	"EOrder:Insufficient margin":    exchange.ErrInsufficientFunds,
+	"EOrder:Unknown order":          exchange.ErrOrderNotFound,
+	"EOrder:Invalid order":          exchange.ErrInvalidOrder,
+	"EOrder:Orders minimum not met": exchange.ErrInvalidOrder,
+	"EGeneral:Invalid arguments":    exchange.ErrInvalidOrder,
+	"EQuery:Unknown asset pair":     exchange.ErrInvalidOrder,
+	"EAPI:Invalid key":              exchange.ErrAuthentication,
+	"EAPI:Invalid signature":        exchange.ErrAuthentication,
+	"EAPI:Invalid nonce":            exchange.ErrAuthentication,
+	"EGeneral:Permission denied":    exchange.ErrAuthentication,
+	"EAPI:Rate limit exceeded":      exchange.ErrRateLimited,
+	"EOrder:Rate limit exceeded":    exchange.ErrRateLimited,
+	"EGeneral:Too many requests":    exchange.ErrRateLimited,
+}
+
+// tradeError maps a kraken error to an exchange error. Errors can have details after the
+// message, ex: EGeneral:Invalid arguments:volume
+func tradeError(msg string) error {
+	err := &exchange.TradeError{Exchange: exchange.KRAKEN, Message: msg}
+	for prefix, known := range tradeErrors {
+		if strings.HasPrefix(msg, prefix) {
+			err.Err = known
+			break
+		}
+	}
+	return err
+}
+
+// tradeSymbol returns the REST name of an exchange pair, ex: XBTUSD for XBT/USD
+func tradeSymbol(exPair string) string {
+	return strings.NewReplacer("/", "", "-", "").Replace(exPair)
+}
+
+// assetName strips the X or Z prefix kraken adds to the REST names of some assets, ex: XXBT
+// is XBT and ZUSD is USD
+func assetName(asset string) string {
+	if len(asset) == 4 && (asset[0] == 'X' || asset[0] == 'Z') {
+		return asset[1:]
+	}
+	return asset
+}
@@ -0,0 +1,117 @@
+package kraken_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/kraken"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+)
+
+var secret = base64.StdEncoding.EncodeToString([]byte("secret"))
+
+// krakenStub checks the signature and nonce of requests and answers like the kraken private
+// REST api
+func krakenStub(t *testing.T) http.HandlerFunc {
+	var lastNonce int64
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		hash := sha256.Sum256([]byte(form.Get("nonce") + string(body)))
+		mac := hmac.New(sha512.New, []byte("secret"))
+		mac.Write([]byte(r.URL.Path))
+		mac.Write(hash[:])
+		if r.Header.Get("API-Key") != "key" || r.Header.Get("API-Sign") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.Write([]byte(`{"error":["EAPI:Invalid key"]}`))
+			return
+		}
+		nonce, _ := strconv.ParseInt(form.Get("nonce"), 10, 64)
+		if nonce <= lastNonce {
+			w.Write([]byte(`{"error":["EAPI:Invalid nonce"]}`))
+			return
+		}
+		lastNonce = nonce
+		switch r.URL.Path {
+		case "/0/private/AddOrder":
+			if form.Get("volume") == "100" {
+				w.Write([]byte(`{"error":["EOrder:Insufficient funds"]}`))
+				return
+			}
+			if form.Get("pair") != "XBTUSD" || form.Get("type") != "buy" || form.Get("ordertype") != "limit" ||
+				form.Get("timeinforce") != "IOC" || form.Get("price") != "100" || form.Get("userref") != "7" {
+				t.Errorf("Unexpected order %s", body)
+			}
+			w.Write([]byte(`{"error":[],"result":{"descr":{"order":"buy 0.5 XBTUSD @ limit 100"},"txid":["OABCDE-FGHIJ-KLMNOP"]}}`))
+		case "/0/private/QueryOrders":
+			if form.Get("txid") != "OABCDE-FGHIJ-KLMNOP" {
+				w.Write([]byte(`{"error":[],"result":{}}`))
+				return
+			}
+			w.Write([]byte(`{"error":[],"result":{"OABCDE-FGHIJ-KLMNOP":{"status":"closed","userref":7,"opentm":1571400000.5,"vol":"0.50000000","vol_exec":"0.20000000","price":"99.5","descr":{"pair":"XBTUSD","type":"buy","ordertype":"limit","price":"100.0"}}}}`))
+		case "/0/private/CancelOrder":
+			w.Write([]byte(`{"error":["EOrder:Unknown order"]}`))
+		case "/0/private/BalanceEx":
+			w.Write([]byte(`{"error":[],"result":{"XXBT":{"balance":"1.5","hold_trade":"0.5"},"ZUSD":{"balance":"100.0000","hold_trade":"0"},"XETH":{"balance":"0","hold_trade":"0"},"DOT":{"balance":"10","hold_trade":"0"}}}`))
+		default:
+			w.Write([]byte(`{"error":["EGeneral:Unknown method"]}`))
+		}
+	}
+}
+
+func TestTrader(t *testing.T) {
+	server, restURL := mock.NewStubServer(krakenStub(t))
+	defer server.Close()
+	trader := kraken.NewTrader("key", secret)
+	trader.RESTURL = restURL
+	ctx := context.Background()
+
+	order, err := trader.PlaceOrder(ctx, &exchange.OrderRequest{
+		ExPair:   "XBT/USD",
+		Side:     exchange.BUY,
+		Type:     exchange.IOC,
+		Quantity: decimal.MustParse("0.5"),
+		Price:    decimal.MustParse("100"),
+		ClientID: "7",
+	})
+	if err != nil || order.ID != "OABCDE-FGHIJ-KLMNOP" || order.Status != exchange.PENDING {
+		t.Fatalf("Expected a pending order but got %+v, %v", order, err)
+	}
+	order, err = trader.GetOrder(ctx, "XBT/USD", order.ID)
+	if err != nil {
+		t.Fatalf("Error getting order: %s", err)
+	}
+	if order.Status != exchange.CANCELED || order.Filled.String() != "0.2" || order.AvgPrice.String() != "99.5" ||
+		order.ClientID != "7" || order.Price.String() != "100" || order.CreatedAt.Unix() != 1571400000 {
+		t.Errorf("Expected a partially filled order but got %+v", order)
+	}
+	if _, err := trader.GetOrder(ctx, "XBT/USD", "OUNKNOWN"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	_, err = trader.PlaceOrder(ctx, &exchange.OrderRequest{ExPair: "XBT/USD", Side: exchange.BUY, Type: exchange.MARKET, Quantity: decimal.MustParse("100")})
+	if exchange.Cause(err) != exchange.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds but got %v", err)
+	}
+	if err := trader.CancelOrder(ctx, "XBT/USD", "OUNKNOWN"); exchange.Cause(err) != exchange.ErrOrderNotFound {
+		t.Errorf("Expected order not found but got %v", err)
+	}
+	balances, err := trader.GetBalances(ctx)
+	if err != nil || len(balances) != 3 || balances["XBT"].Free.String() != "1" || balances["XBT"].Locked.String() != "0.5" ||
+		balances["USD"].Free.String() != "100" || balances["DOT"].Free.String() != "10" {
+		t.Errorf("Expected XBT, USD and DOT balances but got %v, %v", balances, err)
+	}
+
+	trader.APISecret = base64.StdEncoding.EncodeToString([]byte("wrong"))
+	if _, err := trader.GetBalances(ctx); exchange.Cause(err) != exchange.ErrAuthentication {
+		t.Errorf("Expected an authentication error with the wrong secret but got %v", err)
+	}
+}
@@ -4,115 +4,428 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kaplanmaxe/helgart/broker/api"
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
 )
 
+// bookDepths are the depths kraken allows on the book channel
+var bookDepths = []int{10, 25, 100, 500, 1000}
+
+// checksumDepth is the number of levels per side kraken uses to compute book checksums
+const checksumDepth = 10
+
+// channelsPerConnection is the default number of pairs subscribed to on a connection. Kraken
+// doesn't document a limit but drops subscriptions past a few dozen pairs per connection
+const channelsPerConnection = 50
+
 // Client represents an API client
 type Client struct {
-	Pairs          []string
-	quoteCh        chan<- exchange.Quote
-	errorCh        chan<- error
-	API            api.WebSocketHelper
-	channelPairMap exchange.ChannelPairMap
-	exchangeName   string
-	productMap     exchange.ExProductMap
+	Pairs []string
+	// Subscription is the channel quotes are built from, either SPREAD or BOOK
+	Subscription string
+	// Depth is the number of levels per side maintained when subscribed to BOOK
+	Depth int
+	// WSURL overrides the websocket url if set
+	WSURL *url.URL
+	// RESTURL overrides the base url of the REST api if set
+	RESTURL *url.URL
+	// ChannelsPerConnection is the number of pairs subscribed to on each connection
+	ChannelsPerConnection int
+	// NewHelper opens the connections beyond API. Without it every pair shares API
+	NewHelper api.HelperFactory
+	// Limiter spaces out requests to the REST api when polling quotes
+	Limiter *api.RateLimiter
+	// HTTPClient sends every request to the REST api
+	HTTPClient   *http.Client
+	quoteCh      chan<- exchange.Quote
+	errorCh      chan<- error
+	API          api.WebSocketHelper
+	exchangeName string
+	productMap   exchange.ExProductMap
+	orderBookMap exchange.OrderBookMap
+	precisionMap map[string]bookPrecision
+	// restPairs maps websocket pair names to REST pair names
+	restPairs map[string]string
+	pool      *api.Pool
+	// pairShards is the connection each pair is subscribed on
+	pairShards map[string]*api.Shard
+	// channelPairMaps holds the channel ids of each connection keyed by shard id
+	channelPairMaps map[int]exchange.ChannelPairMap
+	parseMtx        sync.Mutex
+}
+
+// bookPrecision holds the number of decimals kraken formats a pair's prices and volumes with.
+// Checksums are computed over the strings as sent so we need it to format them back
+type bookPrecision struct {
+	price  int
+	volume int
 }
 
 // NewClient returns a new instance of the API
-func NewClient(api api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
+func NewClient(helper api.WebSocketHelper, quoteCh chan<- exchange.Quote, errorCh chan<- error) *Client {
 	return &Client{
-		quoteCh:        quoteCh,
-		errorCh:        errorCh,
-		API:            api,
-		channelPairMap: make(exchange.ChannelPairMap),
-		exchangeName:   exchange.KRAKEN,
+		Subscription:          SPREAD,
+		Depth:                 10,
+		ChannelsPerConnection: channelsPerConnection,
+		Limiter:               api.NewRateLimiter(restInterval),
+		HTTPClient:            api.DefaultHTTPClient,
+		quoteCh:               quoteCh,
+		errorCh:               errorCh,
+		API:                   helper,
+		exchangeName:          exchange.KRAKEN,
+		orderBookMap:          make(exchange.OrderBookMap),
+		precisionMap:          make(map[string]bookPrecision),
+		restPairs:             make(map[string]string),
+		channelPairMaps:       make(map[int]exchange.ChannelPairMap),
 	}
 }
 
 // Start starts the api connection and listens for new ticker messages
 func (c *Client) Start(ctx context.Context, productMap exchange.ProductMap, exchangeDoneCh chan<- struct{}) error {
 	c.productMap = productMap[c.exchangeName]
-	err := c.GetPairs()
+	err := c.validateSubscription()
 	if err != nil {
 		return err
 	}
-	err = c.API.Connect(c.GetURL())
+	err = c.GetPairs()
 	if err != nil {
 		return err
 	}
-	err = c.API.SendSubscribeRequest(c.FormatSubscribeRequest())
+	c.Pairs = c.productMap.Tradable(c.Pairs)
+	c.pool = api.NewPool(c.API, c.NewHelper, c.ChannelsPerConnection)
+	c.pairShards = make(map[string]*api.Shard)
+	err = c.pool.Connect(c.GetURL(), len(c.Pairs))
 	if err != nil {
 		return err
 	}
+	for i, pairs := range c.pool.Split(c.Pairs) {
+		shard := c.pool.Shard(i)
+		err = shard.SendSubscribeRequest(c.formatRequest("subscribe", pairs))
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			c.pairShards[pair] = shard
+		}
+	}
 	go c.StartTickerListener(ctx, exchangeDoneCh)
 	return nil
 }
 
+// Name returns the name of the exchange
+func (c *Client) Name() string {
+	return c.exchangeName
+}
+
+// SubscribedPairs returns the pairs subscribed to. Only pairs listed by kraken that are in the
+// product map are subscribed to
+func (c *Client) SubscribedPairs() []string {
+	return c.Pairs
+}
+
+func (c *Client) validateSubscription() error {
+	switch c.Subscription {
+	case SPREAD:
+		return nil
+	case BOOK:
+		for _, val := range bookDepths {
+			if c.Depth == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("Invalid %s book depth %d. Must be one of %v", c.exchangeName, c.Depth, bookDepths)
+	}
+	return fmt.Errorf("Unsupported %s subscription %s", c.exchangeName, c.Subscription)
+}
+
 // FormatSubscribeRequest creates the type for a subscribe request
 func (c *Client) FormatSubscribeRequest() interface{} {
-	return &SubscribeRequest{
-		Event: "subscribe",
-		Pair:  c.Pairs,
-		Subscription: struct {
-			Name string `json:"name"`
-		}{Name: "spread"},
+	return c.formatRequest("subscribe", c.Pairs)
+}
+
+func (c *Client) formatRequest(event string, pairs []string) *SubscribeRequest {
+	req := &SubscribeRequest{
+		Event:        event,
+		Pair:         pairs,
+		Subscription: Subscription{Name: c.Subscription},
+	}
+	if c.Subscription == BOOK {
+		req.Subscription.Depth = c.Depth
 	}
+	return req
 }
 
-// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote
+// ParseTickerResponse parses the ticker response and returns a new instance of a exchange.Quote.
+// The message is treated as read from the first connection
 func (c *Client) ParseTickerResponse(msg []byte) ([]exchange.Quote, error) {
-	var err error
-	var quotes []exchange.Quote
+	return c.parseMessage(0, msg)
+}
+
+// parseMessage routes a message read from the connection of a shard. Events are objects and
+// channel messages are arrays routed on their channel name
+func (c *Client) parseMessage(shardID int, msg []byte) ([]exchange.Quote, error) {
+	if len(msg) > 0 && msg[0] == '{' {
+		return []exchange.Quote{}, c.handleEvent(shardID, msg)
+	}
+	var res channelMessage
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	switch {
+	case res.ChannelName == SPREAD:
+		return c.parseSpreadResponse(msg)
+	case strings.HasPrefix(res.ChannelName, BOOK+"-"):
+		return c.parseBookResponse(msg)
+	}
+	return []exchange.Quote{}, fmt.Errorf("Error parsing message from %s: unexpected channel %s", c.exchangeName, res.ChannelName)
+}
 
+// parseSpreadResponse returns a quote from a spread channel message
+func (c *Client) parseSpreadResponse(msg []byte) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
 	var res SpreadResponse
-	err = json.Unmarshal(msg, &res)
+	err := json.Unmarshal(msg, &res)
 	if err != nil {
 		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
 	}
 	if res.Pair != "" {
 		product := c.productMap[res.Pair]
 		quotes = append(quotes, exchange.Quote{
-			Exchange: c.exchangeName,
-			Bid:      res.Bid,
-			Ask:      res.Ask,
-			ExPair:   product.ExPair,
-			HePair:   product.HePair,
-			ExBase:   product.ExBase,
-			HeBase:   product.HeBase,
-			ExQuote:  product.ExQuote,
-			HeQuote:  product.HeQuote,
+			Exchange:     c.exchangeName,
+			Bid:          res.Bid,
+			Ask:          res.Ask,
+			BidSize:      res.BidVolume,
+			AskSize:      res.AskVolume,
+			ExPair:       product.ExPair,
+			HePair:       product.HePair,
+			ExBase:       product.ExBase,
+			HeBase:       product.HeBase,
+			ExQuote:      product.ExQuote,
+			HeQuote:      product.HeQuote,
+			ExchangeTime: res.Time,
 		})
 	}
 	return quotes, nil
 }
 
-// StartTickerListener starts a new goroutine to listen for new ticker messages
+// parseBookResponse applies a book snapshot or update and returns a quote if the best bid or
+// ask level changed
+func (c *Client) parseBookResponse(msg []byte) ([]exchange.Quote, error) {
+	var quotes []exchange.Quote
+	var res BookResponse
+	err := json.Unmarshal(msg, &res)
+	if err != nil {
+		return []exchange.Quote{}, fmt.Errorf("Error unmarshalling from %s: %s", c.exchangeName, err)
+	}
+	book, ok := c.orderBookMap[res.Pair]
+	if res.Snapshot {
+		if !ok {
+			book = exchange.NewOrderBook(c.Depth)
+			c.orderBookMap[res.Pair] = book
+		}
+		book.Reset()
+		c.precisionMap[res.Pair] = getPrecision(res.Asks, res.Bids)
+	} else if !ok || book.Invalid {
+		// Wait for the snapshot to rebuild the book
+		return quotes, nil
+	}
+
+	cachedBestBid, _ := book.Bids.Best()
+	cachedBestAsk, _ := book.Asks.Best()
+	err = c.applyLevels(book, exchange.ASKS, res.Asks)
+	if err != nil {
+		return []exchange.Quote{}, err
+	}
+	err = c.applyLevels(book, exchange.BIDS, res.Bids)
+	if err != nil {
+		return []exchange.Quote{}, err
+	}
+	// Kraken doesn't send removals for levels pushed out of the subscribed depth
+	book.Truncate()
+
+	if res.Checksum != "" && res.Checksum != c.checksum(res.Pair, book) {
+		return quotes, c.resubscribe(res.Pair)
+	}
+
+	bestBid, okBid := book.Bids.Best()
+	bestAsk, okAsk := book.Asks.Best()
+	if okBid && okAsk && (bestBid != cachedBestBid || bestAsk != cachedBestAsk) {
+		product := c.productMap[res.Pair]
+		quotes = append(quotes, exchange.Quote{
+			Exchange:     c.exchangeName,
+			Bid:          bestBid.Price,
+			Ask:          bestAsk.Price,
+			BidSize:      bestBid.Size,
+			AskSize:      bestAsk.Size,
+			ExPair:       product.ExPair,
+			HePair:       product.HePair,
+			ExBase:       product.ExBase,
+			HeBase:       product.HeBase,
+			ExQuote:      product.ExQuote,
+			HeQuote:      product.HeQuote,
+			ExchangeTime: res.Time(),
+		})
+	}
+	return quotes, nil
+}
+
+// applyLevels applies price levels to a side of the book. A volume of 0 removes the level
+func (c *Client) applyLevels(book *exchange.OrderBook, side int, levels [][]string) error {
+	for _, val := range levels {
+		if len(val) < 2 {
+			return fmt.Errorf("Error parsing order book level from %s: %v", c.exchangeName, val)
+		}
+		price, err := decimal.Parse(val[0])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s: %s", c.exchangeName, err)
+		}
+		volume, err := decimal.Parse(val[1])
+		if err != nil {
+			return fmt.Errorf("Error parsing order book values from %s: %s", c.exchangeName, err)
+		}
+		book.Update(side, price, volume)
+	}
+	return nil
+}
+
+// getPrecision returns the number of decimals used by the first level of a snapshot
+func getPrecision(sides ...[][]string) bookPrecision {
+	for _, levels := range sides {
+		if len(levels) > 0 && len(levels[0]) > 1 {
+			return bookPrecision{
+				price:  decimals(levels[0][0]),
+				volume: decimals(levels[0][1]),
+			}
+		}
+	}
+	return bookPrecision{}
+}
+
+func decimals(val string) int {
+	index := strings.Index(val, ".")
+	if index < 0 {
+		return 0
+	}
+	return len(val) - index - 1
+}
+
+// checksum computes kraken's CRC32 checksum over the top 10 asks followed by the top 10 bids.
+// Each price and volume is formatted as kraken sent it with the decimal point and leading
+// zeros removed
+func (c *Client) checksum(pair string, book *exchange.OrderBook) string {
+	precision := c.precisionMap[pair]
+	var b strings.Builder
+	for _, side := range []*exchange.BookSide{book.Asks, book.Bids} {
+		for _, level := range side.Top(checksumDepth) {
+			b.WriteString(checksumValue(level.Price, precision.price))
+			b.WriteString(checksumValue(level.Size, precision.volume))
+		}
+	}
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(b.String()))), 10)
+}
+
+func checksumValue(val decimal.Decimal, precision int) string {
+	formatted := strings.Replace(val.StringFixed(int32(precision)), ".", "", 1)
+	return strings.TrimLeft(formatted, "0")
+}
+
+// resubscribe marks the book for a pair as invalid and resubscribes to the book channel for just
+// that pair. Kraken answers with a new snapshot which rebuilds the book
+func (c *Client) resubscribe(pair string) error {
+	book := c.orderBookMap[pair]
+	if book.Invalid {
+		return nil
+	}
+	book.Invalid = true
+	log.Printf("Checksum mismatch on %s for %s. Resubscribing\n", c.exchangeName, pair)
+
+	// These aren't sent with SendSubscribeRequest since the original subscription already
+	// covers this pair if the connection has to be replayed
+	for _, event := range []string{"unsubscribe", "subscribe"} {
+		payload, err := json.Marshal(c.formatRequest(event, []string{pair}))
+		if err != nil {
+			return fmt.Errorf("Error marshalling %s request for %s on %s: %s", event, pair, c.exchangeName, err)
+		}
+		err = c.connection(pair).WriteMessage(payload)
+		if err != nil {
+			return fmt.Errorf("Error sending %s request for %s on %s: %s", event, pair, c.exchangeName, err)
+		}
+	}
+	return nil
+}
+
+// connection returns the connection a pair is subscribed on
+func (c *Client) connection(pair string) api.WebSocketHelper {
+	if shard, ok := c.pairShards[pair]; ok {
+		return shard
+	}
+	return c.API
+}
+
+// OrderBook returns the order book maintained for a pair or nil if we haven't received a
+// snapshot for it
+func (c *Client) OrderBook(pair string) *exchange.OrderBook {
+	return c.orderBookMap[pair]
+}
+
+// StartTickerListener starts a new goroutine to listen for new ticker messages. Every
+// connection is read from its own goroutine and doneCh is sent to once all of them are closed
 func (c *Client) StartTickerListener(ctx context.Context, doneCh chan<- struct{}) {
-cLoop:
+	shards := []*api.Shard{{WebSocketHelper: c.API}}
+	if c.pool != nil {
+		shards = c.pool.Shards()
+	}
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *api.Shard) {
+			defer wg.Done()
+			c.listen(ctx, shard)
+		}(shard)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		doneCh <- struct{}{}
+	}
+}
+
+// listen reads messages from the connection of a shard until ctx is done or reading fails
+func (c *Client) listen(ctx context.Context, shard *api.Shard) {
 	for {
-		message, err := c.API.ReadMessage()
+		message, err := shard.ReadMessage()
 		if err != nil {
 			c.errorCh <- fmt.Errorf("Error reading from %s: %s", c.exchangeName, err)
+			return
 		}
+		receivedAt := time.Now()
 		select {
 		case <-ctx.Done():
-			err := c.API.Close()
+			err := shard.Close()
 			if err != nil {
 				c.errorCh <- fmt.Errorf("Error closing %s: %s", c.exchangeName, err)
 			}
-			doneCh <- struct{}{}
-			break cLoop
+			return
 		default:
-			res, err := c.ParseTickerResponse(message)
+			c.parseMtx.Lock()
+			res, err := c.parseMessage(shard.ID, message)
+			c.parseMtx.Unlock()
 			if err != nil {
 				c.errorCh <- err
 			} else if len(res) > 0 {
 				if res[0].HePair != "" {
+					res[0].ReceivedAt = receivedAt
 					c.quoteCh <- res[0]
 				}
 			}
@@ -122,13 +435,27 @@ cLoop:
 
 // GetURL returns the url for the websocket connection
 func (c *Client) GetURL() *url.URL {
+	if c.WSURL != nil {
+		u := *c.WSURL
+		return &u
+	}
 	return &url.URL{Scheme: "wss", Host: "ws.kraken.com"}
 }
 
+// GetRESTURL returns the base url for the REST api
+func (c *Client) GetRESTURL() *url.URL {
+	if c.RESTURL != nil {
+		u := *c.RESTURL
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: "api.kraken.com"}
+}
+
 // GetPairs returns all pairs for an exchange
 func (c *Client) GetPairs() error {
-	u := url.URL{Scheme: "https", Host: "api.kraken.com", Path: "/0/public/AssetPairs"}
-	res, err := http.Get(u.String())
+	u := c.GetRESTURL()
+	u.Path = "/0/public/AssetPairs"
+	res, err := c.HTTPClient.Get(u.String())
 	if err != nil {
 		return err
 	}
@@ -144,9 +471,9 @@ func (c *Client) GetPairs() error {
 	for key := range pairsResponse.Result {
 		if pairsResponse.Result[key].Pair != "" {
 			pairs = append(pairs, pairsResponse.Result[key].Pair)
+			c.restPairs[pairsResponse.Result[key].Pair] = key
 		}
 	}
-	// c.Pairs = pairs
-	c.Pairs = []string{"XBT/USD", "XBT/CAD", "ETH/USD", "ETH/CAD", "XRP/USD", "XRP/CAD"}
+	c.Pairs = pairs
 	return nil
 }
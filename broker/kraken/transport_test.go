@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 	"github.com/kaplanmaxe/helgart/broker/exchange"
 	"github.com/kaplanmaxe/helgart/broker/kraken"
 	"github.com/kaplanmaxe/helgart/broker/mock"
@@ -25,9 +27,15 @@ func TestStart(t *testing.T) {
 	ctx := context.TODO()
 
 	client := kraken.NewClient(mock.NewConnector(ignoreFunc), quoteCh, errorCh)
+	server, restURL := mock.NewRESTServer(`{"error":[],"result":{"XXBTZUSD":{"wsname":"MOCK/USD"}}}`)
+	defer server.Close()
+	client.RESTURL = restURL
 	productMap := mock.MakeMockProductMap()
 	doneCh := make(chan struct{}, 1)
-	client.Start(ctx, productMap, doneCh)
+	err := client.Start(ctx, productMap, doneCh)
+	if err != nil {
+		t.Fatalf("Error starting client: %s", err)
+	}
 	mockResponse := json.RawMessage(`[835,["0.00555670","0.00564450","1559355056.098606","245.68795774","292.87831705"],"spread","MOCK/USD"]`)
 	msg, err := json.Marshal(&mockResponse)
 	if err != nil {
@@ -41,9 +49,12 @@ listener:
 	for {
 		select {
 		case quote := <-quoteCh:
-			if quote.Ask != "0.00564450" {
+			if quote.Ask != decimal.MustParse("0.00564450") {
 				t.Fatalf("Expecting response %#v but got %#v", mockResponse, quote)
 			}
+			if !quote.ExchangeTime.Equal(time.Unix(1559355056, 98606000)) || quote.ReceivedAt.IsZero() {
+				t.Errorf("Expected exchange and receive times to be set but got %s and %s", quote.ExchangeTime, quote.ReceivedAt)
+			}
 			break listener
 		case err := <-errorCh:
 			t.Fatalf("%s", err)
@@ -53,3 +64,126 @@ listener:
 	}
 	client.API.Close()
 }
+
+const mockBookSnapshot = `[0,{"as":[["5541.30000","0.02507000","1534614248.123678"],["5541.31000","1.02507013","1534614248.123678"],["5541.32000","2.02507026","1534614248.123678"],["5541.33000","0.02507039","1534614248.123678"],["5541.34000","1.02507052","1534614248.123678"],["5541.35000","2.02507065","1534614248.123678"],["5541.36000","0.02507078","1534614248.123678"],["5541.37000","1.02507091","1534614248.123678"],["5541.38000","2.02507104","1534614248.123678"],["5541.39000","0.02507117","1534614248.123678"]],"bs":[["5540.90000","1.01529000","1534614248.765567"],["5540.89000","0.01529007","1534614248.765567"],["5540.88000","1.01529014","1534614248.765567"],["5540.87000","0.01529021","1534614248.765567"],["5540.86000","1.01529028","1534614248.765567"],["5540.85000","0.01529035","1534614248.765567"],["5540.84000","1.01529042","1534614248.765567"],["5540.83000","0.01529049","1534614248.765567"],["5540.82000","1.01529056","1534614248.765567"],["5540.81000","0.01529063","1534614248.765567"]]},"book-10","MOCK/USD"]`
+
+func TestBookChecksum(t *testing.T) {
+	connector := mock.NewRecordingConnector()
+	client := kraken.NewClient(connector, make(chan exchange.Quote), make(chan error, 1))
+	client.Subscription = kraken.BOOK
+	client.Depth = 10
+
+	quotes, err := client.ParseTickerResponse([]byte(mockBookSnapshot))
+	if err != nil {
+		t.Fatalf("Error parsing snapshot: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("5540.90000") || quotes[0].Ask != decimal.MustParse("5541.30000") {
+		t.Fatalf("Expected a quote from the snapshot but got %#v", quotes)
+	}
+
+	// Removes the best ask and pushes the worst bid out of the book
+	update := `[0,{"a":[["5541.30000","0.00000000","1534614335.345903"]]},{"b":[["5540.95000","1.00000000","1534614335.345903"]],"c":"83118811"},"book-10","MOCK/USD"]`
+	quotes, err = client.ParseTickerResponse([]byte(update))
+	if err != nil {
+		t.Fatalf("Error parsing update: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("5540.95000") || quotes[0].Ask != decimal.MustParse("5541.31000") {
+		t.Fatalf("Expected a new quote from the update but got %#v", quotes)
+	}
+	book := client.OrderBook("MOCK/USD")
+	if book.Bids.Len() != 10 {
+		t.Errorf("Expected the book to be truncated to 10 bids but got %d", book.Bids.Len())
+	}
+	if len(connector.Messages()) != 0 {
+		t.Errorf("Expected no resubscribe with a valid checksum but got %#v", connector.Messages())
+	}
+
+	// A bad checksum resubscribes the pair and suppresses quotes until the next snapshot
+	update = `[0,{"b":[["5540.96000","1.00000000","1534614335.345903"]],"c":"12345"},"book-10","MOCK/USD"]`
+	quotes, err = client.ParseTickerResponse([]byte(update))
+	if err != nil {
+		t.Fatalf("Error parsing update: %s", err)
+	}
+	if len(quotes) != 0 {
+		t.Errorf("Expected no quotes on a checksum mismatch but got %#v", quotes)
+	}
+	expected := []string{
+		`{"event":"unsubscribe","pair":["MOCK/USD"],"subscription":{"name":"book","depth":10}}`,
+		`{"event":"subscribe","pair":["MOCK/USD"],"subscription":{"name":"book","depth":10}}`,
+	}
+	messages := connector.Messages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages to be sent but got %#v", len(expected), messages)
+	}
+	for key, val := range expected {
+		if messages[key] != val {
+			t.Errorf("Expected message %s but got %s", val, messages[key])
+		}
+	}
+	update = `[0,{"b":[["5540.97000","1.00000000","1534614335.345903"]],"c":"12345"},"book-10","MOCK/USD"]`
+	quotes, _ = client.ParseTickerResponse([]byte(update))
+	if len(quotes) != 0 {
+		t.Errorf("Expected quotes to be suppressed until the next snapshot but got %#v", quotes)
+	}
+
+	quotes, err = client.ParseTickerResponse([]byte(mockBookSnapshot))
+	if err != nil {
+		t.Fatalf("Error parsing snapshot: %s", err)
+	}
+	if len(quotes) != 1 || quotes[0].Bid != decimal.MustParse("5540.90000") {
+		t.Errorf("Expected the book to be rebuilt from the snapshot but got %#v", quotes)
+	}
+}
+
+func TestInvalidBookDepth(t *testing.T) {
+	client := kraken.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	client.Subscription = kraken.BOOK
+	client.Depth = 15
+	err := client.Start(context.TODO(), mock.MakeMockProductMap(), make(chan struct{}, 1))
+	if err == nil {
+		t.Error("Expected an error for an invalid book depth")
+	}
+}
+
+func TestEventRouting(t *testing.T) {
+	client := kraken.NewClient(mock.NewRecordingConnector(), make(chan exchange.Quote), make(chan error, 1))
+	messages := []string{
+		`{"connectionID":8628615390848610000,"event":"systemStatus","status":"online","version":"0.2.0"}`,
+		`{"channelID":10001,"channelName":"spread","event":"subscriptionStatus","pair":"MOCK/USD","status":"subscribed","subscription":{"name":"spread"}}`,
+		`{"event":"heartbeat"}`,
+	}
+	for _, msg := range messages {
+		quotes, err := client.ParseTickerResponse([]byte(msg))
+		if err != nil || len(quotes) != 0 {
+			t.Fatalf("Expected %s to be handled without quotes but got %#v %v", msg, quotes, err)
+		}
+	}
+	if pair, ok := client.ChannelPair(10001); !ok || pair != "MOCK/USD" {
+		t.Errorf("Expected channel 10001 to be recorded for MOCK/USD but got %s", pair)
+	}
+
+	_, err := client.ParseTickerResponse([]byte(`{"errorMessage":"Currency pair not supported MOCK/ZZZ","event":"subscriptionStatus","pair":"MOCK/ZZZ","status":"error","subscription":{"name":"spread"}}`))
+	subErr, ok := err.(*kraken.SubscriptionError)
+	if !ok || subErr.Pair != "MOCK/ZZZ" || subErr.Subscription != kraken.SPREAD {
+		t.Errorf("Expected a subscription error for MOCK/ZZZ but got %#v", err)
+	}
+	_, err = client.ParseTickerResponse([]byte(`{"errorMessage":"Malformed request","event":"error"}`))
+	if _, ok := err.(*kraken.EventError); !ok {
+		t.Errorf("Expected an event error but got %#v", err)
+	}
+
+	// Malformed frames are errors instead of panics
+	for _, msg := range []string{
+		`[]`,
+		`[10001,"spread","MOCK/USD"]`,
+		`[10001,["0.1","0.2"],"spread","MOCK/USD"]`,
+		`[10001,["0.1","0.2","1559355056.098606","1","2"],{},"spread","MOCK/USD"]`,
+		`[10001,{"a":"bad"},"book-10","MOCK/USD"]`,
+		`[10001,{},"unknown","MOCK/USD"]`,
+		`not json`,
+	} {
+		if _, err := client.ParseTickerResponse([]byte(msg)); err == nil {
+			t.Errorf("Expected an error for %s", msg)
+		}
+	}
+}
@@ -3,7 +3,11 @@ package kraken
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
 )
 
 // Enum for subscription events
@@ -28,48 +32,121 @@ const (
 // 	}
 //   }
 type SubscribeRequest struct {
-	Event        string   `json:"event"`
-	Pair         []string `json:"pair"`
-	Subscription struct {
-		Name string `json:"name"`
-	} `json:"subscription"`
+	Event        string       `json:"event"`
+	Pair         []string     `json:"pair"`
+	Subscription Subscription `json:"subscription"`
+}
+
+// Subscription is the channel part of a subscribe request. Depth is only used by the book channel
+type Subscription struct {
+	Name  string `json:"name"`
+	Depth int    `json:"depth,omitempty"`
 }
 
 // SpreadResponse is a response from the ws api with a tick
 type SpreadResponse struct {
 	Pair      string
-	Bid       string
-	Ask       string
-	BidVolume string
-	AskVolume string
+	Bid       decimal.Decimal
+	Ask       decimal.Decimal
+	BidVolume decimal.Decimal
+	AskVolume decimal.Decimal
+	Time      time.Time
+}
+
+// Enum for events sent as objects
+const (
+	SYSTEMSTATUS       = "systemStatus"
+	SUBSCRIPTIONSTATUS = "subscriptionStatus"
+	HEARTBEAT          = "heartbeat"
+	ERROR              = "error"
+)
+
+// EventResponse is an event sent as an object. Fields are only set for the events they
+// belong to
+//
+// Ex:
+// {"connectionID":8628615390848610000,"event":"systemStatus","status":"online","version":"0.2.0"}
+// {"channelID":10001,"channelName":"spread","event":"subscriptionStatus","pair":"XBT/EUR","status":"subscribed","subscription":{"name":"spread"}}
+// {"errorMessage":"Currency pair not supported XBT/ZZZ","event":"subscriptionStatus","pair":"XBT/ZZZ","status":"error","subscription":{"name":"spread"}}
+// {"event":"heartbeat"}
+// {"errorMessage":"Malformed request","event":"error"}
+type EventResponse struct {
+	Event        string       `json:"event"`
+	Status       string       `json:"status"`
+	ChannelID    int          `json:"channelID"`
+	ChannelName  string       `json:"channelName"`
+	Pair         string       `json:"pair"`
+	ErrorMessage string       `json:"errorMessage"`
+	Subscription Subscription `json:"subscription"`
+}
+
+// SubscriptionError is returned when kraken rejects a subscription, ex: for a pair it doesn't
+// support
+type SubscriptionError struct {
+	Pair         string
+	Subscription string
+	Message      string
+}
+
+func (e *SubscriptionError) Error() string {
+	return fmt.Sprintf("Error subscribing to %s for %s on kraken: %s", e.Subscription, e.Pair, e.Message)
+}
+
+// EventError is returned when kraken answers a request with an error event
+type EventError struct {
+	Message string
 }
 
-// SubscriptionResponse is a response after subscribing to an event
-type SubscriptionResponse struct {
-	ChannelID    int    `json:"channelID"`
-	Pair         string `json:"pair"`
-	Status       string `json:"status"`
-	Subscription struct {
-		Name string `json:"name"`
-	} `json:"subscription"`
+func (e *EventError) Error() string {
+	return fmt.Sprintf("Error event from kraken: %s", e.Message)
 }
 
-// channelPairMap maps a channelid returned in the api to a specific pair
-type channelPairMap map[int]string
+// channelMessage splits a channel message into its channel id, payloads, channel name and pair
+// [CHANNEL_ID, PAYLOAD..., CHANNEL_NAME, PAIR]
+type channelMessage struct {
+	ChannelID   int
+	Payloads    []json.RawMessage
+	ChannelName string
+	Pair        string
+}
+
+// UnmarshalJSON unmarshals a channel message from its array representation
+func (m *channelMessage) UnmarshalJSON(msg []byte) error {
+	var resp []json.RawMessage
+	err := json.Unmarshal(msg, &resp)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 4 {
+		return fmt.Errorf("Unexpected channel message: expected at least 4 elements but got %d", len(resp))
+	}
+	err = json.Unmarshal(resp[0], &m.ChannelID)
+	if err != nil {
+		return fmt.Errorf("Unexpected channel id: %s", err)
+	}
+	err = json.Unmarshal(resp[len(resp)-2], &m.ChannelName)
+	if err != nil {
+		return fmt.Errorf("Unexpected channel name: %s", err)
+	}
+	err = json.Unmarshal(resp[len(resp)-1], &m.Pair)
+	if err != nil {
+		return fmt.Errorf("Unexpected pair: %s", err)
+	}
+	m.Payloads = resp[1 : len(resp)-2]
+	return nil
+}
 
 // UnmarshalJSON overrides UnmarshalJSON due to Kraken's weird output
+// [CHANNEL_ID,["5698.40000","5700.00000","1542057299.545897","1.01234567","0.98765432"],"spread","XBT/USD"]
 func (s *SpreadResponse) UnmarshalJSON(msg []byte) error {
-	// Ignore heartbeats, initial connection response, and subscription response
-	// TODO: can we be more efficient?
-	if strings.Contains(string(msg), "heartbeat") || strings.Contains(string(msg), "connectionID") ||
-		strings.Contains(string(msg), "channelID") {
-		return nil
-	}
 	var resp []json.RawMessage
 	err := json.Unmarshal(msg, &resp)
 	if err != nil {
 		return fmt.Errorf("Error unmarshalling kraken SpreadResponse: %s", err)
 	}
+	if len(resp) != 4 {
+		return fmt.Errorf("Error unmarshalling kraken SpreadResponse: expected 4 elements but got %d", len(resp))
+	}
 	var pair string
 	err = json.Unmarshal(resp[3], &pair)
 	if err != nil {
@@ -82,14 +159,133 @@ func (s *SpreadResponse) UnmarshalJSON(msg []byte) error {
 	if err != nil {
 		return fmt.Errorf("Error unmarshalling kraken SpreadResponse spread: %s", err)
 	}
+	if len(spread) < 5 {
+		return fmt.Errorf("Error unmarshalling kraken SpreadResponse spread: expected 5 values but got %d", len(spread))
+	}
 	s.Pair = pair
-	s.Bid = spread[0]
-	s.Ask = spread[1]
-	s.BidVolume = spread[3]
-	s.AskVolume = spread[4]
+	// Values are bid, ask, timestamp, bid volume and ask volume
+	values := []*decimal.Decimal{&s.Bid, &s.Ask, &s.BidVolume, &s.AskVolume}
+	for i, index := range []int{0, 1, 3, 4} {
+		*values[i], err = decimal.Parse(spread[index])
+		if err != nil {
+			return fmt.Errorf("Error unmarshalling kraken SpreadResponse spread: %s", err)
+		}
+	}
+	s.Time, err = parseTimestamp(spread[2])
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling kraken SpreadResponse timestamp: %s", err)
+	}
+	return nil
+}
+
+// parseTimestamp parses the seconds since epoch with microseconds kraken sends as a string,
+// ex: 1534614248.123678
+func parseTimestamp(val string) (time.Time, error) {
+	seconds := val
+	var nanoseconds int64
+	if index := strings.Index(val, "."); index > -1 {
+		seconds = val[:index]
+		fraction := (val[index+1:] + "000000000")[:9]
+		var err error
+		nanoseconds, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, nanoseconds), nil
+}
+
+// BookResponse is a snapshot or an update from the book channel
+//
+// Snapshot:
+// [0,{"as":[["5541.30000","2.50700000","1534614248.123678"]],"bs":[["5541.20000","1.52900000","1534614248.765567"]]},"book-10","XBT/USD"]
+//
+// Update. Asks and bids can be sent in the same object or in two separate objects:
+// [1234,{"a":[["5541.30000","2.50700000","1534614248.456738"]],"c":"974942666"},"book-10","XBT/USD"]
+// [1234,{"a":[["5541.30000","2.50700000","1534614248.456738"]]},{"b":[["5541.30000","0.00000000","1534614335.345903"]],"c":"974942666"},"book-10","XBT/USD"]
+type BookResponse struct {
+	Pair     string
+	Snapshot bool
+	Asks     [][]string
+	Bids     [][]string
+	Checksum string
+}
+
+// Time returns the latest timestamp of the levels in the message
+func (b *BookResponse) Time() time.Time {
+	var latest time.Time
+	for _, levels := range [][][]string{b.Asks, b.Bids} {
+		for _, level := range levels {
+			if len(level) < 3 {
+				continue
+			}
+			timestamp, err := parseTimestamp(level[2])
+			if err == nil && timestamp.After(latest) {
+				latest = timestamp
+			}
+		}
+	}
+	return latest
+}
+
+type bookPayload struct {
+	SnapshotAsks [][]string `json:"as"`
+	SnapshotBids [][]string `json:"bs"`
+	Asks         [][]string `json:"a"`
+	Bids         [][]string `json:"b"`
+	Checksum     string     `json:"c"`
+}
+
+// UnmarshalJSON overrides UnmarshalJSON since book messages are arrays with a variable
+// number of payload objects between the channel id and the channel name
+func (b *BookResponse) UnmarshalJSON(msg []byte) error {
+	var resp []json.RawMessage
+	err := json.Unmarshal(msg, &resp)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling kraken BookResponse: %s", err)
+	}
+	if len(resp) < 4 {
+		return fmt.Errorf("Error unmarshalling kraken BookResponse: expected at least 4 elements but got %d", len(resp))
+	}
+	err = json.Unmarshal(resp[len(resp)-1], &b.Pair)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling kraken BookResponse pair: %s", err)
+	}
+	for _, val := range resp[1 : len(resp)-2] {
+		var payload bookPayload
+		err = json.Unmarshal(val, &payload)
+		if err != nil {
+			return fmt.Errorf("Error unmarshalling kraken BookResponse levels: %s", err)
+		}
+		if payload.SnapshotAsks != nil || payload.SnapshotBids != nil {
+			b.Snapshot = true
+			b.Asks = append(b.Asks, payload.SnapshotAsks...)
+			b.Bids = append(b.Bids, payload.SnapshotBids...)
+		}
+		b.Asks = append(b.Asks, payload.Asks...)
+		b.Bids = append(b.Bids, payload.Bids...)
+		if payload.Checksum != "" {
+			b.Checksum = payload.Checksum
+		}
+	}
 	return nil
 }
 
+// restTickerResponse holds the tickers of pairs from the REST api keyed by their REST name.
+// Best bid and ask are price, whole lot volume and lot volume
+// {"error":[],"result":{"XXBTZUSD":{"a":["52609.60000","1","1.000"],"b":["52609.50000","1","1.000"]}}}
+type restTickerResponse struct {
+	Error  []string `json:"error"`
+	Result map[string]struct {
+		Ask []decimal.Decimal `json:"a"`
+		Bid []decimal.Decimal `json:"b"`
+	} `json:"result"`
+}
+
 type assetPairResponse struct {
 	Error  []string         `json:"error"`
 	Result assetPairsResult `json:"result"`
@@ -0,0 +1,33 @@
+package metrics
+
+import "sync"
+
+// GapCounter counts the sequence gaps detected in the feed of an exchange per pair. It's safe
+// for concurrent use
+type GapCounter struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+// NewGapCounter returns an empty gap counter
+func NewGapCounter() *GapCounter {
+	return &GapCounter{counts: make(map[string]int)}
+}
+
+// Record counts a gap for pair
+func (g *GapCounter) Record(pair string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.counts[pair]++
+}
+
+// Counts returns the number of gaps of every pair with at least one
+func (g *GapCounter) Counts() map[string]int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	counts := make(map[string]int, len(g.counts))
+	for pair, count := range g.counts {
+		counts[pair] = count
+	}
+	return counts
+}
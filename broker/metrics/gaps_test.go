@@ -0,0 +1,22 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/kaplanmaxe/helgart/broker/metrics"
+)
+
+func TestGapCounts(t *testing.T) {
+	gaps := metrics.NewGapCounter()
+	gaps.Record("BTC-USD")
+	gaps.Record("BTC-USD")
+	gaps.Record("ETH-USD")
+	counts := gaps.Counts()
+	if len(counts) != 2 || counts["BTC-USD"] != 2 || counts["ETH-USD"] != 1 {
+		t.Errorf("Expected 2 gaps for BTC-USD and 1 for ETH-USD but got %v", counts)
+	}
+	counts["BTC-USD"] = 0
+	if gaps.Counts()["BTC-USD"] != 2 {
+		t.Error("Expected Counts to return a copy")
+	}
+}
@@ -0,0 +1,107 @@
+// Package metrics keeps runtime statistics about the exchange feeds
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is the number of latency samples kept per exchange
+const DefaultWindow = 1000
+
+// LatencySummary holds the feed latency percentiles of an exchange in milliseconds
+type LatencySummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// LatencyTracker records the delay between the exchange event time and the local receive time
+// of quotes. Only the last window samples of each exchange are kept so the percentiles reflect
+// the current state of the feed. It's safe for concurrent use
+type LatencyTracker struct {
+	mtx     sync.Mutex
+	window  int
+	samples map[string]*ring
+}
+
+// ring is a fixed size buffer of samples overwriting the oldest one when full
+type ring struct {
+	values []time.Duration
+	next   int
+}
+
+func (r *ring) add(val time.Duration, size int) {
+	if len(r.values) < size {
+		r.values = append(r.values, val)
+		return
+	}
+	r.values[r.next] = val
+	r.next = (r.next + 1) % size
+}
+
+// NewLatencyTracker returns a tracker keeping window samples per exchange
+func NewLatencyTracker(window int) *LatencyTracker {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &LatencyTracker{
+		window:  window,
+		samples: make(map[string]*ring),
+	}
+}
+
+// Observe records a quote received at receivedAt for an event that happened on the exchange at
+// exchangeTime. Quotes without an exchange time are ignored
+func (t *LatencyTracker) Observe(exchange string, exchangeTime, receivedAt time.Time) {
+	if exchangeTime.IsZero() || receivedAt.IsZero() {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	r, ok := t.samples[exchange]
+	if !ok {
+		r = &ring{}
+		t.samples[exchange] = r
+	}
+	r.add(receivedAt.Sub(exchangeTime), t.window)
+}
+
+// Summary returns the latency percentiles of every exchange with samples
+func (t *LatencyTracker) Summary() map[string]LatencySummary {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	summary := make(map[string]LatencySummary)
+	for exchange, r := range t.samples {
+		sorted := make([]time.Duration, len(r.values))
+		copy(sorted, r.values)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		summary[exchange] = LatencySummary{
+			Count: len(sorted),
+			P50:   milliseconds(percentile(sorted, 50)),
+			P90:   milliseconds(percentile(sorted, 90)),
+			P99:   milliseconds(percentile(sorted, 99)),
+			Max:   milliseconds(sorted[len(sorted)-1]),
+		}
+	}
+	return summary
+}
+
+// percentile returns the nearest rank percentile of sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
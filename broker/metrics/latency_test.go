@@ -0,0 +1,30 @@
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/metrics"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	tracker := metrics.NewLatencyTracker(100)
+	now := time.Now()
+	// The first 50 samples are pushed out of the window
+	for i := 0; i < 50; i++ {
+		tracker.Observe("mock", now.Add(-time.Hour), now)
+	}
+	for i := 1; i <= 100; i++ {
+		tracker.Observe("mock", now.Add(-time.Duration(i)*time.Millisecond), now)
+	}
+	tracker.Observe("mock", time.Time{}, now)
+
+	summary, ok := tracker.Summary()["mock"]
+	if !ok {
+		t.Fatal("Expected a summary for mock")
+	}
+	expected := metrics.LatencySummary{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}
+	if summary != expected {
+		t.Errorf("Expected %#v but got %#v", expected, summary)
+	}
+}
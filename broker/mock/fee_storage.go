@@ -0,0 +1,25 @@
+package mock
+
+import (
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// FeeStorage is an in memory exchange.FeeStorage
+type FeeStorage struct {
+	fees []exchange.Fee
+	// Err is returned by FetchFees if set
+	Err error
+}
+
+// NewFeeStorage returns a fee storage holding fees
+func NewFeeStorage(fees ...exchange.Fee) *FeeStorage {
+	return &FeeStorage{fees: fees}
+}
+
+// FetchFees returns the stored fees
+func (s *FeeStorage) FetchFees() ([]exchange.Fee, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.fees, nil
+}
@@ -0,0 +1,46 @@
+package mock
+
+import (
+	"sync"
+
+	"github.com/kaplanmaxe/helgart/broker/inventory"
+)
+
+// InventoryStore is an in memory inventory.Store
+type InventoryStore struct {
+	mtx      sync.Mutex
+	holdings map[string][]inventory.Holding
+	// Err is returned by SaveHoldings if set
+	Err error
+}
+
+// NewInventoryStore returns an inventory store holding holdings
+func NewInventoryStore(holdings ...inventory.Holding) *InventoryStore {
+	s := &InventoryStore{holdings: make(map[string][]inventory.Holding)}
+	for _, holding := range holdings {
+		s.holdings[holding.Exchange] = append(s.holdings[holding.Exchange], holding)
+	}
+	return s
+}
+
+// SaveHoldings replaces the stored holdings of an exchange
+func (s *InventoryStore) SaveHoldings(exchangeName string, holdings []inventory.Holding) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	s.holdings[exchangeName] = append([]inventory.Holding(nil), holdings...)
+	return nil
+}
+
+// FetchHoldings returns every stored holding
+func (s *InventoryStore) FetchHoldings() ([]inventory.Holding, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var holdings []inventory.Holding
+	for _, exHoldings := range s.holdings {
+		holdings = append(holdings, exHoldings...)
+	}
+	return holdings, nil
+}
@@ -0,0 +1,74 @@
+package mock
+
+import (
+	"sync"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/paper"
+)
+
+// PaperStore is an in memory paper.Store
+type PaperStore struct {
+	mtx      sync.Mutex
+	fills    []*paper.Fill
+	balances paper.Balances
+	// Err is returned by SaveFill if set
+	Err error
+}
+
+// NewPaperStore returns an empty paper store
+func NewPaperStore() *PaperStore {
+	return &PaperStore{balances: make(paper.Balances)}
+}
+
+// SaveFill stores a fill and the balances it changed
+func (s *PaperStore) SaveFill(fill *paper.Fill, balances paper.Balances) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	fill.ID = int64(len(s.fills) + 1)
+	s.fills = append(s.fills, fill)
+	for exchangeName, assets := range balances {
+		for asset, amount := range assets {
+			s.balances.Set(exchangeName, asset, amount)
+		}
+	}
+	return nil
+}
+
+// FetchBalances returns a copy of the stored balances
+func (s *PaperStore) FetchBalances() (paper.Balances, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.balances.Copy(), nil
+}
+
+// FetchFills returns the stored fills matching query, most recent first
+func (s *PaperStore) FetchFills(query paper.FillQuery) ([]*paper.Fill, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var fills []*paper.Fill
+	for i := len(s.fills) - 1; i >= 0; i-- {
+		fill := s.fills[i]
+		if query.Limit > 0 && len(fills) == query.Limit {
+			break
+		}
+		if (query.HeBase == "" || fill.HeBase == query.HeBase) && !fill.FilledAt.Before(query.Since) {
+			fills = append(fills, fill)
+		}
+	}
+	return fills, nil
+}
+
+// RealizedPnL returns the sum of the PnL of the stored fills
+func (s *PaperStore) RealizedPnL() (decimal.Decimal, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var pnl decimal.Decimal
+	for _, fill := range s.fills {
+		pnl = pnl.Add(fill.PnL)
+	}
+	return pnl, nil
+}
@@ -0,0 +1,89 @@
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// RecordingConnector is a mock connector that records every message written to it instead
+// of sending it to a server. Messages returned by ReadMessage are queued with Push.
+type RecordingConnector struct {
+	URL      *url.URL
+	mtx      sync.Mutex
+	messages [][]byte
+	readCh   chan []byte
+}
+
+// NewRecordingConnector returns a new recording connector
+func NewRecordingConnector() *RecordingConnector {
+	return &RecordingConnector{
+		readCh: make(chan []byte, 100),
+	}
+}
+
+// Connect stores the url the client connected to
+func (m *RecordingConnector) Connect(url *url.URL) error {
+	m.URL = url
+	return nil
+}
+
+// SendSubscribeRequest records a subscribe request
+func (m *RecordingConnector) SendSubscribeRequest(req interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return m.WriteMessage(payload)
+}
+
+// SendSubscribeRequestWithResponse records a subscribe request
+func (m *RecordingConnector) SendSubscribeRequestWithResponse(ctx context.Context, req interface{}) ([]byte, error) {
+	return nil, m.SendSubscribeRequest(req)
+}
+
+// WriteMessage records a message
+func (m *RecordingConnector) WriteMessage(msg []byte) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// WritePongMessage does nothing
+func (m *RecordingConnector) WritePongMessage() error {
+	return nil
+}
+
+// ReadMessage returns the next message queued with Push
+func (m *RecordingConnector) ReadMessage() ([]byte, error) {
+	msg, ok := <-m.readCh
+	if !ok {
+		return []byte{}, fmt.Errorf("Connection closed")
+	}
+	return msg, nil
+}
+
+// Push queues a message to be returned by ReadMessage
+func (m *RecordingConnector) Push(msg []byte) {
+	m.readCh <- msg
+}
+
+// Messages returns every message written so far
+func (m *RecordingConnector) Messages() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var messages []string
+	for _, val := range m.messages {
+		messages = append(messages, string(val))
+	}
+	return messages
+}
+
+// Close closes the connection
+func (m *RecordingConnector) Close() error {
+	close(m.readCh)
+	return nil
+}
@@ -0,0 +1,32 @@
+package mock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// NewRESTServer returns a server answering every request with body and its url so exchanges
+// can fetch their pairs without hitting the network. The server must be closed by the caller
+func NewRESTServer(body string) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return server, u
+}
+
+// NewStubServer returns a server answering requests with handler and its url so trading
+// adapters can be tested without an exchange account. The server must be closed by the caller
+func NewStubServer(handler http.HandlerFunc) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(handler)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return server, u
+}
@@ -0,0 +1,66 @@
+package mock
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// Trader is an exchange.Trader that only reports balances
+type Trader struct {
+	mtx      sync.Mutex
+	balances map[string]exchange.Balance
+	// Err is returned by every call if set
+	Err error
+}
+
+// NewTrader returns a trader holding balances
+func NewTrader(balances map[string]exchange.Balance) *Trader {
+	return &Trader{balances: balances}
+}
+
+// SetBalances replaces the balances of the trader
+func (t *Trader) SetBalances(balances map[string]exchange.Balance) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.balances = balances
+}
+
+// PlaceOrder rejects every order
+func (t *Trader) PlaceOrder(ctx context.Context, req *exchange.OrderRequest) (*exchange.Order, error) {
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	return nil, exchange.ErrInvalidOrder
+}
+
+// CancelOrder fails since there are no orders
+func (t *Trader) CancelOrder(ctx context.Context, exPair, id string) error {
+	if t.Err != nil {
+		return t.Err
+	}
+	return exchange.ErrOrderNotFound
+}
+
+// GetOrder fails since there are no orders
+func (t *Trader) GetOrder(ctx context.Context, exPair, id string) (*exchange.Order, error) {
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	return nil, exchange.ErrOrderNotFound
+}
+
+// GetBalances returns a copy of the balances
+func (t *Trader) GetBalances(ctx context.Context) (map[string]exchange.Balance, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	balances := make(map[string]exchange.Balance)
+	for asset, balance := range t.balances {
+		balances[asset] = balance
+	}
+	return balances, nil
+}
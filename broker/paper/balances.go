@@ -0,0 +1,55 @@
+package paper
+
+import (
+	"strings"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// Balances holds virtual balances by exchange then asset
+type Balances map[string]map[string]decimal.Decimal
+
+// Get returns the balance of an asset on an exchange, 0 if it has none
+func (b Balances) Get(exchangeName, asset string) decimal.Decimal {
+	return b[exchangeName][asset]
+}
+
+// Set sets the balance of an asset on an exchange
+func (b Balances) Set(exchangeName, asset string, amount decimal.Decimal) {
+	if _, ok := b[exchangeName]; !ok {
+		b[exchangeName] = make(map[string]decimal.Decimal)
+	}
+	b[exchangeName][asset] = amount
+}
+
+// Add adds amount, which can be negative, to the balance of an asset on an exchange
+func (b Balances) Add(exchangeName, asset string, amount decimal.Decimal) {
+	b.Set(exchangeName, asset, b.Get(exchangeName, asset).Add(amount))
+}
+
+// Copy returns a deep copy of the balances
+func (b Balances) Copy() Balances {
+	c := make(Balances)
+	for exchangeName, assets := range b {
+		for asset, amount := range assets {
+			c.Set(exchangeName, asset, amount)
+		}
+	}
+	return c
+}
+
+// ParseBalances parses balances from the config. Assets are upper cased since config keys are
+// case insensitive
+func ParseBalances(raw map[string]map[string]string) (Balances, error) {
+	balances := make(Balances)
+	for exchangeName, assets := range raw {
+		for asset, amount := range assets {
+			d, err := decimal.Parse(amount)
+			if err != nil {
+				return nil, err
+			}
+			balances.Set(exchangeName, strings.ToUpper(asset), d)
+		}
+	}
+	return balances, nil
+}
@@ -0,0 +1,29 @@
+package paper
+
+import (
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+)
+
+// FillQuery filters the fills fetched from a store. Zero values don't filter
+type FillQuery struct {
+	// HeBase only returns fills of this base
+	HeBase string
+	// Since only returns fills at or after this time
+	Since time.Time
+	// Limit is the maximum number of fills returned
+	Limit int
+}
+
+// Store persists the fills and balances of a paper trader
+type Store interface {
+	// SaveFill persists a fill along with the balances it changed and sets the ID of the fill
+	SaveFill(fill *Fill, balances Balances) error
+	// FetchBalances returns every persisted balance, empty if nothing was traded yet
+	FetchBalances() (Balances, error)
+	// FetchFills returns the fills matching query, most recent first
+	FetchFills(query FillQuery) ([]*Fill, error)
+	// RealizedPnL returns the sum of the PnL of every fill in USD
+	RealizedPnL() (decimal.Decimal, error)
+}
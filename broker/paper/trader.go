@@ -0,0 +1,216 @@
+package paper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// amountPrecision is the number of decimal places quantities, balances and PnL are rounded to
+const amountPrecision = 8
+
+var one = decimal.NewFromInt(1)
+
+// Config holds the paper trading options from the paper section of the config file
+//
+//	paper:
+//	  enabled: true
+//	  min_spread: 0.5
+//	  max_quantity: 0.1
+//	  balances:
+//	    kraken:
+//	      USD: 10000
+//	      BTC: 1
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinSpread is the minimum spread in percent net of fees of the opportunities traded
+	MinSpread string `mapstructure:"min_spread"`
+	// MaxQuantity caps the quantity of the base traded per opportunity. 0 doesn't cap it
+	MaxQuantity string `mapstructure:"max_quantity"`
+	// Balances are the starting balances by exchange then asset
+	Balances map[string]map[string]string `mapstructure:"balances"`
+}
+
+// Fill is a simulated arbitrage: Quantity of the base bought at the low ask of one exchange
+// and sold at the high bid of another. Prices and fees are in the quote currency of their
+// pair, FeesUSD and PnL in USD
+type Fill struct {
+	ID           int64           `json:"id"`
+	FilledAt     time.Time       `json:"filled_at"`
+	HeBase       string          `json:"he_base"`
+	Spread       decimal.Decimal `json:"spread"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	BuyExchange  string          `json:"buy_exchange"`
+	BuyPair      string          `json:"buy_pair"`
+	BuyPrice     decimal.Decimal `json:"buy_price"`
+	BuyFee       decimal.Decimal `json:"buy_fee"`
+	SellExchange string          `json:"sell_exchange"`
+	SellPair     string          `json:"sell_pair"`
+	SellPrice    decimal.Decimal `json:"sell_price"`
+	SellFee      decimal.Decimal `json:"sell_fee"`
+	FeesUSD      decimal.Decimal `json:"fees_usd"`
+	PnL          decimal.Decimal `json:"pnl"`
+}
+
+// Summary is the state of a paper trader
+type Summary struct {
+	Balances Balances `json:"balances"`
+	// PnL is the realized PnL in USD of every persisted fill
+	PnL decimal.Decimal `json:"pnl"`
+	// Fills is the number of fills since the trader started
+	Fills int `json:"fills"`
+}
+
+// Trader simulates trading the arbitrage opportunities the broker publishes against virtual
+// balances on each exchange. An opportunity is traded if its spread is at least MinSpread, up
+// to the top of book sizes and what the balances allow: the quote currency on the low exchange
+// and the base on the high exchange
+type Trader struct {
+	MinSpread   decimal.Decimal
+	MaxQuantity decimal.Decimal
+	// Fees is the schedule the spreads of opportunities are net of. Fills are charged the same
+	// fees so they're only counted once
+	Fees     *exchange.FeeSchedule
+	store    Store
+	mtx      sync.RWMutex
+	balances Balances
+	pnl      decimal.Decimal
+	fills    int
+}
+
+// NewTrader returns a trader configured from config that persists to store. Balances are
+// restored from the store and assets it doesn't hold start at their configured balance
+func NewTrader(config *Config, store Store) (*Trader, error) {
+	t := &Trader{
+		store: store,
+	}
+	err := decimal.ParseOptions(
+		decimal.Option{Name: "min_spread", Value: config.MinSpread, Dest: &t.MinSpread},
+		decimal.Option{Name: "max_quantity", Value: config.MaxQuantity, Dest: &t.MaxQuantity},
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.balances, err = ParseBalances(config.Balances)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid balances: %s", err)
+	}
+	stored, err := store.FetchBalances()
+	if err != nil {
+		return nil, err
+	}
+	for exchangeName, assets := range stored {
+		for asset, amount := range assets {
+			t.balances.Set(exchangeName, asset, amount)
+		}
+	}
+	t.pnl, err = store.RealizedPnL()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Run trades the opportunities received on arbCh until ctx is done
+func (t *Trader) Run(ctx context.Context, arbCh <-chan *exchange.ArbMarket, errorCh chan<- error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case market := <-arbCh:
+			_, err := t.Trade(market, time.Now())
+			if err != nil {
+				select {
+				case errorCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// Trade simulates trading market at now and persists the fill. It returns nil if the
+// opportunity isn't traded
+func (t *Trader) Trade(market *exchange.ArbMarket, now time.Time) (*Fill, error) {
+	if market.Removed || market.Spread.LessThan(t.MinSpread) || market.Low.Exchange == market.High.Exchange {
+		return nil, nil
+	}
+	low, high := market.Low, market.High
+	if low.Price.Sign() <= 0 || high.Price.Sign() <= 0 || low.TriangulatedPrice.Sign() <= 0 || high.TriangulatedPrice.Sign() <= 0 {
+		return nil, nil
+	}
+	base := market.HeBase
+	buyQuote := low.QuoteCurrency(base)
+	sellQuote := high.QuoteCurrency(base)
+	buyFee := t.Fees.Taker(low.Exchange, low.HePair)
+	sellFee := t.Fees.Taker(high.Exchange, high.HePair)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	affordable := t.balances.Get(low.Exchange, buyQuote).DivRound(low.Price.Mul(one.Add(buyFee)), amountPrecision+1)
+	quantity := decimal.Min(affordable, t.balances.Get(high.Exchange, base))
+	// Sizes are unknown for exchanges that don't send them so only the balances and
+	// MaxQuantity limit those
+	if market.Quantity.Sign() > 0 {
+		quantity = decimal.Min(quantity, market.Quantity)
+	}
+	if t.MaxQuantity.Sign() > 0 {
+		quantity = decimal.Min(quantity, t.MaxQuantity)
+	}
+	quantity = quantity.Floor(amountPrecision)
+	if quantity.Sign() <= 0 {
+		return nil, nil
+	}
+
+	fill := &Fill{
+		FilledAt:     now,
+		HeBase:       base,
+		Spread:       market.Spread,
+		Quantity:     quantity,
+		BuyExchange:  low.Exchange,
+		BuyPair:      low.HePair,
+		BuyPrice:     low.Price,
+		BuyFee:       low.Price.Mul(quantity).Mul(buyFee).Round(amountPrecision),
+		SellExchange: high.Exchange,
+		SellPair:     high.HePair,
+		SellPrice:    high.Price,
+		SellFee:      high.Price.Mul(quantity).Mul(sellFee).Round(amountPrecision),
+	}
+	fill.FeesUSD = low.TriangulatedPrice.Mul(buyFee).Add(high.TriangulatedPrice.Mul(sellFee)).Mul(quantity).Round(amountPrecision)
+	fill.PnL = high.TriangulatedPrice.Sub(low.TriangulatedPrice).Mul(quantity).Round(amountPrecision).Sub(fill.FeesUSD)
+
+	changed := make(Balances)
+	changed.Set(low.Exchange, buyQuote, t.balances.Get(low.Exchange, buyQuote).Sub(low.Price.Mul(quantity).Round(amountPrecision)).Sub(fill.BuyFee))
+	changed.Set(low.Exchange, base, t.balances.Get(low.Exchange, base).Add(quantity))
+	changed.Set(high.Exchange, base, t.balances.Get(high.Exchange, base).Sub(quantity))
+	changed.Set(high.Exchange, sellQuote, t.balances.Get(high.Exchange, sellQuote).Add(high.Price.Mul(quantity).Round(amountPrecision)).Sub(fill.SellFee))
+	err := t.store.SaveFill(fill, changed)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving paper fill: %s", err)
+	}
+	for exchangeName, assets := range changed {
+		for asset, amount := range assets {
+			t.balances.Set(exchangeName, asset, amount)
+		}
+	}
+	t.pnl = t.pnl.Add(fill.PnL)
+	t.fills++
+	return fill, nil
+}
+
+// Summary returns a copy of the balances and the realized PnL
+func (t *Trader) Summary() Summary {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return Summary{Balances: t.balances.Copy(), PnL: t.pnl, Fills: t.fills}
+}
+
+// Fills returns the persisted fills matching query, most recent first
+func (t *Trader) Fills(query FillQuery) ([]*Fill, error) {
+	return t.store.FetchFills(query)
+}
@@ -0,0 +1,178 @@
+package paper_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+	"github.com/kaplanmaxe/helgart/broker/mock"
+	"github.com/kaplanmaxe/helgart/broker/paper"
+)
+
+var start = time.Date(2019, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func side(ex, pair, price, triangulated, size string) exchange.MarketSide {
+	return exchange.MarketSide{
+		Exchange:          ex,
+		HePair:            pair,
+		Price:             decimal.MustParse(price),
+		TriangulatedPrice: decimal.MustParse(triangulated),
+		Size:              decimal.MustParse(size),
+	}
+}
+
+func checkBalances(t *testing.T, balances paper.Balances, expected map[string]string) {
+	t.Helper()
+	for key, amount := range expected {
+		var ex, asset string
+		fmt.Sscanf(key, "%s %s", &ex, &asset)
+		if got := balances.Get(ex, asset); got.String() != amount {
+			t.Errorf("Expected %s balance of %s to be %s but got %s", ex, asset, amount, got)
+		}
+	}
+}
+
+func TestTrader(t *testing.T) {
+	config := &paper.Config{
+		MinSpread:   "0.5",
+		MaxQuantity: "2",
+		Balances: map[string]map[string]string{
+			exchange.COINBASE: {"usd": "1000"},
+			exchange.KRAKEN:   {"btc": "1"},
+		},
+	}
+	store := mock.NewPaperStore()
+	trader, err := paper.NewTrader(config, store)
+	if err != nil {
+		t.Fatalf("Error creating trader: %s", err)
+	}
+	trader.Fees = exchange.NewFeeSchedule()
+	trader.Fees.Default = decimal.MustParse("0.001")
+	trader.Fees.Set(exchange.Fee{Exchange: exchange.KRAKEN, Taker: decimal.MustParse("0.002")})
+	// The spread is net of the same fees fills are charged
+	market := exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "100", "5"), side(exchange.KRAKEN, "BTC-USD", "102", "102", "3"), trader.Fees)
+
+	fill, err := trader.Trade(market, start)
+	if err != nil {
+		t.Fatalf("Error trading: %s", err)
+	}
+	// Only 1 BTC can be sold on kraken
+	if fill == nil || fill.ID != 1 || fill.Quantity.String() != "1" || fill.BuyFee.String() != "0.1" || fill.SellFee.String() != "0.204" ||
+		fill.FeesUSD.String() != "0.304" || fill.PnL.String() != "1.696" {
+		t.Fatalf("Expected to trade 1 BTC for a PnL of 1.696 USD but got %+v", fill)
+	}
+	summary := trader.Summary()
+	checkBalances(t, summary.Balances, map[string]string{
+		"coinbase USD": "899.9",
+		"coinbase BTC": "1",
+		"kraken BTC":   "0",
+		"kraken USD":   "101.796",
+	})
+
+	// Nothing is left to sell on kraken
+	fill, err = trader.Trade(market, start.Add(time.Second))
+	if err != nil || fill != nil {
+		t.Errorf("Expected no trade without BTC on kraken but got %+v, %v", fill, err)
+	}
+	// 0.6% gross is only about 0.3% net of fees
+	narrow := exchange.NewArbMarket("BTC", side(exchange.KRAKEN, "BTC-USD", "100", "100", "5"), side(exchange.COINBASE, "BTC-USD", "100.6", "100.6", "3"), trader.Fees)
+	fill, err = trader.Trade(narrow, start.Add(time.Second))
+	if err != nil || fill != nil {
+		t.Errorf("Expected no trade below the minimum spread net of fees but got %+v, %v", fill, err)
+	}
+
+	// Persisted balances win over the config when restarting
+	trader, err = paper.NewTrader(config, store)
+	if err != nil {
+		t.Fatalf("Error restoring trader: %s", err)
+	}
+	summary = trader.Summary()
+	checkBalances(t, summary.Balances, map[string]string{"coinbase USD": "899.9", "kraken BTC": "0"})
+	if summary.PnL.String() != "1.696" {
+		t.Errorf("Expected the realized PnL to be restored as 1.696 but got %s", summary.PnL)
+	}
+	fills, err := trader.Fills(paper.FillQuery{HeBase: "BTC"})
+	if err != nil || len(fills) != 1 {
+		t.Errorf("Expected 1 BTC fill but got %v, %v", fills, err)
+	}
+}
+
+func TestTraderCrossQuote(t *testing.T) {
+	config := &paper.Config{
+		MaxQuantity: "2",
+		Balances: map[string]map[string]string{
+			exchange.BINANCE: {"BTC": "0.1"},
+			exchange.KRAKEN:  {"ETH": "10"},
+		},
+	}
+	trader, err := paper.NewTrader(config, mock.NewPaperStore())
+	if err != nil {
+		t.Fatalf("Error creating trader: %s", err)
+	}
+	// Sizes are unknown so the max quantity is traded
+	market := exchange.NewArbMarket("ETH", side(exchange.BINANCE, "ETH-BTC", "0.02", "200", "0"), side(exchange.KRAKEN, "ETH-USD", "204", "204", "0"), nil)
+	fill, err := trader.Trade(market, start)
+	if err != nil || fill == nil || fill.Quantity.String() != "2" || fill.PnL.String() != "8" {
+		t.Fatalf("Expected to trade 2 ETH for a PnL of 8 USD but got %+v, %v", fill, err)
+	}
+	checkBalances(t, trader.Summary().Balances, map[string]string{
+		"binance BTC": "0.06",
+		"binance ETH": "2",
+		"kraken ETH":  "8",
+		"kraken USD":  "408",
+	})
+}
+
+func TestTraderUnknownSize(t *testing.T) {
+	config := &paper.Config{
+		Balances: map[string]map[string]string{
+			exchange.COINBASE: {"USD": "150"},
+			exchange.KRAKEN:   {"BTC": "2"},
+		},
+	}
+	trader, err := paper.NewTrader(config, mock.NewPaperStore())
+	if err != nil {
+		t.Fatalf("Error creating trader: %s", err)
+	}
+	// Without sizes nor max_quantity only the balances limit the quantity: 150 USD buys 1.5 BTC
+	market := exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "100", "0"), side(exchange.KRAKEN, "BTC-USD", "102", "102", "0"), nil)
+	fill, err := trader.Trade(market, start)
+	if err != nil || fill == nil || fill.Quantity.String() != "1.5" {
+		t.Fatalf("Expected to trade 1.5 BTC but got %+v, %v", fill, err)
+	}
+}
+
+func TestTraderStoreError(t *testing.T) {
+	store := mock.NewPaperStore()
+	config := &paper.Config{
+		Balances: map[string]map[string]string{
+			exchange.COINBASE: {"USD": "1000"},
+			exchange.KRAKEN:   {"BTC": "1"},
+		},
+	}
+	trader, err := paper.NewTrader(config, store)
+	if err != nil {
+		t.Fatalf("Error creating trader: %s", err)
+	}
+	store.Err = fmt.Errorf("connection refused")
+	market := exchange.NewArbMarket("BTC", side(exchange.COINBASE, "BTC-USD", "100", "100", "5"), side(exchange.KRAKEN, "BTC-USD", "102", "102", "3"), nil)
+	if _, err := trader.Trade(market, start); err == nil {
+		t.Error("Expected an error when the fill can't be saved")
+	}
+	checkBalances(t, trader.Summary().Balances, map[string]string{"coinbase USD": "1000", "kraken BTC": "1"})
+}
+
+func TestNewTraderInvalidConfig(t *testing.T) {
+	configs := []*paper.Config{
+		{MinSpread: "half"},
+		{MaxQuantity: "0.2%"},
+		{Balances: map[string]map[string]string{exchange.KRAKEN: {"BTC": "one"}}},
+	}
+	for _, config := range configs {
+		if _, err := paper.NewTrader(config, mock.NewPaperStore()); err == nil {
+			t.Errorf("Expected an error for config %+v", config)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package mysql
+
+import (
+	"fmt"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/exchange"
+)
+
+// FetchFees fetches the fee schedule. Empty pairs and tiers apply to every pair and tier
+func (c *Client) FetchFees() ([]exchange.Fee, error) {
+	var fees []exchange.Fee
+	results, err := c.DB.Query("SELECT exchange, he_pair, tier, taker FROM fees")
+	if err != nil {
+		return fees, fmt.Errorf("Error getting fees: %s", err)
+	}
+	defer results.Close()
+	for results.Next() {
+		var fee exchange.Fee
+		var taker string
+		err = results.Scan(&fee.Exchange, &fee.HePair, &fee.Tier, &taker)
+		if err != nil {
+			return fees, fmt.Errorf("Error getting fees: %s", err)
+		}
+		fee.Taker, err = decimal.Parse(taker)
+		if err != nil {
+			return fees, fmt.Errorf("Error getting fees: %s", err)
+		}
+		fees = append(fees, fee)
+	}
+	return fees, results.Err()
+}
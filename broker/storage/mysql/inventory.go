@@ -0,0 +1,62 @@
+package mysql
+
+import (
+	"fmt"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/inventory"
+)
+
+// SaveHoldings replaces the holdings of an exchange in one transaction
+func (c *Client) SaveHoldings(exchangeName string, holdings []inventory.Holding) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("Error saving holdings: %s", err)
+	}
+	_, err = tx.Exec("DELETE FROM inventory_holdings WHERE exchange = ?", exchangeName)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving holdings: %s", err)
+	}
+	for _, holding := range holdings {
+		_, err = tx.Exec("INSERT INTO inventory_holdings (exchange, asset, free, locked, updated_at) VALUES (?, ?, ?, ?, ?)",
+			exchangeName, holding.Asset, holding.Free.String(), holding.Locked.String(), holding.UpdatedAt.UTC())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error saving holdings: %s", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Error saving holdings: %s", err)
+	}
+	return nil
+}
+
+// FetchHoldings fetches every inventory holding
+func (c *Client) FetchHoldings() ([]inventory.Holding, error) {
+	var holdings []inventory.Holding
+	results, err := c.DB.Query("SELECT exchange, asset, free, locked, updated_at FROM inventory_holdings ORDER BY exchange, asset")
+	if err != nil {
+		return holdings, fmt.Errorf("Error getting holdings: %s", err)
+	}
+	defer results.Close()
+	for results.Next() {
+		var holding inventory.Holding
+		var free, locked string
+		err = results.Scan(&holding.Exchange, &holding.Asset, &free, &locked, &holding.UpdatedAt)
+		if err != nil {
+			return holdings, fmt.Errorf("Error getting holdings: %s", err)
+		}
+		holding.Free, err = decimal.Parse(free)
+		if err != nil {
+			return holdings, fmt.Errorf("Error getting holdings: %s", err)
+		}
+		holding.Locked, err = decimal.Parse(locked)
+		if err != nil {
+			return holdings, fmt.Errorf("Error getting holdings: %s", err)
+		}
+		holdings = append(holdings, holding)
+	}
+	return holdings, results.Err()
+}
@@ -32,7 +32,7 @@ func NewClient(cfg *Config) exchange.ProductStorage {
 
 // Connect opens a connection to the db
 func (c *Client) Connect() error {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", c.cfg.Username, c.cfg.Password, c.cfg.Host, c.cfg.Port, c.cfg.DBName))
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", c.cfg.Username, c.cfg.Password, c.cfg.Host, c.cfg.Port, c.cfg.DBName))
 
 	if err != nil {
 		return fmt.Errorf("Error connecting to db: %s", err)
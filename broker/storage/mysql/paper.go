@@ -0,0 +1,140 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kaplanmaxe/helgart/broker/decimal"
+	"github.com/kaplanmaxe/helgart/broker/paper"
+)
+
+const fillColumns = "id, filled_at, he_base, spread, quantity, buy_exchange, buy_pair, buy_price, buy_fee, sell_exchange, sell_pair, sell_price, sell_fee, fees_usd, pnl"
+
+// SaveFill inserts a paper fill and updates the balances it changed in one transaction
+func (c *Client) SaveFill(fill *paper.Fill, balances paper.Balances) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("Error saving fill: %s", err)
+	}
+	result, err := tx.Exec("INSERT INTO paper_fills (filled_at, he_base, spread, quantity, buy_exchange, buy_pair, buy_price, buy_fee, sell_exchange, sell_pair, sell_price, sell_fee, fees_usd, pnl) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		fill.FilledAt.UTC(), fill.HeBase, fill.Spread.String(), fill.Quantity.String(),
+		fill.BuyExchange, fill.BuyPair, fill.BuyPrice.String(), fill.BuyFee.String(),
+		fill.SellExchange, fill.SellPair, fill.SellPrice.String(), fill.SellFee.String(),
+		fill.FeesUSD.String(), fill.PnL.String())
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving fill: %s", err)
+	}
+	for exchangeName, assets := range balances {
+		for asset, amount := range assets {
+			_, err = tx.Exec("INSERT INTO paper_balances (exchange, asset, amount) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE amount = VALUES(amount)",
+				exchangeName, asset, amount.String())
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Error saving balances: %s", err)
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Error saving fill: %s", err)
+	}
+	fill.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("Error saving fill: %s", err)
+	}
+	return nil
+}
+
+// FetchBalances fetches every paper balance
+func (c *Client) FetchBalances() (paper.Balances, error) {
+	balances := make(paper.Balances)
+	results, err := c.DB.Query("SELECT exchange, asset, amount FROM paper_balances")
+	if err != nil {
+		return balances, fmt.Errorf("Error getting balances: %s", err)
+	}
+	defer results.Close()
+	for results.Next() {
+		var exchangeName, asset, amount string
+		err = results.Scan(&exchangeName, &asset, &amount)
+		if err != nil {
+			return balances, fmt.Errorf("Error getting balances: %s", err)
+		}
+		d, err := decimal.Parse(amount)
+		if err != nil {
+			return balances, fmt.Errorf("Error getting balances: %s", err)
+		}
+		balances.Set(exchangeName, asset, d)
+	}
+	return balances, results.Err()
+}
+
+// FetchFills fetches the paper fills matching query, most recent first
+func (c *Client) FetchFills(query paper.FillQuery) ([]*paper.Fill, error) {
+	var fills []*paper.Fill
+	var where []string
+	var args []interface{}
+	if query.HeBase != "" {
+		where = append(where, "he_base = ?")
+		args = append(args, query.HeBase)
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "filled_at >= ?")
+		args = append(args, query.Since.UTC())
+	}
+	stmt := "SELECT " + fillColumns + " FROM paper_fills"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY id DESC"
+	if query.Limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	results, err := c.DB.Query(stmt, args...)
+	if err != nil {
+		return fills, fmt.Errorf("Error getting fills: %s", err)
+	}
+	defer results.Close()
+	for results.Next() {
+		var fill paper.Fill
+		var spread, quantity, buyPrice, buyFee, sellPrice, sellFee, feesUSD, pnl string
+		err = results.Scan(&fill.ID, &fill.FilledAt, &fill.HeBase, &spread, &quantity,
+			&fill.BuyExchange, &fill.BuyPair, &buyPrice, &buyFee,
+			&fill.SellExchange, &fill.SellPair, &sellPrice, &sellFee, &feesUSD, &pnl)
+		if err != nil {
+			return fills, fmt.Errorf("Error getting fills: %s", err)
+		}
+		values := []struct {
+			raw  string
+			dest *decimal.Decimal
+		}{
+			{spread, &fill.Spread},
+			{quantity, &fill.Quantity},
+			{buyPrice, &fill.BuyPrice},
+			{buyFee, &fill.BuyFee},
+			{sellPrice, &fill.SellPrice},
+			{sellFee, &fill.SellFee},
+			{feesUSD, &fill.FeesUSD},
+			{pnl, &fill.PnL},
+		}
+		for _, val := range values {
+			*val.dest, err = decimal.Parse(val.raw)
+			if err != nil {
+				return fills, fmt.Errorf("Error getting fills: %s", err)
+			}
+		}
+		fills = append(fills, &fill)
+	}
+	return fills, results.Err()
+}
+
+// RealizedPnL returns the sum of the PnL of every paper fill
+func (c *Client) RealizedPnL() (decimal.Decimal, error) {
+	var pnl string
+	err := c.DB.QueryRow("SELECT COALESCE(SUM(pnl), 0) FROM paper_fills").Scan(&pnl)
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("Error getting realized PnL: %s", err)
+	}
+	return decimal.Parse(pnl)
+}
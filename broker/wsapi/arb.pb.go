@@ -21,13 +21,31 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type ArbMarket struct {
-	HeBase               string                  `protobuf:"bytes,1,opt,name=he_base,json=heBase,proto3" json:"he_base,omitempty"`
-	Spread               float64                 `protobuf:"fixed64,2,opt,name=spread,proto3" json:"spread,omitempty"`
-	Low                  *ArbMarket_ActiveMarket `protobuf:"bytes,3,opt,name=low,proto3" json:"low,omitempty"`
-	High                 *ArbMarket_ActiveMarket `protobuf:"bytes,4,opt,name=high,proto3" json:"high,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}                `json:"-"`
-	XXX_unrecognized     []byte                  `json:"-"`
-	XXX_sizecache        int32                   `json:"-"`
+	HeBase string `protobuf:"bytes,1,opt,name=he_base,json=heBase,proto3" json:"he_base,omitempty"`
+	// spread is the net spread in percent, gross_spread less fees
+	Spread float64                 `protobuf:"fixed64,2,opt,name=spread,proto3" json:"spread,omitempty"`
+	Low    *ArbMarket_ActiveMarket `protobuf:"bytes,3,opt,name=low,proto3" json:"low,omitempty"`
+	High   *ArbMarket_ActiveMarket `protobuf:"bytes,4,opt,name=high,proto3" json:"high,omitempty"`
+	// removed is set when the opportunity no longer exists, ex: one of its quotes
+	// went stale and was evicted
+	Removed bool `protobuf:"varint,5,opt,name=removed,proto3" json:"removed,omitempty"`
+	// quantity is the most of the base that can be bought on low and sold on high. It's 0
+	// if either exchange doesn't send sizes
+	Quantity float64 `protobuf:"fixed64,6,opt,name=quantity,proto3" json:"quantity,omitempty"`
+	// profit is the notional profit in USD of trading quantity
+	Profit float64 `protobuf:"fixed64,7,opt,name=profit,proto3" json:"profit,omitempty"`
+	// executable is set when the inventory holds the quote currency on low and the base
+	// on high. It's always false if inventory tracking is disabled
+	Executable bool `protobuf:"varint,8,opt,name=executable,proto3" json:"executable,omitempty"`
+	// executable_quantity is how much of the base the inventory can trade
+	ExecutableQuantity float64 `protobuf:"fixed64,9,opt,name=executable_quantity,json=executableQuantity,proto3" json:"executable_quantity,omitempty"`
+	// gross_spread is the difference between the high bid and low ask in percent of the low ask
+	GrossSpread float64 `protobuf:"fixed64,10,opt,name=gross_spread,json=grossSpread,proto3" json:"gross_spread,omitempty"`
+	// fees are the taker fees of trading on low and high in percent of the low ask
+	Fees                 float64  `protobuf:"fixed64,11,opt,name=fees,proto3" json:"fees,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *ArbMarket) Reset()         { *m = ArbMarket{} }
@@ -83,12 +101,65 @@ func (m *ArbMarket) GetHigh() *ArbMarket_ActiveMarket {
 	return nil
 }
 
+func (m *ArbMarket) GetRemoved() bool {
+	if m != nil {
+		return m.Removed
+	}
+	return false
+}
+
+func (m *ArbMarket) GetQuantity() float64 {
+	if m != nil {
+		return m.Quantity
+	}
+	return 0
+}
+
+func (m *ArbMarket) GetProfit() float64 {
+	if m != nil {
+		return m.Profit
+	}
+	return 0
+}
+
+func (m *ArbMarket) GetExecutable() bool {
+	if m != nil {
+		return m.Executable
+	}
+	return false
+}
+
+func (m *ArbMarket) GetExecutableQuantity() float64 {
+	if m != nil {
+		return m.ExecutableQuantity
+	}
+	return 0
+}
+
+func (m *ArbMarket) GetGrossSpread() float64 {
+	if m != nil {
+		return m.GrossSpread
+	}
+	return 0
+}
+
+func (m *ArbMarket) GetFees() float64 {
+	if m != nil {
+		return m.Fees
+	}
+	return 0
+}
+
 type ArbMarket_ActiveMarket struct {
-	Exchange             string   `protobuf:"bytes,1,opt,name=exchange,proto3" json:"exchange,omitempty"`
-	HePair               string   `protobuf:"bytes,2,opt,name=he_pair,json=hePair,proto3" json:"he_pair,omitempty"`
-	ExPair               string   `protobuf:"bytes,3,opt,name=ex_pair,json=exPair,proto3" json:"ex_pair,omitempty"`
-	Price                string   `protobuf:"bytes,4,opt,name=price,proto3" json:"price,omitempty"`
-	TriangulatedPrice    string   `protobuf:"bytes,5,opt,name=triangulated_price,json=triangulatedPrice,proto3" json:"triangulated_price,omitempty"`
+	Exchange          string `protobuf:"bytes,1,opt,name=exchange,proto3" json:"exchange,omitempty"`
+	HePair            string `protobuf:"bytes,2,opt,name=he_pair,json=hePair,proto3" json:"he_pair,omitempty"`
+	ExPair            string `protobuf:"bytes,3,opt,name=ex_pair,json=exPair,proto3" json:"ex_pair,omitempty"`
+	Price             string `protobuf:"bytes,4,opt,name=price,proto3" json:"price,omitempty"`
+	TriangulatedPrice string `protobuf:"bytes,5,opt,name=triangulated_price,json=triangulatedPrice,proto3" json:"triangulated_price,omitempty"`
+	// age_ms is how old the quote was in milliseconds when the market was sent
+	AgeMs int64 `protobuf:"varint,6,opt,name=age_ms,json=ageMs,proto3" json:"age_ms,omitempty"`
+	// size is the quantity available at price in the base currency
+	Size                 string   `protobuf:"bytes,7,opt,name=size,proto3" json:"size,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -154,6 +225,20 @@ func (m *ArbMarket_ActiveMarket) GetTriangulatedPrice() string {
 	return ""
 }
 
+func (m *ArbMarket_ActiveMarket) GetAgeMs() int64 {
+	if m != nil {
+		return m.AgeMs
+	}
+	return 0
+}
+
+func (m *ArbMarket_ActiveMarket) GetSize() string {
+	if m != nil {
+		return m.Size
+	}
+	return ""
+}
+
 // ArbMarkets is sent to the client once only on initial connection
 // it returns the markets currently cached by broker
 type ArbMarkets struct {
@@ -204,22 +289,30 @@ func init() {
 func init() { proto.RegisterFile("broker/wsapi/arb.proto", fileDescriptor_fb5fe075d6d1fdf7) }
 
 var fileDescriptor_fb5fe075d6d1fdf7 = []byte{
-	// 271 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x91, 0xc1, 0x4a, 0xc3, 0x40,
-	0x10, 0x86, 0xd9, 0xa6, 0x49, 0xcd, 0xd4, 0x83, 0x2e, 0x52, 0x43, 0x41, 0x08, 0x3d, 0x05, 0xc1,
-	0x04, 0xeb, 0xc5, 0x6b, 0xbd, 0x0b, 0x25, 0x2f, 0x50, 0x26, 0xe9, 0x90, 0x2c, 0xad, 0x4d, 0x98,
-	0x5d, 0x6d, 0x5e, 0xc7, 0x77, 0xf1, 0xc1, 0x24, 0xbb, 0x6d, 0x28, 0x9e, 0xbc, 0xed, 0x3f, 0xdf,
-	0xbf, 0xc3, 0xff, 0x33, 0x30, 0x2b, 0xb8, 0xd9, 0x11, 0x67, 0x47, 0x8d, 0xad, 0xca, 0x90, 0x8b,
-	0xb4, 0xe5, 0xc6, 0x34, 0xd2, 0xb7, 0x83, 0xc5, 0xcf, 0x08, 0xc2, 0x15, 0x17, 0xef, 0xc8, 0x3b,
-	0x32, 0xf2, 0x1e, 0x26, 0x35, 0x6d, 0x0a, 0xd4, 0x14, 0x89, 0x58, 0x24, 0x61, 0x1e, 0xd4, 0xf4,
-	0x86, 0x9a, 0xe4, 0x0c, 0x02, 0xdd, 0x32, 0xe1, 0x36, 0x1a, 0xc5, 0x22, 0x11, 0xf9, 0x49, 0xc9,
-	0x0c, 0xbc, 0x7d, 0x73, 0x8c, 0xbc, 0x58, 0x24, 0xd3, 0xe5, 0x43, 0x6a, 0x77, 0xa6, 0xc3, 0xbe,
-	0x74, 0x55, 0x1a, 0xf5, 0x45, 0x4e, 0xe4, 0xbd, 0x53, 0x3e, 0xc3, 0xb8, 0x56, 0x55, 0x1d, 0x8d,
-	0xff, 0xf3, 0xc3, 0x5a, 0xe7, 0xdf, 0x02, 0xae, 0x2f, 0xc7, 0x72, 0x0e, 0x57, 0xd4, 0x95, 0x35,
-	0x1e, 0xaa, 0x73, 0xcc, 0x41, 0x9f, 0x1a, 0xb4, 0xa8, 0xd8, 0x26, 0xb5, 0x0d, 0xd6, 0xa8, 0xb8,
-	0x07, 0xd4, 0x39, 0xe0, 0x39, 0x40, 0x9d, 0x05, 0x77, 0xe0, 0xb7, 0xac, 0x4a, 0xb2, 0x91, 0xc2,
-	0xdc, 0x09, 0xf9, 0x04, 0xd2, 0xb0, 0xc2, 0x43, 0xf5, 0xb9, 0x47, 0x43, 0xdb, 0x8d, 0xb3, 0xf8,
-	0xd6, 0x72, 0x7b, 0x49, 0xd6, 0x3d, 0x58, 0xbc, 0x02, 0x0c, 0x1d, 0xb4, 0x7c, 0x84, 0xc9, 0x87,
-	0x7b, 0x46, 0x22, 0xf6, 0x92, 0xe9, 0xf2, 0xe6, 0x6f, 0xcf, 0xfc, 0x6c, 0x28, 0x02, 0x7b, 0x8e,
-	0x97, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x7a, 0x7d, 0x0d, 0x81, 0xa8, 0x01, 0x00, 0x00,
+	// 391 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x52, 0xc1, 0x6e, 0xd3, 0x40,
+	0x10, 0xd5, 0xd6, 0xb1, 0x13, 0x8f, 0x7b, 0x80, 0x05, 0xca, 0xaa, 0x12, 0xc8, 0xf4, 0x64, 0x21,
+	0x61, 0x8b, 0x72, 0xe1, 0x5a, 0xee, 0x95, 0xca, 0xf2, 0x01, 0xd6, 0xda, 0x99, 0xda, 0xab, 0x26,
+	0xb1, 0xd9, 0xdd, 0xb4, 0x86, 0xff, 0xe3, 0xc6, 0x47, 0x21, 0xcf, 0xc6, 0x4e, 0xc4, 0xa9, 0xb7,
+	0x79, 0xf3, 0x9e, 0x9f, 0x67, 0xde, 0x2c, 0x5c, 0x54, 0xa6, 0x7b, 0x40, 0x53, 0x3c, 0x59, 0xd5,
+	0xeb, 0x42, 0x99, 0x2a, 0xef, 0x4d, 0xe7, 0x3a, 0x1e, 0x52, 0xe3, 0xea, 0xcf, 0x02, 0xe2, 0x1b,
+	0x53, 0xdd, 0x2a, 0xf3, 0x80, 0x8e, 0xbf, 0x85, 0x65, 0x8b, 0x65, 0xa5, 0x2c, 0x0a, 0x96, 0xb2,
+	0x2c, 0x96, 0x51, 0x8b, 0xdf, 0x94, 0x45, 0x7e, 0x01, 0x91, 0xed, 0x0d, 0xaa, 0xb5, 0x38, 0x4b,
+	0x59, 0xc6, 0xe4, 0x01, 0xf1, 0x02, 0x82, 0x4d, 0xf7, 0x24, 0x82, 0x94, 0x65, 0xc9, 0xf5, 0xbb,
+	0x9c, 0x3c, 0xf3, 0xd9, 0x2f, 0xbf, 0xa9, 0x9d, 0x7e, 0x44, 0x0f, 0xe4, 0xa8, 0xe4, 0x9f, 0x61,
+	0xd1, 0xea, 0xa6, 0x15, 0x8b, 0xe7, 0x7c, 0x41, 0x52, 0x2e, 0x60, 0x69, 0x70, 0xdb, 0x3d, 0xe2,
+	0x5a, 0x84, 0x29, 0xcb, 0x56, 0x72, 0x82, 0xfc, 0x12, 0x56, 0x3f, 0xf7, 0x6a, 0xe7, 0xb4, 0xfb,
+	0x25, 0x22, 0x9a, 0x6b, 0xc6, 0xe3, 0xc4, 0xbd, 0xe9, 0xee, 0xb5, 0x13, 0x4b, 0x3f, 0xb1, 0x47,
+	0xfc, 0x3d, 0x00, 0x0e, 0x58, 0xef, 0x9d, 0xaa, 0x36, 0x28, 0x56, 0x64, 0x78, 0xd2, 0xe1, 0x05,
+	0xbc, 0x3a, 0xa2, 0x72, 0xb6, 0x8f, 0xc9, 0x84, 0x1f, 0xa9, 0xef, 0xd3, 0x8f, 0x3e, 0xc0, 0x79,
+	0x63, 0x3a, 0x6b, 0xcb, 0x43, 0x40, 0x40, 0xca, 0x84, 0x7a, 0x3f, 0x7c, 0x4a, 0x1c, 0x16, 0xf7,
+	0x88, 0x56, 0x24, 0x44, 0x51, 0x7d, 0xf9, 0x97, 0xc1, 0xf9, 0xe9, 0xb2, 0xe3, 0x32, 0x38, 0xd4,
+	0xad, 0xda, 0x35, 0x53, 0xf8, 0x33, 0x3e, 0xdc, 0xa5, 0x57, 0xda, 0x88, 0xb3, 0xe9, 0x2e, 0x77,
+	0x4a, 0x9b, 0x91, 0xc0, 0xc1, 0x13, 0x81, 0x27, 0x70, 0x20, 0xe2, 0x35, 0x84, 0xbd, 0xd1, 0x35,
+	0x52, 0xd0, 0xb1, 0xf4, 0x80, 0x7f, 0x02, 0xee, 0x8c, 0x56, 0xbb, 0x66, 0xbf, 0x51, 0x0e, 0xd7,
+	0xa5, 0x97, 0x84, 0x24, 0x79, 0x79, 0xca, 0xdc, 0x91, 0xfc, 0x0d, 0x44, 0xaa, 0xc1, 0x72, 0x6b,
+	0x29, 0xdd, 0x40, 0x86, 0xaa, 0xc1, 0x5b, 0x3b, 0xae, 0x63, 0xf5, 0x6f, 0xa4, 0x60, 0x63, 0x49,
+	0xf5, 0xd5, 0x57, 0x80, 0xf9, 0x88, 0x96, 0x7f, 0x84, 0xe5, 0xd6, 0x97, 0x82, 0xa5, 0x41, 0x96,
+	0x5c, 0xbf, 0xf8, 0xff, 0xd0, 0x72, 0x12, 0x54, 0x11, 0xbd, 0xc7, 0x2f, 0xff, 0x06, 0x00, 0x6b,
+	0x2b, 0x49, 0xff, 0xa9, 0x02, 0x00, 0x00,
 }